@@ -3384,6 +3384,14 @@ func (a *Agent) ReloadConfig(newCfg *config.RuntimeConfig) error {
 
 	a.State.SetDiscardCheckOutput(newCfg.DiscardCheckOutput)
 
+	// Reopen the managed proxy log files so that external log rotation
+	// tools can have them reopened by sending the agent SIGHUP.
+	if a.proxyManager != nil {
+		if err := a.proxyManager.ReopenLogs(); err != nil {
+			a.logger.Printf("[WARN] agent: failed to reopen proxy log files: %s", err)
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,106 @@
+package proxyprocess
+
+import (
+	"time"
+)
+
+// DaemonBackoffStrategyMaxWait is the longest wait a BackoffStrategy set
+// on a Daemon can cause. Longer waits are capped to it.
+const DaemonBackoffStrategyMaxWait = 1 * time.Hour
+
+// BackoffStrategy calculates how long a Daemon waits before restarting a
+// process that keeps exiting. See the BackoffStrategy field of Daemon.
+type BackoffStrategy interface {
+	// Next returns the wait before the given restart attempt, counting
+	// from 1 for the first attempt past RestartBackoffMin. It is called
+	// from the supervision loop so it must not block.
+	Next(attempt uint) time.Duration
+}
+
+// ExponentialBackoff waits Unit times Base to the power of the attempt,
+// capped at Max. If these are zero then one second, 2 and
+// DaemonRestartMaxWait are used respectively. This is the default
+// strategy, with Max set to RestartMaxWait.
+type ExponentialBackoff struct {
+	Unit time.Duration
+	Base uint
+	Max  time.Duration
+}
+
+func (b ExponentialBackoff) Next(attempt uint) time.Duration {
+	unit, base, max := b.Unit, b.Base, b.Max
+	if unit <= 0 {
+		unit = time.Second
+	}
+	if base == 0 {
+		base = 2
+	}
+	if max <= 0 {
+		max = DaemonRestartMaxWait
+	}
+
+	// Multiply step by step so that the cap applies before an overflow.
+	wait := unit
+	for i := uint(0); i < attempt && base > 1 && wait < max; i++ {
+		if wait > max/time.Duration(base) {
+			return max
+		}
+		wait *= time.Duration(base)
+	}
+	if wait > max {
+		wait = max
+	}
+
+	return wait
+}
+
+// LinearBackoff waits Step times the attempt, capped at Max. If Max is zero
+// then DaemonRestartMaxWait is used.
+type LinearBackoff struct {
+	Step time.Duration
+	Max  time.Duration
+}
+
+func (b LinearBackoff) Next(attempt uint) time.Duration {
+	max := b.Max
+	if max <= 0 {
+		max = DaemonRestartMaxWait
+	}
+	if b.Step <= 0 {
+		return 0
+	}
+	if attempt > uint(max/b.Step) {
+		return max
+	}
+
+	return time.Duration(attempt) * b.Step
+}
+
+// backoffWait returns the wait before the given restart attempt. Without a
+// BackoffStrategy this is an ExponentialBackoff capped at RestartMaxWait.
+// A BackoffStrategy is user-supplied, so if it panics the default is used
+// instead and its result is kept between zero and
+// DaemonBackoffStrategyMaxWait.
+func (p *Daemon) backoffWait(attempt uint) time.Duration {
+	fallback := ExponentialBackoff{Max: p.restartMaxWait()}
+	if p.BackoffStrategy == nil {
+		return fallback.Next(attempt)
+	}
+
+	var wait time.Duration
+	if err := p.safeCall("BackoffStrategy", func() error {
+		wait = p.BackoffStrategy.Next(attempt)
+		return nil
+	}); err != nil {
+		return fallback.Next(attempt)
+	}
+
+	switch {
+	case wait < 0:
+		return 0
+	case wait > DaemonBackoffStrategyMaxWait:
+		return DaemonBackoffStrategyMaxWait
+	}
+
+	return wait
+}
@@ -0,0 +1,64 @@
+package proxyprocess
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffStrategy(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		Strategy BackoffStrategy
+		Attempt  uint
+		Expected time.Duration
+	}{
+		{ExponentialBackoff{}, 1, 2 * time.Second},
+		{ExponentialBackoff{}, 5, 32 * time.Second},
+		{ExponentialBackoff{}, 6, DaemonRestartMaxWait},
+		{ExponentialBackoff{}, 1000, DaemonRestartMaxWait},
+		{ExponentialBackoff{Unit: time.Millisecond, Base: 10, Max: time.Hour}, 3, time.Second},
+		{ExponentialBackoff{Base: 1}, 1000, time.Second},
+		{LinearBackoff{Step: 5 * time.Second}, 3, 15 * time.Second},
+		{LinearBackoff{Step: 5 * time.Second, Max: 12 * time.Second}, 3, 12 * time.Second},
+		{LinearBackoff{Step: time.Second}, ^uint(0), DaemonRestartMaxWait},
+		{LinearBackoff{}, 3, 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%#v/%d", tc.Strategy, tc.Attempt), func(t *testing.T) {
+			require.Equal(t, tc.Expected, tc.Strategy.Next(tc.Attempt))
+		})
+	}
+}
+
+// backoffFunc is a BackoffStrategy implemented by a function.
+type backoffFunc func(attempt uint) time.Duration
+
+func (f backoffFunc) Next(attempt uint) time.Duration { return f(attempt) }
+
+func TestDaemonBackoffWait(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		Name     string
+		Strategy BackoffStrategy
+		Expected time.Duration
+	}{
+		{"default", nil, 2 * time.Second},
+		{"custom", LinearBackoff{Step: 3 * time.Second}, 3 * time.Second},
+		{"negative", backoffFunc(func(uint) time.Duration { return -time.Second }), 0},
+		{"huge", backoffFunc(func(uint) time.Duration { return 1000 * time.Hour }), DaemonBackoffStrategyMaxWait},
+		{"panic", backoffFunc(func(uint) time.Duration { panic("backoff") }), 2 * time.Second},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			d := &Daemon{Logger: testLogger, BackoffStrategy: tc.Strategy}
+			require.Equal(t, tc.Expected, d.backoffWait(1))
+		})
+	}
+}
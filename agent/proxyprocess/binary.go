@@ -0,0 +1,94 @@
+package proxyprocess
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// DaemonWatchBinaryInterval is the default time between checks of the
+// binary with WatchBinary set.
+const DaemonWatchBinaryInterval = 5 * time.Second
+
+// binaryVersion identifies the contents of a binary well enough to notice
+// that it was replaced or rewritten.
+type binaryVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+// statBinary returns the version of the binary at path, or false if there
+// is no executable file there, for example while it is being replaced.
+func statBinary(path string) (binaryVersion, bool) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.IsDir() || !isExecutable(fi) {
+		return binaryVersion{}, false
+	}
+
+	return binaryVersion{size: fi.Size(), modTime: fi.ModTime()}, true
+}
+
+// binaryPath returns the path of the binary of cmd, resolving a relative
+// path against the working directory like starting it does.
+func binaryPath(cmd *exec.Cmd) string {
+	path := cmd.Path
+	if !filepath.IsAbs(path) && cmd.Dir != "" {
+		path = filepath.Join(cmd.Dir, path)
+	}
+
+	return path
+}
+
+// watchBinaryInterval returns WatchBinaryInterval or its default.
+func (p *Daemon) watchBinaryInterval() time.Duration {
+	if p.WatchBinaryInterval > 0 {
+		return p.WatchBinaryInterval
+	}
+
+	return DaemonWatchBinaryInterval
+}
+
+// watchBinary gracefully restarts process once its binary changed on disk,
+// unless stopCh is closed first because it exited. A change is only acted
+// on once the binary was the same for two checks in a row, so that a
+// binary that is still being written isn't started.
+func (p *Daemon) watchBinary(process osProcess, stopCh <-chan struct{}) {
+	interval := p.watchBinaryInterval()
+	// Command may be replaced by Reconfigure.
+	p.lock.Lock()
+	path := binaryPath(p.Command)
+	p.lock.Unlock()
+	current, ok := statBinary(path)
+	if !ok {
+		p.logger().Warn("can't watch daemon binary", "path", path)
+		return
+	}
+
+	var pending binaryVersion
+	for {
+		select {
+		case <-p.getClock().After(interval):
+		case <-stopCh:
+			return
+		}
+
+		version, ok := statBinary(path)
+		if !ok || version == current {
+			pending = binaryVersion{}
+			continue
+		}
+		if version != pending {
+			pending = version
+			continue
+		}
+
+		p.logger().Info("daemon binary changed, restarting daemon",
+			"path", path, "pid", process.Pid())
+		if err := p.restartProcess(process, restartBinaryChanged); err != nil {
+			p.logger().Warn("error restarting daemon for its new binary",
+				"pid", process.Pid(), "error", err)
+		}
+		return
+	}
+}
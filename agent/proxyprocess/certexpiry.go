@@ -0,0 +1,48 @@
+package proxyprocess
+
+import (
+	"time"
+)
+
+// watchCertExpiry gracefully restarts process CertExpiryLead before the
+// time returned by CertExpiry so that it loads a renewed certificate. This
+// returns when stopCh is closed or the restart was requested.
+func (p *Daemon) watchCertExpiry(process osProcess, stopCh <-chan struct{}) {
+	var expiry time.Time
+	if err := p.safeCall("CertExpiry", func() error {
+		expiry = p.CertExpiry()
+		return nil
+	}); err != nil || expiry.IsZero() {
+		return
+	}
+
+	lead := p.CertExpiryLead
+	if lead == 0 {
+		lead = DaemonCertExpiryLead
+	}
+
+	// If we're already past the restart time then restarting would only
+	// load the same certificate again, so there is nothing useful to do.
+	wait := expiry.Add(-lead).Sub(p.now())
+	if wait <= 0 {
+		p.logger().Warn("certificate of daemon expires within the lead time, "+
+			"not restarting", "pid", process.Pid(),
+			"expiry", expiry.Format(time.RFC3339), "lead", lead)
+		return
+	}
+
+	timer := p.getClock().NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+	case <-stopCh:
+		return
+	}
+
+	p.logger().Info("certificate of daemon expires, restarting it",
+		"pid", process.Pid(), "expiry", expiry.Format(time.RFC3339))
+	if err := p.restartProcess(process, restartCertExpiry); err != nil {
+		p.logger().Warn("error restarting daemon for certificate renewal",
+			"pid", process.Pid(), "error", err)
+	}
+}
@@ -0,0 +1,51 @@
+package proxyprocess
+
+import (
+	"time"
+)
+
+// clock is the source of time of the supervision loop and Stop. Tests
+// replace it to control time without sleeping.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) clockTimer
+	After(d time.Duration) <-chan time.Time
+}
+
+// clockTimer is the part of *time.Timer that a clock provides.
+type clockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// realClock is the clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) NewTimer(d time.Duration) clockTimer {
+	return &realTimer{timer: time.NewTimer(d)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t *realTimer) C() <-chan time.Time { return t.timer.C }
+func (t *realTimer) Stop() bool          { return t.timer.Stop() }
+
+// now returns the current time of the clock of the daemon.
+func (p *Daemon) now() time.Time {
+	return p.getClock().Now()
+}
+
+// getClock returns the clock of the daemon, which is the real one unless
+// a test replaced it.
+func (p *Daemon) getClock() clock {
+	if p.clock != nil {
+		return p.clock
+	}
+
+	return realClock{}
+}
@@ -0,0 +1,530 @@
+package proxyprocess
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/testutil/retry"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock whose time only moves with Advance.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) clockTimer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t := &fakeTimer{clock: c, at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// Advance moves the time forward by d and fires all timers that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+
+		t.ch <- c.now
+	}
+	c.timers = pending
+}
+
+// WaitTimers waits until at least n timers are pending, failing the test
+// if that doesn't happen.
+func (c *fakeClock) WaitTimers(t *testing.T, n int) {
+	retry.Run(t, func(r *retry.R) {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if len(c.timers) < n {
+			r.Fatalf("only %d timers pending", len(c.timers))
+		}
+	})
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	ch    chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	for i, other := range t.clock.timers {
+		if other == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestDaemon_clockBackoff(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	events := make(chan DaemonEvent, 100)
+	clock := newFakeClock()
+	runner := &fakeRunner{ExitOnStart: true}
+	d := testFakeDaemon(runner)
+	d.clock = clock
+	d.Events = events
+	d.RestartBackoffMin = 1
+	d.RestartMaxWait = 5 * time.Second
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// The wait doubles with every attempt until it is capped
+	for _, wait := range []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		clock.WaitTimers(t, 1)
+		state := d.BackoffState()
+		require.Equal(wait, state.NextStartAt.Sub(clock.Now()))
+
+		n := runner.Starts()
+		clock.Advance(wait - time.Millisecond)
+		require.Equal(n, runner.Starts())
+		clock.Advance(time.Millisecond)
+		runner.Process(t, n)
+	}
+
+	var waits []time.Duration
+	for len(events) > 0 {
+		if e := <-events; e.Type == DaemonEventBackingOff {
+			waits = append(waits, e.Wait)
+		}
+	}
+	require.Equal([]time.Duration{
+		2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second,
+	}, waits[:4])
+}
+
+func TestDaemon_clockBackoffStrategy(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	clock := newFakeClock()
+	runner := &fakeRunner{ExitOnStart: true}
+	d := testFakeDaemon(runner)
+	d.clock = clock
+	d.RestartBackoffMin = 1
+	d.BackoffStrategy = LinearBackoff{Step: 3 * time.Second, Max: 7 * time.Second}
+	d.RestartMaxWait = time.Second
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// RestartMaxWait doesn't cap a custom strategy
+	for _, wait := range []time.Duration{3 * time.Second, 6 * time.Second, 7 * time.Second} {
+		clock.WaitTimers(t, 1)
+		require.Equal(wait, d.BackoffState().NextStartAt.Sub(clock.Now()))
+		n := runner.Starts()
+		clock.Advance(wait)
+		runner.Process(t, n)
+	}
+}
+
+func TestDaemon_clockHealthyReset(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	clock := newFakeClock()
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.clock = clock
+	d.RestartBackoffMin = 1
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// A process that exits right away is restarted with a backoff
+	runner.Process(t, 0).Exit(nil)
+	clock.WaitTimers(t, 1)
+	require.Equal(uint32(2), d.BackoffState().Attempts)
+	clock.Advance(2 * time.Second)
+	runner.Process(t, 1)
+	retry.Run(t, func(r *retry.R) {
+		if !d.Running() {
+			r.Fatal("not running")
+		}
+	})
+
+	// Once it was up for DaemonRestartHealthy the attempts are reset
+	require.False(d.Healthy())
+	clock.Advance(DaemonRestartHealthy + time.Millisecond)
+	require.True(d.Healthy())
+	runner.Process(t, 1).Exit(nil)
+	runner.Process(t, 2)
+	require.Equal(uint32(1), d.BackoffState().Attempts)
+}
+
+func TestDaemon_clockRestartDelay(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	clock := newFakeClock()
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.clock = clock
+	d.RestartBackoffMin = 10
+	d.RestartDelay = 3 * time.Second
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// The first start isn't delayed
+	runner.Process(t, 0)
+
+	// A clean exit is restarted only after the delay even though the
+	// backoff doesn't apply yet
+	runner.Process(t, 0).Exit(nil)
+	clock.WaitTimers(t, 1)
+	require.Equal(3*time.Second, d.BackoffState().NextStartAt.Sub(clock.Now()))
+	clock.Advance(3*time.Second - time.Millisecond)
+	require.Equal(1, runner.Starts())
+	clock.Advance(time.Millisecond)
+	runner.Process(t, 1)
+
+	// Stopping interrupts the delay
+	runner.Process(t, 1).Exit(nil)
+	clock.WaitTimers(t, 1)
+	require.NoError(d.Stop())
+	select {
+	case <-d.exitedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon should stop")
+	}
+	require.Equal(2, runner.Starts())
+}
+
+func TestDaemon_clockTimeToReady(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	var ready int32
+	events := make(chan DaemonEvent, 100)
+	clock := newFakeClock()
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.clock = clock
+	d.Events = events
+	d.RestartBackoffMin = 10
+	d.ReadyCheck = func(ctx context.Context) error {
+		if atomic.LoadInt32(&ready) == 0 {
+			return fmt.Errorf("not ready")
+		}
+		return nil
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	waitReady := func() DaemonEvent {
+		t.Helper()
+		for {
+			select {
+			case e := <-events:
+				if e.Type == DaemonEventReady {
+					return e
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no ready event")
+			}
+		}
+	}
+
+	// The time is measured from the start until the check passes, both
+	// initially and after a restart
+	runner.Process(t, 0)
+	clock.Advance(2 * time.Second)
+	atomic.StoreInt32(&ready, 1)
+	require.Equal(2*time.Second, waitReady().TimeToReady)
+
+	atomic.StoreInt32(&ready, 0)
+	runner.Process(t, 0).Exit(nil)
+	runner.Process(t, 1)
+	clock.Advance(3 * time.Second)
+	atomic.StoreInt32(&ready, 1)
+	require.Equal(3*time.Second, waitReady().TimeToReady)
+}
+
+func TestDaemon_clockShutdownFunc(t *testing.T) {
+	t.Parallel()
+
+	// start starts a daemon whose ShutdownFunc returns err and makes the
+	// process exit if exit is set, and returns the daemon and its process.
+	start := func(t *testing.T, clock *fakeClock, err error, exit bool) (*Daemon, *fakeProcess) {
+		runner := &fakeRunner{}
+		d := testFakeDaemon(runner)
+		d.clock = clock
+		d.GracefulWait = 10 * time.Second
+		d.ShutdownFunc = func(ctx context.Context) error {
+			if exit {
+				runner.Process(t, 0).Exit(nil)
+			}
+			return err
+		}
+		require.NoError(t, d.Start())
+		return d, runner.Process(t, 0)
+	}
+
+	t.Run("exits", func(t *testing.T) {
+		t.Parallel()
+
+		d, process := start(t, newFakeClock(), nil, true)
+		require.NoError(t, d.Stop())
+		require.Empty(t, process.Signals())
+	})
+
+	t.Run("killed after the graceful wait", func(t *testing.T) {
+		t.Parallel()
+
+		clock := newFakeClock()
+		d, process := start(t, clock, nil, false)
+		errCh := d.AsyncStop()
+		clock.WaitTimers(t, 1)
+		clock.Advance(10*time.Second - time.Millisecond)
+		require.Empty(t, process.Signals())
+		clock.Advance(time.Millisecond)
+		require.NoError(t, <-errCh)
+		require.Equal(t, []os.Signal{os.Kill}, process.Signals())
+	})
+
+	t.Run("falls back to signals", func(t *testing.T) {
+		t.Parallel()
+
+		d, process := start(t, newFakeClock(), fmt.Errorf("no admin API"), false)
+		require.NoError(t, d.Stop())
+		require.Equal(t, []os.Signal{os.Interrupt}, process.Signals())
+	})
+}
+
+func TestDaemon_clockState(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	events := make(chan DaemonEvent, 100)
+	clock := newFakeClock()
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.clock = clock
+	d.Events = events
+	d.RestartBackoffMin = 1
+	require.Equal(DaemonState(""), d.State())
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	states := func(n int) []DaemonState {
+		t.Helper()
+		var result []DaemonState
+		for len(result) < n {
+			select {
+			case e := <-events:
+				if e.Type == DaemonEventStateChanged {
+					result = append(result, e.State)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("only got states %v", result)
+			}
+		}
+		return result
+	}
+
+	runner.Process(t, 0)
+	require.Equal([]DaemonState{DaemonStateStarting, DaemonStateRunning}, states(2))
+	require.Equal(DaemonStateRunning, d.State())
+	require.Equal(DaemonStateRunning, d.Stats().State)
+
+	// A restart backs off before the process is running again
+	runner.Process(t, 0).Exit(nil)
+	clock.WaitTimers(t, 1)
+	require.Equal(DaemonStateBackingOff, d.State())
+	clock.Advance(2 * time.Second)
+	runner.Process(t, 1)
+	require.Equal([]DaemonState{
+		DaemonStateStarting, DaemonStateBackingOff, DaemonStateStarting, DaemonStateRunning,
+	}, states(4))
+
+	require.NoError(d.Stop())
+	require.Equal([]DaemonState{DaemonStateStopped}, states(1))
+	require.Equal(DaemonStateStopped, d.State())
+
+	// Giving up is a failure
+	runner = &fakeRunner{ExitOnStart: true}
+	d = testFakeDaemon(runner)
+	d.MaxRestarts = 1
+	d.RestartBackoffMin = 10
+	require.NoError(d.Start())
+	require.NoError(d.WaitForExit(context.Background()))
+	require.Equal(DaemonStateFailed, d.State())
+}
+
+func TestDaemon_clockWatchBinary(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	bin := filepath.Join(td, "proxy")
+	require.NoError(ioutil.WriteFile(bin, []byte("v1"), 0755))
+
+	clock := newFakeClock()
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.Command = exec.Command(bin)
+	d.clock = clock
+	d.RestartBackoffMin = 1
+	d.WatchBinary = true
+	require.NoError(d.Start())
+	defer d.Stop()
+	runner.Process(t, 0)
+
+	// A binary that is still being written isn't picked up
+	clock.WaitTimers(t, 1)
+	require.NoError(ioutil.WriteFile(bin, []byte("v2"), 0755))
+	clock.Advance(DaemonWatchBinaryInterval)
+	clock.WaitTimers(t, 1)
+	require.NoError(ioutil.WriteFile(bin, []byte("v2 with more"), 0755))
+	clock.Advance(DaemonWatchBinaryInterval)
+	clock.WaitTimers(t, 1)
+	require.Equal(1, runner.Starts())
+
+	// Once it is stable the process is restarted without a backoff
+	clock.Advance(DaemonWatchBinaryInterval)
+	runner.Process(t, 1)
+	require.Equal(uint32(1), d.BackoffState().Attempts)
+}
+
+func TestDaemon_clockCertExpiry(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	var drains, calls int32
+	clock := newFakeClock()
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.clock = clock
+	d.RestartBackoffMin = 1
+	d.CertExpiry = func() time.Time {
+		// No expiry for the first process so that its timer doesn't get
+		// in the way of waiting for the backoff
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return time.Time{}
+		}
+		return clock.Now().Add(DaemonCertExpiryLead + time.Minute)
+	}
+	d.DrainUntil = func(ctx context.Context) error {
+		atomic.AddInt32(&drains, 1)
+		return nil
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Get to a second attempt so that the reset can be seen
+	runner.Process(t, 0).Exit(nil)
+	clock.WaitTimers(t, 1)
+	clock.Advance(2 * time.Second)
+	runner.Process(t, 1)
+	require.Equal(uint32(2), d.BackoffState().Attempts)
+
+	// Lead time before the expiry the process is drained and restarted
+	// without a backoff
+	clock.WaitTimers(t, 1)
+	clock.Advance(time.Minute - time.Millisecond)
+	require.Equal(2, runner.Starts())
+	clock.Advance(time.Millisecond)
+	runner.Process(t, 2)
+	require.Equal(uint32(1), d.BackoffState().Attempts)
+	require.Equal(int32(1), atomic.LoadInt32(&drains))
+}
+
+func TestDaemon_clockRecycle(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	clock := newFakeClock()
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.clock = clock
+	d.RecycleInterval = time.Hour
+	require.NoError(d.Start())
+	defer d.Stop()
+	runner.Process(t, 0)
+
+	// The process is recycled once it ran for the interval
+	clock.WaitTimers(t, 1)
+	clock.Advance(time.Hour - time.Millisecond)
+	require.Equal(1, runner.Starts())
+	clock.Advance(time.Millisecond)
+	runner.Process(t, 1)
+
+	// The restart is counted at the time of the clock
+	require.Equal(1, d.RecentRestarts(time.Minute))
+	clock.WaitTimers(t, 1)
+	clock.Advance(2 * time.Minute)
+	require.Equal(0, d.RecentRestarts(time.Minute))
+}
+
+func TestDaemon_clockBackoffStrategyPanic(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	clock := newFakeClock()
+	runner := &fakeRunner{ExitOnStart: true}
+	d := testFakeDaemon(runner)
+	d.clock = clock
+	d.RestartBackoffMin = 1
+	d.BackoffStrategy = backoffFunc(func(uint) time.Duration { panic("backoff") })
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// The loop survives and falls back to the default backoff
+	clock.WaitTimers(t, 1)
+	require.Equal(2*time.Second, d.BackoffState().NextStartAt.Sub(clock.Now()))
+	clock.Advance(2 * time.Second)
+	runner.Process(t, 1)
+}
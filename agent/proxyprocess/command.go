@@ -0,0 +1,106 @@
+package proxyprocess
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// NewDaemonFromString returns a Daemon for the command given as a single
+// command line string, for configuration that stores commands as strings.
+// The command line is split into words following the quoting rules of a
+// POSIX shell: words are separated by whitespace, single quotes preserve
+// everything literally, and double quotes and backslashes work as in sh.
+//
+// The command line is NOT run by a shell. There is no globbing, variable
+// expansion, pipes or redirection, so characters like * and | are passed
+// to the command as is. Use a []string command directly where possible.
+func NewDaemonFromString(cmdline string, logger *log.Logger) (*Daemon, error) {
+	args, err := splitCommandLine(cmdline)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("command line is empty")
+	}
+
+	return &Daemon{
+		Command: exec.Command(args[0], args[1:]...),
+		Logger:  logger,
+	}, nil
+}
+
+// splitCommandLine splits a command line into words. See
+// NewDaemonFromString for the rules.
+func splitCommandLine(s string) ([]string, error) {
+	var words []string
+	var word bytes.Buffer
+
+	// inWord is true if a word has been started, which may be empty
+	// because of quotes such as ''.
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+
+		case c == '\\':
+			if i+1 >= len(s) {
+				return nil, fmt.Errorf("command line ends with an escape character")
+			}
+			i++
+
+			// An escaped newline is a line continuation
+			if s[i] != '\n' {
+				word.WriteByte(s[i])
+				inWord = true
+			}
+
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote in command line")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				// Within double quotes a backslash only escapes characters
+				// that are special there.
+				if s[i] == '\\' && i+1 < len(s) {
+					switch s[i+1] {
+					case '"', '\\', '$', '`':
+						i++
+					case '\n':
+						i++
+						continue
+					}
+				}
+				word.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("unterminated double quote in command line")
+			}
+			inWord = true
+
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
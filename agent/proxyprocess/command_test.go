@@ -0,0 +1,62 @@
+package proxyprocess
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		Name     string
+		Input    string
+		Expected []string
+		Err      bool
+	}{
+		{"empty", "", nil, false},
+		{"whitespace only", " \t\n ", nil, false},
+		{"simple", "proxy -listen :8080", []string{"proxy", "-listen", ":8080"}, false},
+		{"extra whitespace", "  proxy \t -v  ", []string{"proxy", "-v"}, false},
+		{"single quotes", `proxy '-name=a b' 'x"y\z'`, []string{"proxy", "-name=a b", `x"y\z`}, false},
+		{"double quotes", `proxy "a b" "c\"d" "e\f" "\$HOME"`, []string{"proxy", "a b", `c"d`, `e\f`, "$HOME"}, false},
+		{"empty quotes", `proxy '' ""`, []string{"proxy", "", ""}, false},
+		{"adjacent quotes", `proxy a'b c'"d e"f`, []string{"proxy", "ab cd ef"}, false},
+		{"escapes", `proxy a\ b \'c\'`, []string{"proxy", "a b", "'c'"}, false},
+		{"line continuation", "proxy \\\n-v", []string{"proxy", "-v"}, false},
+		{"no shell semantics", "proxy * | grep $HOME > out", []string{"proxy", "*", "|", "grep", "$HOME", ">", "out"}, false},
+		{"unterminated single quote", "proxy 'a", nil, true},
+		{"unterminated double quote", `proxy "a`, nil, true},
+		{"trailing escape", `proxy a\`, nil, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			actual, err := splitCommandLine(tc.Input)
+			if tc.Err {
+				require.Error(err)
+				return
+			}
+
+			require.NoError(err)
+			require.Equal(tc.Expected, actual)
+		})
+	}
+}
+
+func TestNewDaemonFromString(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	_, err := NewDaemonFromString("  ", testLogger)
+	require.Error(err)
+
+	d, err := NewDaemonFromString(`/bin/proxy -name "web proxy"`, testLogger)
+	require.NoError(err)
+	require.Equal("/bin/proxy", d.Command.Path)
+	require.Equal([]string{"/bin/proxy", "-name", "web proxy"}, d.Command.Args)
+	require.Equal(testLogger, d.Logger)
+}
@@ -0,0 +1,330 @@
+package proxyprocess
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// DaemonConfig is a serializable description of how a Daemon supervises its
+// process, as returned by Daemon.Config. Functions can't be serialized so
+// for hooks only whether they are set is included. Timeouts and windows are
+// the effective values, with defaults applied. Secrets are never included.
+type DaemonConfig struct {
+	Command               *CommandConfig
+	ValidateCommand       *CommandConfig
+	ProxyID               string
+	Name                  string
+	HasProxyToken         bool
+	TokenDelivery         string
+	TokenDir              string
+	TokenEnvName          string
+	RequireProxyToken     bool
+	RequireUUIDProxyToken bool
+	StartSync             bool
+	DryRun                bool
+	PidPath               string
+	LogPath               string
+	LogFileMode           os.FileMode
+	LogMaxBytes           int64
+	LogMaxFiles           int
+	RecentOutputLines     int
+	RecentOutputBytes     int
+	ExitHistorySize       int
+	StderrLogLevel        string
+	RestartHealthy        time.Duration
+	RestartBackoffMin     uint32
+	RestartMaxWait        time.Duration
+	RestartDelay          time.Duration
+	MaxRestarts           uint
+	RestartPolicy         string
+	SuccessExitCodes      []int
+	RestartLogAttempts    uint32
+	RestartLogInterval    time.Duration
+	MinRuntime            time.Duration
+	MaxFastExits          uint
+	RepeatedExitThreshold uint
+	RepeatedExitWindow    time.Duration
+	StopOnRepeatedExit    bool
+	ResetBackoffOnRestart bool
+	ValidateTimeout       time.Duration
+	FlapWindow            time.Duration
+	DeregisterTimeout     time.Duration
+	DrainTimeout          time.Duration
+	ProfileDir            string
+	LogEnvKeys            []string
+	EnvAllowKeys          []string
+	EnvStripKeys          []string
+	EnvFile               string
+	LogEnvSecrets         bool
+	NetnsPath             string
+	ExtraFiles            []string
+	StopSignal            string
+	GracefulWait          time.Duration
+	StopSequence          []StopStepConfig
+	KillWait              time.Duration
+	ReExecSignal          string
+	ReExecPidPath         string
+	ReloadSignal          string
+	Limits                Limits
+	User                  string
+	Group                 string
+	DieWithParent         bool
+	CreateDir             bool
+	DirMode               os.FileMode
+	MetricLabels          []metrics.Label
+	TerminalSignals       []string
+	HeartbeatFile         string
+	HeartbeatTimeout      time.Duration
+	CertExpiryLead        time.Duration
+	RecycleInterval       time.Duration
+	WatchBinary           bool
+	WatchBinaryInterval   time.Duration
+	ResourceInterval      time.Duration
+	ResourceMetrics       bool
+	ReadyTimeout          time.Duration
+	HealthInterval        time.Duration
+	HealthFailures        int
+
+	HasDeregisterFunc  bool
+	HasPreStart        bool
+	HasStdinProvider   bool
+	HasPostStop        bool
+	HasDrainUntil      bool
+	HasShutdownFunc    bool
+	HasProfileFunc     bool
+	HasLogLineFunc     bool
+	HasExitInterpreter bool
+	HasBackoffStrategy bool
+	HasCertExpiry      bool
+	HasReadyCheck      bool
+	HasHealthCheck     bool
+	HasTracer          bool
+	HasEvents          bool
+}
+
+// StopStepConfig is a serializable description of a StopStep.
+type StopStepConfig struct {
+	Signal string
+	Wait   time.Duration
+}
+
+// CommandConfig is a serializable description of an *exec.Cmd. Values of
+// environment variables that look like secrets are redacted.
+type CommandConfig struct {
+	Path string
+	Args []string
+	Dir  string
+	Env  []string
+}
+
+// Config returns a snapshot of the configuration of the daemon. This is
+// meant for debugging, for example to dump exactly how a proxy is
+// supervised, and is safe to serialize.
+func (p *Daemon) Config() *DaemonConfig {
+	reexecSignal := p.ReExecSignal
+	if reexecSignal == nil {
+		reexecSignal = defaultReExecSignal
+	}
+	reloadSignal := p.ReloadSignal
+	if reloadSignal == nil {
+		reloadSignal = defaultReloadSignal
+	}
+
+	p.lock.Lock()
+	command := p.commandConfig(p.Command)
+	validateCommand := p.commandConfig(p.ValidateCommand)
+	hasProxyToken := p.ProxyToken != ""
+	p.lock.Unlock()
+
+	c := &DaemonConfig{
+		Command:               command,
+		ValidateCommand:       validateCommand,
+		ProxyID:               p.ProxyID,
+		Name:                  p.name(),
+		HasProxyToken:         hasProxyToken,
+		TokenDelivery:         string(p.TokenDelivery),
+		TokenDir:              p.TokenDir,
+		TokenEnvName:          p.tokenEnvName(),
+		RequireProxyToken:     p.RequireProxyToken,
+		RequireUUIDProxyToken: p.RequireUUIDProxyToken,
+		StartSync:             p.StartSync,
+		DryRun:                p.DryRun,
+		PidPath:               p.PidPath,
+		LogPath:               p.LogPath,
+		LogFileMode:           p.logFileMode(),
+		LogMaxBytes:           p.LogMaxBytes,
+		LogMaxFiles:           p.LogMaxFiles,
+		RecentOutputLines:     p.RecentOutputLines,
+		RecentOutputBytes:     p.RecentOutputBytes,
+		ExitHistorySize:       p.exitHistorySize(),
+		StderrLogLevel:        p.StderrLogLevel,
+		RestartHealthy:        p.restartHealthy(),
+		RestartBackoffMin:     p.restartBackoffMin(),
+		RestartMaxWait:        p.restartMaxWait(),
+		RestartDelay:          p.RestartDelay,
+		MaxRestarts:           p.MaxRestarts,
+		RestartPolicy:         string(p.restartPolicy()),
+		SuccessExitCodes:      p.successExitCodes(),
+		RestartLogAttempts:    p.restartLogAttempts(),
+		RestartLogInterval:    p.restartLogInterval(),
+		MinRuntime:            p.MinRuntime,
+		MaxFastExits:          p.MaxFastExits,
+		RepeatedExitThreshold: p.RepeatedExitThreshold,
+		RepeatedExitWindow:    p.repeatedExitWindow(),
+		StopOnRepeatedExit:    p.StopOnRepeatedExit,
+		ResetBackoffOnRestart: p.ResetBackoffOnRestart,
+		ValidateTimeout:       p.ValidateTimeout,
+		FlapWindow:            p.flapWindow(),
+		DeregisterTimeout:     p.DeregisterTimeout,
+		DrainTimeout:          p.DrainTimeout,
+		ProfileDir:            p.ProfileDir,
+		LogEnvKeys:            p.LogEnvKeys,
+		EnvAllowKeys:          p.EnvAllowKeys,
+		EnvStripKeys:          p.EnvStripKeys,
+		EnvFile:               p.EnvFile,
+		LogEnvSecrets:         p.LogEnvSecrets,
+		NetnsPath:             p.NetnsPath,
+		ReExecPidPath:         p.ReExecPidPath,
+		StopSignal:            os.Interrupt.String(),
+		GracefulWait:          p.GracefulWait,
+		KillWait:              p.KillWait,
+		Limits:                p.Limits,
+		User:                  p.User,
+		Group:                 p.Group,
+		DieWithParent:         p.DieWithParent,
+		CreateDir:             p.CreateDir,
+		DirMode:               p.dirMode(),
+		MetricLabels:          p.MetricLabels,
+		HeartbeatFile:         p.HeartbeatFile,
+		HeartbeatTimeout:      p.HeartbeatTimeout,
+		CertExpiryLead:        p.CertExpiryLead,
+		RecycleInterval:       p.RecycleInterval,
+		WatchBinary:           p.WatchBinary,
+		WatchBinaryInterval:   p.watchBinaryInterval(),
+		ResourceInterval:      p.ResourceInterval,
+		ResourceMetrics:       p.ResourceMetrics,
+		ReadyTimeout:          p.ReadyTimeout,
+		HealthInterval:        p.HealthInterval,
+		HealthFailures:        p.HealthFailures,
+		HasDeregisterFunc:     p.DeregisterFunc != nil,
+		HasPreStart:           p.PreStart != nil,
+		HasStdinProvider:      p.StdinProvider != nil,
+		HasPostStop:           p.PostStop != nil,
+		HasDrainUntil:         p.DrainUntil != nil,
+		HasShutdownFunc:       p.ShutdownFunc != nil,
+		HasProfileFunc:        p.ProfileFunc != nil,
+		HasLogLineFunc:        p.LogLineFunc != nil,
+		HasExitInterpreter:    p.ExitInterpreter != nil,
+		HasBackoffStrategy:    p.BackoffStrategy != nil,
+		HasCertExpiry:         p.CertExpiry != nil,
+		HasReadyCheck:         p.ReadyCheck != nil,
+		HasHealthCheck:        p.HealthCheck != nil,
+		HasTracer:             p.Tracer != nil,
+		HasEvents:             p.Events != nil,
+	}
+	if c.TokenDelivery == "" {
+		c.TokenDelivery = "env"
+	}
+	if c.ValidateTimeout == 0 {
+		c.ValidateTimeout = DaemonValidateTimeout
+	}
+	if c.DeregisterTimeout == 0 {
+		c.DeregisterTimeout = DaemonDeregisterTimeout
+	}
+	if c.DrainTimeout == 0 {
+		c.DrainTimeout = DaemonDrainTimeout
+	}
+	if c.GracefulWait == 0 {
+		c.GracefulWait = DaemonGracefulWait
+	}
+	if c.CertExpiryLead == 0 {
+		c.CertExpiryLead = DaemonCertExpiryLead
+	}
+	if c.ReadyTimeout == 0 {
+		c.ReadyTimeout = DaemonReadyTimeout
+	}
+	if c.HealthFailures <= 0 {
+		c.HealthFailures = DaemonHealthFailures
+	}
+	if p.StopSignal != nil {
+		c.StopSignal = p.StopSignal.String()
+	}
+	if reexecSignal != nil {
+		c.ReExecSignal = reexecSignal.String()
+	}
+	if reloadSignal != nil {
+		c.ReloadSignal = reloadSignal.String()
+	}
+	for _, step := range p.stopSequence() {
+		c.StopSequence = append(c.StopSequence, StopStepConfig{
+			Signal: step.Signal.String(),
+			Wait:   step.Wait,
+		})
+	}
+	for _, f := range p.ExtraFiles {
+		c.ExtraFiles = append(c.ExtraFiles, f.Name())
+	}
+	for _, sig := range p.TerminalSignals {
+		c.TerminalSignals = append(c.TerminalSignals, sig.String())
+	}
+
+	return c
+}
+
+// commandConfig returns the CommandConfig for cmd, or nil if cmd is nil.
+// Env is the environment start passes to the process rather than cmd.Env,
+// so it is filtered, extended by EnvFile and includes the proxy ID and the
+// redacted token. Like for the process a nil cmd.Env is empty. The lock
+// must be held.
+func (p *Daemon) commandConfig(cmd *exec.Cmd) *CommandConfig {
+	if cmd == nil {
+		return nil
+	}
+
+	// An EnvFile that can't be read fails the start, so there is no
+	// environment to report from it.
+	fileEnv, _ := p.envFile()
+	env := p.commandEnv(cmd.Env, fileEnv)
+	if p.TokenDelivery == TokenDeliveryFile {
+		env = append(env, fmt.Sprintf("%s=<token file>", EnvProxyTokenFile))
+	}
+
+	return &CommandConfig{
+		Path: cmd.Path,
+		Args: cmd.Args,
+		Dir:  cmd.Dir,
+		Env:  redactEnv(redactEnvKey(env, p.tokenEnvName())),
+	}
+}
+
+// redactEnv returns a copy of env with the values of variables that look
+// like secrets replaced.
+func redactEnv(env []string) []string {
+	result := make([]string, len(env))
+	for i, kv := range env {
+		if idx := strings.Index(kv, "="); idx > 0 && isSecretEnvKey(kv[:idx]) {
+			kv = kv[:idx+1] + "<redacted>"
+		}
+		result[i] = kv
+	}
+
+	return result
+}
+
+// redactEnvKey returns a copy of env with the value of key replaced.
+func redactEnvKey(env []string, key string) []string {
+	result := make([]string, len(env))
+	for i, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			kv = key + "=<redacted>"
+		}
+		result[i] = kv
+	}
+
+	return result
+}
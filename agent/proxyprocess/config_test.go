@@ -0,0 +1,78 @@
+package proxyprocess
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDaemonConfig(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	cmd := exec.Command("/bin/proxy", "-listen", ":8080")
+	cmd.Dir = "/tmp"
+	cmd.Env = []string{"FOO=bar", "UPSTREAM_TOKEN=abc123"}
+
+	d := &Daemon{
+		Command:         cmd,
+		ProxyID:         "web-proxy",
+		ProxyToken:      "hello",
+		PidPath:         "/tmp/proxy.pid",
+		DrainTimeout:    time.Minute,
+		TerminalSignals: []os.Signal{syscall.SIGTERM},
+		DrainUntil: func(ctx context.Context) error {
+			return nil
+		},
+	}
+
+	c := d.Config()
+	require.Equal(&CommandConfig{
+		Path: "/bin/proxy",
+		Args: []string{"/bin/proxy", "-listen", ":8080"},
+		Dir:  "/tmp",
+		Env: []string{
+			"FOO=bar",
+			"UPSTREAM_TOKEN=<redacted>",
+			EnvProxyID + "=web-proxy",
+			EnvProxyToken + "=<redacted>",
+		},
+	}, c.Command)
+	require.Nil(c.ValidateCommand)
+	require.Equal("web-proxy", c.ProxyID)
+	require.True(c.HasProxyToken)
+	require.Equal("/tmp/proxy.pid", c.PidPath)
+
+	// Explicit values are kept and defaults are filled in
+	require.Equal(time.Minute, c.DrainTimeout)
+	require.Equal(DaemonDeregisterTimeout, c.DeregisterTimeout)
+	require.Equal(DaemonFlapWindow, c.FlapWindow)
+	require.Equal(DaemonGracefulWait, c.GracefulWait)
+	require.Equal([]StopStepConfig{{os.Interrupt.String(), DaemonGracefulWait}}, c.StopSequence)
+	require.Equal([]string{syscall.SIGTERM.String()}, c.TerminalSignals)
+
+	// Only hooks that are set are reported
+	require.True(c.HasDrainUntil)
+	require.False(c.HasDeregisterFunc)
+	require.False(c.HasProfileFunc)
+
+	// The config must be serializable and never contain secrets
+	bs, err := json.Marshal(c)
+	require.NoError(err)
+	require.NotContains(string(bs), "hello")
+	require.NotContains(string(bs), "abc123")
+
+	// Without an Env the process doesn't inherit ours, which is reported
+	d.Command = exec.Command("/bin/proxy")
+	require.Equal([]string{
+		EnvProxyID + "=web-proxy",
+		EnvProxyToken + "=<redacted>",
+	}, d.Config().Command.Env)
+}
@@ -0,0 +1,47 @@
+package proxyprocess
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// lookupCredential resolves the given user and group, each a name or a
+// numeric ID, to a uid and gid. If group is empty the primary group of the
+// user is used, and if userName is empty the current user is kept.
+func lookupCredential(userName, group string) (uint32, uint32, error) {
+	uid, gid := os.Getuid(), os.Getgid()
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if _, ok := err.(user.UnknownUserError); ok {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("unknown user %q: %s", userName, err)
+		}
+
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, fmt.Errorf("user %q has a non-numeric uid %q", userName, u.Uid)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return 0, 0, fmt.Errorf("user %q has a non-numeric gid %q", userName, u.Gid)
+		}
+	}
+
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			g, err = user.LookupGroupId(group)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("unknown group %q: %s", group, err)
+		}
+
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, fmt.Errorf("group %q has a non-numeric gid %q", group, g.Gid)
+		}
+	}
+
+	return uint32(uid), uint32(gid), nil
+}
@@ -0,0 +1,54 @@
+package proxyprocess
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupCredential(t *testing.T) {
+	t.Parallel()
+
+	current, err := user.Current()
+	require.NoError(t, err)
+	uid, err := strconv.Atoi(current.Uid)
+	require.NoError(t, err)
+	gid, err := strconv.Atoi(current.Gid)
+	require.NoError(t, err)
+
+	cases := []struct {
+		Name  string
+		User  string
+		Group string
+		Uid   int
+		Gid   int
+		Err   string
+	}{
+		{"user name", current.Username, "", uid, gid, ""},
+		{"numeric user", current.Uid, "", uid, gid, ""},
+		{"numeric group", "", current.Gid, os.Getuid(), gid, ""},
+		{"unknown user", "no-such-user-consul", "", 0, 0, "unknown user"},
+		{"unknown group", "", "no-such-group-consul", 0, 0, "unknown group"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+
+			uid, gid, err := lookupCredential(tc.User, tc.Group)
+			if tc.Err != "" {
+				require.Error(err)
+				require.Contains(err.Error(), tc.Err)
+				return
+			}
+
+			require.NoError(err)
+			require.Equal(uint32(tc.Uid), uid)
+			require.Equal(uint32(tc.Gid), gid)
+		})
+	}
+}
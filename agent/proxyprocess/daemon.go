@@ -1,28 +1,85 @@
 package proxyprocess
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/lib"
 	"github.com/hashicorp/consul/lib/file"
 	"github.com/mitchellh/mapstructure"
 )
 
-// Constants related to restart timers with the daemon mode proxies. At some
-// point we will probably want to expose these knobs to an end user, but
-// reasonable defaults are chosen.
+// Constants related to restart timers with the daemon mode proxies. These
+// are the defaults for the RestartHealthy, RestartBackoffMin and
+// RestartMaxWait fields of Daemon.
 const (
 	DaemonRestartHealthy    = 10 * time.Second // time before considering healthy
 	DaemonRestartBackoffMin = 3                // 3 attempts before backing off
 	DaemonRestartMaxWait    = 1 * time.Minute  // maximum backoff wait time
 )
 
+// DaemonFlapWindow is the default sliding window over which restarts are
+// counted for RecentRestarts and the recent restarts metric.
+const DaemonFlapWindow = 5 * time.Minute
+
+// DaemonDeregisterTimeout is the default maximum time DeregisterFunc may
+// take during Stop before the stop proceeds anyway.
+const DaemonDeregisterTimeout = 5 * time.Second
+
+// DaemonDrainTimeout is the default maximum time Stop waits for DrainUntil
+// before signalling the process.
+const DaemonDrainTimeout = 30 * time.Second
+
+// DaemonGracefulWait is the default time Stop waits for the process to exit
+// after sending StopSignal before it is killed.
+const DaemonGracefulWait = 5 * time.Second
+
+// DaemonHealthFailures is the default number of failed health checks in a
+// row after which a process is restarted.
+const DaemonHealthFailures = 3
+
+// DaemonReadyTimeout is the default maximum time a process has to pass
+// ReadyCheck after it is started.
+const DaemonReadyTimeout = 30 * time.Second
+
+// DaemonCertExpiryLead is the default time before certificate expiry at
+// which a process is restarted when CertExpiry is set.
+const DaemonCertExpiryLead = 5 * time.Minute
+
+// DaemonProfileTimeout is the maximum time ProfileFunc may take when a
+// profile is captured with CaptureProfile.
+const DaemonProfileTimeout = 1 * time.Minute
+
+// DaemonDirMode is the default mode of the working directory created with
+// CreateDir.
+const DaemonDirMode os.FileMode = 0700
+
+// DaemonLogFileMode is the default mode of the file at LogPath.
+const DaemonLogFileMode os.FileMode = 0600
+
+// DaemonOutputDrainTimeout is the maximum time to wait, after the process
+// exits, for remaining output to be drained through LogLineFunc. This only
+// runs out if something else (such as a grandchild) still holds the output.
+const DaemonOutputDrainTimeout = 5 * time.Second
+
+// DaemonValidateTimeout is the default maximum time that the ValidateCommand
+// of a Daemon may run before it is killed and validation fails.
+const DaemonValidateTimeout = 30 * time.Second
+
 // Daemon is a long-running proxy process. It is expected to keep running
 // and to use blocking queries to detect changes in configuration, certs,
 // and more.
@@ -30,55 +87,883 @@ const (
 // Consul will ensure that if the daemon crashes, that it is restarted.
 type Daemon struct {
 	// Command is the command to execute to start this daemon. This must
-	// be a Cmd that isn't yet started.
+	// be a Cmd that isn't yet started. Once the daemon is started it must
+	// only be replaced with Reconfigure.
 	Command *exec.Cmd
 
 	// ProxyID is the ID of the proxy service. This is required for API
 	// requests (along with the token) and is passed via env var.
 	ProxyID string
 
+	// Name identifies the daemon in log messages, which is useful to tell
+	// apart the logs of many daemons on one node. If this is empty then
+	// the base name of the command path is used.
+	Name string
+
 	// ProxyToken is the special local-only ACL token that allows a proxy
-	// to communicate to the Connect-specific endpoints.
+	// to communicate to the Connect-specific endpoints. Once the daemon is
+	// started it must only be changed with SetProxyToken.
 	ProxyToken string
 
+	// TokenDelivery is how ProxyToken is passed to the process. By default
+	// it is passed in the environment, which other local users may be able
+	// to read. With TokenDeliveryFile it is written to a file in TokenDir,
+	// or the default temporary directory if that is empty, which is removed
+	// once the process exits. If the agent exits first, the file is left
+	// for the process.
+	TokenDelivery TokenDelivery
+	TokenDir      string
+
+	// TokenEnvName is the name of the environment variable the token is
+	// passed in with TokenDeliveryEnv, for proxies that expect it under
+	// their own name. If this is empty then EnvProxyToken is used. The
+	// value is never logged, even if the name doesn't look like a secret.
+	TokenEnvName string
+
+	// RequireProxyToken makes Start and Validate fail if ProxyToken is
+	// empty rather than starting a proxy that can't communicate with the
+	// agent. RequireUUIDProxyToken also makes them fail if ProxyToken is
+	// set but isn't a UUID, the format of the tokens the agent issues, to
+	// catch a token that was mangled, for example by trailing whitespace
+	// when read from a file. The token is never part of the error.
+	RequireProxyToken     bool
+	RequireUUIDProxyToken bool
+
+	// CreateDir makes every start create Command.Dir, including missing
+	// parents, if it doesn't exist yet, for example for a runtime directory
+	// holding the proxy's sockets. The directory gets DirMode, or
+	// DaemonDirMode if that is zero, and is owned by User and Group if set.
+	// It is created before PreStart is called, so more elaborate setup can
+	// be done there. Existing directories are left untouched.
+	CreateDir bool
+	DirMode   os.FileMode
+
+	// PreStart, if set, is called right before every start of a process,
+	// both the initial start and restarts, for example to create a
+	// directory the proxy needs. If it returns an error the process isn't
+	// started and this counts as a failed attempt, so it is retried with
+	// the usual backoff. It is called with the daemon's lock held, so it
+	// must not call methods of the Daemon.
+	PreStart func() error
+
+	// StdinProvider, if set, is called on every start of a process, after
+	// PreStart, for a fresh reader whose contents are fed to the stdin of
+	// the process in place of Command.Stdin, for proxies that read their
+	// configuration from stdin. The reader is closed once it was read
+	// completely or the process exits. If it returns an error the process
+	// isn't started and this counts as a failed attempt, like an error of
+	// PreStart. It is also called with the daemon's lock held.
+	StdinProvider func() (io.ReadCloser, error)
+
+	// PostStop, if set, is called once after the daemon stopped for good,
+	// to clean up what PreStart set up. This is when the supervision loop
+	// ends and the last process is gone: after Stop, or when the loop gives
+	// up, for example because of MaxRestarts. It isn't called between
+	// restarts, nor if the first start failed with StartSync since Start
+	// may then be called again. Stop returns only after it has returned.
+	PostStop func()
+
+	// DryRun makes Start validate the configuration and log the command
+	// that would be executed, with its arguments, environment (including
+	// the proxy token, redacted) and settings such as User and Limits,
+	// without starting a process. This can be used to preview the proxy
+	// invocation, for example when validating configuration.
+	DryRun bool
+
+	// StartSync makes Start wait until the first process was started and
+	// return the error if that failed, rather than returning right away and
+	// leaving the supervision loop to retry. If the first start fails the
+	// loop ends with LoopExitStartFailed and Start may be called again.
+	// Restarts after that are asynchronous as usual.
+	StartSync bool
+
 	// Logger is where logs will be sent around the management of this
 	// daemon. The actual logs for the daemon itself will be sent to
-	// a file.
+	// a file. If neither this nor StructuredLogger is set, logs are
+	// discarded.
 	Logger *log.Logger
 
+	// StructuredLogger, if set, is used instead of Logger. Messages are
+	// leveled and carry structured data such as the proxy ID, pid, restart
+	// attempt and wait times as key/value pairs. An hclog.Logger can be
+	// used here.
+	StructuredLogger Logger
+
 	// PidPath is the path where a pid file will be created storing the
 	// pid of the active process. If this is empty then a pid-file won't
 	// be created. Under erroneous conditions, the pid file may not be
 	// created but the error will be logged to the Logger.
+	//
+	// The file is written atomically every time a process is started, so
+	// it follows restarts, and removed once the process is stopped or the
+	// daemon gives up on restarting it. Reattach uses it to find the
+	// process if none was recorded.
 	PidPath string
 
-	// For tests, they can set this to change the default duration to wait
-	// for a graceful quit.
-	gracefulWait time.Duration
-
-	// process is the started process
+	// LogPath, if set, is the path of a file that both stdout and stderr of
+	// the process are appended to instead of the Command's. The file is
+	// created if necessary and is reopened for every start, so a file moved
+	// away by log rotation is recreated on restart.
+	LogPath string
+
+	// LogFileMode is the mode of the file at LogPath, which is applied both
+	// when it is created and to an existing file. If this is zero then
+	// DaemonLogFileMode is used so that potentially sensitive proxy logs
+	// aren't readable by other users. The Manager sets its LogFileMode.
+	LogFileMode os.FileMode
+
+	// LogMaxBytes, if positive, rotates the file at LogPath once it would
+	// grow beyond this size. The file is renamed to LogPath.1, shifting
+	// older archives to LogPath.2 and so on, and at most LogMaxFiles
+	// archives are kept; with LogMaxFiles zero the file is simply started
+	// over. Rotation requires the output to be piped through the agent, as
+	// with LogLineFunc.
+	LogMaxBytes int64
+	LogMaxFiles int
+
+	// RestartHealthy is how long a process must run to be considered
+	// healthy, which resets the restart attempt counter. RestartBackoffMin
+	// is the number of start attempts before restarts are delayed with an
+	// exponential backoff, and RestartMaxWait caps that delay. The actual
+	// delay is picked at random between half and all of it so that daemons
+	// that crashed together don't restart in lockstep. If these are zero
+	// then DaemonRestartHealthy, DaemonRestartBackoffMin and
+	// DaemonRestartMaxWait are used respectively.
+	RestartHealthy    time.Duration
+	RestartBackoffMin uint32
+	RestartMaxWait    time.Duration
+
+	// BackoffStrategy, if set, replaces the exponential backoff, for
+	// example with a LinearBackoff or an ExponentialBackoff with a
+	// different unit or base. It is asked for the delay once
+	// RestartBackoffMin is exceeded, and RestartMaxWait doesn't apply to
+	// it, so it must cap the delay itself. The delay is still randomized,
+	// and capped at DaemonBackoffStrategyMaxWait. If it panics the default
+	// backoff is used for that attempt.
+	BackoffStrategy BackoffStrategy
+
+	// RestartDelay is the minimum time between the exit of a process and
+	// the start of the next one, whatever the exit code and regardless of
+	// the backoff. A proxy that keeps exiting cleanly is restarted right
+	// away otherwise, since it never becomes subject to the backoff. The
+	// wait is reported like a backoff, through BackoffState and
+	// DaemonEventBackingOff, and ends early if the daemon is stopped.
+	RestartDelay time.Duration
+
+	// MaxRestarts, if non-zero, is the number of restarts allowed before the
+	// process has run for RestartHealthy. Once exceeded the process is
+	// considered permanently failed and isn't restarted again, ending the
+	// loop with LoopExitMaxRestarts. Zero allows unlimited restarts.
+	MaxRestarts uint
+
+	// RestartPolicy is when a process that exited on its own is restarted.
+	// If this is empty then RestartAlways is used. With RestartNever or
+	// RestartOnFailure the daemon can supervise a one-shot process, such as
+	// a migration, and the loop ends with LoopExitCompleted and publishes
+	// DaemonEventCompleted with the final exit code instead of restarting.
+	// Restarts requested with Restart or by the daemon itself, for example
+	// by HealthCheck, happen regardless.
+	RestartPolicy RestartPolicy
+
+	// SuccessExitCodes are the exit codes that mean the process shut down
+	// cleanly, for proxies with their own exit conventions, such as also
+	// exiting with 143 after SIGTERM. If this is empty then only 0 is a
+	// success. It is used by RestartOnFailure and MinRuntime. A process
+	// that was terminated by a signal or whose exit code isn't known never
+	// exited successfully.
+	SuccessExitCodes []int
+
+	// RestartLogAttempts is the number of restart attempts whose exit and
+	// backoff are logged in full. Beyond that the daemon is considered to
+	// be crash looping and these logs are collapsed into a summary of the
+	// number of restarts, logged at most once per RestartLogInterval, until
+	// the attempts are reset. If these are zero then
+	// DaemonRestartLogAttempts and DaemonRestartLogInterval are used.
+	RestartLogAttempts uint32
+	RestartLogInterval time.Duration
+
+	// MinRuntime, if non-zero, is how long a process must run for its exit
+	// not to count as a fast exit, unless it exited successfully according
+	// to SuccessExitCodes. Once the process
+	// exited fast more than MaxFastExits times in a row it is considered
+	// permanently failed and isn't restarted again, ending the loop with
+	// LoopExitFastExits. This gives up quickly on a proxy that can't even
+	// start, for example because it is misconfigured, rather than backing
+	// off forever. Exits caused by Restart don't count.
+	MinRuntime   time.Duration
+	MaxFastExits uint
+
+	// RepeatedExitThreshold, if non-zero, is the number of consecutive
+	// failed exits with the same exit code after which a
+	// DaemonEventRepeatedExit is published and a warning logged, since a
+	// proxy that keeps failing the same way is likely misconfigured. Exits
+	// are only consecutive if each is within RepeatedExitWindow, or
+	// DaemonRepeatedExitWindow if that is zero, of the previous one. With
+	// StopOnRepeatedExit set the process is also given up on, ending the
+	// loop with LoopExitRepeatedExit. Exits caused by Restart don't count.
+	RepeatedExitThreshold uint
+	RepeatedExitWindow    time.Duration
+	StopOnRepeatedExit    bool
+
+	// ResetBackoffOnRestart, if set, resets the restart attempt counter when
+	// the process is restarted with Restart, so the new process is started
+	// right away and doesn't count towards MaxRestarts. A requested restart
+	// is intentional rather than a crash, so it shouldn't inherit the
+	// backoff of earlier crashes. Restarts of processes that failed their
+	// HealthCheck always accrue backoff like crashes.
+	ResetBackoffOnRestart bool
+
+	// ValidateCommand, if set, is the command executed by Validate to check
+	// the proxy configuration without supervising it, for example
+	// "proxy -validate -config ...". A zero exit code means the configuration
+	// is valid. The proxy ID and token are passed the same way as for
+	// Command. This must be a Cmd that isn't yet started.
+	ValidateCommand *exec.Cmd
+
+	// ValidateTimeout is the maximum time ValidateCommand may run. If this
+	// is zero then DaemonValidateTimeout is used.
+	ValidateTimeout time.Duration
+
+	// FlapWindow is the sliding window over which restarts are retained
+	// for RecentRestarts and the "agent.proxy.daemon.recent_restarts" gauge.
+	// If this is zero then DaemonFlapWindow is used.
+	FlapWindow time.Duration
+
+	// DeregisterFunc, if set, is called at the start of Stop before the
+	// process is signalled. It should deregister the proxy from the catalog
+	// so that clients stop routing to it before it goes away. The context is
+	// cancelled after DeregisterTimeout. An error is logged but doesn't
+	// prevent the stop.
+	DeregisterFunc func(ctx context.Context) error
+
+	// DeregisterTimeout is the maximum time DeregisterFunc may take. If this
+	// is zero then DaemonDeregisterTimeout is used.
+	DeregisterTimeout time.Duration
+
+	// DrainUntil, if set, is called during Stop after DeregisterFunc and
+	// before the process is signalled. It should block until the proxy has
+	// no active connections, for example by telling the proxy to drain
+	// through its admin API and polling its connection count, or until the
+	// context is cancelled after DrainTimeout. Stop proceeds as soon as it
+	// returns, whatever the error, or if the process exits in the meantime.
+	// It isn't called at all if the process is already gone.
+	//
+	// It is also called before planned restarts, by Restart, RecycleInterval,
+	// WatchBinary and CertExpiry, so these don't drop in-flight requests
+	// either. It isn't called when an unhealthy process is restarted.
+	DrainUntil func(ctx context.Context) error
+
+	// DrainTimeout is the maximum time Stop or a restart waits for
+	// DrainUntil. If this is zero then DaemonDrainTimeout is used.
+	DrainTimeout time.Duration
+
+	// ProfileFunc, if set, fetches a profile (goroutine, heap, etc.) from
+	// the running process with the given pid, for example from a pprof
+	// endpoint exposed by the proxy. It is used by CaptureProfile, and a
+	// profile is also captured automatically before the process is killed
+	// for a stale heartbeat or restarted for failing its health check.
+	ProfileFunc func(ctx context.Context, pid int) ([]byte, error)
+
+	// ProfileDir is the directory where CaptureProfile stores profiles. It
+	// is created if it doesn't exist.
+	ProfileDir string
+
+	// LogEnvKeys is a list of environment variable names whose values are
+	// logged at DEBUG level whenever the process is started. This helps
+	// confirm what was passed to the proxy without logging the whole
+	// environment. Values of keys that look like secrets (containing TOKEN,
+	// SECRET, PASSWORD, etc.) are masked unless LogEnvSecrets is true.
+	LogEnvKeys    []string
+	LogEnvSecrets bool
+
+	// EnvAllowKeys, if set, limits the environment of the process to the
+	// listed variables of Command.Env, so that the proxy doesn't inherit
+	// secrets of the agent such as cloud credentials. EnvStripKeys removes
+	// the listed variables instead. A key ending in "*" matches all
+	// variables with that prefix. The proxy ID and token are always passed.
+	// By default the whole Command.Env is passed.
+	EnvAllowKeys []string
+	EnvStripKeys []string
+
+	// EnvFile, if set, is the path of a dotenv-style file of KEY=VALUE
+	// lines with environment variables for the process. They are added
+	// after Command.Env, overriding it, and aren't affected by EnvAllowKeys
+	// and EnvStripKeys. The file is read on every start, so changes apply
+	// once the process restarts. A malformed file fails the start.
+	EnvFile string
+
+	// NetnsPath, if set, is the path to a network namespace (for example
+	// /var/run/netns/web-proxy) that the process is started in. The
+	// namespace must be created and configured out of band. This is only
+	// supported on Linux and requires the agent to have CAP_SYS_ADMIN. If
+	// the namespace can't be joined then the start fails.
+	NetnsPath string
+
+	// ExtraFiles are open files passed to the process on every start, for
+	// example a listening socket so that the proxy doesn't race to bind its
+	// port, or a configuration file. They follow any Command.ExtraFiles, so
+	// with none of those the process sees ExtraFiles[i] as file descriptor
+	// 3+i. Every process gets its own duplicate, so the files stay open in
+	// the agent and are passed again on restart. The daemon never closes
+	// them; the caller must keep them open for as long as the daemon runs.
+	// This isn't supported on Windows.
+	ExtraFiles []*os.File
+
+	// RecentOutputLines, if positive, keeps this many of the most recent
+	// lines of output of the process in memory so they can be looked at with
+	// RecentOutput, for example when the proxy is crash looping. This works
+	// alongside LogPath and LogLineFunc. RecentOutputBytes, if positive,
+	// also limits the total size of the kept lines. The oldest lines are
+	// dropped when the limit is reached, so the process is never blocked.
+	RecentOutputLines int
+	RecentOutputBytes int
+
+	// ExitHistorySize is the number of the most recent process exits kept
+	// for ExitHistory. If zero, DaemonExitHistorySize is used. A negative
+	// value disables the history.
+	ExitHistorySize int
+
+	// LogLineFunc, if set, is called for every line the process writes to
+	// stdout or stderr (stderr is true for the latter) before it is written
+	// to Command.Stdout or Command.Stderr. The returned line is written
+	// instead; returning an empty string drops the line. This can be used to
+	// scrub or normalize output. It is called on the goroutine draining the
+	// output so it must be cheap.
+	//
+	// When set, output is copied through a pipe by the agent instead of the
+	// process writing to its destination directly. A process that outlives
+	// the agent (or is restored from a snapshot) can no longer write output.
+	LogLineFunc func(line string, stderr bool) string
+
+	// StderrLogLevel, if set, logs every line the process writes to stderr
+	// through Logger at this level, one of "DEBUG", "INFO", "WARN" or
+	// "ERR", instead of writing it to Command.Stderr or LogPath. Lines are
+	// attributed to the proxy, as "[INFO] agent/proxy[<proxy id>]: <line>",
+	// so that proxy output is in the agent's log but still greppable. With
+	// StructuredLogger the line is the message instead. Like with
+	// LogLineFunc, output is copied through a pipe by the agent.
+	StderrLogLevel string
+
+	// StopSignal is the signal sent by Stop to ask the process to exit
+	// gracefully before it is killed. If this is nil then os.Interrupt is
+	// used. If the signal can't be delivered, for example because the
+	// platform doesn't support it, the process is killed right away. On
+	// Unix both the stop signal and the kill are sent to the whole process
+	// group of the process, so that children it started are stopped too.
+	// On Windows os.Interrupt is sent as a CTRL_BREAK event, which requires
+	// the process to share the agent's console, and other signals can't be
+	// delivered.
+	StopSignal os.Signal
+
+	// GracefulWait is how long Stop, and Restart, wait for the process to
+	// exit after StopSignal before killing it. Proxies that need time to
+	// drain connections can raise it. If this is zero then
+	// DaemonGracefulWait is used.
+	GracefulWait time.Duration
+
+	// StopSequence, if set, replaces StopSignal and GracefulWait with a
+	// sequence of signals to escalate through, for example SIGTERM, then
+	// SIGINT and finally the kill, for proxies that don't always respond
+	// to the first signal. Each step sends its signal and waits for the
+	// process to exit for the step's Wait. If the process is still running
+	// after the last step it is killed.
+	StopSequence []StopStep
+
+	// ShutdownFunc, if set, replaces the stop signals of Stop and Restart
+	// for proxies that are told to shut down through their own protocol,
+	// for example a call to their admin API, rather than a signal. Once it
+	// returns without error the process has GracefulWait, counted from
+	// the call, to exit before it is killed. If it returns an error the
+	// stop falls back to StopSignal or StopSequence. The context is
+	// cancelled after GracefulWait.
+	ShutdownFunc func(ctx context.Context) error
+
+	// KillWait, if positive, is how long Stop and Restart wait for the
+	// process to be reaped after killing it. A process that doesn't go away
+	// by then, for example because it is stuck in an uninterruptible state,
+	// is considered stuck: Stop returns an error, DaemonEventStuck is
+	// published and Stats reports it until the process is eventually
+	// reaped. If this is zero then there is no bound on the wait.
+	KillWait time.Duration
+
+	// ReExecSignal is the signal sent by ReExec to ask the process to
+	// re-execute itself in place, keeping its listeners open. If this is
+	// nil then SIGUSR2 is used, which isn't available on Windows.
+	ReExecSignal os.Signal
+
+	// ReExecPidPath is the path to a pid file maintained by the proxy
+	// itself. Proxies that re-execute by starting a new process and then
+	// exiting the old one (nginx-style) write the new pid here. If this is
+	// set, when the process exits after ReExec the pid is read from this
+	// file and the new process is supervised instead of being restarted.
+	ReExecPidPath string
+
+	// ReloadSignal is the signal sent by Reload to ask the process to
+	// reload its configuration without exiting. If this is nil then SIGHUP
+	// is used, which isn't available on Windows.
+	ReloadSignal os.Signal
+
+	// Limits are resource limits applied to the process, such as the
+	// maximum number of open files. On Linux they are applied with
+	// prlimit right after the process starts. Limits that aren't
+	// supported on the platform are skipped with a warning.
+	Limits Limits
+
+	// User and Group, if set, are the user and group the process runs as,
+	// each given as a name or a numeric ID. If only User is set, the
+	// primary group of the user is used. Changing the user requires the
+	// agent to run as root and isn't supported on Windows, in which case
+	// starting the process fails. The file at LogPath, the token file and
+	// the directory created with CreateDir are owned by them too.
+	User  string
+	Group string
+
+	// DieWithParent makes the kernel kill the process if the agent exits
+	// unexpectedly, so that a proxy never outlives a crashed agent. By
+	// default proxies keep running so that a restarted agent can recover
+	// them. Processes recovered from a snapshot or adopted aren't affected.
+	// This is only supported on Linux; elsewhere starting the process fails.
+	DieWithParent bool
+
+	// TerminalSignals are signals that, when they terminate the process and
+	// weren't sent by Stop, mean the process was deliberately shut down
+	// from outside (for example by an init system) and must not be
+	// restarted. The loop then ends with LoopExitTerminalSignal. This only
+	// applies to processes started by this Daemon since the exit status of
+	// adopted processes isn't available.
+	TerminalSignals []os.Signal
+
+	// HeartbeatFile, if set, is a file that the process must keep updating
+	// as a sign of liveness. If its modification time doesn't advance for
+	// HeartbeatTimeout then the process is considered hung and is killed so
+	// that it is restarted. HeartbeatTimeout must be set for this to apply.
+	HeartbeatFile    string
+	HeartbeatTimeout time.Duration
+
+	// HealthCheck, if set, is called every HealthInterval while the process
+	// is running and ready to check that it is actually serving. After
+	// HealthFailures failures in a row, or DaemonHealthFailures if that is
+	// zero, the process is restarted as by Restart. A passing check also
+	// counts as the process being healthy for the restart backoff, as if it
+	// ran for RestartHealthy. HealthInterval must be set for this to apply.
+	HealthCheck    func() error
+	HealthInterval time.Duration
+	HealthFailures int
+
+	// CertExpiry, if set, returns when the certificate that the process
+	// loads at startup expires, or the zero time if unknown. It is called
+	// whenever a process starts being supervised. CertExpiryLead before the
+	// expiry the process is gracefully restarted as with Restart so that it
+	// loads a renewed certificate. This is for proxies that can't reload
+	// certificates while running. Like a recycle this resets the restart
+	// attempts.
+	CertExpiry func() time.Time
+
+	// ReadyCheck, if set, is called after a process is started, or adopted,
+	// until it returns nil to determine when the proxy is actually ready,
+	// for example that it is listening. Until then Ready returns false and
+	// the Manager doesn't consider the proxy up. A ReadyCheck may either
+	// return an error right away or block until the proxy is ready or ctx
+	// is done. It is called for at most ReadyTimeout, or DaemonReadyTimeout
+	// if that is zero, after which the process stays not ready.
+	ReadyCheck   func(ctx context.Context) error
+	ReadyTimeout time.Duration
+
+	// CertExpiryLead is how long before the certificate expires the process
+	// is restarted. If this is zero then DaemonCertExpiryLead is used.
+	CertExpiryLead time.Duration
+
+	// RecycleInterval, if non-zero, is how long a process runs before it
+	// is gracefully restarted as with Restart, for proxies that leak memory
+	// over time. The actual time is picked at random between half and all
+	// of it so that a fleet of proxies isn't recycled at once. A recycle
+	// isn't a crash, so it resets the restart attempts.
+	RecycleInterval time.Duration
+
+	// WatchBinary, if set, checks the binary of Command every
+	// WatchBinaryInterval, or DaemonWatchBinaryInterval if that is zero,
+	// and gracefully restarts the process as with Restart once the binary
+	// changed, so that an upgraded proxy is picked up. A change is noticed
+	// by the size and modification time, and only acted on once those
+	// stayed the same for a whole interval so that a binary that is still
+	// being written isn't started. Like a recycle this resets the restart
+	// attempts.
+	WatchBinary         bool
+	WatchBinaryInterval time.Duration
+
+	// ResourceInterval, if positive, samples the CPU time and resident
+	// memory of the process every interval while it runs. The latest
+	// sample is in Stats, and with ResourceMetrics set it is also emitted
+	// as gauges. Sampling is only supported on Linux, where it reads /proc.
+	ResourceInterval time.Duration
+	ResourceMetrics  bool
+
+	// ExitInterpreter, if set, replaces the built-in interpretation of how
+	// a started process exited. It returns the exit code, whether the
+	// process was terminated by a signal, or an error if the exit status
+	// can't be interpreted. This is useful for wrappers that report the
+	// exit code of the real proxy differently. The result is used for
+	// logging, tracing and TerminalSignals, where the signal itself is still
+	// taken from the process state. It isn't used for adopted processes
+	// since their exit status isn't available.
+	ExitInterpreter func(ps *os.ProcessState) (code int, signaled bool, err error)
+
+	// Tracer, if set, is used to create spans around starting, restarting
+	// and stopping the process. Spans have a "proxy_id" attribute and, where
+	// applicable, "pid", "attempt" and "exit_code" attributes.
+	Tracer Tracer
+
+	// MetricLabels are added to the labels of all metrics emitted for the
+	// daemon, after the "proxy_id" label, so that a metric can be traced
+	// back to a specific service proxy. The metrics are a counter of
+	// restarts, gauges of recent restarts and the current backoff wait and
+	// a timer of the uptime of each process.
+	MetricLabels []metrics.Label
+
+	// Events, if set, receives lifecycle events of the daemon such as the
+	// process starting, exiting and being restarted. Sends never block: an
+	// event is dropped if the channel isn't ready to receive it, so it
+	// should be buffered. The channel is never closed.
+	Events chan<- DaemonEvent
+
+	// For tests, they can set this to replace the runner that starts real
+	// processes.
+	runner processRunner
+
+	// For tests, they can set this to replace lib.RandomStagger, which is
+	// used to add jitter to the restart backoff.
+	stagger func(time.Duration) time.Duration
+
+	// For tests, they can set this to replace the real clock used by the
+	// supervision loop and Stop.
+	clock clock
+
+	// startSlots, if set, limits how many daemons sharing it start a
+	// process at the same time: a slot is taken before every start and
+	// given back once the process is ready. It is set by the Manager.
+	startSlots chan struct{}
+
+	// commandLock protects Command and ProxyToken once the daemon started,
+	// since Reconfigure and SetProxyToken replace them. They are only
+	// written with both lock and commandLock held, so holding either is
+	// enough to read them. commandLock may be taken while lock is held but
+	// not the other way around, which lets currentCommand be used where
+	// lock may already be held, such as by logger.
+	commandLock sync.Mutex
+
+	// process is the supervised process, or nil if there is none. It, and
+	// the fields below, are protected by lock. keepAlive works on its own
+	// copy of process, which is only ever replaced through setProcess with
+	// the lock held, so that everything else sees the same process as the
+	// loop.
 	lock     sync.Mutex
 	stopped  bool
 	stopCh   chan struct{}
 	exitedCh chan struct{}
-	process  *os.Process
+	process  osProcess
+
+	// stuck is true if the process was killed but not reaped within
+	// KillWait. It is protected by lock and reset once the process is
+	// reaped.
+	stuck bool
+
+	// lastExit is how the most recent process exited, or nil if none has
+	// exited yet. It is protected by lock.
+	lastExit *daemonExit
+
+	// exitHistory holds the most recent exits, oldest first. It is
+	// protected by lock.
+	exitHistory []ExitRecord
+
+	// resources is the latest ResourceSample. It is protected by lock.
+	resources ResourceSample
+
+	// lastCommand is the command most recently passed to the runner, with
+	// the token redacted, or nil if none was started yet. It is protected
+	// by lock.
+	lastCommand *CommandConfig
+
+	// processExitedCh is closed once process exits or is replaced, and is
+	// nil while there is no process. It is protected by lock.
+	processExitedCh chan struct{}
+
+	// ready is true once process passed ReadyCheck, or right away if
+	// ReadyCheck isn't set. It is protected by lock.
+	ready bool
+
+	// tokenFile is the path of the token file of process, if the token is
+	// delivered in a file. It is protected by lock.
+	tokenFile string
+
+	// recentOutput records recent output if RecentOutputLines is set. It is
+	// created on first start and kept across restarts. It is protected by
+	// lock, but is safe for concurrent use itself.
+	recentOutput *outputRing
+
+	// startedCh receives the result of the first start with StartSync and
+	// is nil otherwise. It is protected by lock.
+	startedCh chan error
+
+	// restartReason is set by Restart and the health checker so that
+	// keepAlive knows that the process exiting was requested, and why. It
+	// is protected by lock.
+	restartReason restartReason
+
+	// loopExitReason is set by keepAlive right before it returns so that
+	// callers can determine why supervision ended. It is protected by lock.
+	loopExitReason LoopExitReason
+
+	// state is the lifecycle state returned by State. It is only changed
+	// with setState and protected by lock.
+	state DaemonState
+
+	// attemptsDeadline is the time at which we consider the daemon to have
+	// been alive long enough that we can reset the attempt counter.
+	//
+	// attempts keeps track of the number of restart attempts we've had and
+	// is used to calculate the wait time using an exponential backoff.
+	//
+	// These are only used by keepAlive but live here so that they can be
+	// inspected and restored. They are protected by lock.
+	attemptsDeadline time.Time
+	attempts         uint32
+
+	// processStartTime is the start time of process as returned by
+	// processStartTime, or zero if unknown. It is protected by lock.
+	processStartTime uint64
+
+	// reattach is the snapshot decoded by UnmarshalJSON for Reattach. It is
+	// protected by lock.
+	reattach *daemonSnapshot
+
+	// nextStartAt is the time the next start is scheduled for while
+	// waiting out a restart backoff, and zero otherwise. It is protected
+	// by lock.
+	nextStartAt time.Time
+
+	// draining is set when the agent is shutting down. A process that
+	// exits while draining isn't restarted. It is protected by lock.
+	draining bool
+
+	// reexecPending is set by ReExec and cleared when the process next
+	// exits. It is protected by lock.
+	reexecPending bool
+
+	// pgids are the process groups of the most recent processes supervised
+	// by this daemon, used to find leftover processes in tests. It is
+	// protected by lock.
+	pgids []int
+
+	// restartTimes are the times of restarts within the last FlapWindow,
+	// oldest first. It is protected by lock.
+	restartTimes []time.Time
+
+	// restarts is the total number of restarts since Start and lastStart
+	// the time a process last started being supervised. lastHealthyReset
+	// is the time attempts was last reset because a process was healthy.
+	// They are protected by lock.
+	restarts         uint64
+	lastStart        time.Time
+	lastHealthyReset time.Time
+
+	// fastExits is the number of consecutive exits within MinRuntime. It is
+	// protected by lock.
+	fastExits uint
 }
 
+// RestartPolicy is when the process of a Daemon is restarted after it exited.
+type RestartPolicy string
+
+const (
+	// RestartAlways restarts the process whenever it exits.
+	RestartAlways RestartPolicy = "always"
+
+	// RestartOnFailure restarts the process unless it exited successfully,
+	// with one of SuccessExitCodes. A process whose exit code isn't known,
+	// such as an adopted one, is assumed to have failed.
+	RestartOnFailure RestartPolicy = "on-failure"
+
+	// RestartNever never restarts the process.
+	RestartNever RestartPolicy = "never"
+)
+
+// restartReason is why the process is being restarted by the daemon itself.
+type restartReason int
+
+const (
+	// restartNone means no restart was requested, so the process exiting
+	// is a crash or an external stop.
+	restartNone restartReason = iota
+
+	// restartRequested is a restart requested with Restart.
+	restartRequested
+
+	// restartUnhealthy is a restart because the process failed HealthCheck.
+	// It accrues backoff like a crash.
+	restartUnhealthy
+
+	// restartRecycle is a restart because the process ran for
+	// RecycleInterval.
+	restartRecycle
+
+	// restartBinaryChanged is a restart because the binary changed on disk
+	// with WatchBinary set.
+	restartBinaryChanged
+
+	// restartCertExpiry is a restart because the certificate of the process
+	// is about to expire with CertExpiry set.
+	restartCertExpiry
+)
+
+// LoopExitReason describes why the supervision loop of a Daemon ended.
+type LoopExitReason string
+
+const (
+	// LoopExitNone means the supervision loop hasn't ended (or never ran).
+	LoopExitNone LoopExitReason = ""
+
+	// LoopExitStopped means the loop ended because Stop or Close was called.
+	LoopExitStopped LoopExitReason = "stopped-by-user"
+
+	// LoopExitShutdown means the process exited while the agent was shutting
+	// down so it wasn't restarted.
+	LoopExitShutdown LoopExitReason = "agent-shutdown"
+
+	// LoopExitTerminalSignal means the process was terminated from outside
+	// by one of TerminalSignals so it wasn't restarted.
+	LoopExitTerminalSignal LoopExitReason = "terminal-signal"
+
+	// LoopExitStartFailed means the first process couldn't be started with
+	// StartSync set, so the error was returned from Start instead.
+	LoopExitStartFailed LoopExitReason = "start-failed"
+
+	// LoopExitMaxRestarts means the process kept exiting and was restarted
+	// MaxRestarts times without becoming healthy, so it was given up on.
+	LoopExitMaxRestarts LoopExitReason = "max-restarts"
+
+	// LoopExitFastExits means the process exited within MinRuntime more
+	// than MaxFastExits times in a row, so it was given up on.
+	LoopExitFastExits LoopExitReason = "fast-exits"
+
+	// LoopExitRepeatedExit means the process failed with the same exit code
+	// RepeatedExitThreshold times in a row with StopOnRepeatedExit set, so
+	// it was given up on.
+	LoopExitRepeatedExit LoopExitReason = "repeated-exit"
+
+	// LoopExitCompleted means the process exited and RestartPolicy says it
+	// isn't restarted. Unlike the other reasons that end the loop on its own
+	// this isn't a failure, even if the process exited with an error.
+	LoopExitCompleted LoopExitReason = "completed"
+)
+
 // Start starts the daemon and keeps it running.
 //
-// This function returns after the process is successfully started.
+// This function returns once the supervision loop is running, or with
+// StartSync once the first process was started.
+//
+// Starting a daemon that is already running does nothing, and once Stop
+// was called Start always fails: a stopped Daemon is never started again,
+// so a new one must be created instead. Only if the loop ended on its own,
+// for example because of MaxRestarts, does Start begin a new loop, and the
+// previous one has then fully exited.
 func (p *Daemon) Start() error {
+	return p.StartContext(context.Background())
+}
+
+// StartContext is like Start, but cancelling ctx stops the daemon the same
+// way Stop does, including during a restart backoff. The context is only
+// tied to the daemon if this call starts the supervision loop. With
+// StartSync, cancelling ctx also stops waiting for the first start.
+func (p *Daemon) StartContext(ctx context.Context) error {
 	p.lock.Lock()
-	defer p.lock.Unlock()
+	startedCh, exitedCh, err := p.startLocked()
+	p.lock.Unlock()
+	if err != nil || exitedCh == nil {
+		return err
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				p.Stop()
+			case <-exitedCh:
+			}
+		}()
+	}
+
+	if startedCh == nil {
+		return nil
+	}
 
+	select {
+	case err := <-startedCh:
+		return err
+
+	case <-exitedCh:
+		// The loop ends right after reporting a failed start, but it can
+		// also end before starting anything if Stop is called.
+		select {
+		case err := <-startedCh:
+			return err
+		default:
+			return fmt.Errorf("stopped")
+		}
+	}
+}
+
+// startLocked validates the configuration and starts the supervision loop
+// if it isn't running yet. With StartSync it returns a channel that receives
+// the result of the first start and the channel closed when the loop ends.
+// The lock must be held.
+func (p *Daemon) startLocked() (<-chan error, <-chan struct{}, error) {
 	// A stopped proxy cannot be restarted
 	if p.stopped {
-		return fmt.Errorf("stopped")
+		return nil, nil, fmt.Errorf("stopped")
 	}
 
-	// If we're already running, that is okay
-	if p.process != nil {
-		return nil
+	// If we're already running, that is okay. The loop may be running
+	// without a process while it is waiting to restart one, or not have
+	// started its first one yet. Since exitedCh is set below while the
+	// lock is still held, concurrent calls start only a single loop.
+	if p.process != nil || p.loopRunning() {
+		return nil, nil, nil
+	}
+
+	if err := p.validateProxyToken(); err != nil {
+		return nil, nil, err
+	}
+
+	// Catch a bad command now rather than on every start attempt.
+	if err := p.validateCommand(p.Command); err != nil {
+		return nil, nil, err
+	}
+	if _, err := p.envFile(); err != nil {
+		return nil, nil, err
+	}
+	switch p.restartPolicy() {
+	case RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		return nil, nil, fmt.Errorf("invalid restart policy %q", p.RestartPolicy)
+	}
+	if p.StderrLogLevel != "" && !validStderrLogLevel(p.StderrLogLevel) {
+		return nil, nil, fmt.Errorf("invalid stderr log level %q", p.StderrLogLevel)
+	}
+
+	// Catch a bad User or Group now rather than on every start attempt.
+	if p.User != "" || p.Group != "" {
+		uid, gid, err := lookupCredential(p.User, p.Group)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := checkCredential(uid, gid); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if p.DryRun {
+		p.logDryRun()
+		return nil, nil, nil
 	}
 
 	// Setup our stop channel
@@ -86,79 +971,191 @@ func (p *Daemon) Start() error {
 	exitedCh := make(chan struct{})
 	p.stopCh = stopCh
 	p.exitedCh = exitedCh
+	p.loopExitReason = LoopExitNone
+	p.fastExits = 0
+	p.setState(DaemonStateStarting)
+
+	var startedCh chan error
+	if p.StartSync {
+		startedCh = make(chan error, 1)
+		p.startedCh = startedCh
+	}
 
 	// Start the loop.
 	go p.keepAlive(stopCh, exitedCh)
 
-	return nil
+	return startedCh, exitedCh, nil
 }
 
 // keepAlive starts and keeps the configured process alive until it
 // is stopped via Stop.
 func (p *Daemon) keepAlive(stopCh <-chan struct{}, exitedCh chan<- struct{}) {
 	defer close(exitedCh)
+	defer p.postStop()
+	defer p.publishLoopExit()
 
 	p.lock.Lock()
 	process := p.process
+	if process != nil {
+		p.setState(DaemonStateRunning)
+	}
 	p.lock.Unlock()
 
-	// attemptsDeadline is the time at which we consider the daemon to have
-	// been alive long enough that we can reset the attempt counter.
-	//
-	// attempts keeps track of the number of restart attempts we've had and
-	// is used to calculate the wait time using an exponential backoff.
-	var attemptsDeadline time.Time
-	var attempts uint32
-
 	// Assume the process is adopted, we reset this when we start a new process
 	// ourselves below and use it to decide on a strategy for waiting.
 	adopted := true
 
+	// outputDoneCh is closed once all output of the current process has
+	// been drained. It is nil if output isn't copied by us.
+	var outputDoneCh <-chan struct{}
+
+	// spawned tracks whether a process has ever run under this loop so that
+	// any subsequent start is counted as a restart.
+	spawned := process != nil
+
+	// exitCode is the exit code of the last process to exit, or -1 if it
+	// isn't known.
+	exitCode := -1
+
+	// startedAt is when the last process started by this loop was started,
+	// and restarted is whether that was a restart. These are used to time
+	// how long the process takes to become ready.
+	var startedAt time.Time
+	var restarted bool
+
+	// releaseSlot gives back the start slot taken for the current process
+	// once it is ready. It is nil if no slot is held.
+	var releaseSlot func()
+	defer func() {
+		if releaseSlot != nil {
+			releaseSlot()
+		}
+	}()
+
+	// restartLog collapses the restart logs of a crash looping daemon.
+	// quiet is set while it does so that the exit and backoff of every
+	// attempt aren't logged.
+	restartLog := &restartLogLimiter{p: p}
+	quiet := false
+
+	// repeatedExits tells a process that keeps failing the same way.
+	repeatedExits := &repeatedExitDetector{p: p}
+
+	// watchStopCh stops the watchdogs of the current process, such as the
+	// heartbeat watchdog. It is nil if no watchdogs were started yet.
+	var watchStopCh chan struct{}
+	defer func() {
+		if watchStopCh != nil {
+			close(watchStopCh)
+		}
+	}()
+
 	for {
 		if process == nil {
+			p.lock.Lock()
+			p.setState(DaemonStateStarting)
+
 			// If we're passed the attempt deadline then reset the attempts
-			if !attemptsDeadline.IsZero() && time.Now().After(attemptsDeadline) {
-				attempts = 0
+			if !p.attemptsDeadline.IsZero() && p.now().After(p.attemptsDeadline) {
+				if p.attempts > 0 {
+					p.lastHealthyReset = p.attemptsDeadline
+				}
+				p.attempts = 0
 			}
 			// Set ourselves a deadline - we have to make it at least this long before
 			// we come around the loop to consider it to have been a "successful"
 			// daemon startup and rest the counter above. Note that if the daemon
 			// fails before this, we reset the deadline to zero below so that backoff
 			// sleeps in the loop don't count as "success" time.
-			attemptsDeadline = time.Now().Add(DaemonRestartHealthy)
-			attempts++
-
-			// Calculate the exponential backoff and wait if we have to
-			if attempts > DaemonRestartBackoffMin {
-				exponent := (attempts - DaemonRestartBackoffMin)
-				if exponent > 31 {
-					exponent = 31
+			p.attemptsDeadline = p.now().Add(p.restartHealthy())
+			p.attempts++
+			attempts := p.attempts
+
+			// The first attempt is the initial start, the rest are restarts.
+			if p.MaxRestarts > 0 && uint(attempts-1) > p.MaxRestarts && !p.stopped {
+				p.loopExitReason = LoopExitMaxRestarts
+				p.lock.Unlock()
+				p.logger().Error("daemon restarted too many times without "+
+					"becoming healthy, giving up", "max_restarts", p.MaxRestarts)
+				return
+			}
+
+			p.lock.Unlock()
+			quiet = restartLog.quiet(attempts)
+
+			// Calculate the backoff
+			var waitTime time.Duration
+			if backoffMin := p.restartBackoffMin(); attempts > backoffMin {
+				waitTime = p.backoffWait(uint(attempts - backoffMin))
+
+				// Randomize the wait so that many daemons that crashed at
+				// once don't restart in lockstep.
+				waitTime = p.jitter(waitTime)
+			}
+
+			// Every restart waits at least RestartDelay, so that even a process
+			// that keeps exiting cleanly doesn't restart in a tight loop.
+			if spawned && waitTime < p.RestartDelay {
+				waitTime = p.RestartDelay
+			}
+
+			// Wait if we have to
+			if waitTime > 0 {
+				// If we are waiting, reset the success deadline so we don't
+				// accidentally interpret backoff sleep as successful runtime.
+				nextStartAt := p.now().Add(waitTime)
+				p.lock.Lock()
+				p.attemptsDeadline = time.Time{}
+				p.nextStartAt = nextStartAt
+				p.setState(DaemonStateBackingOff)
+				p.lock.Unlock()
+				p.emitBackoff(waitTime)
+				p.publish(DaemonEvent{
+					Type:     DaemonEventBackingOff,
+					Attempt:  attempts,
+					ExitCode: -1,
+					Wait:     waitTime,
+				})
+
+				if !quiet {
+					p.logger().Warn("waiting before restarting daemon",
+						"attempt", attempts, "wait", waitTime,
+						"next_start", nextStartAt.Format(time.RFC3339))
 				}
-				waitTime := (1 << exponent) * time.Second
-				if waitTime > DaemonRestartMaxWait {
-					waitTime = DaemonRestartMaxWait
+
+				timer := p.getClock().NewTimer(waitTime)
+				select {
+				case <-timer.C():
+					// Timer is up, good! The process we start now has
+					// to stay up until the deadline to be healthy.
+					p.lock.Lock()
+					p.nextStartAt = time.Time{}
+					p.attemptsDeadline = p.now().Add(p.restartHealthy())
+					p.setState(DaemonStateStarting)
+					p.lock.Unlock()
+					p.emitBackoff(0)
+
+				case <-stopCh:
+					// During our backoff wait, we've been signalled to
+					// quit, so just quit.
+					timer.Stop()
+					p.lock.Lock()
+					p.nextStartAt = time.Time{}
+					p.lock.Unlock()
+					p.emitBackoff(0)
+					p.setLoopExitReason(LoopExitStopped)
+					return
 				}
+			}
 
-				if waitTime > 0 {
-					// If we are waiting, reset the success deadline so we don't
-					// accidentally interpret backoff sleep as successful runtime.
-					attemptsDeadline = time.Time{}
-
-					p.Logger.Printf(
-						"[WARN] agent/proxy: waiting %s before restarting daemon",
-						waitTime)
-
-					timer := time.NewTimer(waitTime)
-					select {
-					case <-timer.C:
-						// Timer is up, good!
-
-					case <-stopCh:
-						// During our backoff wait, we've been signalled to
-						// quit, so just quit.
-						timer.Stop()
-						return
-					}
+			// Wait for a slot if the number of concurrent starts is limited.
+			if p.startSlots != nil {
+				select {
+				case p.startSlots <- struct{}{}:
+					releaseSlot = func() { <-p.startSlots }
+				case <-stopCh:
+					p.setLoopExitReason(LoopExitStopped)
+					return
 				}
 			}
 
@@ -166,25 +1163,125 @@ func (p *Daemon) keepAlive(stopCh <-chan struct{}, exitedCh chan<- struct{}) {
 
 			// If we gracefully stopped then don't restart.
 			if p.stopped {
+				p.loopExitReason = LoopExitStopped
 				p.lock.Unlock()
 				return
 			}
 
 			// Process isn't started currently. We're restarting. Start it
 			// and save the process if we have it.
+			spanName := "proxy.daemon.start"
+			spanAttrs := map[string]interface{}{
+				"proxy_id": p.ProxyID,
+				"attempt":  attempts,
+			}
+			if spawned {
+				p.publish(DaemonEvent{
+					Type:     DaemonEventRestarting,
+					Attempt:  attempts,
+					ExitCode: -1,
+				})
+
+				spanName = "proxy.daemon.restart"
+				if exitCode >= 0 {
+					spanAttrs["exit_code"] = exitCode
+				}
+			}
+			span := p.tracer().StartSpan(spanName, spanAttrs)
+
 			var err error
-			process, err = p.start()
+			var recentRestarts int
+			var totalRestarts uint64
+			process, outputDoneCh, err = p.start()
+
+			// Report the first start to a synchronous Start. If it failed
+			// the error is returned from there, so don't retry.
+			firstStartFailed := false
+			if p.startedCh != nil {
+				p.startedCh <- err
+				p.startedCh = nil
+				if err != nil {
+					firstStartFailed = true
+					p.loopExitReason = LoopExitStartFailed
+				}
+			}
 			if err == nil {
-				p.process = process
+				span.SetAttribute("pid", process.Pid())
+				p.setProcess(process)
+				p.setState(DaemonStateRunning)
+				p.publish(DaemonEvent{
+					Type:     DaemonEventStarted,
+					PID:      process.Pid(),
+					Attempt:  attempts,
+					ExitCode: -1,
+				})
 				adopted = false
+				startedAt, restarted = p.lastStart, spawned
+				if spawned {
+					p.restarts++
+					totalRestarts = p.restarts
+					recentRestarts = p.recordRestart(p.now())
+				}
 			}
 			p.lock.Unlock()
+			span.End(err)
+
+			// Without a ReadyCheck the slot is given back once the process
+			// is started, otherwise by watchReady below.
+			if releaseSlot != nil && (err != nil || p.ReadyCheck == nil) {
+				releaseSlot()
+				releaseSlot = nil
+			}
 
 			if err != nil {
-				p.Logger.Printf("[ERR] agent/proxy: error restarting daemon: %s", err)
+				p.logger().Error("error restarting daemon", "attempt", attempts, "error", err)
+				if firstStartFailed {
+					return
+				}
 				continue
 			}
 
+			if spawned {
+				p.emitRestart(recentRestarts, totalRestarts)
+			}
+			spawned = true
+
+		}
+
+		if watchStopCh == nil {
+			watchStopCh = make(chan struct{})
+			if p.HeartbeatFile != "" && p.HeartbeatTimeout > 0 {
+				go p.watchHeartbeat(process, watchStopCh)
+			}
+			if p.CertExpiry != nil {
+				go p.watchCertExpiry(process, watchStopCh)
+			}
+			if p.ReadyCheck != nil {
+				// The start of an adopted process isn't known.
+				var readyFrom time.Time
+				if !adopted {
+					readyFrom = startedAt
+				}
+				go func(process osProcess, restarted bool, stopCh <-chan struct{}, release func()) {
+					if release != nil {
+						defer release()
+					}
+					p.watchReady(process, readyFrom, restarted, stopCh)
+				}(process, restarted, watchStopCh, releaseSlot)
+				releaseSlot = nil
+			}
+			if p.HealthCheck != nil && p.HealthInterval > 0 {
+				go p.watchHealth(process, watchStopCh)
+			}
+			if p.RecycleInterval > 0 {
+				go p.watchRecycle(process, watchStopCh)
+			}
+			if p.WatchBinary {
+				go p.watchBinary(process, watchStopCh)
+			}
+			if p.ResourceInterval > 0 {
+				go p.watchResources(process, watchStopCh)
+			}
 		}
 
 		var ps *os.ProcessState
@@ -192,7 +1289,7 @@ func (p *Daemon) keepAlive(stopCh <-chan struct{}, exitedCh chan<- struct{}) {
 
 		if adopted {
 			// assign to err outside scope
-			_, err = findProcess(process.Pid)
+			_, err = findProcess(process.Pid())
 			if err == nil {
 				// Process appears to be running still, wait a bit before we poll again.
 				// We want a busy loop, but not too busy. 1 second between detecting a
@@ -211,146 +1308,2108 @@ func (p *Daemon) keepAlive(stopCh <-chan struct{}, exitedCh chan<- struct{}) {
 			}
 		} else {
 			// Wait for child to exit
-			ps, err = process.Wait()
+			ps, err = p.waitProcess(process)
+
+			// A failed wait doesn't necessarily mean the process is gone,
+			// for example if something else reaped it as it would with
+			// SIGCHLD ignored. If it still appears to be running, poll it
+			// as if it was adopted rather than starting a second one.
+			if err != nil {
+				if _, findErr := findProcess(process.Pid()); findErr == nil {
+					p.logger().Warn("error waiting for daemon but it is still running, polling instead",
+						"pid", process.Pid(), "error", err)
+					adopted = true
+					continue
+				}
+			}
 		}
 
-		// Process exited somehow.
+		// Process exited somehow. Before doing anything else, and in
+		// particular before a restart, make sure the last output of the
+		// process was drained and written out. The drain closes our read end
+		// of the output pipes once it sees EOF, so no descriptors of this
+		// process are left open when we move on to the next one.
+		pid := process.Pid()
 		process = nil
+		if watchStopCh != nil {
+			close(watchStopCh)
+			watchStopCh = nil
+		}
+		if outputDoneCh != nil {
+			select {
+			case <-outputDoneCh:
+			case <-p.getClock().After(DaemonOutputDrainTimeout):
+				p.logger().Warn("daemon output not drained after exit, continuing",
+					"pid", pid, "timeout", DaemonOutputDrainTimeout)
+			}
+			outputDoneCh = nil
+		}
+
+		logExit := p.logger().Info
+		if quiet {
+			logExit = func(string, ...interface{}) {}
+		}
+		exitCode = -1
+		signaled := false
 		if err != nil {
-			p.Logger.Printf("[INFO] agent/proxy: daemon exited with error: %s", err)
-		} else if ps != nil && !ps.Exited() {
-			p.Logger.Printf("[INFO] agent/proxy: daemon left running")
-		} else if status, ok := exitStatus(ps); ok {
-			p.Logger.Printf("[INFO] agent/proxy: daemon exited with exit code: %d", status)
+			logExit("daemon exited with error", "pid", pid, "error", err)
+		} else if ps != nil {
+			var code int
+			code, signaled, err = p.interpretExit(ps)
+			if err != nil {
+				logExit("daemon exited", "pid", pid, "error", err)
+			} else if signaled {
+				if sig, ok := exitSignal(ps); ok {
+					logExit("daemon terminated by signal", "pid", pid, "signal", sig)
+				} else {
+					logExit("daemon terminated by a signal", "pid", pid)
+				}
+			} else {
+				exitCode = code
+				logExit("daemon exited", "pid", pid, "exit_code", code)
+			}
 		}
-	}
-}
 
-// start starts and returns the process. This will create a copy of the
-// configured *exec.Command with the modifications documented on Daemon
-// such as setting the proxy token environmental variable.
-func (p *Daemon) start() (*os.Process, error) {
-	cmd := *p.Command
+		// If the process exited because it re-executed into a new process,
+		// supervise the new process rather than restarting.
+		if proc := p.reexecProcess(); proc != nil {
+			p.logger().Info("daemon re-executed, now supervising the new process",
+				"old_pid", pid, "pid", proc.Pid())
+			process = proc
+			adopted = true
+			continue
+		}
 
-	// Add the proxy token to the environment. We first copy the env because it is
-	// a slice and therefore the "copy" above will only copy the slice reference.
-	// We allocate an exactly sized slice.
-	//
-	// Note that anything we add to the Env here is NOT persisted in the snapshot
-	// which only looks at p.Command.Env so it needs to be reconstructible exactly
-	// from data in the snapshot otherwise.
-	cmd.Env = make([]string, len(p.Command.Env), len(p.Command.Env)+2)
-	copy(cmd.Env, p.Command.Env)
-	cmd.Env = append(cmd.Env,
-		fmt.Sprintf("%s=%s", EnvProxyID, p.ProxyID),
-		fmt.Sprintf("%s=%s", EnvProxyToken, p.ProxyToken))
+		exitErr := err
+		if exitErr == nil && signaled {
+			if sig, ok := exitSignal(ps); ok {
+				exitErr = fmt.Errorf("terminated by signal: %s", sig)
+			} else {
+				exitErr = fmt.Errorf("terminated by a signal")
+			}
+		}
 
-	// Update the Daemon env
+		// The process is gone so don't let Stop or anything else act on it.
+		// This also means that from here on Stop only needs to prevent the
+		// next start, which it does by setting stopped under the lock that
+		// is held while starting.
+		p.lock.Lock()
+		reason := p.restartReason
+		restarting := reason != restartNone
+		p.restartReason = restartNone
+		lastStart := p.lastStart
+		if reason == restartRecycle || reason == restartBinaryChanged ||
+			reason == restartCertExpiry ||
+			reason == restartRequested && p.ResetBackoffOnRestart {
+			p.attempts = 0
+			p.attemptsDeadline = time.Time{}
+		}
+		if p.MinRuntime > 0 && !restarting {
+			if !lastStart.IsZero() && p.now().Sub(lastStart) < p.MinRuntime &&
+				!p.successfulExit(exitCode, exitErr) {
+				p.fastExits++
+			} else {
+				p.fastExits = 0
+			}
+		}
+		if p.stuck {
+			p.stuck = false
+			p.logger().Info("stuck daemon was reaped", "pid", pid)
+		}
+		p.setProcess(nil)
+		p.removeTokenFile()
+		p.lastExit = &daemonExit{code: exitCode, err: exitErr}
+		record := ExitRecord{
+			Time:     p.now(),
+			PID:      pid,
+			ExitCode: exitCode,
+			Err:      exitErr,
+			Attempt:  p.attempts,
+		}
+		if sig, ok := exitSignal(ps); ok && signaled {
+			record.Signal = sig
+		}
+		if !lastStart.IsZero() {
+			record.Runtime = record.Time.Sub(lastStart)
+		}
+		p.recordExit(record)
+		p.publish(DaemonEvent{
+			Type:      DaemonEventExited,
+			PID:       pid,
+			Attempt:   p.attempts,
+			ExitCode:  exitCode,
+			FastExits: p.fastExits,
+		})
+		p.lock.Unlock()
+		p.emitUptime(lastStart)
 
-	// Args must always contain a 0 entry which is usually the executed binary.
-	// To be safe and a bit more robust we default this, but only to prevent
-	// a panic below.
-	if len(cmd.Args) == 0 {
-		cmd.Args = []string{cmd.Path}
-	}
+		// Don't fight an external shutdown. If we sent the signal ourselves
+		// then either Stop was called and the loop ends below as usual, or
+		// Restart was called and we restart.
+		if sig, ok := exitSignal(ps); ok && signaled && !restarting && p.isTerminalSignal(sig) {
+			p.lock.Lock()
+			stopped := p.stopped
+			if !stopped {
+				p.loopExitReason = LoopExitTerminalSignal
+			}
+			p.lock.Unlock()
+			if !stopped {
+				p.logger().Info("daemon terminated externally, not restarting",
+					"pid", pid, "signal", sig)
+				return
+			}
+		}
 
-	// Perform system-specific setup. In particular, Unix-like systems
-	// shuld set sid so that killing the agent doesn't kill the daemon.
-	configureDaemon(&cmd)
+		// Don't restart a process that we're about to be told to stop
+		// anyway because the agent is shutting down.
+		p.lock.Lock()
+		draining := p.draining
+		if draining {
+			p.loopExitReason = LoopExitShutdown
+		}
+		p.lock.Unlock()
+		if draining {
+			p.logger().Info("agent is shutting down, not restarting daemon", "pid", pid)
+			return
+		}
 
-	// Start it
-	p.Logger.Printf("[DEBUG] agent/proxy: starting proxy: %q %#v", cmd.Path, cmd.Args[1:])
-	if err := cmd.Start(); err != nil {
-		return nil, err
-	}
+		// A one-shot process is done once it exited, unless we restarted
+		// it ourselves.
+		if !restarting && !p.restartPolicy().restarts(p.successfulExit(exitCode, exitErr)) {
+			p.lock.Lock()
+			stopped := p.stopped
+			if !stopped {
+				p.loopExitReason = LoopExitCompleted
+			}
+			p.lock.Unlock()
+			if !stopped {
+				p.logger().Info("daemon completed, not restarting per restart policy",
+					"pid", pid, "exit_code", exitCode, "restart_policy", p.restartPolicy())
+				return
+			}
+		}
 
-	// Write the pid file. This might error and that's okay.
-	if p.PidPath != "" {
-		pid := strconv.FormatInt(int64(cmd.Process.Pid), 10)
-		if err := file.WriteAtomic(p.PidPath, []byte(pid)); err != nil {
-			p.Logger.Printf(
-				"[DEBUG] agent/proxy: error writing pid file %q: %s",
-				p.PidPath, err)
+		// Give up on a process that can't even stay up for MinRuntime.
+		p.lock.Lock()
+		fastExits := p.fastExits
+		giveUp := p.MinRuntime > 0 && fastExits > p.MaxFastExits && !p.stopped
+		if giveUp {
+			p.loopExitReason = LoopExitFastExits
+		}
+		p.lock.Unlock()
+		if giveUp {
+			p.logger().Error("daemon exited too quickly too many times, giving up",
+				"pid", pid, "fast_exits", fastExits, "min_runtime", p.MinRuntime)
+			return
+		}
+
+		// Point out a process that keeps failing the same way, once.
+		if p.RepeatedExitThreshold > 0 && !restarting {
+			n := repeatedExits.exited(exitCode, p.successfulExit(exitCode, exitErr))
+			if n == p.RepeatedExitThreshold {
+				p.lock.Lock()
+				giveUp := p.StopOnRepeatedExit && !p.stopped
+				if giveUp {
+					p.loopExitReason = LoopExitRepeatedExit
+				}
+				p.publish(DaemonEvent{
+					Type:          DaemonEventRepeatedExit,
+					PID:           pid,
+					Attempt:       p.attempts,
+					ExitCode:      exitCode,
+					RepeatedExits: n,
+				})
+				p.lock.Unlock()
+				if giveUp {
+					p.logger().Error("daemon keeps exiting with the same exit code, "+
+						"it is likely misconfigured, giving up",
+						"pid", pid, "exit_code", exitCode, "exits", n)
+					return
+				}
+				p.logger().Warn("daemon keeps exiting with the same exit code, "+
+					"it is likely misconfigured",
+					"pid", pid, "exit_code", exitCode, "exits", n)
+			}
 		}
 	}
+}
 
-	return cmd.Process, nil
+// waitProcess waits for process to exit, retrying if the wait is
+// interrupted.
+func (p *Daemon) waitProcess(process osProcess) (*os.ProcessState, error) {
+	for {
+		ps, err := process.Wait()
+		if err == nil || !isInterruptedWaitErr(err) {
+			return ps, err
+		}
+
+		p.logger().Debug("wait for daemon interrupted, retrying",
+			"pid", process.Pid(), "error", err)
+	}
 }
 
-// Stop stops the daemon.
-//
-// This will attempt a graceful stop (SIGINT) before force killing the
-// process (SIGKILL). In either case, the process won't be automatically
-// restarted unless Start is called again.
-//
-// This is safe to call multiple times. If the daemon is already stopped,
-// then this returns no error.
-func (p *Daemon) Stop() error {
-	p.lock.Lock()
+// jitter returns a random duration between d/2 and d.
+func (p *Daemon) jitter(d time.Duration) time.Duration {
+	stagger := p.stagger
+	if stagger == nil {
+		stagger = lib.RandomStagger
+	}
 
-	// If we're already stopped or never started, then no problem.
-	if p.stopped || p.process == nil {
-		// In the case we never even started, calling Stop makes it so
-		// that we can't ever start in the future, either, so mark this.
-		p.stopped = true
-		p.lock.Unlock()
-		return nil
+	half := d / 2
+	return d - half + stagger(half)
+}
+
+// restartHealthy returns RestartHealthy or its default.
+func (p *Daemon) restartHealthy() time.Duration {
+	if p.RestartHealthy > 0 {
+		return p.RestartHealthy
 	}
 
-	// Note that we've stopped
-	p.stopped = true
-	close(p.stopCh)
-	process := p.process
-	p.lock.Unlock()
+	return DaemonRestartHealthy
+}
 
-	gracefulWait := p.gracefulWait
-	if gracefulWait == 0 {
-		gracefulWait = 5 * time.Second
+// restartBackoffMin returns RestartBackoffMin or its default.
+func (p *Daemon) restartBackoffMin() uint32 {
+	if p.RestartBackoffMin > 0 {
+		return p.RestartBackoffMin
 	}
 
-	// Defer removing the pid file. Even under error conditions we
+	return DaemonRestartBackoffMin
+}
+
+// restartMaxWait returns RestartMaxWait or its default.
+func (p *Daemon) restartMaxWait() time.Duration {
+	if p.RestartMaxWait > 0 {
+		return p.RestartMaxWait
+	}
+
+	return DaemonRestartMaxWait
+}
+
+// restartPolicy returns RestartPolicy or its default.
+func (p *Daemon) restartPolicy() RestartPolicy {
+	if p.RestartPolicy != "" {
+		return p.RestartPolicy
+	}
+
+	return RestartAlways
+}
+
+// restarts returns true if a process that exited on its own, successfully
+// or not, should be restarted under policy.
+func (policy RestartPolicy) restarts(success bool) bool {
+	switch policy {
+	case RestartNever:
+		return false
+	case RestartOnFailure:
+		return !success
+	default:
+		return true
+	}
+}
+
+// successfulExit returns true if a process that exited with the given exit
+// code, -1 if unknown, and error exited successfully per SuccessExitCodes.
+func (p *Daemon) successfulExit(exitCode int, err error) bool {
+	if exitCode < 0 || err != nil {
+		return false
+	}
+
+	for _, code := range p.successExitCodes() {
+		if exitCode == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// successExitCodes returns SuccessExitCodes or its default.
+func (p *Daemon) successExitCodes() []int {
+	if len(p.SuccessExitCodes) > 0 {
+		return p.SuccessExitCodes
+	}
+
+	return []int{0}
+}
+
+// maxBackoffAttempts is the largest restart attempt count that affects the
+// backoff. Beyond this, the exponent is capped, so larger values are only
+// ever the result of corrupted or injected state.
+func (p *Daemon) maxBackoffAttempts() uint32 {
+	return p.restartBackoffMin() + 31
+}
+
+// BackoffState is the restart backoff state of a Daemon. It can be read
+// and restored so that backoff continues across, for example, an agent
+// upgrade rather than resetting to zero.
+type BackoffState struct {
+	// Attempts is the number of start attempts made since the daemon was
+	// last considered healthy. Backoff starts after RestartBackoffMin.
+	Attempts uint32
+
+	// Deadline is the time at which the current process is considered
+	// healthy, resetting Attempts. It is zero while waiting to restart.
+	Deadline time.Time
+
+	// NextStartAt is the time the process will next be started while
+	// waiting out a restart backoff, and zero otherwise. It is informational
+	// and ignored by SetBackoffState.
+	NextStartAt time.Time
+}
+
+// BackoffState returns the current restart backoff state.
+func (p *Daemon) BackoffState() BackoffState {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return BackoffState{
+		Attempts:    p.attempts,
+		Deadline:    p.attemptsDeadline,
+		NextStartAt: p.nextStartAt,
+	}
+}
+
+// SetBackoffState restores the restart backoff state, usually before Start
+// is called. The state is validated so that an out of range attempt count
+// or deadline is rejected rather than causing a bogus backoff.
+func (p *Daemon) SetBackoffState(s BackoffState) error {
+	if max := p.maxBackoffAttempts(); s.Attempts > max {
+		return fmt.Errorf("backoff attempts %d exceeds the maximum of %d",
+			s.Attempts, max)
+	}
+	if !s.Deadline.IsZero() && s.Deadline.After(p.now().Add(p.restartHealthy())) {
+		return fmt.Errorf("backoff deadline %s is too far in the future", s.Deadline)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.attempts = s.Attempts
+	p.attemptsDeadline = s.Deadline
+	return nil
+}
+
+// ReExec asks the running process to re-execute itself in place by sending
+// it ReExecSignal. This doesn't go through the restart loop and doesn't
+// affect the restart backoff. See ReExecPidPath for proxies whose pid
+// changes when they re-execute.
+func (p *Daemon) ReExec() error {
+	sig := p.ReExecSignal
+	if sig == nil {
+		sig = defaultReExecSignal
+	}
+	if sig == nil {
+		return fmt.Errorf("re-exec is not supported on this platform")
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := p.signalLocked(sig); err != nil {
+		return err
+	}
+
+	p.reexecPending = p.ReExecPidPath != ""
+	return nil
+}
+
+// Signal sends sig to the process, for example to forward a signal that the
+// agent received, such as one that toggles the log level of the proxy. This
+// doesn't affect the supervision of the process: if the signal makes the
+// process exit it is restarted as if it crashed, unless sig is one of
+// TerminalSignals. It is an error if the process isn't currently running.
+func (p *Daemon) Signal(sig os.Signal) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.signalLocked(sig)
+}
+
+// signalLocked sends sig to the process, returning an error if there is no
+// running process. The lock must be held.
+func (p *Daemon) signalLocked(sig os.Signal) error {
+	if p.stopped || p.process == nil {
+		return fmt.Errorf("daemon is not running")
+	}
+
+	return p.process.Signal(sig)
+}
+
+// Reload sends ReloadSignal to the process so that it reloads its
+// configuration, for example to pick up rotated certificates, without
+// dropping connections. The process keeps running so this neither restarts
+// it nor affects the restart attempts. It is an error if the process isn't
+// currently running.
+func (p *Daemon) Reload() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.reloadLocked()
+}
+
+// reloadLocked sends ReloadSignal to the process, returning an error if there
+// is no running process. The lock must be held.
+func (p *Daemon) reloadLocked() error {
+	sig := p.ReloadSignal
+	if sig == nil {
+		sig = defaultReloadSignal
+	}
+	if sig == nil {
+		return fmt.Errorf("reload is not supported on this platform")
+	}
+
+	return p.signalLocked(sig)
+}
+
+// reexecProcess is called after the process exits. If the exit was due to
+// ReExec and ReExecPidPath contains the pid of a different live process,
+// that process is recorded as the supervised process and returned.
+// Otherwise this returns nil.
+func (p *Daemon) reexecProcess() osProcess {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.reexecPending {
+		return nil
+	}
+	p.reexecPending = false
+
+	if p.stopped {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(p.ReExecPidPath)
+	if err != nil {
+		p.logger().Warn("error reading re-exec pid file",
+			"path", p.ReExecPidPath, "error", err)
+		return nil
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || (p.process != nil && pid == p.process.Pid()) {
+		return nil
+	}
+
+	found, err := findProcess(pid)
+	if err != nil {
+		return nil
+	}
+
+	proc := &execProcess{process: found}
+	p.setProcess(proc)
+	if p.PidPath != "" {
+		if err := file.WriteAtomic(p.PidPath, []byte(strconv.Itoa(pid))); err != nil {
+			p.logger().Debug("error writing pid file", "path", p.PidPath, "error", err)
+		}
+	}
+
+	return proc
+}
+
+// setDraining marks the daemon as draining because the agent is shutting
+// down. From then on a process exit is terminal and isn't restarted.
+func (p *Daemon) setDraining() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.draining = true
+}
+
+// flapWindow returns the configured FlapWindow or the default.
+func (p *Daemon) flapWindow() time.Duration {
+	if p.FlapWindow > 0 {
+		return p.FlapWindow
+	}
+
+	return DaemonFlapWindow
+}
+
+// recordRestart records a restart at the given time, drops any restarts
+// older than the flap window and returns the number of restarts within it.
+// The lock must be held.
+func (p *Daemon) recordRestart(now time.Time) int {
+	p.restartTimes = append(p.restartTimes, now)
+
+	cutoff := now.Add(-p.flapWindow())
+	idx := 0
+	for idx < len(p.restartTimes) && p.restartTimes[idx].Before(cutoff) {
+		idx++
+	}
+	p.restartTimes = p.restartTimes[idx:]
+
+	return len(p.restartTimes)
+}
+
+// RecentRestarts returns the number of times the daemon was restarted
+// within the given window up to now. Restarts are only retained for
+// FlapWindow, so a window larger than that is effectively capped to it.
+func (p *Daemon) RecentRestarts(window time.Duration) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	cutoff := p.now().Add(-window)
+	count := 0
+	for _, t := range p.restartTimes {
+		if !t.Before(cutoff) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// interpretExit interprets how a started process exited using
+// ExitInterpreter if it is set, or the platform specific exit status.
+func (p *Daemon) interpretExit(ps *os.ProcessState) (code int, signaled bool, err error) {
+	if p.ExitInterpreter == nil {
+		return defaultExitInterpreter(ps)
+	}
+
+	err = p.safeCall("ExitInterpreter", func() error {
+		var err error
+		code, signaled, err = p.ExitInterpreter(ps)
+		return err
+	})
+	return code, signaled, err
+}
+
+// defaultExitInterpreter interprets ps using the platform specific exit
+// status.
+func defaultExitInterpreter(ps *os.ProcessState) (int, bool, error) {
+	if _, ok := exitSignal(ps); ok {
+		return -1, true, nil
+	}
+	if !ps.Exited() {
+		return -1, false, fmt.Errorf("daemon left running")
+	}
+	if code, ok := exitStatus(ps); ok {
+		return code, false, nil
+	}
+
+	return -1, false, fmt.Errorf("exit status unavailable on this platform")
+}
+
+// daemonExit records how a process exited. See Daemon.LastExit.
+type daemonExit struct {
+	code int
+	err  error
+}
+
+// LastExit returns how the most recent process of the daemon exited. The
+// code is the exit code, or -1 if the process didn't exit normally or its
+// exit status isn't known, such as for an adopted process. Then err, if
+// known, describes why: the error waiting for the process or interpreting
+// its exit, or the signal that terminated it. ok is false if no process
+// has exited yet.
+func (p *Daemon) LastExit() (code int, err error, ok bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.lastExit == nil {
+		return 0, nil, false
+	}
+
+	return p.lastExit.code, p.lastExit.err, true
+}
+
+// LastCommand returns the command line of the most recent attempt to start
+// the process: the path, the arguments including argv[0], and the
+// environment, exactly as they were passed to the runner after resolving
+// defaults, the token file and so on. The value of the token variable is
+// redacted. All are empty if no process was started yet.
+func (p *Daemon) LastCommand() (path string, args []string, env []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.lastCommand == nil {
+		return "", nil, nil
+	}
+
+	c := p.lastCommand
+	return c.Path, append([]string(nil), c.Args...), append([]string(nil), c.Env...)
+}
+
+// isTerminalSignal returns true if sig is one of TerminalSignals.
+func (p *Daemon) isTerminalSignal(sig os.Signal) bool {
+	for _, s := range p.TerminalSignals {
+		if s == sig {
+			return true
+		}
+	}
+
+	return false
+}
+
+// StartBlockedReason describes why a Daemon isn't starting a process right
+// now. See Daemon.StartBlockedReason.
+type StartBlockedReason string
+
+const (
+	// StartBlockedNone means nothing is holding back a start. Either the
+	// process is running or it is about to be started.
+	StartBlockedNone StartBlockedReason = ""
+
+	// StartBlockedNotStarted means Start was never called.
+	StartBlockedNotStarted StartBlockedReason = "not-started"
+
+	// StartBlockedStopped means Stop or Close was called. A stopped
+	// daemon can't be started again.
+	StartBlockedStopped StartBlockedReason = "stopped"
+
+	// StartBlockedBackoff means the loop is waiting out the restart backoff.
+	StartBlockedBackoff StartBlockedReason = "backoff"
+
+	// StartBlockedLoopExited means the supervision loop ended without Stop
+	// being called. TerminalReason has the details.
+	StartBlockedLoopExited StartBlockedReason = "loop-exited"
+)
+
+// StartBlockedReason returns why the daemon isn't (re)starting its process
+// right now and, where known, the time at which the next start happens.
+// The time is zero if it isn't known or doesn't apply.
+func (p *Daemon) StartBlockedReason() (StartBlockedReason, time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch {
+	case p.stopped:
+		return StartBlockedStopped, time.Time{}
+
+	case p.exitedCh == nil:
+		return StartBlockedNotStarted, time.Time{}
+
+	case !p.loopRunning():
+		return StartBlockedLoopExited, time.Time{}
+
+	case p.process == nil && !p.nextStartAt.IsZero():
+		return StartBlockedBackoff, p.nextStartAt
+	}
+
+	return StartBlockedNone, time.Time{}
+}
+
+// publishLoopExit publishes DaemonEventFailed if the supervision loop ended
+// on its own rather than because it was stopped or the agent is shutting
+// down, or DaemonEventCompleted if it ended because of RestartPolicy. The
+// process won't be restarted in either case, so the pid file is removed as
+// well.
+func (p *Daemon) publishLoopExit() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.loopExitReason.failed() {
+		p.setState(DaemonStateFailed)
+	} else {
+		p.setState(DaemonStateStopped)
+	}
+
+	switch p.loopExitReason {
+	case LoopExitNone, LoopExitStopped, LoopExitShutdown:
+		return
+	}
+
+	p.removePidFile()
+	if p.loopExitReason == LoopExitCompleted {
+		exitCode := -1
+		if p.lastExit != nil {
+			exitCode = p.lastExit.code
+		}
+		p.publish(DaemonEvent{
+			Type:     DaemonEventCompleted,
+			Attempt:  p.attempts,
+			ExitCode: exitCode,
+		})
+		return
+	}
+
+	p.publish(DaemonEvent{
+		Type:      DaemonEventFailed,
+		Attempt:   p.attempts,
+		ExitCode:  -1,
+		Reason:    p.loopExitReason,
+		FastExits: p.fastExits,
+	})
+}
+
+// postStop calls PostStop, if set, when keepAlive ends unless Start may be
+// called again.
+func (p *Daemon) postStop() {
+	if p.PostStop == nil || p.TerminalReason() == LoopExitStartFailed {
+		return
+	}
+
+	p.safeCall("PostStop", func() error {
+		p.PostStop()
+		return nil
+	})
+}
+
+// setLoopExitReason records why keepAlive is about to return.
+func (p *Daemon) setLoopExitReason(reason LoopExitReason) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.loopExitReason = reason
+}
+
+// TerminalReason returns the reason the supervision loop ended. This
+// returns LoopExitNone if the loop is still running or was never started.
+func (p *Daemon) TerminalReason() LoopExitReason {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.loopExitReason
+}
+
+// loopRunning returns true if the supervision loop is running, even if it
+// currently has no process. The lock must be held.
+func (p *Daemon) loopRunning() bool {
+	if p.exitedCh == nil {
+		return false
+	}
+
+	select {
+	case <-p.exitedCh:
+		return false
+	default:
+		return true
+	}
+}
+
+// start starts and returns the process. This will create a copy of the
+// configured *exec.Command with the modifications documented on Daemon
+// such as setting the proxy token environmental variable.
+//
+// If output is copied through LogLineFunc, the returned channel is closed
+// once all output of the process has been drained. Otherwise it is nil.
+func (p *Daemon) start() (osProcess, <-chan struct{}, error) {
+	if err := p.createDir(); err != nil {
+		return nil, nil, fmt.Errorf("error creating working directory: %s", err)
+	}
+
+	if p.PreStart != nil {
+		if err := p.safeCall("PreStart", p.PreStart); err != nil {
+			return nil, nil, fmt.Errorf("error running pre-start hook: %s", err)
+		}
+	}
+
+	cmd := *p.Command
+
+	fileEnv, err := p.envFile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Add the proxy token to the environment. Note that anything we add to
+	// the Env here is NOT persisted in the snapshot which only looks at
+	// p.Command.Env so it needs to be reconstructible exactly from data in the
+	// snapshot otherwise.
+	cmd.Env = p.commandEnv(p.Command.Env, fileEnv)
+
+	// Args must always contain a 0 entry which is usually the executed binary.
+	// To be safe and a bit more robust we default this, but only to prevent
+	// a panic below.
+	if len(cmd.Args) == 0 {
+		cmd.Args = []string{cmd.Path}
+	}
+
+	// A reader can only be consumed once, so every process gets a new one.
+	if p.StdinProvider != nil {
+		var src io.ReadCloser
+		err := p.safeCall("StdinProvider", func() error {
+			var err error
+			src, err = p.StdinProvider()
+			if err == nil && src == nil {
+				err = fmt.Errorf("no reader returned")
+			}
+			return err
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("error getting stdin: %s", err)
+		}
+
+		stdin, err := feedInput(src)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error creating stdin pipe: %s", err)
+		}
+		defer stdin.Close()
+		cmd.Stdin = stdin
+	}
+
+	// Copy the slice so the extra files are never appended to the
+	// Command's own ExtraFiles.
+	if len(p.ExtraFiles) > 0 {
+		extraFiles := make([]*os.File, 0, len(cmd.ExtraFiles)+len(p.ExtraFiles))
+		extraFiles = append(extraFiles, cmd.ExtraFiles...)
+		cmd.ExtraFiles = append(extraFiles, p.ExtraFiles...)
+	}
+
+	// Send all output to the log file if set. If the file is rotated by
+	// size we must see every write, so the output goes through a pipe.
+	var logFile io.WriteCloser
+	var pipeOutput bool
+	if p.LogPath != "" {
+		// Like the token file the log file is owned by the user the
+		// process runs as, since it is the process's output.
+		uid, gid, err := p.logFileOwner()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if p.LogMaxBytes > 0 {
+			f, err := openRotatingFile(p.LogPath, p.logFileMode(), uid, gid, p.LogMaxBytes, p.LogMaxFiles)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error opening log file: %s", err)
+			}
+
+			logFile = f
+			pipeOutput = true
+		} else {
+			f, err := openLogFile(p.LogPath, p.logFileMode())
+			if err != nil {
+				return nil, nil, fmt.Errorf("error opening log file: %s", err)
+			}
+			if err := chownLogFile(f, uid, gid); err != nil {
+				f.Close()
+				return nil, nil, fmt.Errorf("error changing owner of log file: %s", err)
+			}
+
+			logFile = f
+			cmd.Stdout = f
+			cmd.Stderr = f
+		}
+	}
+
+	// Recording recent output also needs to see every write.
+	ring := p.outputRing()
+	if ring != nil {
+		pipeOutput = true
+	}
+
+	// So does logging stderr.
+	if p.StderrLogLevel != "" {
+		pipeOutput = true
+	}
+
+	// Route output through LogLineFunc if set. We close our copies of the
+	// write ends once the process is started (or failed to start) so that
+	// the drain goroutines exit when the process closes its copies.
+	var outputDoneCh chan struct{}
+	if p.LogLineFunc != nil || pipeOutput {
+		// The output is written to whatever output is configured at the
+		// time so that SetOutput applies to the running process too, unless
+		// it goes to our own log file.
+		var stdoutDst, stderrDst io.Writer = &daemonOutput{p, false}, &daemonOutput{p, true}
+		if logFile != nil {
+			stdoutDst, stderrDst = logFile, logFile
+		}
+		if p.StderrLogLevel != "" {
+			stderrDst = &stderrLogger{p}
+		}
+
+		// The ring records the output as it is logged, so after
+		// LogLineFunc. It comes first since it never fails.
+		var stdoutRing, stderrRing *outputRingWriter
+		if ring != nil {
+			stdoutRing, stderrRing = ring.writer(), ring.writer()
+			stdoutDst = io.MultiWriter(stdoutRing, stdoutDst)
+			stderrDst = io.MultiWriter(stderrRing, stderrDst)
+		}
+
+		stdout, stdoutDoneCh, err := p.outputPipe(stdoutDst, false)
+		if err != nil {
+			if logFile != nil {
+				logFile.Close()
+			}
+			return nil, nil, fmt.Errorf("error creating stdout pipe: %s", err)
+		}
+		defer stdout.Close()
+
+		stderr, stderrDoneCh, err := p.outputPipe(stderrDst, true)
+		if err != nil {
+			if logFile != nil {
+				logFile.Close()
+			}
+			return nil, nil, fmt.Errorf("error creating stderr pipe: %s", err)
+		}
+		defer stderr.Close()
+
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+
+		outputDoneCh = make(chan struct{})
+		go func() {
+			<-stdoutDoneCh
+			<-stderrDoneCh
+			if logFile != nil {
+				logFile.Close()
+			}
+			if ring != nil {
+				stdoutRing.Flush()
+				stderrRing.Flush()
+			}
+			close(outputDoneCh)
+		}()
+	} else if logFile != nil {
+		// The process gets its own copy of the file so we only need ours
+		// until it is started.
+		defer logFile.Close()
+	}
+
+	// Perform system-specific setup. In particular, Unix-like systems
+	// shuld set sid so that killing the agent doesn't kill the daemon.
+	configureDaemon(&cmd)
+	if p.DieWithParent {
+		if err := configureDieWithParent(&cmd); err != nil {
+			return nil, nil, err
+		}
+	}
+	var uid, gid uint32
+	setCredential := p.User != "" || p.Group != ""
+	if setCredential {
+		var err error
+		if uid, gid, err = lookupCredential(p.User, p.Group); err != nil {
+			return nil, nil, err
+		}
+		if err := configureCredential(&cmd, uid, gid); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Start it
+	p.logger().Debug("starting proxy", "path", cmd.Path, "args", cmd.Args[1:])
+	if len(p.LogEnvKeys) > 0 {
+		env := cmd.Env
+		if !p.LogEnvSecrets {
+			env = redactEnvKey(env, p.tokenEnvName())
+		}
+		p.logger().Debug("proxy environment",
+			"env", loggableEnv(env, p.LogEnvKeys, p.LogEnvSecrets))
+	}
+	var tokenFile string
+	if p.TokenDelivery == TokenDeliveryFile {
+		path, err := p.writeTokenFile(p.TokenDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error writing token file: %s", err)
+		}
+
+		tokenFile = path
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", EnvProxyTokenFile, path))
+
+		// The process must be able to read the file as its own user.
+		if setCredential {
+			if err := os.Chown(path, int(uid), int(gid)); err != nil {
+				os.Remove(path)
+				return nil, nil, fmt.Errorf("error changing owner of token file: %s", err)
+			}
+		}
+	}
+
+	runner := p.runner
+	if runner == nil {
+		runner = execRunner{}
+	}
+
+	p.lastCommand = &CommandConfig{
+		Path: cmd.Path,
+		Args: append([]string(nil), cmd.Args...),
+		Dir:  cmd.Dir,
+		Env:  redactEnvKey(cmd.Env, p.tokenEnvName()),
+	}
+
+	var process osProcess
+	runCmd := func() error {
+		var err error
+		process, err = runner.Start(&cmd)
+		return err
+	}
+
+	if p.NetnsPath != "" {
+		err = startInNetns(p.NetnsPath, runCmd)
+	} else {
+		err = runCmd()
+	}
+	if err != nil {
+		if tokenFile != "" {
+			os.Remove(tokenFile)
+		}
+		return nil, nil, err
+	}
+	p.tokenFile = tokenFile
+	p.applyLimits(process.Pid())
+
+	// Write the pid file. This might error and that's okay.
+	if p.PidPath != "" {
+		pid := strconv.FormatInt(int64(process.Pid()), 10)
+		if err := file.WriteAtomic(p.PidPath, []byte(pid)); err != nil {
+			p.logger().Debug("error writing pid file", "path", p.PidPath, "error", err)
+		}
+	}
+
+	return process, outputDoneCh, nil
+}
+
+// logger returns the Logger to log to: StructuredLogger if set, or Logger
+// otherwise. Every message starts with the name of the daemon and the proxy
+// ID, if set.
+func (p *Daemon) logger() Logger {
+	var logger Logger = p.StructuredLogger
+	if logger == nil {
+		logger = &stdLogger{logger: p.stdLogger()}
+	}
+
+	var args []interface{}
+	if name := p.name(); name != "" {
+		args = append(args, "daemon", name)
+	}
+	if p.ProxyID != "" {
+		args = append(args, "proxy_id", p.ProxyID)
+	}
+	if len(args) == 0 {
+		return logger
+	}
+
+	return &argsLogger{logger: logger, args: args}
+}
+
+// name returns Name or, if that is empty, the base name of the command
+// path.
+func (p *Daemon) name() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	cmd, _ := p.currentCommand()
+	if cmd == nil || cmd.Path == "" {
+		return ""
+	}
+
+	return filepath.Base(cmd.Path)
+}
+
+// currentCommand returns Command and ProxyToken, which Reconfigure and
+// SetProxyToken may replace while the daemon runs. It can be called with
+// or without the lock held.
+func (p *Daemon) currentCommand() (*exec.Cmd, string) {
+	p.commandLock.Lock()
+	defer p.commandLock.Unlock()
+
+	return p.Command, p.ProxyToken
+}
+
+// tracer returns the configured Tracer, guarded against panics, or a no-op
+// Tracer.
+func (p *Daemon) tracer() Tracer {
+	if p.Tracer != nil {
+		return safeTracer{p: p, tracer: p.Tracer}
+	}
+
+	return noopTracer{}
+}
+
+// safeCall calls fn, which invokes a user-supplied callback, and recovers
+// from a panic so that a buggy callback can't crash the agent. A panic is
+// logged and returned as an error.
+func (p *Daemon) safeCall(name string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.logger().Error("panic in hook", "hook", name, "panic", r)
+			err = fmt.Errorf("panic in %s: %v", name, r)
+		}
+	}()
+
+	return fn()
+}
+
+// logLine passes a line of output through LogLineFunc. If LogLineFunc
+// panics the line is dropped since it may contain data that LogLineFunc
+// was meant to scrub.
+func (p *Daemon) logLine(line string, stderr bool) string {
+	if p.LogLineFunc == nil {
+		return line
+	}
+
+	var result string
+	p.safeCall("LogLineFunc", func() error {
+		result = p.LogLineFunc(line, stderr)
+		return nil
+	})
+
+	return result
+}
+
+// SetOutput replaces the stdout and stderr of Command and returns the
+// previous ones, for example after the log files were rotated. The new
+// output is used for any process started afterwards and, if LogLineFunc is
+// set, immediately for the running process too, since its output passes
+// through the agent. Otherwise the running process keeps writing to the
+// files it was started with. Once this returns the previous output is no
+// longer written to by this Daemon and can be closed.
+func (p *Daemon) SetOutput(stdout, stderr io.Writer) (io.Writer, io.Writer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.commandLock.Lock()
+	defer p.commandLock.Unlock()
+
+	oldStdout, oldStderr := p.Command.Stdout, p.Command.Stderr
+	p.Command.Stdout = stdout
+	p.Command.Stderr = stderr
+	return oldStdout, oldStderr
+}
+
+// outputPipe returns a pipe for the stdout or stderr of the process that
+// writes to dst, filtered through LogLineFunc if set. Logged stderr is
+// written line by line.
+func (p *Daemon) outputPipe(dst io.Writer, stderr bool) (*os.File, <-chan struct{}, error) {
+	if p.LogLineFunc != nil || stderr && p.StderrLogLevel != "" {
+		return filterOutput(dst, stderr, p.logLine)
+	}
+
+	return copyOutput(dst)
+}
+
+// outputRing returns the ring that recent output is recorded in, creating it
+// on first use, or nil if RecentOutputLines isn't set. The lock must be
+// held.
+func (p *Daemon) outputRing() *outputRing {
+	if p.RecentOutputLines <= 0 {
+		return nil
+	}
+	if p.recentOutput == nil {
+		p.recentOutput = newOutputRing(p.RecentOutputLines, p.RecentOutputBytes)
+	}
+
+	return p.recentOutput
+}
+
+// RecentOutput returns the most recent lines of output of the process, or
+// its predecessors, oldest first. Output from stdout and stderr is
+// interleaved in the order it was read. This returns nil if
+// RecentOutputLines isn't set.
+func (p *Daemon) RecentOutput() []string {
+	p.lock.Lock()
+	ring := p.recentOutput
+	p.lock.Unlock()
+
+	if ring == nil {
+		return nil
+	}
+
+	return ring.Lines()
+}
+
+// daemonOutput is an io.Writer that writes to the current stdout or stderr
+// of the Command of a Daemon.
+type daemonOutput struct {
+	daemon *Daemon
+	stderr bool
+}
+
+func (o *daemonOutput) Write(b []byte) (int, error) {
+	o.daemon.lock.Lock()
+	defer o.daemon.lock.Unlock()
+
+	w := o.daemon.Command.Stdout
+	if o.stderr {
+		w = o.daemon.Command.Stderr
+	}
+	if w == nil {
+		return len(b), nil
+	}
+
+	return w.Write(b)
+}
+
+// envFile returns the variables in EnvFile, or nil if it isn't set.
+func (p *Daemon) envFile() ([]string, error) {
+	if p.EnvFile == "" {
+		return nil, nil
+	}
+
+	return readEnvFile(p.EnvFile)
+}
+
+// commandEnv returns a copy of env, filtered by EnvAllowKeys and
+// EnvStripKeys, followed by extra, which usually comes from EnvFile, and
+// with the proxy ID and, unless it is delivered in a file, the token
+// appended. We copy the env because it is a slice and a copy of an exec.Cmd
+// only copies the slice reference. We allocate a slice with room for the
+// token file.
+func (p *Daemon) commandEnv(env, extra []string) []string {
+	result := make([]string, 0, len(env)+len(extra)+3)
+	for _, kv := range env {
+		k := kv
+		if idx := strings.Index(kv, "="); idx >= 0 {
+			k = kv[:idx]
+		}
+		if len(p.EnvAllowKeys) > 0 && !matchEnvKey(k, p.EnvAllowKeys) {
+			continue
+		}
+		if matchEnvKey(k, p.EnvStripKeys) {
+			continue
+		}
+
+		result = append(result, kv)
+	}
+	result = append(result, extra...)
+	result = append(result, fmt.Sprintf("%s=%s", EnvProxyID, p.ProxyID))
+	if p.TokenDelivery != TokenDeliveryFile {
+		result = append(result, fmt.Sprintf("%s=%s", p.tokenEnvName(), p.ProxyToken))
+	}
+
+	return result
+}
+
+// tokenEnvName returns the name of the environment variable the token is
+// passed in.
+func (p *Daemon) tokenEnvName() string {
+	if p.TokenEnvName != "" {
+		return p.TokenEnvName
+	}
+
+	return EnvProxyToken
+}
+
+// matchEnvKey returns true if the environment variable name k is one of
+// keys, where keys ending in "*" match by prefix.
+func matchEnvKey(k string, keys []string) bool {
+	for _, key := range keys {
+		if strings.HasSuffix(key, "*") {
+			if strings.HasPrefix(k, key[:len(key)-1]) {
+				return true
+			}
+		} else if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// secretEnvMarkers are substrings of environment variable names that
+// indicate the value is likely a secret and shouldn't be logged.
+var secretEnvMarkers = []string{
+	"TOKEN", "SECRET", "PASSWORD", "PASSWD", "CREDENTIAL", "PRIVATE",
+}
+
+// loggableEnv formats the values of the given keys from env for logging.
+// Keys that aren't set are shown as unset and, unless secrets is true,
+// values of keys that look like secrets are masked.
+func loggableEnv(env []string, keys []string, secrets bool) string {
+	// Later values override earlier ones, matching how exec treats
+	// duplicate keys.
+	values := make(map[string]string, len(env))
+	for _, kv := range env {
+		if idx := strings.Index(kv, "="); idx > 0 {
+			values[kv[:idx]] = kv[idx+1:]
+		}
+	}
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v, ok := values[k]
+		switch {
+		case !ok:
+			parts = append(parts, fmt.Sprintf("%s=<unset>", k))
+
+		case !secrets && isSecretEnvKey(k):
+			parts = append(parts, fmt.Sprintf("%s=<redacted>", k))
+
+		default:
+			parts = append(parts, fmt.Sprintf("%s=%q", k, v))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// isSecretEnvKey returns true if the environment variable name looks like
+// it holds a secret.
+func isSecretEnvKey(k string) bool {
+	upper := strings.ToUpper(k)
+	for _, marker := range secretEnvMarkers {
+		if strings.Contains(upper, marker) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate checks ProxyToken as configured by RequireProxyToken and
+// RequireUUIDProxyToken and that Command can be started, then runs
+// ValidateCommand, if it is set, and returns an error if the command fails
+// or doesn't complete within ValidateTimeout. The error includes the
+// combined stdout and stderr of the command so that the reason the
+// configuration was rejected is visible.
+//
+// This doesn't start the daemon and can be called before Start to reject a
+// bad configuration up front rather than discovering it via a crash loop.
+// Start itself only does the checks of ProxyToken and Command since
+// ValidateCommand may take a while to run.
+func (p *Daemon) Validate() error {
+	p.lock.Lock()
+	err := p.validateProxyToken()
+	p.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	command, _ := p.currentCommand()
+	if err := p.validateCommand(command); err != nil {
+		return err
+	}
+
+	if p.ValidateCommand == nil {
+		return nil
+	}
+
+	timeout := p.ValidateTimeout
+	if timeout == 0 {
+		timeout = DaemonValidateTimeout
+	}
+
+	var output bytes.Buffer
+	cmd := *p.ValidateCommand
+	p.lock.Lock()
+	tokenPath, err := p.validateEnv(&cmd)
+	p.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if tokenPath != "" {
+		defer os.Remove(tokenPath)
+	}
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if len(cmd.Args) == 0 {
+		cmd.Args = []string{cmd.Path}
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting validate command: %s", err)
+	}
+
+	doneCh := make(chan error, 1)
+	go func() { doneCh <- cmd.Wait() }()
+
+	select {
+	case err := <-doneCh:
+		if err != nil {
+			return fmt.Errorf("proxy configuration is invalid: %s: %s",
+				err, strings.TrimSpace(output.String()))
+		}
+
+		return nil
+
+	case <-time.After(timeout):
+		// Kill it and wait for Wait to return so that output is no
+		// longer being written to.
+		cmd.Process.Kill()
+		<-doneCh
+		return fmt.Errorf("validate command did not complete within %s: %s",
+			timeout, strings.TrimSpace(output.String()))
+	}
+}
+
+// validateEnv sets the environment of cmd, a copy of ValidateCommand, the
+// way start does, writing a token file if the token is delivered in one.
+// It returns the path of that file, if any, for the caller to remove. The
+// lock must be held since SetProxyToken may replace the token meanwhile.
+func (p *Daemon) validateEnv(cmd *exec.Cmd) (string, error) {
+	fileEnv, err := p.envFile()
+	if err != nil {
+		return "", err
+	}
+	cmd.Env = p.commandEnv(p.ValidateCommand.Env, fileEnv)
+	if p.TokenDelivery != TokenDeliveryFile {
+		return "", nil
+	}
+
+	path, err := p.writeTokenFile(p.TokenDir)
+	if err != nil {
+		return "", fmt.Errorf("error writing token file: %s", err)
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", EnvProxyTokenFile, path))
+	return path, nil
+}
+
+// createDir creates Command.Dir if CreateDir is set and it doesn't exist.
+func (p *Daemon) createDir() error {
+	dir := p.Command.Dir
+	if !p.CreateDir || dir == "" {
+		return nil
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return nil
+	}
+
+	mode := p.dirMode()
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+
+	// The mode given to MkdirAll is subject to the umask.
+	if err := os.Chmod(dir, mode); err != nil {
+		return err
+	}
+
+	if p.User != "" || p.Group != "" {
+		uid, gid, err := lookupCredential(p.User, p.Group)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(dir, int(uid), int(gid)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dirMode returns DirMode or its default.
+func (p *Daemon) dirMode() os.FileMode {
+	if p.DirMode != 0 {
+		return p.DirMode
+	}
+
+	return DaemonDirMode
+}
+
+// logFileMode returns LogFileMode or its default.
+func (p *Daemon) logFileMode() os.FileMode {
+	if p.LogFileMode != 0 {
+		return p.LogFileMode
+	}
+
+	return DaemonLogFileMode
+}
+
+// logFileOwner returns the uid and gid the file at LogPath is owned by,
+// which are those of User and Group if set and -1 to keep the owner
+// otherwise.
+func (p *Daemon) logFileOwner() (int, int, error) {
+	if p.User == "" && p.Group == "" {
+		return -1, -1, nil
+	}
+
+	uid, gid, err := lookupCredential(p.User, p.Group)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int(uid), int(gid), nil
+}
+
+// validateCommand checks that cmd, the Command or a replacement for it, is
+// set, has arguments, its binary exists and is executable and its working
+// directory exists, unless it is created with CreateDir.
+func (p *Daemon) validateCommand(cmd *exec.Cmd) error {
+	if cmd == nil {
+		return fmt.Errorf("command is required")
+	}
+	if len(cmd.Args) == 0 {
+		return fmt.Errorf("command args must not be empty")
+	}
+
+	if cmd.Dir != "" {
+		fi, err := os.Stat(cmd.Dir)
+		switch {
+		case os.IsNotExist(err) && p.CreateDir:
+			// It is created when the process is started.
+		case err != nil:
+			return fmt.Errorf("invalid working directory %q: %s", cmd.Dir, err)
+		case !fi.IsDir():
+			return fmt.Errorf("invalid working directory %q: not a directory", cmd.Dir)
+		}
+	}
+
+	if cmd.Path == "" {
+		return fmt.Errorf("command path is required")
+	}
+
+	// A relative path is resolved against the working directory of the
+	// process, just like when it's started.
+	path := binaryPath(cmd)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("invalid command path %q: %s", cmd.Path, err)
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("invalid command path %q: is a directory", cmd.Path)
+	}
+	if !isExecutable(fi) {
+		return fmt.Errorf("invalid command path %q: not executable", cmd.Path)
+	}
+
+	return nil
+}
+
+// CaptureProfile fetches a profile of the running process using ProfileFunc
+// and stores it in ProfileDir, returning the path of the written file.
+// This returns an error if ProfileFunc or ProfileDir aren't set or if the
+// daemon isn't currently running a process.
+func (p *Daemon) CaptureProfile() (string, error) {
+	if p.ProfileFunc == nil || p.ProfileDir == "" {
+		return "", fmt.Errorf("ProfileFunc and ProfileDir must be set to capture a profile")
+	}
+
+	p.lock.Lock()
+	process := p.process
+	stopped := p.stopped
+	p.lock.Unlock()
+	if stopped || process == nil {
+		return "", fmt.Errorf("daemon is not running")
+	}
+
+	return p.captureProfile(process)
+}
+
+// profileUnresponsive captures a profile of process before it is killed or
+// restarted for being unresponsive, so there is something to debug the hang
+// with afterwards. It does nothing unless ProfileFunc and ProfileDir are
+// set, and errors are only logged since the kill must go ahead regardless.
+func (p *Daemon) profileUnresponsive(process osProcess) {
+	if p.ProfileFunc == nil || p.ProfileDir == "" {
+		return
+	}
+
+	if _, err := p.captureProfile(process); err != nil {
+		p.logger().Warn("error capturing profile of unresponsive daemon",
+			"pid", process.Pid(), "error", err)
+	}
+}
+
+// captureProfile fetches a profile of process using ProfileFunc, bounded by
+// DaemonProfileTimeout, and stores it in ProfileDir.
+func (p *Daemon) captureProfile(process osProcess) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DaemonProfileTimeout)
+	defer cancel()
+	var data []byte
+	err := p.safeCall("ProfileFunc", func() error {
+		var err error
+		data, err = p.ProfileFunc(ctx, process.Pid())
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("error capturing profile: %s", err)
+	}
+
+	if err := os.MkdirAll(p.ProfileDir, 0700); err != nil {
+		return "", err
+	}
+
+	name := p.ProxyID
+	if name == "" {
+		name = "daemon"
+	}
+	path := filepath.Join(p.ProfileDir, fmt.Sprintf("%s-%d-%s.prof",
+		name, process.Pid(), p.now().UTC().Format("20060102T150405.000Z")))
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+
+	p.logger().Info("captured daemon profile", "path", path)
+	return path, nil
+}
+
+// Stop stops the daemon.
+//
+// This will attempt a graceful stop (SIGINT, or ShutdownFunc if set) before
+// force killing the process (SIGKILL). A graceful signal that can't be sent
+// only temporarily is retried briefly before escalating. In either case,
+// the process won't be automatically restarted.
+//
+// This is safe to call multiple times. If the daemon is already stopped,
+// then this returns no error.
+func (p *Daemon) Stop() error {
+	process := p.beginStop()
+	if process == nil {
+		return nil
+	}
+
+	return p.stopProcess(process)
+}
+
+// AsyncStop is like Stop but returns immediately after the daemon is marked
+// as stopped, performing the graceful stop and, if needed, the force kill in
+// the background. The result of the stop is sent on the returned channel,
+// which is closed afterwards.
+//
+// Once AsyncStop returns, the daemon won't restart the process and Start
+// returns an error, even if the process hasn't exited yet.
+func (p *Daemon) AsyncStop() <-chan error {
+	resultCh := make(chan error, 1)
+	process := p.beginStop()
+	if process == nil {
+		close(resultCh)
+		return resultCh
+	}
+
+	go func() {
+		defer close(resultCh)
+		resultCh <- p.stopProcess(process)
+	}()
+
+	return resultCh
+}
+
+// Restart stops the current process gracefully, killing it if it doesn't
+// exit in time, and lets the supervision loop start it again as it would
+// after a crash, including any restart backoff unless ResetBackoffOnRestart
+// is set. Like Stop the process is drained first if DrainUntil is set, but
+// the proxy isn't deregistered. This returns once the process has exited.
+// It is an error if the daemon was never started, was stopped or its loop
+// ended. If no process is running, for example during a restart backoff,
+// this does nothing.
+func (p *Daemon) Restart() error {
+	p.lock.Lock()
+	if p.stopped {
+		p.lock.Unlock()
+		return fmt.Errorf("stopped")
+	}
+	if !p.loopRunning() {
+		p.lock.Unlock()
+		return fmt.Errorf("not running")
+	}
+
+	process := p.process
+	p.lock.Unlock()
+
+	if process == nil {
+		return nil
+	}
+
+	return p.restartProcess(process, restartRequested)
+}
+
+// Reconfigure replaces Command and ProxyToken, for example after the proxy
+// configuration changed, and gracefully restarts the process as with
+// Restart so that the new configuration takes effect. Unlike replacing the
+// Daemon this keeps the supervision loop, its state and Events. cmd must be
+// a Cmd that isn't yet started.
+//
+// cmd is checked as by Start first, and if it can't be started an error is
+// returned and the current configuration is left running. ValidateCommand
+// isn't run, so call Validate on a Daemon with the new configuration for
+// that. If no process is running, for example during a restart backoff, the
+// next start uses the new configuration. It is an error if the daemon was
+// stopped.
+func (p *Daemon) Reconfigure(cmd *exec.Cmd, token string) error {
+	if err := p.validateCommand(cmd); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	if p.stopped {
+		p.lock.Unlock()
+		return fmt.Errorf("stopped")
+	}
+
+	p.commandLock.Lock()
+	p.Command = cmd
+	p.ProxyToken = token
+	p.commandLock.Unlock()
+	process := p.process
+	p.lock.Unlock()
+
+	if process == nil {
+		return nil
+	}
+
+	return p.restartProcess(process, restartRequested)
+}
+
+// restartProcess stops process gracefully so that it is restarted by the
+// supervision loop for the given reason, unless the daemon is stopped or
+// supervises another process by now.
+func (p *Daemon) restartProcess(process osProcess, reason restartReason) error {
+	p.lock.Lock()
+	if p.stopped || p.process != process {
+		p.lock.Unlock()
+		return nil
+	}
+
+	p.restartReason = reason
+	exitedCh := p.processExitedCh
+	p.lock.Unlock()
+
+	// A planned restart lets existing connections finish first, like Stop.
+	if p.DrainUntil != nil && reason != restartUnhealthy && p.drain(exitedCh) {
+		return nil
+	}
+
+	return p.signalStop(process, exitedCh)
+}
+
+// WaitForExit blocks until the supervision loop has ended, which means the
+// process has exited and won't be restarted, or until ctx is done in which
+// case the error of ctx is returned. This returns immediately if the daemon
+// was never started or has already exited and is safe to call concurrently.
+//
+// Note that after Close the process keeps running, and the loop keeps
+// watching it, so this only returns once the process exits on its own.
+func (p *Daemon) WaitForExit(ctx context.Context) error {
+	select {
+	case <-p.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closedCh is returned by Done for a daemon that was never started.
+var closedCh = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// Done returns a channel that is closed once the supervision loop has ended,
+// as described for WaitForExit. If the daemon was never started the channel
+// is already closed. Since the loop may be started again after it ended on
+// its own, the channel is only for the loop running at the time of the call.
+func (p *Daemon) Done() <-chan struct{} {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.exitedCh == nil {
+		return closedCh
+	}
+
+	return p.exitedCh
+}
+
+// beginStop marks the daemon as stopped and signals the supervision loop to
+// quit. It returns the process that must be stopped, or nil if the daemon
+// was already stopped or never started.
+func (p *Daemon) beginStop() osProcess {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// If we're already stopped or never started, then no problem.
+	if p.stopped || p.process == nil {
+		// The loop may be waiting to restart a process that exited, so
+		// tell it to quit. There is no process to stop but the pid file
+		// still has to go, as in terminate.
+		if !p.stopped && p.loopRunning() {
+			close(p.stopCh)
+			p.removePidFile()
+			p.publish(DaemonEvent{
+				Type:     DaemonEventStopped,
+				Attempt:  p.attempts,
+				ExitCode: -1,
+			})
+		}
+
+		// In the case we never even started, calling Stop makes it so
+		// that we can't ever start in the future, either, so mark this.
+		p.stopped = true
+		p.setState(DaemonStateStopped)
+		return nil
+	}
+
+	// Note that we've stopped
+	p.stopped = true
+	p.setState(DaemonStateStopped)
+	close(p.stopCh)
+	p.publish(DaemonEvent{
+		Type:     DaemonEventStopped,
+		PID:      p.process.Pid(),
+		Attempt:  p.attempts,
+		ExitCode: -1,
+	})
+	return p.process
+}
+
+// removePidFile removes PidPath, if set. Errors are only logged.
+func (p *Daemon) removePidFile() {
+	if p.PidPath == "" {
+		return
+	}
+
+	if err := os.Remove(p.PidPath); err != nil && !os.IsNotExist(err) {
+		p.logger().Debug("error removing pid file", "path", p.PidPath, "error", err)
+	}
+}
+
+// stopProcess stops the given process, which must be the process of this
+// daemon after beginStop was called, gracefully and then forcibly.
+func (p *Daemon) stopProcess(process osProcess) error {
+	span := p.tracer().StartSpan("proxy.daemon.stop", map[string]interface{}{
+		"proxy_id": p.ProxyID,
+		"pid":      process.Pid(),
+	})
+	err := p.terminate(process)
+	span.End(err)
+	return err
+}
+
+// terminate deregisters the proxy if configured and then stops the process
+// gracefully, killing it if it doesn't exit in time.
+func (p *Daemon) terminate(process osProcess) error {
+	// Defer removing the pid file. Even under error conditions we
 	// delete the pid file since Stop means that the manager is no
 	// longer managing this proxy and therefore nothing else will ever
 	// clean it up.
-	if p.PidPath != "" {
-		defer func() {
-			if err := os.Remove(p.PidPath); err != nil && !os.IsNotExist(err) {
-				p.Logger.Printf(
-					"[DEBUG] agent/proxy: error removing pid file %q: %s",
-					p.PidPath, err)
-			}
-		}()
+	defer p.removePidFile()
+
+	// Deregister before signalling so nothing is routed to the proxy
+	// while it shuts down.
+	if p.DeregisterFunc != nil {
+		timeout := p.DeregisterTimeout
+		if timeout == 0 {
+			timeout = DaemonDeregisterTimeout
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := p.safeCall("DeregisterFunc", func() error {
+			return p.DeregisterFunc(ctx)
+		})
+		cancel()
+		if err != nil {
+			p.logger().Warn("error deregistering proxy before stop, stopping anyway",
+				"error", err)
+		}
 	}
 
-	// First, try a graceful stop
-	err := process.Signal(os.Interrupt)
-	if err == nil {
-		select {
-		case <-p.exitedCh:
-			// Success!
+	// Let existing connections finish before signalling. If the process
+	// exits while draining there is nothing left to stop.
+	if p.DrainUntil != nil && p.drain(p.exitedCh) {
+		return nil
+	}
+
+	return p.signalStop(process, p.exitedCh)
+}
+
+// StopStep is a step of Daemon.StopSequence.
+type StopStep struct {
+	// Signal is sent to the process.
+	Signal os.Signal
+
+	// Wait is how long to wait for the process to exit after Signal before
+	// moving on to the next step.
+	Wait time.Duration
+}
+
+// stopSequence returns StopSequence or, if that is empty, the single step
+// of StopSignal and GracefulWait.
+func (p *Daemon) stopSequence() []StopStep {
+	if len(p.StopSequence) > 0 {
+		return p.StopSequence
+	}
+
+	step := StopStep{Signal: p.StopSignal, Wait: p.gracefulWait()}
+	if step.Signal == nil {
+		step.Signal = os.Interrupt
+	}
+
+	return []StopStep{step}
+}
+
+// gracefulWait returns GracefulWait or its default.
+func (p *Daemon) gracefulWait() time.Duration {
+	if p.GracefulWait > 0 {
+		return p.GracefulWait
+	}
+
+	return DaemonGracefulWait
+}
+
+// signalStop walks the stop sequence, sending each signal to process and
+// waiting for exitedCh to be closed, and kills the process if that doesn't
+// happen by the end of the sequence. With ShutdownFunc set that is called
+// instead of sending the signals, unless it fails.
+func (p *Daemon) signalStop(process osProcess, exitedCh <-chan struct{}) error {
+	if p.ShutdownFunc != nil {
+		exited, err := p.shutdown(process, exitedCh)
+		if exited {
 			return nil
+		}
+		if err == nil {
+			return p.killStop(process, exitedCh)
+		}
+
+		p.logger().Warn("error calling shutdown func, sending stop signal instead",
+			"pid", process.Pid(), "error", err)
+	}
 
-		case <-time.After(gracefulWait):
-			// Interrupt didn't work
-			p.Logger.Printf("[DEBUG] agent/proxy: graceful wait of %s passed, "+
-				"killing", gracefulWait)
+	for _, step := range p.stopSequence() {
+		err := p.sendStopSignal(process, step.Signal)
+		if err == nil {
+			select {
+			case <-exitedCh:
+				// Success!
+				return nil
+
+			case <-p.getClock().After(step.Wait):
+				// The signal didn't work
+				p.logger().Debug("stop wait passed, escalating",
+					"pid", process.Pid(), "signal", step.Signal, "wait", step.Wait)
+			}
+		} else if isProcessAlreadyFinishedErr(err) {
+			// This can happen due to races between signals and polling. The
+			// process was already waited for but the loop may still be
+			// draining its output, so let it finish.
+			<-exitedCh
+			return nil
+		} else {
+			p.logger().Debug("sending stop signal failed, escalating",
+				"pid", process.Pid(), "signal", step.Signal, "error", err)
 		}
-	} else if isProcessAlreadyFinishedErr(err) {
-		// This can happen due to races between signals and polling.
-		return nil
-	} else {
-		p.Logger.Printf("[DEBUG] agent/proxy: sigint failed, killing: %s", err)
 	}
 
 	// Graceful didn't work (e.g. on windows where SIGINT isn't implemented),
 	// forcibly kill
-	err = process.Kill()
+	return p.killStop(process, exitedCh)
+}
+
+// shutdown calls ShutdownFunc and waits up to GracefulWait from the call
+// for exitedCh to be closed. It returns true if the process exited. The
+// error of ShutdownFunc is returned if it failed, in which case the caller
+// should send the stop signals instead of killing the process.
+func (p *Daemon) shutdown(process osProcess, exitedCh <-chan struct{}) (bool, error) {
+	wait := p.gracefulWait()
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+
+	// ShutdownFunc may block, so the wait runs alongside it.
+	timer := p.getClock().NewTimer(wait)
+	defer timer.Stop()
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- p.safeCall("ShutdownFunc", func() error {
+			return p.ShutdownFunc(ctx)
+		})
+	}()
+
+	select {
+	case <-exitedCh:
+		return true, nil
+	case err := <-doneCh:
+		if err != nil {
+			return false, err
+		}
+	case <-timer.C():
+		p.logger().Debug("shutdown func didn't return in time, killing",
+			"pid", process.Pid(), "wait", wait)
+		return false, nil
+	}
+
+	select {
+	case <-exitedCh:
+		return true, nil
+	case <-timer.C():
+		p.logger().Debug("shutdown wait passed, killing",
+			"pid", process.Pid(), "wait", wait)
+		return false, nil
+	}
+}
+
+// killStop kills process, for when it didn't stop gracefully, and waits for
+// exitedCh to be closed as configured by KillWait.
+func (p *Daemon) killStop(process osProcess, exitedCh <-chan struct{}) error {
+	err := killProcess(process)
 	if err != nil && isProcessAlreadyFinishedErr(err) {
+		<-exitedCh
 		return nil
 	}
+	if err != nil || p.KillWait <= 0 {
+		return err
+	}
+
+	return p.waitKilled(process, exitedCh)
+}
+
+// Sending a stop signal that failed temporarily is retried up to
+// stopSignalRetries times, stopSignalRetryDelay apart, before escalating.
+const (
+	stopSignalRetries    = 2
+	stopSignalRetryDelay = 100 * time.Millisecond
+)
+
+// sendStopSignal sends sig to the process group of process for a step of
+// the stop sequence, retrying if that fails only temporarily.
+func (p *Daemon) sendStopSignal(process osProcess, sig os.Signal) error {
+	err := process.SignalGroup(sig)
+	for i := 0; i < stopSignalRetries && err != nil && isTransientSignalErr(err); i++ {
+		p.logger().Debug("sending stop signal failed, retrying",
+			"pid", process.Pid(), "signal", sig, "error", err)
+		<-p.getClock().After(stopSignalRetryDelay)
+		err = process.SignalGroup(sig)
+	}
+
 	return err
 }
 
+// waitKilled waits up to KillWait for exitedCh to be closed after process
+// was killed. If that doesn't happen the process is marked as stuck and an
+// error is returned, rather than blocking the caller indefinitely.
+func (p *Daemon) waitKilled(process osProcess, exitedCh <-chan struct{}) error {
+	timer := p.getClock().NewTimer(p.KillWait)
+	defer timer.Stop()
+
+	select {
+	case <-exitedCh:
+		return nil
+	case <-timer.C():
+	}
+
+	pid := process.Pid()
+	p.lock.Lock()
+	p.stuck = true
+	p.publish(DaemonEvent{
+		Type:     DaemonEventStuck,
+		PID:      pid,
+		Attempt:  p.attempts,
+		ExitCode: -1,
+	})
+	p.lock.Unlock()
+	p.emitStuck()
+
+	p.logger().Error("daemon not reaped after kill, it may be stuck",
+		"pid", pid, "wait", p.KillWait)
+	return fmt.Errorf("process %d not reaped within %s of being killed", pid, p.KillWait)
+}
+
+// drain calls DrainUntil, bounded by DrainTimeout. It returns true if
+// exitedCh was closed because the process exited, before or while draining.
+func (p *Daemon) drain(exitedCh <-chan struct{}) bool {
+	select {
+	case <-exitedCh:
+		return true
+	default:
+	}
+
+	timeout := p.DrainTimeout
+	if timeout == 0 {
+		timeout = DaemonDrainTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- p.safeCall("DrainUntil", func() error {
+			return p.DrainUntil(ctx)
+		})
+	}()
+
+	select {
+	case err := <-doneCh:
+		if err != nil {
+			p.logger().Warn("error draining proxy connections, stopping anyway",
+				"error", err)
+		}
+		return false
+
+	case <-ctx.Done():
+		p.logger().Warn("proxy connections not drained in time, stopping anyway",
+			"timeout", timeout)
+		return false
+
+	case <-exitedCh:
+		return true
+	}
+}
+
 // Close implements Proxy by stopping the run loop but not killing the process.
 // One Close is called, Stop has no effect.
 func (p *Daemon) Close() error {
@@ -359,31 +3418,93 @@ func (p *Daemon) Close() error {
 
 	// If we're already stopped or never started, then no problem.
 	if p.stopped || p.process == nil {
+		if !p.stopped && p.loopRunning() {
+			close(p.stopCh)
+		}
+
 		p.stopped = true
+		p.setState(DaemonStateStopped)
 		return nil
 	}
 
 	// Note that we've stopped
 	p.stopped = true
+	p.setState(DaemonStateStopped)
 	close(p.stopCh)
 
 	return nil
 }
 
 // Equal implements Proxy to check for equality.
+//
+// Two daemons are equal if they start the same process in the same way, so
+// that the manager only replaces a daemon when that has an effect. Fields
+// that only affect supervision, such as the restart backoff, are ignored,
+// and so are functions since they can't be compared. Command.Stdout and
+// Command.Stderr are ignored too because the manager opens new log files
+// for every daemon it creates, and of Command.Stdin only whether it is set
+// is compared. Command.SysProcAttr is ignored since it is overwritten on
+// start anyway. Extra files are the same if they refer to the same file.
 func (p *Daemon) Equal(raw Proxy) bool {
 	p2, ok := raw.(*Daemon)
 	if !ok {
 		return false
 	}
 
-	// We compare equality on a subset of the command configuration
-	return p.ProxyToken == p2.ProxyToken &&
+	cmd, token := p.currentCommand()
+	cmd2, token2 := p2.currentCommand()
+	return token == token2 &&
 		p.ProxyID == p2.ProxyID &&
-		p.Command.Path == p2.Command.Path &&
-		p.Command.Dir == p2.Command.Dir &&
-		reflect.DeepEqual(p.Command.Args, p2.Command.Args) &&
-		reflect.DeepEqual(p.Command.Env, p2.Command.Env)
+		p.TokenDelivery == p2.TokenDelivery &&
+		p.TokenDir == p2.TokenDir &&
+		p.tokenEnvName() == p2.tokenEnvName() &&
+		p.LogPath == p2.LogPath &&
+		p.logFileMode() == p2.logFileMode() &&
+		p.NetnsPath == p2.NetnsPath &&
+		p.Limits == p2.Limits &&
+		p.User == p2.User &&
+		p.Group == p2.Group &&
+		p.DieWithParent == p2.DieWithParent &&
+		cmd.Path == cmd2.Path &&
+		cmd.Dir == cmd2.Dir &&
+		p.CreateDir == p2.CreateDir &&
+		p.dirMode() == p2.dirMode() &&
+		reflect.DeepEqual(cmd.Args, cmd2.Args) &&
+		reflect.DeepEqual(cmd.Env, cmd2.Env) &&
+		reflect.DeepEqual(p.EnvAllowKeys, p2.EnvAllowKeys) &&
+		reflect.DeepEqual(p.EnvStripKeys, p2.EnvStripKeys) &&
+		p.EnvFile == p2.EnvFile &&
+		(cmd.Stdin == nil) == (cmd2.Stdin == nil) &&
+		sameFiles(cmd.ExtraFiles, cmd2.ExtraFiles) &&
+		sameFiles(p.ExtraFiles, p2.ExtraFiles)
+}
+
+// sameFiles returns true if a and b refer to the same files in the same
+// order. This uses Stat rather than Fd since the latter puts the file into
+// blocking mode, which would break listeners the daemon is still serving.
+func sameFiles(a, b []*os.File) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] == b[i] {
+			continue
+		}
+		if a[i] == nil || b[i] == nil {
+			return false
+		}
+
+		fi, err := a[i].Stat()
+		if err != nil {
+			return false
+		}
+		fi2, err := b[i].Stat()
+		if err != nil || !os.SameFile(fi, fi2) {
+			return false
+		}
+	}
+
+	return true
 }
 
 // MarshalSnapshot implements Proxy
@@ -396,8 +3517,8 @@ func (p *Daemon) MarshalSnapshot() map[string]interface{} {
 		return nil
 	}
 
-	return map[string]interface{}{
-		"Pid":         p.process.Pid,
+	result := map[string]interface{}{
+		"Pid":         p.process.Pid(),
 		"CommandPath": p.Command.Path,
 		"CommandArgs": p.Command.Args,
 		"CommandDir":  p.Command.Dir,
@@ -405,6 +3526,128 @@ func (p *Daemon) MarshalSnapshot() map[string]interface{} {
 		"ProxyToken":  p.ProxyToken,
 		"ProxyID":     p.ProxyID,
 	}
+
+	// Record when the process started where supported so that a restored
+	// snapshot can't mistake another process that reused the pid for ours.
+	if p.processStartTime != 0 {
+		result["StartTime"] = p.processStartTime
+	}
+
+	if p.tokenFile != "" {
+		result["TokenFile"] = p.tokenFile
+	}
+
+	if p.attempts > 0 {
+		result["Attempts"] = p.attempts
+		if !p.attemptsDeadline.IsZero() {
+			result["AttemptsDeadline"] = p.attemptsDeadline.UnixNano()
+		}
+	}
+
+	return result
+}
+
+// MarshalJSON encodes the state needed to reattach to the running process
+// after an agent restart, as MarshalSnapshot. This is null if the daemon
+// isn't running a process.
+func (p *Daemon) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.MarshalSnapshot())
+}
+
+// UnmarshalJSON restores the configuration encoded by MarshalJSON. Unlike
+// UnmarshalSnapshot this doesn't start supervising anything. Call Reattach
+// to do so.
+func (p *Daemon) UnmarshalJSON(data []byte) error {
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+
+	var s daemonSnapshot
+	if err := mapstructure.Decode(m, &s); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.restoreSnapshot(&s)
+	p.reattach = &s
+	return nil
+}
+
+// Reattach resumes supervising the process recorded by UnmarshalJSON if it
+// is still running and is the same process, and otherwise starts a new one
+// as Start does.
+//
+// If no process was recorded, or it is gone, the pid in PidPath is tried
+// next, for example when the agent crashed before persisting the daemon.
+// That process is only reattached to if it runs the executable of Command,
+// which can only be verified on Linux.
+func (p *Daemon) Reattach() error {
+	p.lock.Lock()
+	s := p.reattach
+	p.reattach = nil
+	if !p.stopped && p.process == nil && !p.loopRunning() {
+		if s != nil {
+			proc, err := snapshotProcess(s)
+			if err == nil {
+				p.adopt(proc)
+				p.lock.Unlock()
+				return nil
+			}
+
+			p.logger().Info("not reattaching to process", "pid", s.Pid, "error", err)
+			p.removeTokenFile()
+		}
+
+		if p.PidPath != "" {
+			proc, err := p.pidFileProcess()
+			if err == nil {
+				p.logger().Info("reattaching to process from pid file",
+					"pid", proc.Pid, "path", p.PidPath)
+				p.adopt(proc)
+				p.lock.Unlock()
+				return nil
+			}
+
+			if !os.IsNotExist(err) {
+				p.logger().Info("not reattaching to process from pid file",
+					"path", p.PidPath, "error", err)
+			}
+		}
+	}
+	p.lock.Unlock()
+
+	return p.Start()
+}
+
+// pidFileProcess returns the live process whose pid is in PidPath if it
+// runs the executable of Command. The lock must be held.
+func (p *Daemon) pidFileProcess() (*os.Process, error) {
+	data, err := ioutil.ReadFile(p.PidPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pid file: %s", err)
+	}
+
+	proc, err := findProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	exe, err := processExecutable(pid)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying identity of process %d: %s", pid, err)
+	}
+	if p.Command == nil || !sameExecutable(exe, p.Command.Path) {
+		return nil, fmt.Errorf("process %d is running %q, not the proxy", pid, exe)
+	}
+
+	return proc, nil
 }
 
 // UnmarshalSnapshot implements Proxy
@@ -418,31 +3661,190 @@ func (p *Daemon) UnmarshalSnapshot(m map[string]interface{}) error {
 	defer p.lock.Unlock()
 
 	// Set the basic fields
-	p.ProxyToken = s.ProxyToken
+	p.restoreSnapshot(&s)
+
+	// If the process is gone, so is the need for the files it left behind.
+	proc, err := snapshotProcess(&s)
+	if err != nil {
+		p.removeTokenFile()
+		p.removePidFile()
+		return err
+	}
+
+	// "Start it"
+	p.adopt(proc)
+	return nil
+}
+
+// restoreSnapshot sets the configuration and restart backoff state recorded
+// in a snapshot. The lock must be held.
+func (p *Daemon) restoreSnapshot(s *daemonSnapshot) {
 	p.ProxyID = s.ProxyID
+	p.tokenFile = s.TokenFile
+	if s.TokenFile != "" {
+		p.TokenDelivery = TokenDeliveryFile
+	}
+	p.commandLock.Lock()
+	p.ProxyToken = s.ProxyToken
 	p.Command = &exec.Cmd{
 		Path: s.CommandPath,
 		Args: s.CommandArgs,
 		Dir:  s.CommandDir,
 		Env:  s.CommandEnv,
 	}
+	p.commandLock.Unlock()
+
+	p.attempts = s.Attempts
+	p.attemptsDeadline = time.Time{}
+	if s.AttemptsDeadline != 0 {
+		p.attemptsDeadline = time.Unix(0, s.AttemptsDeadline)
+	}
+
+	// The snapshot may be from a while ago. If the process stayed up past
+	// the deadline it was healthy, so it doesn't inherit the attempts, the
+	// same as if the agent had been running. Otherwise keep the attempts
+	// but don't trust values out of range.
+	now := p.now()
+	switch {
+	case !p.attemptsDeadline.IsZero() && now.After(p.attemptsDeadline):
+		p.attempts = 0
+		p.attemptsDeadline = time.Time{}
+
+	case p.attemptsDeadline.After(now.Add(p.restartHealthy())):
+		p.attemptsDeadline = now.Add(p.restartHealthy())
+	}
+	if max := p.maxBackoffAttempts(); p.attempts > max {
+		p.attempts = max
+	}
+}
 
+// snapshotProcess returns the process recorded in a snapshot if it is
+// still running and, where that can be checked, is the same process.
+func snapshotProcess(s *daemonSnapshot) (*os.Process, error) {
 	// FindProcess on many systems returns no error even if the process
 	// is now dead. We perform an extra check that the process is alive.
 	proc, err := findProcess(s.Pid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Guard against the pid having been reused by another process.
+	if s.StartTime != 0 {
+		startTime, err := processStartTime(s.Pid)
+		if err == nil && startTime != s.StartTime {
+			return nil, fmt.Errorf("process %d is not the process in the snapshot", s.Pid)
+		}
+	}
+
+	return proc, nil
+}
+
+// AdoptPID makes the daemon supervise an already running process that it
+// did not start, as if it had started it. This is meant for recovery
+// tooling where the snapshot is lost but the proxy process is still alive.
+//
+// The process must be alive and, if identity is non-empty, the executable
+// of the process must match the path given by identity. This guards against
+// adopting an unrelated process that reused the pid. Verifying identity is
+// only supported on Linux; on other platforms a non-empty identity results
+// in an error.
+//
+// Once adopted, the daemon can be stopped as usual and if the adopted
+// process exits, it is restarted using Command.
+func (p *Daemon) AdoptPID(pid int, identity string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.stopped {
+		return fmt.Errorf("stopped")
+	}
+	if p.process != nil {
+		return fmt.Errorf("daemon is already supervising pid %d", p.process.Pid())
+	}
+	if p.loopRunning() {
+		return fmt.Errorf("daemon is already running")
+	}
+
+	proc, err := findProcess(pid)
 	if err != nil {
 		return err
 	}
 
-	// "Start it"
+	if identity != "" {
+		exe, err := processExecutable(pid)
+		if err != nil {
+			return fmt.Errorf("error verifying identity of process %d: %s", pid, err)
+		}
+
+		if !sameExecutable(exe, identity) {
+			return fmt.Errorf("process %d is running %q, not %q", pid, exe, identity)
+		}
+	}
+
+	p.adopt(proc)
+	return nil
+}
+
+// adopt starts the supervision loop monitoring the given process which
+// was not started by this Daemon. The lock must be held.
+func (p *Daemon) adopt(proc *os.Process) {
 	stopCh := make(chan struct{})
 	exitedCh := make(chan struct{})
 	p.stopCh = stopCh
 	p.exitedCh = exitedCh
-	p.process = proc
+	p.setProcess(&execProcess{process: proc})
 	go p.keepAlive(stopCh, exitedCh)
+}
 
-	return nil
+// setProcess records proc, which may be nil, as the supervised process.
+// The lock must be held.
+func (p *Daemon) setProcess(proc osProcess) {
+	if p.processExitedCh != nil {
+		close(p.processExitedCh)
+		p.processExitedCh = nil
+	}
+
+	p.process = proc
+	p.processStartTime = 0
+	p.ready = proc != nil && p.ReadyCheck == nil
+	if proc == nil {
+		return
+	}
+
+	p.processExitedCh = make(chan struct{})
+	p.lastStart = p.now()
+
+	p.recordProcessGroup(proc.Pid())
+	if startTime, err := processStartTime(proc.Pid()); err == nil {
+		p.processStartTime = startTime
+	}
+}
+
+// maxProcessGroups is the number of process groups retained in pgids.
+const maxProcessGroups = 64
+
+// recordProcessGroup records the process group of a supervised process.
+// Processes are started in a new session so their pid is also their
+// process group id. The lock must be held.
+func (p *Daemon) recordProcessGroup(pgid int) {
+	p.pgids = append(p.pgids, pgid)
+	if len(p.pgids) > maxProcessGroups {
+		p.pgids = p.pgids[len(p.pgids)-maxProcessGroups:]
+	}
+}
+
+// sameExecutable returns true if the two paths refer to the same executable.
+// Symlinks are resolved where possible so that a symlinked identity matches
+// the resolved path reported by the operating system.
+func sameExecutable(a, b string) bool {
+	if resolved, err := filepath.EvalSymlinks(a); err == nil {
+		a = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(b); err == nil {
+		b = resolved
+	}
+
+	return filepath.Clean(a) == filepath.Clean(b)
 }
 
 // daemonSnapshot is the structure of the marshalled data for snapshotting.
@@ -466,4 +3868,18 @@ type daemonSnapshot struct {
 	ProxyToken string
 
 	ProxyID string
+
+	// TokenFile is the token file of the process with TokenDeliveryFile,
+	// so that it is removed once the process exits.
+	TokenFile string
+
+	// StartTime is when the process started, in a platform specific unit,
+	// or zero if unknown. It guards against the pid being reused.
+	StartTime uint64
+
+	// Attempts and AttemptsDeadline, in Unix nanoseconds or zero, are the
+	// restart backoff state so that backoff continues across agent
+	// restarts. See BackoffState.
+	Attempts         uint32
+	AttemptsDeadline int64
 }
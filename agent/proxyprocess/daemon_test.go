@@ -1,15 +1,25 @@
 package proxyprocess
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/testutil/retry"
 	"github.com/hashicorp/go-uuid"
 	"github.com/stretchr/testify/require"
@@ -70,41 +80,2478 @@ func TestDaemonStartStop(t *testing.T) {
 	})
 }
 
+func TestDaemonStart_requireProxyToken(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+
+	d := &Daemon{
+		Command:           helperProcess("start-stop", path),
+		Logger:            testLogger,
+		RequireProxyToken: true,
+	}
+	err := d.Start()
+	require.Error(err)
+	require.Contains(err.Error(), "token")
+
+	// Nothing should have been started
+	time.Sleep(100 * time.Millisecond)
+	_, err = os.Stat(path)
+	require.True(os.IsNotExist(err))
+}
+
+func TestDaemonValidate_proxyToken(t *testing.T) {
+	t.Parallel()
+
+	token, err := uuid.GenerateUUID()
+	require.NoError(t, err)
+
+	cases := []struct {
+		Name        string
+		Token       string
+		Require     bool
+		RequireUUID bool
+		Err         string
+	}{
+		{"not required", "", false, false, ""},
+		{"empty", "", true, false, "required but empty"},
+		{"any format", "secret", true, false, ""},
+		{"uuid", token, true, true, ""},
+		{"not a uuid", token + "\n", true, true, "not a UUID"},
+		{"uuid only checked if set", "", false, true, ""},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			require := require.New(t)
+			d := &Daemon{
+				Command:               helperProcess("start-stop", "unused"),
+				Logger:                testLogger,
+				ProxyToken:            tc.Token,
+				RequireProxyToken:     tc.Require,
+				RequireUUIDProxyToken: tc.RequireUUID,
+			}
+
+			err := d.Validate()
+			if tc.Err == "" {
+				require.NoError(err)
+				return
+			}
+
+			require.Error(err)
+			require.Contains(err.Error(), tc.Err)
+			require.NotContains(err.Error(), token)
+
+			// Start rejects the token the same way
+			err = d.Start()
+			require.Error(err)
+			require.Contains(err.Error(), tc.Err)
+		})
+	}
+}
+
+func TestDaemonTerminalReason(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+
+	d := &Daemon{
+		Command:    helperProcess("start-stop", path),
+		ProxyToken: "hello",
+		Logger:     testLogger,
+	}
+	require.Equal(LoopExitNone, d.TerminalReason())
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Wait for the file to exist
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if err == nil {
+			return
+		}
+
+		r.Fatalf("error: %s", err)
+	})
+
+	// Still running so there is no reason yet
+	require.Equal(LoopExitNone, d.TerminalReason())
+
+	// Stop the process and wait for the loop to exit
+	require.NoError(d.Stop())
+	<-d.exitedCh
+	require.Equal(LoopExitStopped, d.TerminalReason())
+}
+
+func TestDaemonStop_deregister(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+
+	var running bool
+	d := &Daemon{
+		Command:    helperProcess("start-stop", path),
+		ProxyToken: "hello",
+		Logger:     testLogger,
+		DeregisterFunc: func(ctx context.Context) error {
+			// The process must still be running when deregistering
+			_, err := os.Stat(path)
+			running = err == nil
+			return fmt.Errorf("deregister failed")
+		},
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Wait for the file to exist
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if err == nil {
+			return
+		}
+
+		r.Fatalf("error: %s", err)
+	})
+
+	// Stop should proceed even though deregistering failed
+	require.NoError(d.Stop())
+	require.True(running)
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return
+		}
+
+		r.Fatalf("should not exist: %s", err)
+	})
+}
+
+func TestDaemonStop_drain(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+
+	// Pretend the proxy has a few connections that finish one at a time.
+	conns := 3
+	var running bool
+	d := &Daemon{
+		Command:    helperProcess("start-stop", path),
+		ProxyToken: "hello",
+		Logger:     testLogger,
+		DrainUntil: func(ctx context.Context) error {
+			for ; conns > 0; conns-- {
+				select {
+				case <-time.After(10 * time.Millisecond):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+
+			// The process must still be running once drained
+			_, err := os.Stat(path)
+			running = err == nil
+			return nil
+		},
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Wait for the file to exist
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if err == nil {
+			return
+		}
+
+		r.Fatalf("error: %s", err)
+	})
+
+	require.NoError(d.Stop())
+	require.Equal(0, conns)
+	require.True(running)
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return
+		}
+
+		r.Fatalf("should not exist: %s", err)
+	})
+}
+
+func TestDaemonStop_drainTimeout(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+
+	d := &Daemon{
+		Command:      helperProcess("start-stop", path),
+		ProxyToken:   "hello",
+		Logger:       testLogger,
+		DrainTimeout: 100 * time.Millisecond,
+		DrainUntil: func(ctx context.Context) error {
+			// Connections never drain
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Wait for the file to exist
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if err == nil {
+			return
+		}
+
+		r.Fatalf("error: %s", err)
+	})
+
+	// Stop should give up on draining and stop the process anyway
+	require.NoError(d.Stop())
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return
+		}
+
+		r.Fatalf("should not exist: %s", err)
+	})
+}
+
+func TestDaemonCaptureProfile(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	profileDir := filepath.Join(td, "profiles")
+
+	var profiledPid int
+	d := &Daemon{
+		Command:    helperProcess("start-stop", path),
+		ProxyID:    "web-proxy",
+		ProxyToken: "hello",
+		Logger:     testLogger,
+		ProfileDir: profileDir,
+		ProfileFunc: func(ctx context.Context, pid int) ([]byte, error) {
+			profiledPid = pid
+			return []byte("profile"), nil
+		},
+	}
+
+	// Not running yet
+	_, err := d.CaptureProfile()
+	require.Error(err)
+
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Wait for the file to exist
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if err == nil {
+			return
+		}
+
+		r.Fatalf("error: %s", err)
+	})
+
+	profilePath, err := d.CaptureProfile()
+	require.NoError(err)
+	require.Equal(profileDir, filepath.Dir(profilePath))
+	require.Contains(filepath.Base(profilePath), "web-proxy-")
+
+	data, err := ioutil.ReadFile(profilePath)
+	require.NoError(err)
+	require.Equal("profile", string(data))
+
+	d.lock.Lock()
+	require.Equal(d.process.Pid(), profiledPid)
+	d.lock.Unlock()
+}
+
+func TestDaemonStart_logLineFunc(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+
+	var stdout, stderr syncBuffer
+	cmd := helperProcess("output", path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	d := &Daemon{
+		Command:    cmd,
+		ProxyToken: "hello",
+		Logger:     testLogger,
+		LogLineFunc: func(line string, isStderr bool) string {
+			if isStderr {
+				return ""
+			}
+
+			return strings.ToUpper(line)
+		},
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Wait for the output to be written
+	retry.Run(t, func(r *retry.R) {
+		if got := stdout.String(); got != "HELLO STDOUT\n" {
+			r.Fatalf("bad stdout: %q", got)
+		}
+	})
+
+	// Stderr lines were dropped
+	require.Empty(stderr.String())
+}
+
+func TestDaemonStart_stderrLogLevel(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	// Lines are attributed to the proxy in the agent's log
+	var buf syncBuffer
+	d := &Daemon{
+		Command:        helperProcess("exit", "1", "hello stderr"),
+		ProxyID:        "web",
+		Logger:         log.New(&buf, "", 0),
+		StderrLogLevel: "WARN",
+		MaxRestarts:    1,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+	retry.Run(t, func(r *retry.R) {
+		if got := buf.String(); !strings.Contains(got, "[WARN] agent/proxy[web]: hello stderr\n") {
+			r.Fatalf("bad log: %q", got)
+		}
+	})
+
+	// A structured logger gets the line as the message
+	logger := &testStructuredLogger{}
+	d = &Daemon{
+		Command:          helperProcess("exit", "1", "hello stderr"),
+		ProxyID:          "web",
+		StructuredLogger: logger,
+		StderrLogLevel:   "ERR",
+		MaxRestarts:      1,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+	retry.Run(t, func(r *retry.R) {
+		e, ok := logger.Find("hello stderr")
+		if !ok {
+			r.Fatal("line not logged")
+		}
+		if e.Level != "ERR" || e.Args["proxy_id"] != "web" || e.Args["stream"] != "stderr" {
+			r.Fatalf("bad entry: %#v", e)
+		}
+	})
+
+	// Only the levels of the agent are allowed
+	d = &Daemon{
+		Command:        helperProcess("exit", "1", "hello stderr"),
+		Logger:         testLogger,
+		StderrLogLevel: "LOUD",
+	}
+	require.Error(d.Start())
+}
+
+// Verify that all output of a process is drained before it is restarted.
+func TestDaemonStart_logPath(t *testing.T) {
+	t.Parallel()
+
+	td, closer := testTempDir(t)
+	defer closer()
+
+	cases := []struct {
+		Name        string
+		LogLineFunc func(string, bool) string
+		LogFileMode os.FileMode
+	}{
+		{"direct", nil, 0},
+		{"filtered", func(line string, stderr bool) string { return "filtered: " + line }, 0},
+		{"mode", nil, 0640},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			logPath := filepath.Join(td, tc.Name+".log")
+
+			// The Command output isn't used when LogPath is set
+			var output syncBuffer
+			cmd := helperProcess("exit", "1", "crashed")
+			cmd.Stdout = &output
+			cmd.Stderr = &output
+			d := &Daemon{
+				Command:     cmd,
+				Logger:      testLogger,
+				LogPath:     logPath,
+				LogLineFunc: tc.LogLineFunc,
+				LogFileMode: tc.LogFileMode,
+			}
+			require.NoError(d.Start())
+			defer d.Stop()
+
+			// Output of every restart is appended
+			retry.Run(t, func(r *retry.R) {
+				bs, err := ioutil.ReadFile(logPath)
+				if err != nil {
+					r.Fatalf("error: %s", err)
+				}
+				if n := strings.Count(string(bs), "crashed"); n < 2 {
+					r.Fatalf("expected output of 2 runs, got %d", n)
+				}
+			})
+			require.NoError(d.Stop())
+			require.Empty(output.String())
+
+			bs, err := ioutil.ReadFile(logPath)
+			require.NoError(err)
+			if tc.LogLineFunc != nil {
+				require.Contains(string(bs), "filtered: crashed")
+			}
+
+			mode := tc.LogFileMode
+			if mode == 0 {
+				mode = DaemonLogFileMode
+			}
+			fi, err := os.Stat(logPath)
+			require.NoError(err)
+			require.Equal(mode, fi.Mode().Perm())
+		})
+	}
+}
+
+func TestDaemonStart_sync(t *testing.T) {
+	t.Parallel()
+
+	td, closer := testTempDir(t)
+	defer closer()
+
+	t.Run("started", func(t *testing.T) {
+		require := require.New(t)
+
+		path := filepath.Join(td, "file")
+		d := &Daemon{
+			Command:   helperProcess("start-stop", path),
+			Logger:    testLogger,
+			StartSync: true,
+		}
+		require.NoError(d.Start())
+		defer d.Stop()
+
+		// The process is running by the time Start returns
+		require.True(d.Stats().Running)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		require := require.New(t)
+
+		// The log file can't be opened so the process can't be started
+		d := &Daemon{
+			Command:   helperProcess("start-stop", filepath.Join(td, "file2")),
+			Logger:    testLogger,
+			LogPath:   filepath.Join(td, "missing", "proxy.log"),
+			StartSync: true,
+		}
+		err := d.Start()
+		require.Error(err)
+		defer d.Stop()
+
+		// The loop doesn't keep retrying and Start may be called again
+		select {
+		case <-d.exitedCh:
+		case <-time.After(5 * time.Second):
+			t.Fatal("loop should end")
+		}
+		require.Equal(LoopExitStartFailed, d.TerminalReason())
+
+		d.LogPath = ""
+		require.NoError(d.Start())
+		require.True(d.Stats().Running)
+		require.Equal(LoopExitNone, d.TerminalReason())
+	})
+}
+
+func TestDaemonStart_hooks(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	// The process needs a directory that PreStart creates and PostStop
+	// removes. The first PreStart fails, which is retried like a failed
+	// start.
+	dir := filepath.Join(td, "sockets")
+	var preStarts, postStops int32
+	d := &Daemon{
+		Command: helperProcess("start-stop", filepath.Join(dir, "file")),
+		Logger:  testLogger,
+		PreStart: func() error {
+			if atomic.AddInt32(&preStarts, 1) == 1 {
+				return fmt.Errorf("not yet")
+			}
+			return os.Mkdir(dir, 0700)
+		},
+		PostStop: func() {
+			atomic.AddInt32(&postStops, 1)
+			os.RemoveAll(dir)
+		},
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(filepath.Join(dir, "file")); err != nil {
+			r.Fatalf("error: %s", err)
+		}
+	})
+	require.Equal(int32(2), atomic.LoadInt32(&preStarts))
+	require.Equal(uint32(2), d.BackoffState().Attempts)
+	require.Equal(int32(0), atomic.LoadInt32(&postStops))
+
+	// PostStop has run by the time Stop returns, and only once
+	require.NoError(d.Stop())
+	require.Equal(int32(1), atomic.LoadInt32(&postStops))
+	_, err := os.Stat(dir)
+	require.True(os.IsNotExist(err))
+
+	require.NoError(d.Stop())
+	require.Equal(int32(1), atomic.LoadInt32(&postStops))
+}
+
+func TestDaemonStart_createDir(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	// The working directory is created, with its parents, before the
+	// process starts in it
+	dir := filepath.Join(td, "run", "sockets")
+	cmd := helperProcess("start-stop", "file")
+	cmd.Dir = dir
+	d := &Daemon{
+		Command:   cmd,
+		Logger:    testLogger,
+		CreateDir: true,
+		DirMode:   0750,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(filepath.Join(dir, "file")); err != nil {
+			r.Fatalf("error: %s", err)
+		}
+	})
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(dir)
+		require.NoError(err)
+		require.Equal(os.FileMode(0750), fi.Mode().Perm())
+	}
+	require.NoError(d.Stop())
+
+	// Without CreateDir a missing directory is an error
+	cmd = helperProcess("start-stop", "file")
+	cmd.Dir = filepath.Join(td, "missing")
+	d = &Daemon{Command: cmd, Logger: testLogger}
+	require.Error(d.Start())
+}
+
+func TestDaemonRecentOutput(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	// The process crash loops. Its output goes to the log file and the
+	// most recent lines are kept across restarts.
+	logPath := filepath.Join(td, "proxy.log")
+	d := &Daemon{
+		Command:           helperProcess("exit", "1", "boom"),
+		Logger:            testLogger,
+		LogPath:           logPath,
+		RecentOutputLines: 2,
+	}
+	require.Nil(d.RecentOutput())
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	retry.Run(t, func(r *retry.R) {
+		if d.Stats().Restarts < 2 {
+			r.Fatal("not restarted")
+		}
+	})
+	require.NoError(d.Stop())
+	require.Equal([]string{"boom", "boom"}, d.RecentOutput())
+
+	data, err := ioutil.ReadFile(logPath)
+	require.NoError(err)
+	require.Contains(string(data), "boom\n")
+}
+
+func TestDaemonStart_logRotate(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	// Every run writes a single line and the limit only fits one line per
+	// file, so each restart has to rotate based on what is on disk.
+	logPath := filepath.Join(td, "proxy.log")
+	d := &Daemon{
+		Command:           helperProcess("exit", "1", "crashed"),
+		Logger:            testLogger,
+		LogPath:           logPath,
+		LogMaxBytes:       10,
+		LogMaxFiles:       2,
+		RestartBackoffMin: 10,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(logPath + ".2"); err != nil {
+			r.Fatalf("error: %s", err)
+		}
+	})
+	require.NoError(d.Stop())
+
+	for _, path := range []string{logPath, logPath + ".1", logPath + ".2"} {
+		bs, err := ioutil.ReadFile(path)
+		require.NoError(err)
+		require.Equal("crashed\n", string(bs))
+	}
+	_, err := os.Stat(logPath + ".3")
+	require.True(os.IsNotExist(err), "only LogMaxFiles archives should be kept")
+}
+
+func TestDaemonSetOutput(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	var first, second syncBuffer
+	cmd := helperProcess("tick")
+	cmd.Stdout = &first
+	d := &Daemon{
+		Command: cmd,
+		Logger:  testLogger,
+		LogLineFunc: func(line string, stderr bool) string {
+			return line
+		},
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	retry.Run(t, func(r *retry.R) {
+		if !strings.Contains(first.String(), "tick") {
+			r.Fatal("no output yet")
+		}
+	})
+	d.lock.Lock()
+	pid := d.process.Pid()
+	d.lock.Unlock()
+
+	// The running process switches to the new output
+	oldStdout, _ := d.SetOutput(&second, nil)
+	require.Equal(&first, oldStdout)
+	retry.Run(t, func(r *retry.R) {
+		if !strings.Contains(second.String(), "tick") {
+			r.Fatal("no output yet")
+		}
+	})
+	require.Contains(second.String(), fmt.Sprintf("%d tick", pid))
+}
+
+func TestDaemonRestart_drainsOutputFirst(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	var lock sync.Mutex
+	var lines []string
+	d := &Daemon{
+		Command:    helperProcess("lines", "3"),
+		ProxyToken: "hello",
+		Logger:     testLogger,
+		LogLineFunc: func(line string, isStderr bool) string {
+			// Be slow so that without ordering the next generation
+			// would start while we're still draining.
+			time.Sleep(50 * time.Millisecond)
+
+			lock.Lock()
+			defer lock.Unlock()
+			lines = append(lines, line)
+			return ""
+		},
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Wait for two generations worth of output
+	var got []string
+	retry.Run(t, func(r *retry.R) {
+		lock.Lock()
+		defer lock.Unlock()
+		if len(lines) < 6 {
+			r.Fatalf("only %d lines", len(lines))
+		}
+		got = append([]string(nil), lines[:6]...)
+	})
+	require.NoError(d.Stop())
+
+	// Lines of each process must be contiguous and in order
+	for gen := 0; gen < 2; gen++ {
+		pid := strings.Fields(got[gen*3])[0]
+		for i := 0; i < 3; i++ {
+			require.Equal(fmt.Sprintf("%s %d", pid, i), got[gen*3+i])
+		}
+	}
+	require.NotEqual(got[0], got[3])
+}
+
+// Verify that a panic in any user-supplied callback doesn't crash the
+// agent and is treated as a failure of that callback.
+func TestDaemon_callbackPanics(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+
+	var stdout syncBuffer
+	cmd := helperProcess("output", path)
+	cmd.Stdout = &stdout
+
+	d := &Daemon{
+		Command:    cmd,
+		ProxyToken: "hello",
+		Logger:     testLogger,
+		ProfileDir: filepath.Join(td, "profiles"),
+		LogLineFunc: func(line string, isStderr bool) string {
+			panic("log line")
+		},
+		ProfileFunc: func(ctx context.Context, pid int) ([]byte, error) {
+			panic("profile")
+		},
+		DeregisterFunc: func(ctx context.Context) error {
+			panic("deregister")
+		},
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// The process writes its output (which panics) and then the file
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if err == nil {
+			return
+		}
+
+		r.Fatalf("error: %s", err)
+	})
+	require.Empty(stdout.String())
+
+	_, err := d.CaptureProfile()
+	require.Error(err)
+	require.Contains(err.Error(), "panic")
+
+	require.NoError(d.Stop())
+}
+
+func TestDaemon_orphans(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("process group enumeration is only supported on Linux")
+	}
+	t.Parallel()
+
+	t.Run("no orphans", func(t *testing.T) {
+		require := require.New(t)
+		td, closer := testTempDir(t)
+		defer closer()
+
+		path := filepath.Join(td, "file")
+		d := &Daemon{
+			Command:    helperProcess("start-stop", path),
+			ProxyToken: "hello",
+			Logger:     testLogger,
+		}
+		require.NoError(d.Start())
+		defer d.Stop()
+
+		retry.Run(t, func(r *retry.R) {
+			if len(TestDaemonOrphans(t, d)) == 0 {
+				r.Fatal("daemon process should be running")
+			}
+		})
+
+		require.NoError(d.Stop())
+		retry.Run(t, func(r *retry.R) {
+			if pids := TestDaemonOrphans(t, d); len(pids) > 0 {
+				r.Fatalf("orphans: %v", pids)
+			}
+		})
+	})
+
+	t.Run("orphaned grandchild", func(t *testing.T) {
+		require := require.New(t)
+		td, closer := testTempDir(t)
+		defer closer()
+
+		// The grandchild ignores the stop signal sent to the process group
+		// and survives the daemon process exiting.
+		path := filepath.Join(td, "file")
+		d := &Daemon{
+			Command:    helperProcess("spawn-child", "stop-kill", path),
+			ProxyToken: "hello",
+			Logger:     testLogger,
+		}
+		require.NoError(d.Start())
+		defer d.Stop()
+
+		// Wait for the grandchild to be running
+		retry.Run(t, func(r *retry.R) {
+			_, err := os.Stat(path)
+			if err == nil {
+				return
+			}
+
+			r.Fatalf("error: %s", err)
+		})
+
+		require.NoError(d.Stop())
+
+		// The grandchild survives the daemon process
+		var pids []int
+		retry.Run(t, func(r *retry.R) {
+			pids = TestDaemonOrphans(t, d)
+			if len(pids) != 1 {
+				r.Fatalf("expected one orphan: %v", pids)
+			}
+		})
+
+		proc, err := os.FindProcess(pids[0])
+		require.NoError(err)
+		require.NoError(proc.Kill())
+	})
+}
+
 func TestDaemonRestart(t *testing.T) {
 	t.Parallel()
 
 	require := require.New(t)
 	td, closer := testTempDir(t)
 	defer closer()
-	path := filepath.Join(td, "file")
+	path := filepath.Join(td, "file")
+
+	d := &Daemon{
+		Command: helperProcess("restart", path),
+		Logger:  testLogger,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Wait for the file to exist. We save the func so we can reuse the test.
+	waitFile := func() {
+		retry.Run(t, func(r *retry.R) {
+			_, err := os.Stat(path)
+			if err == nil {
+				return
+			}
+			r.Fatalf("error waiting for path: %s", err)
+		})
+	}
+	waitFile()
+
+	// Delete the file
+	require.NoError(os.Remove(path))
+
+	// File should re-appear because the process is restart
+	waitFile()
+}
+
+func TestDaemonRecentRestarts(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+	path := filepath.Join(td, "file")
+
+	d := &Daemon{
+		Command: helperProcess("restart", path),
+		Logger:  testLogger,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	waitFile := func() {
+		retry.Run(t, func(r *retry.R) {
+			_, err := os.Stat(path)
+			if err == nil {
+				return
+			}
+			r.Fatalf("error waiting for path: %s", err)
+		})
+	}
+	waitFile()
+
+	// The first start isn't a restart
+	require.Equal(0, d.RecentRestarts(time.Minute))
+
+	// Delete the file to make the process exit and restart
+	require.NoError(os.Remove(path))
+	waitFile()
+
+	retry.Run(t, func(r *retry.R) {
+		if n := d.RecentRestarts(time.Minute); n != 1 {
+			r.Fatalf("expected 1 restart, got %d", n)
+		}
+	})
+
+	// Restarts outside of the window aren't counted
+	require.Equal(0, d.RecentRestarts(0))
+}
+
+func TestDaemonRecordRestart_window(t *testing.T) {
+	t.Parallel()
+
+	d := &Daemon{FlapWindow: time.Minute}
+	now := time.Now()
+	require.Equal(t, 1, d.recordRestart(now.Add(-2*time.Minute)))
+
+	// The first restart falls out of the window
+	require.Equal(t, 1, d.recordRestart(now.Add(-30*time.Second)))
+	require.Equal(t, 2, d.recordRestart(now))
+	require.Len(t, d.restartTimes, 2)
+}
+
+func TestDaemonRestart_explicit(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	pidPath := filepath.Join(td, "pid")
+
+	// The stop signal is also terminal to make sure a restart we asked for
+	// isn't mistaken for an external shutdown.
+	d := &Daemon{
+		Command:         helperProcess("start-stop", path),
+		Logger:          testLogger,
+		PidPath:         pidPath,
+		TerminalSignals: []os.Signal{os.Interrupt},
+	}
+	require.Error(d.Restart())
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	readPid := func(r *retry.R) string {
+		bs, err := ioutil.ReadFile(pidPath)
+		if err != nil {
+			r.Fatalf("error: %s", err)
+		}
+		return string(bs)
+	}
+
+	var pid string
+	retry.Run(t, func(r *retry.R) {
+		pid = readPid(r)
+	})
+
+	require.NoError(d.Restart())
+	retry.Run(t, func(r *retry.R) {
+		if newPid := readPid(r); newPid == pid {
+			r.Fatal("not restarted yet")
+		}
+	})
+	require.Equal(LoopExitNone, d.TerminalReason())
+
+	require.NoError(d.Stop())
+	require.Error(d.Restart())
+}
+
+func TestDaemonRestartPolicy(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		Name         string
+		Policy       RestartPolicy
+		SuccessCodes []int
+		ExitCode     string
+		Reason       LoopExitReason
+	}{
+		{"never", RestartNever, nil, "1", LoopExitCompleted},
+		{"on failure, success", RestartOnFailure, nil, "0", LoopExitCompleted},
+		{"on failure, failure", RestartOnFailure, nil, "1", LoopExitMaxRestarts},
+		{"on failure, custom success", RestartOnFailure, []int{0, 143}, "143", LoopExitCompleted},
+		{"on failure, custom failure", RestartOnFailure, []int{143}, "0", LoopExitMaxRestarts},
+		{"always", RestartAlways, nil, "0", LoopExitMaxRestarts},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			require := require.New(t)
+			events := make(chan DaemonEvent, 100)
+			d := &Daemon{
+				Command:           helperProcess("exit", tc.ExitCode),
+				Logger:            testLogger,
+				RestartPolicy:     tc.Policy,
+				SuccessExitCodes:  tc.SuccessCodes,
+				MaxRestarts:       1,
+				RestartBackoffMin: 10,
+				Events:            events,
+			}
+			require.NoError(d.Start())
+			defer d.Stop()
+			require.NoError(d.WaitForExit(context.Background()))
+			require.Equal(tc.Reason, d.TerminalReason())
+			require.Equal(tc.Reason != LoopExitCompleted, d.Stats().Failed())
+
+			var last DaemonEvent
+			for len(events) > 0 {
+				last = <-events
+			}
+			if tc.Reason == LoopExitCompleted {
+				require.Equal(DaemonEventCompleted, last.Type)
+				code, _ := strconv.Atoi(tc.ExitCode)
+				require.Equal(code, last.ExitCode)
+				require.Equal(uint32(1), last.Attempt)
+			} else {
+				require.Equal(DaemonEventFailed, last.Type)
+			}
+		})
+	}
+
+	// Unknown policies are rejected
+	d := &Daemon{
+		Command:       helperProcess("exit", "0"),
+		Logger:        testLogger,
+		RestartPolicy: "sometimes",
+	}
+	require.Error(t, d.Start())
+
+	// Signals and unknown exit codes are never a success
+	d = &Daemon{SuccessExitCodes: []int{0, 143}}
+	require.True(t, d.successfulExit(143, nil))
+	require.False(t, d.successfulExit(-1, nil))
+	require.False(t, d.successfulExit(0, fmt.Errorf("terminated by signal: terminated")))
+}
+
+func TestDaemonReady(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	// The proxy is ready once the file exists
+	path := filepath.Join(td, "file")
+	events := make(chan DaemonEvent, 10)
+	d := &Daemon{
+		Command: helperProcess("start-stop", path),
+		Logger:  testLogger,
+		Events:  events,
+		ReadyCheck: func(ctx context.Context) error {
+			_, err := os.Stat(path)
+			return err
+		},
+	}
+	require.False(d.Ready())
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	retry.Run(t, func(r *retry.R) {
+		if !d.Ready() {
+			r.Fatal("not ready")
+		}
+	})
+	_, err := os.Stat(path)
+	require.NoError(err)
+
+	var types []DaemonEventType
+	for len(events) > 0 {
+		if e := <-events; e.Type != DaemonEventStateChanged {
+			types = append(types, e.Type)
+		}
+	}
+	require.Equal([]DaemonEventType{DaemonEventStarted, DaemonEventReady}, types)
+
+	require.NoError(d.Stop())
+	require.False(d.Ready())
+}
+
+func TestDaemonReady_timeout(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	calls := int32(0)
+	d := &Daemon{
+		Command: helperProcess("start-stop", filepath.Join(td, "file")),
+		Logger:  testLogger,
+		ReadyCheck: func(ctx context.Context) error {
+			atomic.AddInt32(&calls, 1)
+			return fmt.Errorf("not listening")
+		},
+		ReadyTimeout: 200 * time.Millisecond,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// The check is retried until the timeout and then given up on
+	retry.Run(t, func(r *retry.R) {
+		if atomic.LoadInt32(&calls) < 2 {
+			r.Fatal("not retried")
+		}
+	})
+	time.Sleep(300 * time.Millisecond)
+	n := atomic.LoadInt32(&calls)
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(n, atomic.LoadInt32(&calls))
+	require.False(d.Ready())
+}
+
+func TestDaemonRestart_healthCheck(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	pidPath := filepath.Join(td, "pid")
+
+	var unhealthy int32
+	d := &Daemon{
+		Command: helperProcess("start-stop", path),
+		Logger:  testLogger,
+		PidPath: pidPath,
+		HealthCheck: func() error {
+			if atomic.LoadInt32(&unhealthy) == 1 {
+				return fmt.Errorf("wedged")
+			}
+			return nil
+		},
+		HealthInterval: 20 * time.Millisecond,
+		HealthFailures: 2,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	var pid []byte
+	retry.Run(t, func(r *retry.R) {
+		var err error
+		if pid, err = ioutil.ReadFile(pidPath); err != nil {
+			r.Fatalf("error: %s", err)
+		}
+	})
+
+	// Passing checks make the process count as healthy right away
+	retry.Run(t, func(r *retry.R) {
+		if d.BackoffState().Deadline.After(time.Now()) {
+			r.Fatal("not healthy yet")
+		}
+	})
+
+	// Failing checks restart the process
+	atomic.StoreInt32(&unhealthy, 1)
+	retry.Run(t, func(r *retry.R) {
+		newPid, err := ioutil.ReadFile(pidPath)
+		if err != nil {
+			r.Fatalf("error: %s", err)
+		}
+		if string(newPid) == string(pid) {
+			r.Fatal("not restarted yet")
+		}
+	})
+	require.Equal(LoopExitNone, d.TerminalReason())
+	require.NoError(d.Stop())
+}
+
+func TestDaemonStart_tokenFile(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	tokenDir := filepath.Join(td, "tokens")
+	require.NoError(os.Mkdir(tokenDir, 0700))
+
+	path := filepath.Join(td, "file")
+	d := &Daemon{
+		Command:       helperProcess("token", path),
+		ProxyToken:    "hello",
+		Logger:        testLogger,
+		TokenDelivery: TokenDeliveryFile,
+		TokenDir:      tokenDir,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// The token is only in the file
+	retry.Run(t, func(r *retry.R) {
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			r.Fatalf("error: %s", err)
+		}
+		if string(bs) != "\nhello" {
+			r.Fatalf("bad: %q", bs)
+		}
+	})
+
+	files, err := ioutil.ReadDir(tokenDir)
+	require.NoError(err)
+	require.Len(files, 1)
+	require.Equal(os.FileMode(0600), files[0].Mode().Perm())
+
+	// The file is removed once the process exits
+	require.NoError(d.Stop())
+	files, err = ioutil.ReadDir(tokenDir)
+	require.NoError(err)
+	require.Empty(files)
+}
+
+func TestDaemonStart_dryRun(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	logger := &testStructuredLogger{}
+	path := filepath.Join(td, "file")
+	d := &Daemon{
+		Command:          helperProcess("start-stop", path),
+		ProxyID:          "web",
+		ProxyToken:       "secret",
+		StructuredLogger: logger,
+		DryRun:           true,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// The command is logged, without the token
+	e, ok := logger.Find("dry run, not starting proxy")
+	require.True(ok)
+	require.Equal(d.Command.Path, e.Args["path"])
+	require.Equal(d.Command.Args[1:], e.Args["args"])
+	env := e.Args["env"].([]string)
+	require.Contains(env, EnvProxyID+"=web")
+	require.Contains(env, EnvProxyToken+"=<redacted>")
+
+	// Nothing was started
+	time.Sleep(200 * time.Millisecond)
+	_, err := os.Stat(path)
+	require.True(os.IsNotExist(err))
+	require.False(d.Stats().Running)
+
+	// The configuration is still validated
+	d = &Daemon{
+		Command: helperProcess("start-stop", path),
+		Logger:  testLogger,
+		DryRun:  true,
+	}
+	d.Command.Dir = filepath.Join(td, "missing")
+	require.Error(d.Start())
+}
+
+func TestDaemonStart_envFile(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	envPath := filepath.Join(td, "proxy.env")
+	require.NoError(ioutil.WriteFile(envPath, []byte("# proxy env\nFOO=2\nBAR=\"x y\"\n"), 0644))
+
+	path := filepath.Join(td, "file")
+	d := &Daemon{
+		Command: helperProcess("environ", path),
+		Logger:  testLogger,
+		EnvFile: envPath,
+	}
+	d.Command.Env = []string{"FOO=1"}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// The file overrides the command's environment
+	retry.Run(t, func(r *retry.R) {
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			r.Fatalf("error: %s", err)
+		}
+		if string(bs) != "BAR=x y\nFOO=2\n" {
+			r.Fatalf("bad: %q", bs)
+		}
+	})
+
+	// A malformed file is caught by Start
+	require.NoError(ioutil.WriteFile(envPath, []byte("FOO\n"), 0644))
+	d = &Daemon{
+		Command: helperProcess("environ", path),
+		Logger:  testLogger,
+		EnvFile: envPath,
+	}
+	err := d.Start()
+	require.Error(err)
+	require.Contains(err.Error(), "line 1")
+}
+
+func TestDaemonStart_extraFiles(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	extraPath := filepath.Join(td, "extra")
+	require.NoError(ioutil.WriteFile(extraPath, []byte("hello"), 0644))
+	extra, err := os.Open(extraPath)
+	require.NoError(err)
+	defer extra.Close()
+
+	path := filepath.Join(td, "file")
+	d := &Daemon{
+		Command:    helperProcess("extra-file", path),
+		Logger:     testLogger,
+		ExtraFiles: []*os.File{extra},
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	waitFile := func() {
+		retry.Run(t, func(r *retry.R) {
+			bs, err := ioutil.ReadFile(path)
+			if err != nil {
+				r.Fatalf("error: %s", err)
+			}
+			if string(bs) != "hello" {
+				r.Fatalf("bad: %q", bs)
+			}
+		})
+	}
+	waitFile()
+
+	// The restarted process gets the file again
+	require.NoError(os.Remove(path))
+	require.NoError(d.Restart())
+	waitFile()
+	require.Empty(d.Command.ExtraFiles)
+}
+
+// closeCounter is an io.ReadCloser that counts how often it was closed.
+type closeCounter struct {
+	io.Reader
+	closed *int32
+}
+
+func (c closeCounter) Close() error {
+	atomic.AddInt32(c.closed, 1)
+	return nil
+}
+
+func TestDaemonStart_stdinProvider(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	// The first start fails since the provider does, which counts as an
+	// attempt like any other failed start.
+	var calls, closed int32
+	path := filepath.Join(td, "file")
+	d := &Daemon{
+		Command:           helperProcess("stdin", path),
+		Logger:            testLogger,
+		RestartBackoffMin: 10,
+		StdinProvider: func() (io.ReadCloser, error) {
+			n := atomic.AddInt32(&calls, 1)
+			if n == 1 {
+				return nil, fmt.Errorf("not yet")
+			}
+			r := strings.NewReader(fmt.Sprintf("config %d", n))
+			return closeCounter{r, &closed}, nil
+		},
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	waitFile := func(expected string) {
+		retry.Run(t, func(r *retry.R) {
+			bs, err := ioutil.ReadFile(path)
+			if err != nil {
+				r.Fatalf("error: %s", err)
+			}
+			if string(bs) != expected {
+				r.Fatalf("bad: %q", bs)
+			}
+		})
+	}
+	waitFile("config 2")
+	require.Equal(uint32(2), d.BackoffState().Attempts)
+
+	// The restarted process gets a fresh reader and the old one is closed
+	require.NoError(os.Remove(path))
+	require.NoError(d.Restart())
+	waitFile("config 3")
+	retry.Run(t, func(r *retry.R) {
+		if n := atomic.LoadInt32(&closed); n != 2 {
+			r.Fatalf("closed %d readers", n)
+		}
+	})
+}
+
+func TestDaemonSetProxyToken(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	d := &Daemon{
+		Command:       helperProcess("token-reload", path),
+		ProxyToken:    "hello",
+		Logger:        testLogger,
+		TokenDelivery: TokenDeliveryFile,
+		TokenDir:      td,
+	}
+
+	// Before starting this only changes the token to start with
+	require.NoError(d.SetProxyToken("first"))
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	readToken := func(want string) {
+		retry.Run(t, func(r *retry.R) {
+			bs, err := ioutil.ReadFile(path)
+			if err != nil {
+				r.Fatalf("error: %s", err)
+			}
+			if string(bs) != want {
+				r.Fatalf("bad: %q", bs)
+			}
+		})
+	}
+	readToken("first")
+	pid := d.Stats().PID
+
+	// The running process rereads the new token without restarting
+	require.NoError(d.SetProxyToken("second"))
+	readToken("second")
+	require.Equal(pid, d.Stats().PID)
+	require.Equal(uint64(0), d.Stats().Restarts)
+}
+
+func TestDaemonStart_user(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	// An unknown user is caught by Start
+	d := &Daemon{
+		Command: helperProcess("start-stop", filepath.Join(td, "file")),
+		Logger:  testLogger,
+		User:    "no-such-user-consul",
+	}
+	err := d.Start()
+	require.Error(err)
+	require.Contains(err.Error(), "unknown user")
+
+	// Running as ourselves is always allowed
+	path := filepath.Join(td, "file")
+	d = &Daemon{
+		Command: helperProcess("start-stop", path),
+		Logger:  testLogger,
+		User:    strconv.Itoa(os.Getuid()),
+		Group:   strconv.Itoa(os.Getgid()),
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(path); err != nil {
+			r.Fatalf("error: %s", err)
+		}
+	})
+}
+
+func TestDaemonRestart_draining(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+	path := filepath.Join(td, "file")
+
+	d := &Daemon{
+		Command: helperProcess("restart", path),
+		Logger:  testLogger,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if err == nil {
+			return
+		}
+		r.Fatalf("error waiting for path: %s", err)
+	})
+
+	// Drain and then make the process exit. It shouldn't be restarted.
+	d.setDraining()
+	require.NoError(os.Remove(path))
+
+	select {
+	case <-d.exitedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervision loop should have exited")
+	}
+	require.Equal(LoopExitShutdown, d.TerminalReason())
+
+	_, err := os.Stat(path)
+	require.True(os.IsNotExist(err), "process should not be restarted")
+}
+
+func TestDaemonBackoffState(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+	path := filepath.Join(td, "file")
+
+	d := &Daemon{
+		Command: helperProcess("restart", path),
+		Logger:  testLogger,
+	}
+	require.Equal(BackoffState{}, d.BackoffState())
+
+	// Invalid states are rejected
+	require.Error(d.SetBackoffState(BackoffState{Attempts: 1 << 31}))
+	require.Error(d.SetBackoffState(BackoffState{
+		Deadline: time.Now().Add(24 * time.Hour),
+	}))
+
+	// Restore a state that is already past the backoff minimum
+	require.NoError(d.SetBackoffState(BackoffState{
+		Attempts: DaemonRestartBackoffMin,
+	}))
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// The first start counts on top of the restored attempts rather than
+	// starting from zero, so it waits out a backoff first.
+	retry.Run(t, func(r *retry.R) {
+		s := d.BackoffState()
+		if s.Attempts != DaemonRestartBackoffMin+1 {
+			r.Fatalf("bad attempts: %d", s.Attempts)
+		}
+		if s.NextStartAt.IsZero() {
+			r.Fatal("next start time should be set")
+		}
+		if s.NextStartAt.After(time.Now().Add(2 * time.Second)) {
+			r.Fatalf("bad next start time: %s", s.NextStartAt)
+		}
+	})
+
+	reason, eta := d.StartBlockedReason()
+	require.Equal(StartBlockedBackoff, reason)
+	require.False(eta.IsZero())
+
+	// Once started, there is no next start time
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(path); err != nil {
+			r.Fatalf("error: %s", err)
+		}
+	})
+	require.True(d.BackoffState().NextStartAt.IsZero())
+	reason, _ = d.StartBlockedReason()
+	require.Equal(StartBlockedNone, reason)
+}
+
+func TestDaemonBackoffState_restartSettings(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	d := &Daemon{
+		Command:           helperProcess("exit", "1"),
+		Logger:            testLogger,
+		RestartHealthy:    30 * time.Second,
+		RestartBackoffMin: 1,
+		RestartMaxWait:    500 * time.Millisecond,
+	}
+
+	// The healthy window bounds restored deadlines
+	require.NoError(d.SetBackoffState(BackoffState{
+		Deadline: time.Now().Add(20 * time.Second),
+	}))
+	require.Error(d.SetBackoffState(BackoffState{Attempts: 33}))
+	require.NoError(d.SetBackoffState(BackoffState{}))
+
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Backoff starts after the first attempt and is capped by the max wait
+	retry.Run(t, func(r *retry.R) {
+		s := d.BackoffState()
+		if s.NextStartAt.IsZero() {
+			r.Fatal("should be waiting to restart")
+		}
+		if s.Attempts < 2 {
+			r.Fatalf("bad attempts: %d", s.Attempts)
+		}
+		if s.NextStartAt.After(time.Now().Add(500 * time.Millisecond)) {
+			r.Fatalf("bad next start time: %s", s.NextStartAt)
+		}
+	})
+}
+
+func TestDaemon_tracer(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+	path := filepath.Join(td, "file")
+
+	tracer := &testTracer{}
+	d := &Daemon{
+		Command: helperProcess("restart", path),
+		ProxyID: "web-proxy",
+		Logger:  testLogger,
+		Tracer:  tracer,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	waitFile := func() {
+		retry.Run(t, func(r *retry.R) {
+			_, err := os.Stat(path)
+			if err == nil {
+				return
+			}
+			r.Fatalf("error waiting for path: %s", err)
+		})
+	}
+	waitFile()
+
+	// Make the process exit cleanly so it is restarted
+	require.NoError(os.Remove(path))
+	waitFile()
+	retry.Run(t, func(r *retry.R) {
+		if n := len(tracer.Spans()); n < 2 {
+			r.Fatalf("expected 2 spans, got %d", n)
+		}
+	})
+
+	require.NoError(d.Stop())
+
+	spans := tracer.Spans()
+	require.Len(spans, 3)
+	require.Equal("proxy.daemon.start", spans[0].Name)
+	require.Equal("proxy.daemon.restart", spans[1].Name)
+	require.Equal("proxy.daemon.stop", spans[2].Name)
+	for _, s := range spans {
+		require.True(s.Ended)
+		require.NoError(s.Err)
+		require.Equal("web-proxy", s.Attrs["proxy_id"])
+		require.NotZero(s.Attrs["pid"])
+	}
+	require.Equal(0, spans[1].Attrs["exit_code"])
+	require.Equal(uint32(2), spans[1].Attrs["attempt"])
+}
+
+func TestDaemon_exitInterpreter(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	// Pretend the process is a wrapper that offsets the exit code of the
+	// real proxy by 40.
+	tracer := &testTracer{}
+	d := &Daemon{
+		Command: helperProcess("exit", "42"),
+		Logger:  testLogger,
+		Tracer:  tracer,
+		ExitInterpreter: func(ps *os.ProcessState) (int, bool, error) {
+			status, ok := exitStatus(ps)
+			if !ok {
+				return -1, false, fmt.Errorf("no exit status")
+			}
+			return status - 40, false, nil
+		},
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// The restart is traced with the interpreted exit code
+	retry.Run(t, func(r *retry.R) {
+		for _, s := range tracer.Spans() {
+			if s.Name == "proxy.daemon.restart" {
+				return
+			}
+		}
+		r.Fatal("no restart yet")
+	})
+	require.NoError(d.Stop())
+
+	for _, s := range tracer.Spans() {
+		if s.Name == "proxy.daemon.restart" {
+			require.Equal(2, s.Attrs["exit_code"])
+		}
+	}
+}
+
+func TestDaemonJitter(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	d := &Daemon{}
+	require.Equal(time.Duration(0), d.jitter(0))
+	for i := 0; i < 100; i++ {
+		wait := d.jitter(8 * time.Second)
+		require.True(wait >= 4*time.Second && wait <= 8*time.Second, "bad wait: %s", wait)
+	}
+
+	d.stagger = func(d time.Duration) time.Duration { return d / 2 }
+	require.Equal(6*time.Second, d.jitter(8*time.Second))
+}
+
+func TestDaemonLastExit(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	d := &Daemon{
+		Command: helperProcess("exit", "127"),
+		Logger:  testLogger,
+	}
+	_, _, ok := d.LastExit()
+	require.False(ok)
+
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	retry.Run(t, func(r *retry.R) {
+		if _, _, ok := d.LastExit(); !ok {
+			r.Fatal("no exit yet")
+		}
+	})
+
+	// Check before stopping since Stop interrupts any restarted process
+	code, err, ok := d.LastExit()
+	require.True(ok)
+	require.NoError(err)
+	require.Equal(127, code)
+}
+
+func TestDaemonRepeatedExit(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	repeated := func(events chan DaemonEvent) []DaemonEvent {
+		var result []DaemonEvent
+		for len(events) > 0 {
+			if e := <-events; e.Type == DaemonEventRepeatedExit {
+				result = append(result, e)
+			}
+		}
+		return result
+	}
+
+	// The event is only published once the threshold is reached, and the
+	// process keeps being restarted
+	events := make(chan DaemonEvent, 100)
+	d := &Daemon{
+		Command:               helperProcess("exit", "1"),
+		Logger:                testLogger,
+		Events:                events,
+		RestartBackoffMin:     10,
+		RepeatedExitThreshold: 2,
+	}
+	require.NoError(d.Start())
+	retry.Run(t, func(r *retry.R) {
+		if n := d.Stats().Restarts; n < 4 {
+			r.Fatalf("only %d restarts", n)
+		}
+	})
+	require.NoError(d.Stop())
+	e := repeated(events)
+	require.Len(e, 1)
+	require.Equal(1, e[0].ExitCode)
+	require.Equal(uint(2), e[0].RepeatedExits)
+
+	// With StopOnRepeatedExit the process is given up on
+	events = make(chan DaemonEvent, 100)
+	d = &Daemon{
+		Command:               helperProcess("exit", "1"),
+		Logger:                testLogger,
+		Events:                events,
+		RestartBackoffMin:     10,
+		RepeatedExitThreshold: 3,
+		StopOnRepeatedExit:    true,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+	require.NoError(d.WaitForExit(context.Background()))
+	require.Equal(LoopExitRepeatedExit, d.TerminalReason())
+	require.True(d.Stats().Failed())
+	require.Len(d.ExitHistory(), 3)
+	require.Len(repeated(events), 1)
+}
+
+func TestDaemonExitHistory(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	d := &Daemon{
+		Command:           helperProcess("exit", "127"),
+		Logger:            testLogger,
+		RestartBackoffMin: 10,
+		ExitHistorySize:   2,
+	}
+	require.Empty(d.ExitHistory())
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	retry.Run(t, func(r *retry.R) {
+		if n := d.Stats().Restarts; n < 3 {
+			r.Fatalf("only %d restarts", n)
+		}
+	})
+
+	// Only the most recent exits are kept, oldest first
+	history := d.ExitHistory()
+	require.Len(history, 2)
+	for _, e := range history {
+		require.Equal(127, e.ExitCode)
+		require.Nil(e.Signal)
+		require.NoError(e.Err)
+		require.NotZero(e.PID)
+		require.True(e.Runtime > 0)
+	}
+	require.True(history[0].Attempt >= 2)
+	require.Equal(history[0].Attempt+1, history[1].Attempt)
+	require.False(history[1].Time.Before(history[0].Time))
+
+	// The result is a copy
+	history[0].ExitCode = 0
+	require.Equal(127, d.ExitHistory()[0].ExitCode)
+}
+
+func TestDaemonStats(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
 
 	d := &Daemon{
-		Command: helperProcess("restart", path),
+		Command: helperProcess("start-stop", filepath.Join(td, "file")),
 		Logger:  testLogger,
 	}
+	require.Equal(DaemonStats{}, d.Stats())
+	require.False(d.Running())
+
+	start := time.Now()
 	require.NoError(d.Start())
 	defer d.Stop()
 
-	// Wait for the file to exist. We save the func so we can reuse the test.
-	waitFile := func() {
+	var stats DaemonStats
+	retry.Run(t, func(r *retry.R) {
+		if stats = d.Stats(); !stats.Running {
+			r.Fatal("not running")
+		}
+	})
+	require.NotZero(stats.PID)
+	require.True(d.Running())
+	require.Equal(uint64(0), stats.Restarts)
+	require.False(stats.LastStart.Before(start))
+	require.False(stats.Failed())
+
+	// A restart is counted and the new process shows up
+	require.NoError(d.Restart())
+	retry.Run(t, func(r *retry.R) {
+		s := d.Stats()
+		if !s.Running || s.Restarts != 1 {
+			r.Fatalf("not restarted: %#v", s)
+		}
+		if s.PID == stats.PID {
+			r.Fatal("same pid")
+		}
+		if !s.LastStart.After(stats.LastStart) {
+			r.Fatal("last start not updated")
+		}
+	})
+
+	require.NoError(d.Stop())
+	stats = d.Stats()
+	require.False(stats.Running)
+	require.False(d.Running())
+	require.Zero(stats.PID)
+	require.True(stats.Stopped)
+	require.Equal(LoopExitStopped, stats.TerminalReason)
+	require.False(stats.Failed())
+}
+
+func TestDaemonEvents(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	events := make(chan DaemonEvent, 100)
+	d := &Daemon{
+		Command:           helperProcess("exit", "1"),
+		ProxyID:           "tubes",
+		Logger:            testLogger,
+		Events:            events,
+		RestartBackoffMin: 2,
+		stagger:           func(d time.Duration) time.Duration { return d },
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Wait until the restart is delayed by the backoff. State changes are
+	// covered by TestDaemon_clockState.
+	var got []DaemonEvent
+	timeout := time.After(10 * time.Second)
+	for len(got) == 0 || got[len(got)-1].Type != DaemonEventBackingOff {
+		select {
+		case e := <-events:
+			if e.Type != DaemonEventStateChanged {
+				got = append(got, e)
+			}
+		case <-timeout:
+			t.Fatalf("no backoff: %v", got)
+		}
+	}
+	require.NoError(d.Stop())
+
+	var types []DaemonEventType
+	for _, e := range got {
+		types = append(types, e.Type)
+		require.Equal("tubes", e.ProxyID)
+		require.False(e.Time.IsZero())
+	}
+	require.Equal([]DaemonEventType{
+		DaemonEventStarted,
+		DaemonEventExited,
+		DaemonEventRestarting,
+		DaemonEventStarted,
+		DaemonEventExited,
+		DaemonEventBackingOff,
+	}, types)
+
+	require.NotZero(got[0].PID)
+	require.Equal(uint32(1), got[0].Attempt)
+	require.Equal(got[0].PID, got[1].PID)
+	require.Equal(1, got[1].ExitCode)
+	require.Equal(uint32(2), got[3].Attempt)
+	require.Equal(uint32(3), got[5].Attempt)
+	require.Equal(2*time.Second, got[5].Wait)
+
+	// Stopping while backing off is published too
+	for {
+		select {
+		case e := <-events:
+			if e.Type == DaemonEventStateChanged {
+				continue
+			}
+			require.Equal(DaemonEventStopped, e.Type)
+			require.Zero(e.PID)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no stop event")
+		}
+		break
+	}
+}
+
+func TestDaemonRestart_maxRestarts(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	events := make(chan DaemonEvent, 100)
+	d := &Daemon{
+		Command:           helperProcess("exit", "1"),
+		Logger:            testLogger,
+		Events:            events,
+		MaxRestarts:       2,
+		RestartBackoffMin: 10,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	select {
+	case <-d.exitedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon should give up")
+	}
+	require.Equal(LoopExitMaxRestarts, d.TerminalReason())
+	reason, _ := d.StartBlockedReason()
+	require.Equal(StartBlockedLoopExited, reason)
+
+	// The initial start and two restarts
+	starts := 0
+	for len(events) > 0 {
+		if e := <-events; e.Type == DaemonEventStarted {
+			starts++
+		}
+	}
+	require.Equal(3, starts)
+}
+
+// This test isn't parallel since it replaces the global metrics sink.
+func TestDaemonMetrics(t *testing.T) {
+	require := require.New(t)
+
+	conf := metrics.DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	_, err := metrics.NewGlobal(conf, sink)
+	require.NoError(err)
+	defer metrics.NewGlobal(conf, &metrics.BlackholeSink{})
+
+	d := &Daemon{
+		Command:           helperProcess("exit", "1"),
+		ProxyID:           "web-proxy",
+		Logger:            testLogger,
+		MetricLabels:      []metrics.Label{{Name: "service", Value: "web"}},
+		MaxRestarts:       2,
+		RestartBackoffMin: 2,
+		RestartMaxWait:    100 * time.Millisecond,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	select {
+	case <-d.exitedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon should give up")
+	}
+
+	// Metrics may straddle an interval boundary so combine all of them
+	counters := make(map[string]int)
+	samples := make(map[string]int)
+	gauges := make(map[string]float32)
+	for _, intv := range sink.Data() {
+		intv.RLock()
+		for k, v := range intv.Counters {
+			counters[k] += v.Count
+		}
+		for k, v := range intv.Samples {
+			samples[k] += v.Count
+		}
+		for k, v := range intv.Gauges {
+			gauges[k] = v.Value
+		}
+		intv.RUnlock()
+	}
+
+	suffix := ";proxy_id=web-proxy;service=web"
+
+	// The initial start and two restarts, which each exited
+	require.Equal(2, counters["agent.proxy.daemon.restart"+suffix], "%v", counters)
+	require.Equal(3, samples["agent.proxy.daemon.uptime"+suffix], "%v", samples)
+	require.Equal(float32(2), gauges["agent.proxy.daemon.recent_restarts"+suffix], "%v", gauges)
+	require.Equal(float32(2), gauges["agent.proxy.daemon.total_restarts"+suffix], "%v", gauges)
+
+	// The last restart backed off and the gauge was reset afterwards
+	backoff, ok := gauges["agent.proxy.daemon.backoff_wait"+suffix]
+	require.True(ok, "%v", gauges)
+	require.Equal(float32(0), backoff)
+}
+
+func TestDaemonHeartbeat(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	pidPath := filepath.Join(td, "pid")
+	heartbeatPath := filepath.Join(td, "heartbeat")
+
+	d := &Daemon{
+		Command:          helperProcess("restart", path),
+		Logger:           testLogger,
+		PidPath:          pidPath,
+		HeartbeatFile:    heartbeatPath,
+		HeartbeatTimeout: 200 * time.Millisecond,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	readPid := func() string {
+		var pid string
 		retry.Run(t, func(r *retry.R) {
-			_, err := os.Stat(path)
-			if err == nil {
-				return
+			bs, err := ioutil.ReadFile(pidPath)
+			if err != nil {
+				r.Fatalf("error: %s", err)
 			}
-			r.Fatalf("error waiting for path: %s", err)
+			pid = string(bs)
+		})
+		return pid
+	}
+	pid := readPid()
+
+	// Keep the heartbeat going on behalf of the process for a while. It
+	// shouldn't be killed in the meantime.
+	for i := 0; i < 10; i++ {
+		now := time.Now()
+		require.NoError(ioutil.WriteFile(heartbeatPath, nil, 0644))
+		require.NoError(os.Chtimes(heartbeatPath, now, now))
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.Equal(pid, readPid())
+
+	// Once the heartbeat stops the process is killed and restarted
+	retry.Run(t, func(r *retry.R) {
+		bs, err := ioutil.ReadFile(pidPath)
+		if err != nil {
+			r.Fatalf("error: %s", err)
+		}
+		if string(bs) == pid {
+			r.Fatal("process should have been restarted")
+		}
+	})
+}
+
+func TestDaemonHeartbeat_profile(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	pidPath := filepath.Join(td, "pid")
+	heartbeatPath := filepath.Join(td, "heartbeat")
+	profileDir := filepath.Join(td, "profiles")
+
+	d := &Daemon{
+		Command:          helperProcess("restart", path),
+		ProxyID:          "web-proxy",
+		Logger:           testLogger,
+		PidPath:          pidPath,
+		HeartbeatFile:    heartbeatPath,
+		HeartbeatTimeout: 200 * time.Millisecond,
+		ProfileDir:       profileDir,
+		ProfileFunc: func(ctx context.Context, pid int) ([]byte, error) {
+			return []byte("profile"), nil
+		},
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	var pid string
+	retry.Run(t, func(r *retry.R) {
+		bs, err := ioutil.ReadFile(pidPath)
+		if err != nil {
+			r.Fatalf("error: %s", err)
+		}
+		pid = string(bs)
+	})
+
+	// The heartbeat is never written, so the process is killed and
+	// restarted, with a profile of it captured first.
+	retry.Run(t, func(r *retry.R) {
+		bs, err := ioutil.ReadFile(pidPath)
+		if err != nil {
+			r.Fatalf("error: %s", err)
+		}
+		if string(bs) == pid {
+			r.Fatal("process should have been restarted")
+		}
+	})
+
+	matches, err := filepath.Glob(filepath.Join(profileDir, "web-proxy-"+pid+"-*.prof"))
+	require.NoError(err)
+	require.Len(matches, 1)
+	data, err := ioutil.ReadFile(matches[0])
+	require.NoError(err)
+	require.Equal("profile", string(data))
+}
+
+func TestDaemonRestart_certExpiry(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	pidPath := filepath.Join(td, "pid")
+
+	// The first process gets a certificate that is about to expire, the
+	// restarted one gets a fresh one.
+	var lock sync.Mutex
+	calls := 0
+	d := &Daemon{
+		Command:        helperProcess("restart", path),
+		Logger:         testLogger,
+		PidPath:        pidPath,
+		CertExpiryLead: time.Minute,
+		CertExpiry: func() time.Time {
+			lock.Lock()
+			defer lock.Unlock()
+			calls++
+			if calls == 1 {
+				return time.Now().Add(time.Minute + 200*time.Millisecond)
+			}
+			return time.Now().Add(24 * time.Hour)
+		},
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	readPid := func(r *retry.R) string {
+		bs, err := ioutil.ReadFile(pidPath)
+		if err != nil {
+			r.Fatalf("error: %s", err)
+		}
+		return string(bs)
+	}
+	var pid string
+	retry.Run(t, func(r *retry.R) { pid = readPid(r) })
+
+	// The process is restarted before the certificate expires
+	retry.Run(t, func(r *retry.R) {
+		if readPid(r) == pid {
+			r.Fatal("process should have been restarted")
+		}
+	})
+
+	// The restarted process isn't restarted again
+	retry.Run(t, func(r *retry.R) {
+		lock.Lock()
+		defer lock.Unlock()
+		if calls != 2 {
+			r.Fatalf("bad calls: %d", calls)
+		}
+	})
+}
+
+func TestDaemonStop_stopSignal(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+
+	// The process ignores interrupts, so only SIGTERM stops it before the
+	// graceful wait is up.
+	d := &Daemon{
+		Command:      helperProcess("stop-kill", path),
+		ProxyToken:   "hello",
+		Logger:       testLogger,
+		StopSignal:   syscall.SIGTERM,
+		GracefulWait: 10 * time.Second,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Wait for the file to exist
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if err == nil {
+			return
+		}
+
+		r.Fatalf("error: %s", err)
+	})
+
+	start := time.Now()
+	require.NoError(d.Stop())
+	require.True(time.Since(start) < 5*time.Second, "process should stop on SIGTERM")
+}
+
+// This is mostly useful under the race detector: starting, inspecting and
+// stopping a daemon concurrently must not race on the supervised process.
+func TestDaemonStartStop_concurrent(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	for i := 0; i < 5; i++ {
+		path := filepath.Join(td, fmt.Sprintf("file-%d", i))
+		d := &Daemon{
+			Command:      helperProcess("start-stop", path),
+			ProxyToken:   "hello",
+			Logger:       testLogger,
+			GracefulWait: 2 * time.Second,
+		}
+		other := &Daemon{Command: helperProcess("start-stop", path)}
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		run := func(f func()) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				f()
+			}()
+		}
+
+		run(func() { d.Start() })
+		run(func() { d.Start() })
+		run(func() { d.Restart() })
+		run(func() { d.Equal(other) })
+		run(func() { d.MarshalSnapshot() })
+		run(func() { d.Stats() })
+		run(func() { d.Ready() })
+		run(func() {
+			// Give the process a chance to start so Stop has something to
+			// stop, but don't wait for it.
+			time.Sleep(time.Duration(i) * 10 * time.Millisecond)
+			d.Stop()
 		})
+
+		close(start)
+		wg.Wait()
+
+		// Whatever the interleaving, the daemon ends up stopped for good
+		require.NoError(d.Stop())
+		require.False(d.Stats().Running)
+		require.Error(d.Start())
+	}
+}
+
+func TestDaemonStop_stopSequence(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+
+	// The process ignores interrupts, so the sequence has to escalate to
+	// SIGTERM to stop it before the kill.
+	d := &Daemon{
+		Command: helperProcess("stop-kill", path),
+		Logger:  testLogger,
+		StopSequence: []StopStep{
+			{Signal: os.Interrupt, Wait: 200 * time.Millisecond},
+			{Signal: syscall.SIGTERM, Wait: 10 * time.Second},
+		},
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(path); err != nil {
+			r.Fatalf("error: %s", err)
+		}
+	})
+
+	start := time.Now()
+	require.NoError(d.Stop())
+	elapsed := time.Since(start)
+	require.True(elapsed >= 200*time.Millisecond, "interrupt should be tried first")
+	require.True(elapsed < 5*time.Second, "process should stop on SIGTERM")
+}
+
+func TestDaemonStop_processGroup(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	// The grandchild removes the file when it gets the stop signal
+	path := filepath.Join(td, "file")
+	d := &Daemon{
+		Command: helperProcess("spawn-child", "start-stop", path),
+		Logger:  testLogger,
 	}
-	waitFile()
+	require.NoError(d.Start())
+	defer d.Stop()
 
-	// Delete the file
-	require.NoError(os.Remove(path))
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(path); err != nil {
+			r.Fatalf("error: %s", err)
+		}
+	})
 
-	// File should re-appear because the process is restart
-	waitFile()
+	require.NoError(d.Stop())
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			r.Fatalf("should not exist: %s", err)
+		}
+	})
 }
 
-func TestDaemonLaunchesNewProcessGroup(t *testing.T) {
+func TestDaemonStop_kill(t *testing.T) {
 	t.Parallel()
 
 	require := require.New(t)
@@ -112,32 +2559,16 @@ func TestDaemonLaunchesNewProcessGroup(t *testing.T) {
 	defer closer()
 
 	path := filepath.Join(td, "file")
-	pidPath := filepath.Join(td, "child.pid")
-
-	// Start the parent process wrapping a start-stop test. The parent is acting
-	// as our "agent". We need an extra indirection to be able to kill the "agent"
-	// and still be running the test process.
-	parentCmd := helperProcess("parent", pidPath, "start-stop", path)
 
-	// We MUST run this as a separate process group otherwise the Kill below will
-	// kill this test process (and possibly your shell/editor that launched it!)
-	parentCmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
-
-	require.NoError(parentCmd.Start())
-
-	// Wait for the pid file to exist so we know parent is running
-	retry.Run(t, func(r *retry.R) {
-		_, err := os.Stat(pidPath)
-		if err == nil {
-			return
-		}
-
-		r.Fatalf("error: %s", err)
-	})
+	d := &Daemon{
+		Command:      helperProcess("stop-kill", path),
+		ProxyToken:   "hello",
+		Logger:       testLogger,
+		GracefulWait: 200 * time.Millisecond,
+	}
+	require.NoError(d.Start())
 
-	// And wait for the actual file to be sure the child is running (it should be
-	// since parent doesn't write PID until child starts but the child might not
-	// have completed the write to disk yet which causes flakiness below).
+	// Wait for the file to exist
 	retry.Run(t, func(r *retry.R) {
 		_, err := os.Stat(path)
 		if err == nil {
@@ -147,108 +2578,22 @@ func TestDaemonLaunchesNewProcessGroup(t *testing.T) {
 		r.Fatalf("error: %s", err)
 	})
 
-	// Get the child PID
-	bs, err := ioutil.ReadFile(pidPath)
-	require.NoError(err)
-	pid, err := strconv.Atoi(string(bs))
-	require.NoError(err)
-	proc, err := os.FindProcess(pid)
-	require.NoError(err)
-
-	// Always cleanup child process after
-	defer func() {
-		if proc != nil {
-			proc.Kill()
-		}
-	}()
-
-	// Now kill the parent's whole process group and wait for it
-	pgid, err := syscall.Getpgid(parentCmd.Process.Pid)
+	// Stop the process
+	require.NoError(d.Stop())
 
+	// Stat the file so that we can get the mtime
+	fi, err := os.Stat(path)
 	require.NoError(err)
-	// Yep the minus PGid is how you kill a whole process group in unix... no idea
-	// how this works on windows. We TERM no KILL since we rely on the child
-	// catching the signal and deleting it's file to detect correct behaviour.
-	require.NoError(syscall.Kill(-pgid, syscall.SIGTERM))
+	mtime := fi.ModTime()
 
-	_, err = parentCmd.Process.Wait()
+	// The mtime shouldn't change
+	time.Sleep(100 * time.Millisecond)
+	fi, err = os.Stat(path)
 	require.NoError(err)
-
-	// The child should still be running so file should still be there
-	_, err = os.Stat(path)
-	require.NoError(err, "child should still be running")
-
-	// TEST PART 2 - verify that adopting an existing process works and picks up
-	// monitoring even though it's not a child. We can't do this accurately with
-	// Restart test since even if we create a new `Daemon` object the test process
-	// is still the parent. We need the indirection of the `parent` test helper to
-	// actually verify "adoption" on restart works.
-
-	// Start a new parent that will "adopt" the existing child even though it will
-	// not be an actual child process.
-	fosterCmd := helperProcess("parent", pidPath, "start-stop", path)
-	// Don't care about it being same process group this time as we will just kill
-	// it normally.
-	require.NoError(fosterCmd.Start())
-	defer func() {
-		// Clean up the daemon and wait for it to prevent it becoming a zombie.
-		fosterCmd.Process.Kill()
-		fosterCmd.Wait()
-	}()
-
-	// The child should still be running so file should still be there
-	_, err = os.Stat(path)
-	require.NoError(err, "child should still be running")
-
-	{
-		// Get the child PID - it shouldn't have changed and should be running
-		bs2, err := ioutil.ReadFile(pidPath)
-		require.NoError(err)
-		pid2, err := strconv.Atoi(string(bs2))
-		require.NoError(err)
-		// Defer a cleanup (til end of test function)
-		proc, err := os.FindProcess(pid)
-		require.NoError(err)
-		defer func() { proc.Kill() }()
-
-		require.Equal(pid, pid2)
-		t.Logf("Child PID was %d and still %d", pid, pid2)
-	}
-
-	// Now killing the child directly should still be restarted by the Daemon
-	require.NoError(proc.Kill())
-	proc = nil
-
-	retry.Run(t, func(r *retry.R) {
-		// Get the child PID - it should have changed
-		bs, err := ioutil.ReadFile(pidPath)
-		r.Check(err)
-
-		newPid, err := strconv.Atoi(string(bs))
-		r.Check(err)
-		if newPid == pid {
-			r.Fatalf("Child PID file not changed, Daemon not restarting it")
-		}
-		t.Logf("Child PID was %d and is now %d", pid, newPid)
-	})
-
-	// I had to run through this test in debugger a lot of times checking ps state
-	// by hand at different points to convince myself it was doing the right
-	// thing. It doesn't help that with verbose logs on it seems that the stdio
-	// from the `parent` process can sometimes miss lines out due to timing. For
-	// example the `[INFO] agent/proxy: daemon exited...` log from Daemon that
-	// indicates that the child was detected to have failed and is restarting is
-	// never output on my Mac at full speed. But if I run in debugger and have it
-	// pause at the step after the child is killed above, then it shows. The
-	// `[DEBUG] agent/proxy: starting proxy:` for the restart does always come
-	// through though which is odd. I assume this is some odd quirk of timing
-	// between processes and stdio or something but it makes debugging this stuff
-	// even harder!
-
-	// Let defer clean up the child process(es)
+	require.Equal(mtime, fi.ModTime())
 }
 
-func TestDaemonStop_kill(t *testing.T) {
+func TestDaemonAsyncStop(t *testing.T) {
 	t.Parallel()
 
 	require := require.New(t)
@@ -261,7 +2606,7 @@ func TestDaemonStop_kill(t *testing.T) {
 		Command:      helperProcess("stop-kill", path),
 		ProxyToken:   "hello",
 		Logger:       testLogger,
-		gracefulWait: 200 * time.Millisecond,
+		GracefulWait: 200 * time.Millisecond,
 	}
 	require.NoError(d.Start())
 
@@ -275,19 +2620,80 @@ func TestDaemonStop_kill(t *testing.T) {
 		r.Fatalf("error: %s", err)
 	})
 
-	// Stop the process
-	require.NoError(d.Stop())
+	// The process ignores the interrupt so the stop has to escalate, but
+	// AsyncStop returns right away.
+	resultCh := d.AsyncStop()
 
-	// Stat the file so that we can get the mtime
+	// Start is rejected while the stop is in progress
+	require.Error(d.Start())
+
+	select {
+	case err := <-resultCh:
+		require.NoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop should have completed")
+	}
+
+	// The process was killed so the file stops changing
 	fi, err := os.Stat(path)
 	require.NoError(err)
 	mtime := fi.ModTime()
-
-	// The mtime shouldn't change
 	time.Sleep(100 * time.Millisecond)
 	fi, err = os.Stat(path)
 	require.NoError(err)
 	require.Equal(mtime, fi.ModTime())
+
+	// Stopping again is a no-op with a closed channel
+	_, ok := <-d.AsyncStop()
+	require.False(ok)
+}
+
+func TestDaemonWaitForExit(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	// Never started, so there is nothing to wait for
+	d := &Daemon{
+		Command: helperProcess("start-stop", filepath.Join(td, "file")),
+		Logger:  testLogger,
+	}
+	require.NoError(d.WaitForExit(context.Background()))
+
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Running, so we time out
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.Equal(context.DeadlineExceeded, d.WaitForExit(ctx))
+
+	// Any number of waiters return once the process is stopped
+	errCh := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errCh <- d.WaitForExit(context.Background())
+		}()
+	}
+	d.AsyncStop()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errCh:
+			require.NoError(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("should have returned")
+		}
+	}
+
+	d.lock.Lock()
+	process := d.process
+	d.lock.Unlock()
+	require.Nil(process)
+
+	// Already exited, so this returns right away
+	require.NoError(d.WaitForExit(context.Background()))
 }
 
 func TestDaemonStop_killAdopted(t *testing.T) {
@@ -326,7 +2732,7 @@ func TestDaemonStop_killAdopted(t *testing.T) {
 		Command:      helperProcess("stop-kill", path),
 		ProxyToken:   "hello",
 		Logger:       testLogger,
-		gracefulWait: 200 * time.Millisecond,
+		GracefulWait: 200 * time.Millisecond,
 		// Can't just set process as it will bypass intializing stopCh etc.
 	}
 	// Adopt the pid from a fake state snapshot (this correctly initialises Daemon
@@ -356,16 +2762,292 @@ func TestDaemonStop_killAdopted(t *testing.T) {
 	// Stop the process
 	require.NoError(d.Stop())
 
-	// Stat the file so that we can get the mtime
-	fi, err := os.Stat(path)
-	require.NoError(err)
-	mtime := fi.ModTime()
+	// Stat the file so that we can get the mtime
+	fi, err := os.Stat(path)
+	require.NoError(err)
+	mtime := fi.ModTime()
+
+	// The mtime shouldn't change
+	time.Sleep(100 * time.Millisecond)
+	fi, err = os.Stat(path)
+	require.NoError(err)
+	require.Equal(mtime, fi.ModTime())
+}
+
+func TestDaemonAdoptPID(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+
+	// Start the process outside of a Daemon
+	childCmd := helperProcess("start-stop", path)
+	require.NoError(childCmd.Start())
+	go func() { childCmd.Wait() }() // Prevent it becoming a zombie when killed
+	defer func() { childCmd.Process.Kill() }()
+
+	// Wait for the file to exist
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if err == nil {
+			return
+		}
+
+		r.Fatalf("error: %s", err)
+	})
+
+	// Identity is only verifiable on Linux
+	identity := ""
+	if runtime.GOOS == "linux" {
+		var err error
+		identity, err = filepath.Abs(childCmd.Path)
+		require.NoError(err)
+
+		// A mismatched identity should be rejected
+		d := &Daemon{Command: helperProcess("start-stop", path), Logger: testLogger}
+		require.Error(d.AdoptPID(childCmd.Process.Pid, "/bin/not-the-proxy"))
+	}
+
+	// A stopped daemon can't adopt
+	d := &Daemon{Command: helperProcess("start-stop", path), Logger: testLogger}
+	require.NoError(d.Stop())
+	require.Error(d.AdoptPID(childCmd.Process.Pid, identity))
+
+	d = &Daemon{
+		Command:    helperProcess("start-stop", path),
+		ProxyToken: "hello",
+		Logger:     testLogger,
+	}
+	require.NoError(d.AdoptPID(childCmd.Process.Pid, identity))
+	defer d.Stop()
+
+	// Adopting twice is an error
+	require.Error(d.AdoptPID(childCmd.Process.Pid, identity))
+
+	// Stop should stop the adopted process
+	require.NoError(d.Stop())
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return
+		}
+
+		// err might be nil here but that's okay
+		r.Fatalf("should not exist: %s", err)
+	})
+}
+
+func TestDaemonReload(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	d := &Daemon{
+		Command: helperProcess("reload", path),
+		Logger:  testLogger,
+	}
+	require.Error(d.Reload())
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	readFile := func(r *retry.R) string {
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			r.Fatalf("error: %s", err)
+		}
+		return string(bs)
+	}
+	retry.Run(t, func(r *retry.R) {
+		if v := readFile(r); v != "0" {
+			r.Fatalf("bad: %q", v)
+		}
+	})
+	attempts := d.BackoffState().Attempts
+
+	// The same process reloads so the count goes up without restarting
+	require.NoError(d.Reload())
+	retry.Run(t, func(r *retry.R) {
+		if v := readFile(r); v != "1" {
+			r.Fatalf("bad: %q", v)
+		}
+	})
+	require.Equal(attempts, d.BackoffState().Attempts)
+	_, _, exited := d.LastExit()
+	require.False(exited)
+
+	require.NoError(d.Stop())
+	require.Error(d.Reload())
+}
+
+func TestDaemonSignal(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	d := &Daemon{
+		Command: helperProcess("reload", path),
+		Logger:  testLogger,
+	}
+	require.Error(d.Signal(syscall.SIGHUP))
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	readFile := func(r *retry.R) string {
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			r.Fatalf("error: %s", err)
+		}
+		return string(bs)
+	}
+	retry.Run(t, func(r *retry.R) {
+		if v := readFile(r); v != "0" {
+			r.Fatalf("bad: %q", v)
+		}
+	})
+	stats := d.Stats()
+
+	// The signal reaches the same process without disturbing supervision
+	for _, want := range []string{"1", "2"} {
+		require.NoError(d.Signal(syscall.SIGHUP))
+		retry.Run(t, func(r *retry.R) {
+			if v := readFile(r); v != want {
+				r.Fatalf("bad: %q", v)
+			}
+		})
+	}
+	require.Equal(stats, d.Stats())
+
+	require.NoError(d.Stop())
+	require.Error(d.Signal(syscall.SIGHUP))
+}
+
+func TestDaemonReExec(t *testing.T) {
+	if defaultReExecSignal == nil {
+		t.Skip("there is no default ReExec signal on this platform")
+	}
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	proxyPidPath := filepath.Join(td, "proxy.pid")
+
+	d := &Daemon{
+		Command:       helperProcess("reexec", proxyPidPath, path),
+		ProxyToken:    "hello",
+		Logger:        testLogger,
+		ReExecPidPath: proxyPidPath,
+	}
+
+	// Not running yet
+	require.Error(d.ReExec())
+
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Wait for the file to exist
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if err == nil {
+			return
+		}
+
+		r.Fatalf("error: %s", err)
+	})
+
+	d.lock.Lock()
+	oldPid := d.process.Pid()
+	d.lock.Unlock()
+
+	require.NoError(d.ReExec())
+
+	// The daemon should now supervise the new process rather than
+	// restarting the old one.
+	retry.Run(t, func(r *retry.R) {
+		d.lock.Lock()
+		pid := d.process.Pid()
+		d.lock.Unlock()
+		if pid == oldPid {
+			r.Fatalf("still supervising old pid %d", pid)
+		}
+
+		data, err := ioutil.ReadFile(proxyPidPath)
+		r.Check(err)
+		if string(data) != strconv.Itoa(pid) {
+			r.Fatalf("supervising %d but proxy pid is %s", pid, data)
+		}
+	})
+	require.Equal(uint32(1), d.BackoffState().Attempts, "re-exec is not a restart")
+
+	// Stopping should stop the new process
+	require.NoError(d.Stop())
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return
+		}
+
+		r.Fatalf("should not exist: %s", err)
+	})
+}
+
+// Test that a process exiting at about the same time as Stop is called
+// never results in a new process being left running.
+func TestDaemonStop_crashRace(t *testing.T) {
+	t.Parallel()
 
-	// The mtime shouldn't change
-	time.Sleep(100 * time.Millisecond)
-	fi, err = os.Stat(path)
-	require.NoError(err)
-	require.Equal(mtime, fi.ModTime())
+	for i := 0; i < 10; i++ {
+		delay := time.Duration(i*5) * time.Millisecond
+		t.Run(delay.String(), func(t *testing.T) {
+			require := require.New(t)
+			td, closer := testTempDir(t)
+			defer closer()
+
+			path := filepath.Join(td, "file")
+			d := &Daemon{
+				Command: helperProcess("restart", path),
+				Logger:  testLogger,
+			}
+			require.NoError(d.Start())
+			defer d.Stop()
+
+			retry.Run(t, func(r *retry.R) {
+				if _, err := os.Stat(path); err != nil {
+					r.Fatalf("error: %s", err)
+				}
+			})
+
+			// Make the process exit and stop the daemon around the same time
+			require.NoError(os.Remove(path))
+			time.Sleep(delay)
+			require.NoError(d.Stop())
+
+			select {
+			case <-d.exitedCh:
+			case <-time.After(5 * time.Second):
+				t.Fatal("supervision loop should have exited")
+			}
+
+			// A restarted process would recreate the file
+			time.Sleep(100 * time.Millisecond)
+			_, err := os.Stat(path)
+			require.True(os.IsNotExist(err), "a process is still running")
+			if runtime.GOOS == "linux" {
+				require.Empty(TestDaemonOrphans(t, d))
+			}
+		})
+	}
 }
 
 func TestDaemonStart_pidFile(t *testing.T) {
@@ -463,6 +3145,231 @@ func TestDaemonRestart_pidFile(t *testing.T) {
 	require.NotEqual(pidRaw, pidRaw2)
 }
 
+func TestDaemonValidate(t *testing.T) {
+	t.Parallel()
+
+	t.Run("no command", func(t *testing.T) {
+		d := &Daemon{Command: helperProcess("exit", "1")}
+		require.NoError(t, d.Validate())
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		d := &Daemon{
+			Command:         helperProcess("exit", "1"),
+			ValidateCommand: helperProcess("exit", "0", "config ok"),
+		}
+		require.NoError(t, d.Validate())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		d := &Daemon{
+			Command:         helperProcess("exit", "0"),
+			ValidateCommand: helperProcess("exit", "1", "bad listener"),
+		}
+		err := d.Validate()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "bad listener")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		td, closer := testTempDir(t)
+		defer closer()
+
+		d := &Daemon{
+			Command:         helperProcess("exit", "0"),
+			ValidateCommand: helperProcess("stop-kill", filepath.Join(td, "file")),
+			ValidateTimeout: 200 * time.Millisecond,
+		}
+		err := d.Validate()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "did not complete")
+	})
+}
+
+func TestDaemonValidate_command(t *testing.T) {
+	t.Parallel()
+
+	td, closer := testTempDir(t)
+	defer closer()
+
+	notExec := filepath.Join(td, "not-exec")
+	require.NoError(t, ioutil.WriteFile(notExec, []byte("#!/bin/sh\n"), 0644))
+
+	cases := []struct {
+		Name    string
+		Command func() *exec.Cmd
+		Err     string
+	}{
+		{
+			"valid",
+			func() *exec.Cmd { return helperProcess("exit", "0") },
+			"",
+		},
+		{
+			"no command",
+			func() *exec.Cmd { return nil },
+			"command is required",
+		},
+		{
+			"no args",
+			func() *exec.Cmd { return &exec.Cmd{Path: os.Args[0]} },
+			"args must not be empty",
+		},
+		{
+			"missing binary",
+			func() *exec.Cmd { return exec.Command(filepath.Join(td, "missing")) },
+			"invalid command path",
+		},
+		{
+			"directory as binary",
+			func() *exec.Cmd { return exec.Command(td) },
+			"is a directory",
+		},
+		{
+			"missing working directory",
+			func() *exec.Cmd {
+				cmd := helperProcess("exit", "0")
+				cmd.Dir = filepath.Join(td, "missing")
+				return cmd
+			},
+			"invalid working directory",
+		},
+		{
+			"file as working directory",
+			func() *exec.Cmd {
+				cmd := helperProcess("exit", "0")
+				cmd.Dir = notExec
+				return cmd
+			},
+			"not a directory",
+		},
+	}
+
+	if runtime.GOOS != "windows" {
+		cases = append(cases, struct {
+			Name    string
+			Command func() *exec.Cmd
+			Err     string
+		}{
+			"not executable",
+			func() *exec.Cmd { return exec.Command(notExec) },
+			"not executable",
+		})
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			d := &Daemon{Command: tc.Command(), Logger: testLogger}
+			err := d.Validate()
+			if tc.Err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.Err)
+
+			// Start catches it too rather than going into a crash loop.
+			err = d.Start()
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.Err)
+		})
+	}
+}
+
+func TestLoggableEnv(t *testing.T) {
+	t.Parallel()
+
+	env := []string{
+		"FOO=bar",
+		"FOO=baz",
+		"AWS_SECRET_ACCESS_KEY=shh",
+		EnvProxyToken + "=abc",
+	}
+	keys := []string{"FOO", "MISSING", "AWS_SECRET_ACCESS_KEY", EnvProxyToken}
+
+	require.Equal(t,
+		`FOO="baz" MISSING=<unset> AWS_SECRET_ACCESS_KEY=<redacted> CONNECT_PROXY_TOKEN=<redacted>`,
+		loggableEnv(env, keys, false))
+	require.Equal(t,
+		`FOO="baz" MISSING=<unset> AWS_SECRET_ACCESS_KEY="shh" CONNECT_PROXY_TOKEN="abc"`,
+		loggableEnv(env, keys, true))
+}
+
+func TestDaemonCommandEnv(t *testing.T) {
+	t.Parallel()
+
+	env := []string{
+		"HOME=/home/consul",
+		"PATH=/bin",
+		"AWS_ACCESS_KEY_ID=id",
+		"AWS_SECRET_ACCESS_KEY=shh",
+	}
+	cases := []struct {
+		Name     string
+		Allow    []string
+		Strip    []string
+		Delivery TokenDelivery
+		Expected []string
+	}{
+		{
+			"default",
+			nil, nil, TokenDeliveryEnv,
+			append(env[:len(env):len(env)], EnvProxyID+"=web", EnvProxyToken+"=abc"),
+		},
+		{
+			"allow",
+			[]string{"HOME", "PATH"}, nil, TokenDeliveryEnv,
+			[]string{"HOME=/home/consul", "PATH=/bin", EnvProxyID + "=web", EnvProxyToken + "=abc"},
+		},
+		{
+			"strip prefix",
+			nil, []string{"AWS_*"}, TokenDeliveryFile,
+			[]string{"HOME=/home/consul", "PATH=/bin", EnvProxyID + "=web"},
+		},
+		{
+			"allow and strip",
+			[]string{"AWS_*", "PATH"}, []string{"AWS_SECRET_ACCESS_KEY"}, TokenDeliveryEnv,
+			[]string{"PATH=/bin", "AWS_ACCESS_KEY_ID=id", EnvProxyID + "=web", EnvProxyToken + "=abc"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			d := &Daemon{
+				ProxyID:       "web",
+				ProxyToken:    "abc",
+				TokenDelivery: tc.Delivery,
+				EnvAllowKeys:  tc.Allow,
+				EnvStripKeys:  tc.Strip,
+			}
+			require.Equal(t, tc.Expected, d.commandEnv(env, nil))
+		})
+	}
+}
+
+func TestDaemonCommandEnv_tokenEnvName(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	d := &Daemon{
+		ProxyID:      "web",
+		ProxyToken:   "abc",
+		TokenEnvName: "ENVOY_AUTH",
+	}
+	require.Equal([]string{"PATH=/bin", EnvProxyID + "=web", "ENVOY_AUTH=abc"},
+		d.commandEnv([]string{"PATH=/bin"}, nil))
+	require.Equal("ENVOY_AUTH", d.Config().TokenEnvName)
+
+	// The token is redacted even though the name doesn't look secret
+	require.Equal([]string{"PATH=/bin", "ENVOY_AUTH=<redacted>"},
+		redactEnvKey([]string{"PATH=/bin", "ENVOY_AUTH=abc"}, "ENVOY_AUTH"))
+
+	// Not setting the name is the same as setting the default
+	d1 := &Daemon{Command: &exec.Cmd{}}
+	d2 := &Daemon{Command: &exec.Cmd{}, TokenEnvName: EnvProxyToken}
+	require.True(d1.Equal(d2))
+}
+
 func TestDaemonEqual(t *testing.T) {
 	cases := []struct {
 		Name     string
@@ -566,6 +3473,98 @@ func TestDaemonEqual(t *testing.T) {
 	}
 }
 
+func TestDaemonEqual_fields(t *testing.T) {
+	newDaemon := func() *Daemon {
+		return &Daemon{
+			Command: &exec.Cmd{
+				Path: "/foo",
+				Args: []string{"/foo", "-bar"},
+			},
+			ProxyID: "web",
+		}
+	}
+
+	// Each change affects how the process is started
+	changes := map[string]func(d *Daemon){
+		"token delivery":  func(d *Daemon) { d.TokenDelivery = TokenDeliveryFile },
+		"token dir":       func(d *Daemon) { d.TokenDir = "/tokens" },
+		"token env name":  func(d *Daemon) { d.TokenEnvName = "ENVOY_AUTH" },
+		"log path":        func(d *Daemon) { d.LogPath = "/proxy.log" },
+		"netns path":      func(d *Daemon) { d.NetnsPath = "/var/run/netns/web" },
+		"limits":          func(d *Daemon) { d.Limits.MaxOpenFiles = 1024 },
+		"user":            func(d *Daemon) { d.User = "proxy" },
+		"group":           func(d *Daemon) { d.Group = "proxy" },
+		"die with parent": func(d *Daemon) { d.DieWithParent = true },
+		"stdin":           func(d *Daemon) { d.Command.Stdin = strings.NewReader("hello") },
+		"env allow keys":  func(d *Daemon) { d.EnvAllowKeys = []string{"HOME"} },
+		"env strip keys":  func(d *Daemon) { d.EnvStripKeys = []string{"AWS_*"} },
+		"env file":        func(d *Daemon) { d.EnvFile = "/proxy.env" },
+		"create dir":      func(d *Daemon) { d.CreateDir = true },
+		"dir mode":        func(d *Daemon) { d.DirMode = 0750 },
+	}
+	for name, change := range changes {
+		t.Run(name, func(t *testing.T) {
+			d1, d2 := newDaemon(), newDaemon()
+			change(d2)
+			require.False(t, d1.Equal(d2))
+			require.False(t, d2.Equal(d1))
+
+			d3 := newDaemon()
+			change(d3)
+			require.True(t, d2.Equal(d3))
+		})
+	}
+
+	// Output is ignored since the manager opens new log files every time
+	d1, d2 := newDaemon(), newDaemon()
+	d2.Command.Stdout = os.Stdout
+	d2.Command.Stderr = os.Stderr
+	d2.MaxRestarts = 3
+	require.True(t, d1.Equal(d2))
+}
+
+func TestDaemonEqual_identical(t *testing.T) {
+	td, closer := testTempDir(t)
+	defer closer()
+
+	f, err := os.Create(filepath.Join(td, "listener"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	// Two daemons built the same way are equal, even if the values they
+	// are built with aren't comparable and one was already started
+	newDaemon := func() *Daemon {
+		cmd := exec.Command("/foo", "-bar")
+		cmd.Stdin = strings.NewReader("config")
+		cmd.ExtraFiles = []*os.File{f}
+		return &Daemon{
+			Command:    cmd,
+			ProxyID:    "web",
+			ExtraFiles: []*os.File{f},
+		}
+	}
+	d1, d2 := newDaemon(), newDaemon()
+	ioutil.ReadAll(d1.Command.Stdin)
+	d1.Command.SysProcAttr = &syscall.SysProcAttr{}
+	require.True(t, d1.Equal(d2))
+	require.True(t, d2.Equal(d1))
+
+	// Opening the same file again still refers to the same file
+	f2, err := os.Open(f.Name())
+	require.NoError(t, err)
+	defer f2.Close()
+	d2.ExtraFiles = []*os.File{f2}
+	require.True(t, d1.Equal(d2))
+
+	// A different file isn't the same
+	f3, err := os.Create(filepath.Join(td, "other"))
+	require.NoError(t, err)
+	defer f3.Close()
+	d2.ExtraFiles = []*os.File{f3}
+	require.False(t, d1.Equal(d2))
+	require.False(t, d2.Equal(d1))
+}
+
 func TestDaemonMarshalSnapshot(t *testing.T) {
 	cases := []struct {
 		Name     string
@@ -585,7 +3584,7 @@ func TestDaemonMarshalSnapshot(t *testing.T) {
 			&Daemon{
 				Command: &exec.Cmd{Path: "/foo"},
 				ProxyID: "web",
-				process: &os.Process{Pid: 42},
+				process: &execProcess{process: &os.Process{Pid: 42}},
 			},
 			map[string]interface{}{
 				"Pid":         42,
@@ -597,6 +3596,28 @@ func TestDaemonMarshalSnapshot(t *testing.T) {
 				"ProxyID":     "web",
 			},
 		},
+
+		{
+			"backoff",
+			&Daemon{
+				Command:          &exec.Cmd{Path: "/foo"},
+				ProxyID:          "web",
+				process:          &execProcess{process: &os.Process{Pid: 42}},
+				attempts:         4,
+				attemptsDeadline: time.Unix(0, 1234),
+			},
+			map[string]interface{}{
+				"Pid":              42,
+				"CommandPath":      "/foo",
+				"CommandArgs":      []string(nil),
+				"CommandDir":       "",
+				"CommandEnv":       []string(nil),
+				"ProxyToken":       "",
+				"ProxyID":          "web",
+				"Attempts":         uint32(4),
+				"AttemptsDeadline": int64(1234),
+			},
+		},
 	}
 
 	for _, tc := range cases {
@@ -665,6 +3686,250 @@ func TestDaemonUnmarshalSnapshot(t *testing.T) {
 	})
 }
 
+func TestDaemonUnmarshalSnapshot_cleanup(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	// A process that is gone
+	cmd := helperProcess("exit", "0")
+	require.NoError(cmd.Run())
+
+	tokenPath := filepath.Join(td, "token")
+	pidPath := filepath.Join(td, "pid")
+	require.NoError(ioutil.WriteFile(tokenPath, []byte("hello"), 0600))
+	require.NoError(ioutil.WriteFile(pidPath, []byte("1"), 0600))
+
+	// The files it left behind are removed when it can't be restored
+	d := &Daemon{Logger: testLogger, PidPath: pidPath}
+	require.Error(d.UnmarshalSnapshot(map[string]interface{}{
+		"Pid":         cmd.ProcessState.Pid(),
+		"CommandPath": cmd.Path,
+		"TokenFile":   tokenPath,
+	}))
+	_, err := os.Stat(tokenPath)
+	require.True(os.IsNotExist(err))
+	_, err = os.Stat(pidPath)
+	require.True(os.IsNotExist(err))
+}
+
+func TestDaemonUnmarshalSnapshot_pidReused(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("process start times are only supported on Linux")
+	}
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	d := &Daemon{
+		Command: helperProcess("start-stop", path),
+		Logger:  testLogger,
+	}
+	defer d.Stop()
+	require.NoError(d.Start())
+
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(path); err != nil {
+			r.Fatalf("error: %s", err)
+		}
+	})
+
+	// Pretend the pid now belongs to a process that started at another time
+	snap := d.MarshalSnapshot()
+	require.NotZero(snap["StartTime"])
+	snap["StartTime"] = snap["StartTime"].(uint64) + 1
+
+	d2 := &Daemon{Logger: testLogger}
+	require.Error(d2.UnmarshalSnapshot(snap))
+}
+
+func TestDaemonReattach(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	d := &Daemon{
+		Command:    helperProcess("start-stop", path),
+		ProxyToken: "hello",
+		Logger:     testLogger,
+	}
+	defer d.Stop()
+	require.NoError(d.Start())
+
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(path); err != nil {
+			r.Fatalf("error: %s", err)
+		}
+	})
+	d.lock.Lock()
+	pid := d.process.Pid()
+	d.lock.Unlock()
+
+	// Persist the daemon and leave the process running, as an agent
+	// restart would.
+	data, err := json.Marshal(d)
+	require.NoError(err)
+	require.NoError(d.Close())
+
+	// The restored daemon supervises the same process
+	d2 := &Daemon{Logger: testLogger}
+	require.NoError(json.Unmarshal(data, d2))
+	require.Equal("hello", d2.ProxyToken)
+	require.NoError(d2.Reattach())
+	d2.lock.Lock()
+	require.Equal(pid, d2.process.Pid())
+	d2.lock.Unlock()
+
+	// Once the process is gone, reattaching starts a new one
+	require.NoError(d2.Stop())
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			r.Fatalf("should not exist: %s", err)
+		}
+	})
+
+	d3 := &Daemon{Logger: testLogger}
+	require.NoError(json.Unmarshal(data, d3))
+	require.NoError(d3.Reattach())
+	defer d3.Stop()
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(path); err != nil {
+			r.Fatalf("error: %s", err)
+		}
+	})
+	d3.lock.Lock()
+	require.NotEqual(pid, d3.process.Pid())
+	d3.lock.Unlock()
+}
+
+func TestDaemonReattach_pidFile(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS != "linux" {
+		t.Skip("verifying the executable of a process is only supported on Linux")
+	}
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	pidPath := filepath.Join(td, "pid")
+	d := &Daemon{
+		Command: helperProcess("start-stop", path),
+		PidPath: pidPath,
+		Logger:  testLogger,
+	}
+	defer d.Stop()
+	require.NoError(d.Start())
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(path); err != nil {
+			r.Fatalf("error: %s", err)
+		}
+	})
+	d.lock.Lock()
+	pid := d.process.Pid()
+	d.lock.Unlock()
+	require.NoError(d.Close())
+
+	// Nothing was recorded, so the process is found with the pid file
+	d2 := &Daemon{
+		Command: helperProcess("start-stop", path),
+		PidPath: pidPath,
+		Logger:  testLogger,
+	}
+	require.NoError(d2.Reattach())
+	require.Equal(pid, d2.Stats().PID)
+	require.NoError(d2.Stop())
+	_, err := os.Stat(pidPath)
+	require.True(os.IsNotExist(err))
+
+	// The first daemon still watches the process, so it reaps it
+	require.NoError(d.WaitForExit(context.Background()))
+
+	// A stale pid file is ignored and a new process started
+	require.NoError(ioutil.WriteFile(pidPath, []byte(strconv.Itoa(pid)), 0600))
+	d3 := &Daemon{
+		Command: helperProcess("start-stop", path),
+		PidPath: pidPath,
+		Logger:  testLogger,
+	}
+	require.NoError(d3.Reattach())
+	defer d3.Stop()
+	require.NotEqual(pid, d3.Stats().PID)
+	retry.Run(t, func(r *retry.R) {
+		data, err := ioutil.ReadFile(pidPath)
+		if err != nil {
+			r.Fatalf("error: %s", err)
+		}
+		if string(data) == strconv.Itoa(pid) {
+			r.Fatal("pid file not rewritten")
+		}
+	})
+}
+
+func TestDaemonUnmarshalJSON_backoff(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	cases := []struct {
+		Name             string
+		Attempts         uint32
+		Deadline         time.Time
+		ExpectedAttempts uint32
+		ExpectedDeadline time.Time
+	}{
+		{
+			"not yet healthy",
+			5, now.Add(5 * time.Second),
+			5, now.Add(5 * time.Second),
+		},
+		{
+			"healthy before the agent restarted",
+			5, now.Add(-time.Second),
+			0, time.Time{},
+		},
+		{
+			"waiting to restart",
+			5, time.Time{},
+			5, time.Time{},
+		},
+		{
+			"out of range",
+			1000, now.Add(time.Hour),
+			DaemonRestartBackoffMin + 31, now.Add(DaemonRestartHealthy),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+
+			d := &Daemon{
+				Command:          &exec.Cmd{Path: "/foo"},
+				process:          &execProcess{process: &os.Process{Pid: 42}},
+				attempts:         tc.Attempts,
+				attemptsDeadline: tc.Deadline,
+			}
+			data, err := json.Marshal(d)
+			require.NoError(err)
+
+			d2 := &Daemon{}
+			require.NoError(json.Unmarshal(data, d2))
+			state := d2.BackoffState()
+			require.Equal(tc.ExpectedAttempts, state.Attempts)
+			require.WithinDuration(tc.ExpectedDeadline, state.Deadline, time.Second)
+		})
+	}
+}
+
 func TestDaemonUnmarshalSnapshot_notRunning(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,315 @@
+// +build !windows
+
+package proxyprocess
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/testutil/retry"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDaemonStartBlockedReason(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	pidPath := filepath.Join(td, "pid")
+
+	d := &Daemon{
+		Command:         helperProcess("restart", path),
+		Logger:          testLogger,
+		PidPath:         pidPath,
+		TerminalSignals: []os.Signal{syscall.SIGTERM},
+	}
+	reason, _ := d.StartBlockedReason()
+	require.Equal(StartBlockedNotStarted, reason)
+
+	require.NoError(d.Start())
+	defer d.Stop()
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(path); err != nil {
+			r.Fatalf("error: %s", err)
+		}
+	})
+	reason, _ = d.StartBlockedReason()
+	require.Equal(StartBlockedNone, reason)
+
+	// Terminate the process externally so the loop ends
+	bs, err := ioutil.ReadFile(pidPath)
+	require.NoError(err)
+	pid, err := strconv.Atoi(string(bs))
+	require.NoError(err)
+	require.NoError(syscall.Kill(pid, syscall.SIGTERM))
+	retry.Run(t, func(r *retry.R) {
+		if reason, _ := d.StartBlockedReason(); reason != StartBlockedLoopExited {
+			r.Fatalf("bad reason: %q", reason)
+		}
+	})
+
+	require.NoError(d.Stop())
+	reason, _ = d.StartBlockedReason()
+	require.Equal(StartBlockedStopped, reason)
+}
+
+func TestDaemonLaunchesNewProcessGroup(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	pidPath := filepath.Join(td, "child.pid")
+
+	// Start the parent process wrapping a start-stop test. The parent is acting
+	// as our "agent". We need an extra indirection to be able to kill the "agent"
+	// and still be running the test process.
+	parentCmd := helperProcess("parent", pidPath, "start-stop", path)
+
+	// We MUST run this as a separate process group otherwise the Kill below will
+	// kill this test process (and possibly your shell/editor that launched it!)
+	parentCmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	require.NoError(parentCmd.Start())
+
+	// Wait for the pid file to exist so we know parent is running
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(pidPath)
+		if err == nil {
+			return
+		}
+
+		r.Fatalf("error: %s", err)
+	})
+
+	// And wait for the actual file to be sure the child is running (it should be
+	// since parent doesn't write PID until child starts but the child might not
+	// have completed the write to disk yet which causes flakiness below).
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if err == nil {
+			return
+		}
+
+		r.Fatalf("error: %s", err)
+	})
+
+	// Get the child PID
+	bs, err := ioutil.ReadFile(pidPath)
+	require.NoError(err)
+	pid, err := strconv.Atoi(string(bs))
+	require.NoError(err)
+	proc, err := os.FindProcess(pid)
+	require.NoError(err)
+
+	// Always cleanup child process after
+	defer func() {
+		if proc != nil {
+			proc.Kill()
+		}
+	}()
+
+	// Now kill the parent's whole process group and wait for it
+	pgid, err := syscall.Getpgid(parentCmd.Process.Pid)
+
+	require.NoError(err)
+	// Yep the minus PGid is how you kill a whole process group in unix... no idea
+	// how this works on windows. We TERM no KILL since we rely on the child
+	// catching the signal and deleting it's file to detect correct behaviour.
+	require.NoError(syscall.Kill(-pgid, syscall.SIGTERM))
+
+	_, err = parentCmd.Process.Wait()
+	require.NoError(err)
+
+	// The child should still be running so file should still be there
+	_, err = os.Stat(path)
+	require.NoError(err, "child should still be running")
+
+	// TEST PART 2 - verify that adopting an existing process works and picks up
+	// monitoring even though it's not a child. We can't do this accurately with
+	// Restart test since even if we create a new `Daemon` object the test process
+	// is still the parent. We need the indirection of the `parent` test helper to
+	// actually verify "adoption" on restart works.
+
+	// Start a new parent that will "adopt" the existing child even though it will
+	// not be an actual child process.
+	fosterCmd := helperProcess("parent", pidPath, "start-stop", path)
+	// Don't care about it being same process group this time as we will just kill
+	// it normally.
+	require.NoError(fosterCmd.Start())
+	defer func() {
+		// Clean up the daemon and wait for it to prevent it becoming a zombie.
+		fosterCmd.Process.Kill()
+		fosterCmd.Wait()
+	}()
+
+	// The child should still be running so file should still be there
+	_, err = os.Stat(path)
+	require.NoError(err, "child should still be running")
+
+	{
+		// Get the child PID - it shouldn't have changed and should be running
+		bs2, err := ioutil.ReadFile(pidPath)
+		require.NoError(err)
+		pid2, err := strconv.Atoi(string(bs2))
+		require.NoError(err)
+		// Defer a cleanup (til end of test function)
+		proc, err := os.FindProcess(pid)
+		require.NoError(err)
+		defer func() { proc.Kill() }()
+
+		require.Equal(pid, pid2)
+		t.Logf("Child PID was %d and still %d", pid, pid2)
+	}
+
+	// Now killing the child directly should still be restarted by the Daemon
+	require.NoError(proc.Kill())
+	proc = nil
+
+	retry.Run(t, func(r *retry.R) {
+		// Get the child PID - it should have changed
+		bs, err := ioutil.ReadFile(pidPath)
+		r.Check(err)
+
+		newPid, err := strconv.Atoi(string(bs))
+		r.Check(err)
+		if newPid == pid {
+			r.Fatalf("Child PID file not changed, Daemon not restarting it")
+		}
+		t.Logf("Child PID was %d and is now %d", pid, newPid)
+	})
+
+	// I had to run through this test in debugger a lot of times checking ps state
+	// by hand at different points to convince myself it was doing the right
+	// thing. It doesn't help that with verbose logs on it seems that the stdio
+	// from the `parent` process can sometimes miss lines out due to timing. For
+	// example the `[INFO] agent/proxy: daemon exited...` log from Daemon that
+	// indicates that the child was detected to have failed and is restarting is
+	// never output on my Mac at full speed. But if I run in debugger and have it
+	// pause at the step after the child is killed above, then it shows. The
+	// `[DEBUG] agent/proxy: starting proxy:` for the restart does always come
+	// through though which is odd. I assume this is some odd quirk of timing
+	// between processes and stdio or something but it makes debugging this stuff
+	// even harder!
+
+	// Let defer clean up the child process(es)
+}
+
+func TestDaemonDieWithParent(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("DieWithParent is only supported on Linux")
+	}
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	pidPath := filepath.Join(td, "child.pid")
+
+	// Start the parent process, acting as our "agent", with DieWithParent
+	// enabled for its child.
+	parentCmd := helperProcess("parent", pidPath, "start-stop", path)
+	parentCmd.Env = append(os.Environ(), testDieWithParentEnv+"=1")
+	parentCmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	require.NoError(parentCmd.Start())
+
+	// Wait for the child to be running
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if err == nil {
+			return
+		}
+
+		r.Fatalf("error: %s", err)
+	})
+	bs, err := ioutil.ReadFile(pidPath)
+	require.NoError(err)
+	pid, err := strconv.Atoi(string(bs))
+	require.NoError(err)
+	defer func() {
+		if proc, err := os.FindProcess(pid); err == nil {
+			proc.Kill()
+		}
+	}()
+
+	// Kill just the parent. The child should be killed by the kernel.
+	require.NoError(parentCmd.Process.Kill())
+	_, err = parentCmd.Process.Wait()
+	require.NoError(err)
+
+	retry.Run(t, func(r *retry.R) {
+		pids, err := processGroupMembers(pid)
+		r.Check(err)
+		if len(pids) > 0 {
+			r.Fatalf("child still running: %v", pids)
+		}
+	})
+}
+
+func TestDaemonRestart_terminalSignal(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	path := filepath.Join(td, "file")
+	pidPath := filepath.Join(td, "pid")
+
+	events := make(chan DaemonEvent, 10)
+	d := &Daemon{
+		Command:         helperProcess("restart", path),
+		Logger:          testLogger,
+		PidPath:         pidPath,
+		TerminalSignals: []os.Signal{syscall.SIGTERM},
+		Events:          events,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Wait for the file to exist
+	retry.Run(t, func(r *retry.R) {
+		_, err := os.Stat(path)
+		if err == nil {
+			return
+		}
+
+		r.Fatalf("error: %s", err)
+	})
+
+	// Terminate the process from outside the daemon
+	bs, err := ioutil.ReadFile(pidPath)
+	require.NoError(err)
+	pid, err := strconv.Atoi(string(bs))
+	require.NoError(err)
+	require.NoError(syscall.Kill(pid, syscall.SIGTERM))
+
+	// The loop should end rather than restarting the process
+	select {
+	case <-d.exitedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon should not restart")
+	}
+	require.Equal(LoopExitTerminalSignal, d.TerminalReason())
+
+	// The last event says the process won't be restarted
+	var last DaemonEvent
+	for len(events) > 0 {
+		last = <-events
+	}
+	require.Equal(DaemonEventFailed, last.Type)
+	require.Equal(LoopExitTerminalSignal, last.Reason)
+}
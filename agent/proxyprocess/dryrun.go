@@ -0,0 +1,43 @@
+package proxyprocess
+
+import (
+	"fmt"
+)
+
+// logDryRun logs the command that start would execute for DryRun. The lock
+// must be held.
+func (p *Daemon) logDryRun() {
+	args := p.Command.Args
+	if len(args) == 0 {
+		args = []string{p.Command.Path}
+	}
+
+	// The file was already read successfully by startLocked.
+	fileEnv, _ := p.envFile()
+	env := p.commandEnv(p.Command.Env, fileEnv)
+	if p.TokenDelivery == TokenDeliveryFile {
+		env = append(env, fmt.Sprintf("%s=<token file>", EnvProxyTokenFile))
+	}
+
+	kv := []interface{}{
+		"path", p.Command.Path,
+		"args", args[1:],
+		"dir", p.Command.Dir,
+		"env", redactEnv(redactEnvKey(env, p.tokenEnvName())),
+	}
+	if p.User != "" || p.Group != "" {
+		kv = append(kv, "user", p.User, "group", p.Group)
+	}
+	if p.Limits != (Limits{}) {
+		kv = append(kv, "max_open_files", p.Limits.MaxOpenFiles,
+			"max_memory", p.Limits.MaxMemory)
+	}
+	if p.NetnsPath != "" {
+		kv = append(kv, "netns", p.NetnsPath)
+	}
+	if p.LogPath != "" {
+		kv = append(kv, "log_path", p.LogPath)
+	}
+
+	p.logger().Info("dry run, not starting proxy", kv...)
+}
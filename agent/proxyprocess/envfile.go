@@ -0,0 +1,115 @@
+package proxyprocess
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readEnvFile reads the environment variables in the file at path. See
+// parseEnvFile for the format.
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading env file: %s", err)
+	}
+	defer f.Close()
+
+	env, err := parseEnvFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing env file %s: %s", path, err)
+	}
+
+	return env, nil
+}
+
+// parseEnvFile parses dotenv-style environment variables and returns them
+// as KEY=VALUE entries in the order they appear. Each line holds one
+// variable as KEY=VALUE, optionally preceded by "export". Empty lines and
+// lines starting with # are ignored. Values may be double quoted, in which
+// case Go escapes such as \n are interpreted, or single quoted, in which
+// case they are taken literally. Unquoted values end at a " #" comment.
+func parseEnvFile(r io.Reader) ([]string, error) {
+	var env []string
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		idx := strings.Index(line, "=")
+		if idx < 0 {
+			return nil, fmt.Errorf("line %d: missing '='", n)
+		}
+
+		key := strings.TrimSpace(line[:idx])
+		if !isEnvKey(key) {
+			return nil, fmt.Errorf("line %d: invalid variable name %q", n, key)
+		}
+
+		value, err := parseEnvValue(strings.TrimSpace(line[idx+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+
+		env = append(env, key+"="+value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// parseEnvValue returns the value of a variable in an env file given the
+// text after the '='.
+func parseEnvValue(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+
+	switch s[0] {
+	case '"':
+		value, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid double quoted value %s", s)
+		}
+		return value, nil
+
+	case '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return "", fmt.Errorf("unterminated single quoted value %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	}
+
+	if idx := strings.Index(s, " #"); idx >= 0 {
+		s = strings.TrimSpace(s[:idx])
+	}
+
+	return s, nil
+}
+
+// isEnvKey returns true if k is a valid environment variable name: letters,
+// digits and underscores, not starting with a digit.
+func isEnvKey(k string) bool {
+	if k == "" {
+		return false
+	}
+
+	for i, c := range k {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,106 @@
+package proxyprocess
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		Name     string
+		Input    string
+		Expected []string
+		Err      string
+	}{
+		{
+			"empty",
+			"",
+			nil,
+			"",
+		},
+		{
+			"comments and blank lines",
+			"# comment\n\n  # indented comment\nFOO=bar\n",
+			[]string{"FOO=bar"},
+			"",
+		},
+		{
+			"export and spaces",
+			"export FOO = bar baz \n",
+			[]string{"FOO=bar baz"},
+			"",
+		},
+		{
+			"inline comment",
+			"FOO=bar # comment\nBAR=a#b\n",
+			[]string{"FOO=bar", "BAR=a#b"},
+			"",
+		},
+		{
+			"double quoted",
+			`FOO="bar # not a comment\n"`,
+			[]string{"FOO=bar # not a comment\n"},
+			"",
+		},
+		{
+			"single quoted",
+			`FOO='bar\n'`,
+			[]string{`FOO=bar\n`},
+			"",
+		},
+		{
+			"empty value",
+			"FOO=\n",
+			[]string{"FOO="},
+			"",
+		},
+		{
+			"duplicates are kept in order",
+			"FOO=1\nFOO=2\n",
+			[]string{"FOO=1", "FOO=2"},
+			"",
+		},
+		{
+			"missing equals",
+			"FOO=1\nBAR\n",
+			nil,
+			"line 2: missing '='",
+		},
+		{
+			"invalid name",
+			"1FOO=1\n",
+			nil,
+			`line 1: invalid variable name "1FOO"`,
+		},
+		{
+			"unterminated double quote",
+			`FOO="bar`,
+			nil,
+			"line 1: invalid double quoted value",
+		},
+		{
+			"unterminated single quote",
+			`FOO='bar`,
+			nil,
+			"line 1: unterminated single quoted value",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			env, err := parseEnvFile(strings.NewReader(tc.Input))
+			if tc.Err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.Err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.Expected, env)
+		})
+	}
+}
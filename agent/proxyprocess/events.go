@@ -0,0 +1,116 @@
+package proxyprocess
+
+import (
+	"time"
+)
+
+// DaemonEventType is the type of a DaemonEvent.
+type DaemonEventType string
+
+const (
+	// DaemonEventStarted is published when a process was started, both
+	// initially and on restart.
+	DaemonEventStarted DaemonEventType = "started"
+
+	// DaemonEventReady is published when a process passed ReadyCheck. It
+	// isn't published if ReadyCheck isn't set.
+	DaemonEventReady DaemonEventType = "ready"
+
+	// DaemonEventExited is published when the process exited, whether or
+	// not it is going to be restarted.
+	DaemonEventExited DaemonEventType = "exited"
+
+	// DaemonEventRestarting is published right before a process that
+	// exited is started again.
+	DaemonEventRestarting DaemonEventType = "restarting"
+
+	// DaemonEventBackingOff is published when the restart of a process is
+	// delayed by the restart backoff.
+	DaemonEventBackingOff DaemonEventType = "backing-off"
+
+	// DaemonEventFailed is published when the supervision loop ends without
+	// Stop being called or the agent shutting down, so the process won't be
+	// restarted again. Reason says why.
+	DaemonEventFailed DaemonEventType = "permanently-failed"
+
+	// DaemonEventCompleted is published when the supervision loop ends
+	// because RestartPolicy says the process that exited isn't restarted.
+	// ExitCode is the exit code of that process.
+	DaemonEventCompleted DaemonEventType = "completed"
+
+	// DaemonEventStopped is published when Stop is called.
+	DaemonEventStopped DaemonEventType = "stopped"
+
+	// DaemonEventStuck is published when the process wasn't reaped within
+	// KillWait of being killed.
+	DaemonEventStuck DaemonEventType = "stuck"
+
+	// DaemonEventRepeatedExit is published when the process failed with
+	// the same exit code RepeatedExitThreshold times in a row. ExitCode is
+	// that exit code.
+	DaemonEventRepeatedExit DaemonEventType = "repeated-exit"
+
+	// DaemonEventStateChanged is published whenever the State of the daemon
+	// changes. State is the new state.
+	DaemonEventStateChanged DaemonEventType = "state-changed"
+)
+
+// DaemonEvent is a lifecycle event of a Daemon. See Daemon.Events.
+type DaemonEvent struct {
+	Type DaemonEventType
+	Time time.Time
+
+	// ProxyID is the ProxyID of the Daemon.
+	ProxyID string
+
+	// PID is the pid of the process the event is about, or zero if there
+	// is none.
+	PID int
+
+	// Attempt is the current restart attempt count.
+	Attempt uint32
+
+	// ExitCode is the exit code for DaemonEventExited and
+	// DaemonEventCompleted, or -1 if the process didn't exit normally or its
+	// exit status isn't known. It is -1 for all other events.
+	ExitCode int
+
+	// Wait is how long the restart is delayed for DaemonEventBackingOff.
+	Wait time.Duration
+
+	// TimeToReady is the time from the start of the process until it
+	// passed ReadyCheck for DaemonEventReady. It is zero if the process was
+	// adopted rather than started by the daemon.
+	TimeToReady time.Duration
+
+	// Reason is why the loop ended for DaemonEventFailed, and for
+	// DaemonEventStateChanged once the loop ended.
+	Reason LoopExitReason
+
+	// State is the new state for DaemonEventStateChanged.
+	State DaemonState
+
+	// FastExits is the number of consecutive exits within MinRuntime for
+	// DaemonEventExited and DaemonEventFailed. It is zero if MinRuntime
+	// isn't set.
+	FastExits uint
+
+	// RepeatedExits is the number of consecutive failed exits with the same
+	// exit code for DaemonEventRepeatedExit.
+	RepeatedExits uint
+}
+
+// publish sends e on Events, if set, without blocking. The event is dropped
+// if the channel isn't ready to receive it.
+func (p *Daemon) publish(e DaemonEvent) {
+	if p.Events == nil {
+		return
+	}
+
+	e.Time = p.now()
+	e.ProxyID = p.ProxyID
+	select {
+	case p.Events <- e:
+	default:
+	}
+}
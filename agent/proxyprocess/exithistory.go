@@ -0,0 +1,77 @@
+package proxyprocess
+
+import (
+	"os"
+	"time"
+)
+
+// DaemonExitHistorySize is the default for the ExitHistorySize field of
+// Daemon.
+const DaemonExitHistorySize = 10
+
+// ExitRecord describes one exit of a process of a Daemon. See
+// Daemon.ExitHistory.
+type ExitRecord struct {
+	// Time is when the exit was noticed.
+	Time time.Time
+
+	// PID is the pid of the process that exited.
+	PID int
+
+	// ExitCode is the exit code, or -1 if the process didn't exit normally
+	// or its exit status isn't known.
+	ExitCode int
+
+	// Signal is the signal that terminated the process, or nil if it
+	// wasn't terminated by a signal or that isn't known.
+	Signal os.Signal
+
+	// Err describes why the process exited when ExitCode is -1, if known.
+	// See Daemon.LastExit.
+	Err error
+
+	// Runtime is how long the process was supervised before it exited, or
+	// zero if that isn't known.
+	Runtime time.Duration
+
+	// Attempt is the restart attempt count at the time of the exit.
+	Attempt uint32
+}
+
+// exitHistorySize returns ExitHistorySize or its default. It is zero if the
+// history is disabled.
+func (p *Daemon) exitHistorySize() int {
+	switch {
+	case p.ExitHistorySize < 0:
+		return 0
+	case p.ExitHistorySize == 0:
+		return DaemonExitHistorySize
+	default:
+		return p.ExitHistorySize
+	}
+}
+
+// recordExit adds r to the exit history, dropping the oldest record once
+// the history is full. The lock must be held.
+func (p *Daemon) recordExit(r ExitRecord) {
+	size := p.exitHistorySize()
+	if size == 0 {
+		return
+	}
+
+	p.exitHistory = append(p.exitHistory, r)
+	if drop := len(p.exitHistory) - size; drop > 0 {
+		// Copy rather than reslice so the dropped records can be collected.
+		p.exitHistory = append([]ExitRecord(nil), p.exitHistory[drop:]...)
+	}
+}
+
+// ExitHistory returns a copy of the most recent exits of the process, oldest
+// first, to help diagnose a proxy that keeps exiting after the fact. At
+// most ExitHistorySize exits are kept, and the history is kept across
+// restarts for the lifetime of the Daemon.
+func (p *Daemon) ExitHistory() []ExitRecord {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]ExitRecord(nil), p.exitHistory...)
+}
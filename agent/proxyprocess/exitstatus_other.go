@@ -1,4 +1,4 @@
-// +build !darwin,!linux,!windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
 
 package proxyprocess
 
@@ -8,3 +8,8 @@ import "os"
 func exitStatus(ps *os.ProcessState) (int, bool) {
 	return 0, false
 }
+
+// exitSignal for other platforms where we don't know how to extract it.
+func exitSignal(ps *os.ProcessState) (os.Signal, bool) {
+	return nil, false
+}
@@ -0,0 +1,33 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package proxyprocess
+
+import (
+	"os"
+	"syscall"
+)
+
+// exitStatus for Unix platforms, which are listed at the top of this file
+// in the build constraints, using syscall.WaitStatus. This is false if the
+// process didn't exit normally, for example because it was terminated by a
+// signal.
+func exitStatus(ps *os.ProcessState) (int, bool) {
+	if status, ok := ps.Sys().(syscall.WaitStatus); ok && status.Exited() {
+		return status.ExitStatus(), true
+	}
+
+	return 0, false
+}
+
+// exitSignal returns the signal that terminated the process, if any.
+func exitSignal(ps *os.ProcessState) (os.Signal, bool) {
+	if ps == nil {
+		return nil, false
+	}
+
+	if status, ok := ps.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return status.Signal(), true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,49 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package proxyprocess
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitStatus(t *testing.T) {
+	t.Parallel()
+
+	for _, code := range []int{0, 1, 42, 255} {
+		cmd := helperProcess("exit", strconv.Itoa(code))
+		cmd.Run()
+
+		status, ok := exitStatus(cmd.ProcessState)
+		require.True(t, ok)
+		require.Equal(t, code, status)
+
+		_, ok = exitSignal(cmd.ProcessState)
+		require.False(t, ok)
+	}
+}
+
+func TestExitStatus_signaled(t *testing.T) {
+	t.Parallel()
+
+	td, closer := testTempDir(t)
+	defer closer()
+
+	cmd := helperProcess("stop-kill", filepath.Join(td, "file"))
+	require.NoError(t, cmd.Start())
+	require.NoError(t, cmd.Process.Signal(syscall.SIGKILL))
+	cmd.Wait()
+
+	// A process terminated by a signal has no exit status
+	_, ok := exitStatus(cmd.ProcessState)
+	require.False(t, ok)
+
+	sig, ok := exitSignal(cmd.ProcessState)
+	require.True(t, ok)
+	require.Equal(t, os.Signal(syscall.SIGKILL), sig)
+}
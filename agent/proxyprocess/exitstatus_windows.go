@@ -0,0 +1,23 @@
+// +build windows
+
+package proxyprocess
+
+import (
+	"os"
+	"syscall"
+)
+
+// exitStatus for Windows, where the exit code is always available. A
+// process that was killed exits with code 1.
+func exitStatus(ps *os.ProcessState) (int, bool) {
+	if status, ok := ps.Sys().(syscall.WaitStatus); ok {
+		return status.ExitStatus(), true
+	}
+
+	return 0, false
+}
+
+// exitSignal for Windows, where processes aren't terminated by signals.
+func exitSignal(ps *os.ProcessState) (os.Signal, bool) {
+	return nil, false
+}
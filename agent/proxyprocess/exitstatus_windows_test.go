@@ -0,0 +1,47 @@
+// +build windows
+
+package proxyprocess
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitStatus(t *testing.T) {
+	t.Parallel()
+
+	for _, code := range []int{0, 1, 42, 255} {
+		cmd := helperProcess("exit", strconv.Itoa(code))
+		cmd.Run()
+
+		status, ok := exitStatus(cmd.ProcessState)
+		require.True(t, ok)
+		require.Equal(t, code, status)
+
+		_, ok = exitSignal(cmd.ProcessState)
+		require.False(t, ok)
+	}
+}
+
+func TestExitStatus_killed(t *testing.T) {
+	t.Parallel()
+
+	td, closer := testTempDir(t)
+	defer closer()
+
+	cmd := helperProcess("stop-kill", filepath.Join(td, "file"))
+	require.NoError(t, cmd.Start())
+	require.NoError(t, cmd.Process.Kill())
+	cmd.Wait()
+
+	// There are no signals, a killed process exits with code 1
+	status, ok := exitStatus(cmd.ProcessState)
+	require.True(t, ok)
+	require.Equal(t, 1, status)
+
+	_, ok = exitSignal(cmd.ProcessState)
+	require.False(t, ok)
+}
@@ -0,0 +1,57 @@
+package proxyprocess
+
+// watchHealth calls HealthCheck every HealthInterval while process is
+// running and ready. After HealthFailures failures in a row the process is
+// restarted the same way as by Restart. A passing check means the process
+// is healthy, so a later crash doesn't count towards the restart backoff.
+// This returns when stopCh is closed or the process was restarted.
+func (p *Daemon) watchHealth(process osProcess, stopCh <-chan struct{}) {
+	threshold := p.HealthFailures
+	if threshold <= 0 {
+		threshold = DaemonHealthFailures
+	}
+
+	failures := 0
+	for {
+		select {
+		case <-p.getClock().After(p.HealthInterval):
+		case <-stopCh:
+			return
+		}
+
+		// Don't probe a proxy that isn't expected to serve yet.
+		p.lock.Lock()
+		ready := p.ready && p.process == process
+		p.lock.Unlock()
+		if !ready {
+			continue
+		}
+
+		err := p.safeCall("HealthCheck", p.HealthCheck)
+		if err == nil {
+			failures = 0
+
+			p.lock.Lock()
+			if now := p.now(); p.attemptsDeadline.After(now) {
+				p.attemptsDeadline = now
+			}
+			p.lock.Unlock()
+			continue
+		}
+
+		failures++
+		p.logger().Warn("daemon health check failed",
+			"pid", process.Pid(), "failures", failures, "error", err)
+		if failures < threshold {
+			continue
+		}
+
+		p.logger().Warn("daemon unhealthy, restarting it", "pid", process.Pid())
+		p.profileUnresponsive(process)
+		if err := p.restartProcess(process, restartUnhealthy); err != nil {
+			p.logger().Warn("error restarting unhealthy daemon",
+				"pid", process.Pid(), "error", err)
+		}
+		return
+	}
+}
@@ -0,0 +1,51 @@
+package proxyprocess
+
+import (
+	"os"
+	"time"
+)
+
+// watchHeartbeat kills process if HeartbeatFile isn't modified for longer
+// than HeartbeatTimeout, so that a hung process is restarted by the
+// supervision loop. The time the watch starts counts as the first
+// heartbeat so the process has HeartbeatTimeout to write the file. This
+// returns when stopCh is closed or the process was killed.
+func (p *Daemon) watchHeartbeat(process osProcess, stopCh <-chan struct{}) {
+	timeout := p.HeartbeatTimeout
+	interval := timeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+
+	last := p.now()
+	for {
+		select {
+		case <-p.getClock().After(interval):
+		case <-stopCh:
+			return
+		}
+
+		if fi, err := os.Stat(p.HeartbeatFile); err == nil && fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+		if p.now().Sub(last) <= timeout {
+			continue
+		}
+
+		// Don't interfere with a process that is being stopped.
+		p.lock.Lock()
+		stopped := p.stopped
+		p.lock.Unlock()
+		if stopped {
+			return
+		}
+
+		p.logger().Warn("heartbeat file not updated in time, killing daemon",
+			"path", p.HeartbeatFile, "timeout", timeout, "pid", process.Pid())
+		p.profileUnresponsive(process)
+		if err := process.Kill(); err != nil && !isProcessAlreadyFinishedErr(err) {
+			p.logger().Warn("error killing hung daemon", "pid", process.Pid(), "error", err)
+		}
+		return
+	}
+}
@@ -0,0 +1,57 @@
+package proxyprocess
+
+// Limits are resource limits applied to the process of a Daemon. A zero
+// value means that limit isn't applied and is inherited from the agent.
+type Limits struct {
+	// MaxOpenFiles is the maximum number of open file descriptors
+	// (RLIMIT_NOFILE).
+	MaxOpenFiles uint64
+
+	// MaxMemory is the maximum size in bytes of the virtual memory of the
+	// process (RLIMIT_AS).
+	MaxMemory uint64
+}
+
+// limitResource identifies a resource limit independent of the platform.
+type limitResource int
+
+const (
+	limitOpenFiles limitResource = iota
+	limitMemory
+)
+
+func (r limitResource) String() string {
+	switch r {
+	case limitOpenFiles:
+		return "max open files"
+	case limitMemory:
+		return "max memory"
+	default:
+		return "unknown limit"
+	}
+}
+
+// applyLimits sets Limits on the process with the given pid. Limits that
+// can't be applied, for example because the platform doesn't support them,
+// are skipped with a warning so that the same configuration works
+// everywhere.
+func (p *Daemon) applyLimits(pid int) {
+	limits := []struct {
+		resource limitResource
+		value    uint64
+	}{
+		{limitOpenFiles, p.Limits.MaxOpenFiles},
+		{limitMemory, p.Limits.MaxMemory},
+	}
+
+	for _, l := range limits {
+		if l.value == 0 {
+			continue
+		}
+
+		if err := setProcessLimit(pid, l.resource, l.value); err != nil {
+			p.logger().Warn("error applying resource limit, continuing without it",
+				"pid", pid, "limit", l.resource.String(), "error", err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// +build linux
+
+package proxyprocess
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/testutil/retry"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDaemonStart_limits(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	d := &Daemon{
+		Command: helperProcess("start-stop", filepath.Join(td, "file")),
+		Logger:  testLogger,
+		Limits: Limits{
+			MaxOpenFiles: 128,
+			MaxMemory:    1 << 40,
+		},
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	var pid int
+	retry.Run(t, func(r *retry.R) {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		if d.process == nil {
+			r.Fatal("process not started")
+		}
+		pid = d.process.Pid()
+	})
+
+	raw, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/limits", pid))
+	require.NoError(err)
+
+	var openFiles, memory string
+	for _, line := range strings.Split(string(raw), "\n") {
+		switch {
+		case strings.HasPrefix(line, "Max open files"):
+			openFiles = strings.Join(strings.Fields(line)[3:5], " ")
+		case strings.HasPrefix(line, "Max address space"):
+			memory = strings.Join(strings.Fields(line)[3:5], " ")
+		}
+	}
+	require.Equal("128 128", openFiles)
+	require.Equal("1099511627776 1099511627776", memory)
+}
@@ -0,0 +1,80 @@
+package proxyprocess
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// discardLogger is used in place of a nil Daemon.Logger.
+var discardLogger = log.New(ioutil.Discard, "", 0)
+
+// Logger is a leveled logger that takes structured data as alternating
+// key/value pairs after the message. It is a subset of hclog.Logger so an
+// hclog.Logger can be used directly.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// stdLogger adapts a *log.Logger to Logger. Lines are formatted like the
+// rest of the agent's logs, with the key/value pairs appended:
+//
+//	[WARN] agent/proxy: message: key=value key2=value2
+type stdLogger struct {
+	logger *log.Logger
+}
+
+func (l *stdLogger) Debug(msg string, args ...interface{}) { l.log("DEBUG", msg, args) }
+func (l *stdLogger) Info(msg string, args ...interface{})  { l.log("INFO", msg, args) }
+func (l *stdLogger) Warn(msg string, args ...interface{})  { l.log("WARN", msg, args) }
+func (l *stdLogger) Error(msg string, args ...interface{}) { l.log("ERR", msg, args) }
+
+func (l *stdLogger) log(level, msg string, args []interface{}) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "[%s] agent/proxy: %s", level, msg)
+
+	for i := 0; i < len(args); i += 2 {
+		sep := " "
+		if i == 0 {
+			sep = ": "
+		}
+
+		if i+1 < len(args) {
+			fmt.Fprintf(&buf, "%s%v=%v", sep, args[i], args[i+1])
+		} else {
+			fmt.Fprintf(&buf, "%s%v", sep, args[i])
+		}
+	}
+
+	l.logger.Print(buf.String())
+}
+
+// argsLogger is a Logger that adds args to the key/value pairs of every
+// message of another Logger.
+type argsLogger struct {
+	logger Logger
+	args   []interface{}
+}
+
+func (l *argsLogger) Debug(msg string, args ...interface{}) { l.logger.Debug(msg, l.with(args)...) }
+func (l *argsLogger) Info(msg string, args ...interface{})  { l.logger.Info(msg, l.with(args)...) }
+func (l *argsLogger) Warn(msg string, args ...interface{})  { l.logger.Warn(msg, l.with(args)...) }
+func (l *argsLogger) Error(msg string, args ...interface{}) { l.logger.Error(msg, l.with(args)...) }
+
+func (l *argsLogger) with(args []interface{}) []interface{} {
+	return append(l.args[:len(l.args):len(l.args)], args...)
+}
+
+// stdLogger returns Logger, or a logger that discards everything if it isn't
+// set.
+func (p *Daemon) stdLogger() *log.Logger {
+	if p.Logger == nil {
+		return discardLogger
+	}
+
+	return p.Logger
+}
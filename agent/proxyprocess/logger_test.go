@@ -0,0 +1,145 @@
+package proxyprocess
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/testutil/retry"
+	"github.com/stretchr/testify/require"
+)
+
+// testStructuredLogger is a Logger that records all messages.
+type testStructuredLogger struct {
+	lock    sync.Mutex
+	entries []testLogEntry
+}
+
+type testLogEntry struct {
+	Level string
+	Msg   string
+	Args  map[string]interface{}
+}
+
+func (l *testStructuredLogger) Debug(msg string, args ...interface{}) { l.log("DEBUG", msg, args) }
+func (l *testStructuredLogger) Info(msg string, args ...interface{})  { l.log("INFO", msg, args) }
+func (l *testStructuredLogger) Warn(msg string, args ...interface{})  { l.log("WARN", msg, args) }
+func (l *testStructuredLogger) Error(msg string, args ...interface{}) { l.log("ERR", msg, args) }
+
+func (l *testStructuredLogger) log(level, msg string, args []interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	e := testLogEntry{Level: level, Msg: msg, Args: make(map[string]interface{})}
+	for i := 0; i+1 < len(args); i += 2 {
+		e.Args[fmt.Sprint(args[i])] = args[i+1]
+	}
+	l.entries = append(l.entries, e)
+}
+
+// Find returns the first entry with the given message.
+func (l *testStructuredLogger) Find(msg string) (testLogEntry, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, e := range l.entries {
+		if e.Msg == msg {
+			return e, true
+		}
+	}
+
+	return testLogEntry{}, false
+}
+
+// Count returns the number of entries with the given message.
+func (l *testStructuredLogger) Count(msg string) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	n := 0
+	for _, e := range l.entries {
+		if e.Msg == msg {
+			n++
+		}
+	}
+
+	return n
+}
+
+func TestStdLogger(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	var buf bytes.Buffer
+	l := &stdLogger{logger: log.New(&buf, "", 0)}
+	l.Warn("waiting before restarting daemon", "attempt", 4, "wait", "2s")
+	l.Error("giving up")
+	l.Debug("odd", "key")
+	require.Equal(
+		"[WARN] agent/proxy: waiting before restarting daemon: attempt=4 wait=2s\n"+
+			"[ERR] agent/proxy: giving up\n"+
+			"[DEBUG] agent/proxy: odd: key\n",
+		buf.String())
+}
+
+func TestDaemon_structuredLogger(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	logger := &testStructuredLogger{}
+	d := &Daemon{
+		Command:          helperProcess("exit", "3"),
+		ProxyID:          "tubes",
+		StructuredLogger: logger,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	var e testLogEntry
+	retry.Run(t, func(r *retry.R) {
+		var ok bool
+		if e, ok = logger.Find("daemon exited"); !ok {
+			r.Fatal("no exit logged")
+		}
+	})
+	require.NoError(d.Stop())
+
+	require.Equal("INFO", e.Level)
+	require.Equal("tubes", e.Args["proxy_id"])
+	require.Equal(filepath.Base(os.Args[0]), e.Args["daemon"])
+	require.Equal(3, e.Args["exit_code"])
+	require.NotZero(e.Args["pid"])
+}
+
+func TestDaemon_loggerName(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	d := &Daemon{
+		Command: exec.Command("/usr/local/bin/envoy"),
+		ProxyID: "web-proxy",
+		Logger:  log.New(&buf, "", 0),
+	}
+	d.logger().Warn("restarting", "attempt", 2)
+
+	// An explicit name overrides the command base name
+	d.Name = "web-sidecar"
+	d.logger().Warn("restarting", "attempt", 3)
+
+	// With no command and no proxy ID the message is left alone
+	d = &Daemon{Logger: log.New(&buf, "", 0)}
+	d.logger().Warn("restarting")
+
+	require.Equal(t,
+		"[WARN] agent/proxy: restarting: daemon=envoy proxy_id=web-proxy attempt=2\n"+
+			"[WARN] agent/proxy: restarting: daemon=web-sidecar proxy_id=web-proxy attempt=3\n"+
+			"[WARN] agent/proxy: restarting\n",
+		buf.String())
+}
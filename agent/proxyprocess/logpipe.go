@@ -0,0 +1,97 @@
+package proxyprocess
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// filterOutput creates a pipe whose write end should be given to a child
+// process as its stdout or stderr. Each line the child writes is passed
+// through fn along with whether it came from stderr and the result, unless
+// it is empty, is written to dst. The returned channel is closed once all
+// output has been copied, which happens when every copy of the write end
+// has been closed. The caller must close its copy of the write end after
+// the child is started.
+func filterOutput(dst io.Writer, stderr bool, fn func(string, bool) string) (*os.File, <-chan struct{}, error) {
+	if dst == nil {
+		dst = ioutil.Discard
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		defer r.Close()
+
+		// We use ReadString rather than a Scanner so that a very long line
+		// can't stop us from draining the pipe and block the child.
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if len(line) > 0 {
+				hasNewline := line[len(line)-1] == '\n'
+				if hasNewline {
+					line = line[:len(line)-1]
+				}
+
+				if line = fn(line, stderr); line != "" {
+					io.WriteString(dst, line+"\n")
+				}
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return w, doneCh, nil
+}
+
+// copyOutput is like filterOutput but copies the output to dst unchanged.
+func copyOutput(dst io.Writer) (*os.File, <-chan struct{}, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		defer r.Close()
+
+		// Keep draining the pipe if dst fails so the child never blocks.
+		if _, err := io.Copy(dst, r); err != nil {
+			io.Copy(ioutil.Discard, r)
+		}
+	}()
+
+	return w, doneCh, nil
+}
+
+// feedInput creates a pipe whose read end should be given to a child
+// process as its stdin, and copies src into it. src is closed once it was
+// copied completely or the child stopped reading, for example because it
+// exited. The caller must close its copy of the read end after the child
+// is started.
+func feedInput(src io.ReadCloser) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+
+	go func() {
+		defer src.Close()
+		defer w.Close()
+		io.Copy(w, src)
+	}()
+
+	return r, nil
+}
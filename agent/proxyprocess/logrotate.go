@@ -0,0 +1,151 @@
+package proxyprocess
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile is an io.WriteCloser that appends to the file at path and
+// rotates it once it would grow beyond maxBytes. On rotation the file is
+// renamed to path.1, the existing path.1 to path.2 and so on, keeping at
+// most maxFiles archives. All state is read from disk when the file is
+// opened so rotation carries on where it left off across restarts. If
+// rotating fails, for example because an archive can't be replaced, writes
+// carry on in the current file, which then grows beyond maxBytes until a
+// later rotation succeeds, rather than losing output.
+type rotatingFile struct {
+	path     string
+	mode     os.FileMode
+	uid, gid int
+	maxBytes int64
+	maxFiles int
+
+	lock sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// openRotatingFile opens the file at path for appending, creating it with
+// the given mode if necessary. Every file is owned by uid and gid, either
+// of which may be -1 to keep it.
+func openRotatingFile(path string, mode os.FileMode, uid, gid int, maxBytes int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:     path,
+		mode:     mode,
+		uid:      uid,
+		gid:      gid,
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Write writes b to the file. A write is never split across files: if it
+// doesn't fit the file is rotated first, unless the file is empty in which
+// case it is written as is even if it is larger than maxBytes.
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	if r.size > 0 && r.size+int64(len(b)) > r.maxBytes {
+		if err := r.rotate(); err != nil && r.f == nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the file.
+func (r *rotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// open opens the file at path and records its current size. This must be
+// called with the lock held.
+func (r *rotatingFile) open() error {
+	f, err := openLogFile(r.path, r.mode)
+	if err != nil {
+		return err
+	}
+	if err := chownLogFile(f, r.uid, r.gid); err != nil {
+		f.Close()
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+// rotate closes the current file, shifts the archives and opens a new
+// file. The file at path is reopened even if shifting fails, in which case
+// the error is returned with the file open for appending. This must be
+// called with the lock held.
+func (r *rotatingFile) rotate() error {
+	err := r.f.Close()
+	r.f = nil
+	if err == nil {
+		err = r.shift()
+	}
+
+	if openErr := r.open(); openErr != nil {
+		return openErr
+	}
+
+	return err
+}
+
+// shift moves the closed file at path to the first archive, shifting the
+// existing archives up by one, or removes it if no archives are kept.
+func (r *rotatingFile) shift() error {
+	if r.maxFiles > 0 {
+		// Shift the archives up by one starting with the oldest, which is
+		// overwritten if we already keep the maximum number.
+		for i := r.maxFiles - 1; i > 0; i-- {
+			err := os.Rename(r.archivePath(i), r.archivePath(i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error rotating log file: %s", err)
+			}
+		}
+
+		if err := os.Rename(r.path, r.archivePath(1)); err != nil {
+			return fmt.Errorf("error rotating log file: %s", err)
+		}
+	} else if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error rotating log file: %s", err)
+	}
+
+	return nil
+}
+
+// archivePath returns the path of the n-th archive, 1 being the newest.
+func (r *rotatingFile) archivePath(n int) string {
+	return fmt.Sprintf("%s.%d", r.path, n)
+}
@@ -0,0 +1,46 @@
+package proxyprocess
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatingFile_rotateError(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	// A directory with content can't be replaced by the archive
+	path := filepath.Join(td, "proxy.log")
+	require.NoError(os.MkdirAll(filepath.Join(path+".1", "keep"), 0700))
+
+	r, err := openRotatingFile(path, 0600, -1, -1, 4, 1)
+	require.NoError(err)
+	defer r.Close()
+
+	// A failed rotation keeps writing to the current file
+	_, err = r.Write([]byte("one\n"))
+	require.NoError(err)
+	_, err = r.Write([]byte("two\n"))
+	require.NoError(err)
+	bs, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Equal("one\ntwo\n", string(bs))
+
+	// Once the archive can be written the next write rotates again
+	require.NoError(os.RemoveAll(path + ".1"))
+	_, err = r.Write([]byte("three\n"))
+	require.NoError(err)
+	bs, err = ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Equal("three\n", string(bs))
+	bs, err = ioutil.ReadFile(path + ".1")
+	require.NoError(err)
+	require.Equal("one\ntwo\n", string(bs))
+}
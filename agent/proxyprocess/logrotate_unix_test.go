@@ -0,0 +1,60 @@
+// +build !windows
+
+package proxyprocess
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDaemonStart_logFileOwner(t *testing.T) {
+	t.Parallel()
+
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner of files requires root")
+	}
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	owner := func(path string) (uint32, uint32) {
+		fi, err := os.Stat(path)
+		require.NoError(err)
+		st := fi.Sys().(*syscall.Stat_t)
+		return st.Uid, st.Gid
+	}
+
+	// The log file is owned by the user the process runs as
+	logPath := filepath.Join(td, "proxy.log")
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.LogPath = logPath
+	d.User = "65534"
+	d.Group = "65534"
+	require.NoError(d.Start())
+	defer d.Stop()
+	runner.Process(t, 0)
+	uid, gid := owner(logPath)
+	require.Equal(uint32(65534), uid)
+	require.Equal(uint32(65534), gid)
+
+	// So is every file created by rotation
+	rotatePath := filepath.Join(td, "rotate.log")
+	r, err := openRotatingFile(rotatePath, 0600, 65534, 65534, 4, 1)
+	require.NoError(err)
+	defer r.Close()
+	_, err = r.Write([]byte("one\n"))
+	require.NoError(err)
+	_, err = r.Write([]byte("two\n"))
+	require.NoError(err)
+	for _, path := range []string{rotatePath, rotatePath + ".1"} {
+		uid, gid := owner(path)
+		require.Equal(uint32(65534), uid)
+		require.Equal(uint32(65534), gid)
+	}
+}
@@ -2,10 +2,12 @@ package proxyprocess
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -72,6 +74,13 @@ type Manager struct {
 	// Extra environment variables to set for the proxies
 	ProxyEnv []string
 
+	// LogFileMode is the permission mode of the proxy log files in the
+	// logs directory. The mode is applied both when the files are created
+	// and to existing files. If this is zero then DaemonLogFileMode is used
+	// so that potentially sensitive proxy logs aren't readable by other
+	// users.
+	LogFileMode os.FileMode
+
 	// SnapshotPeriod is the duration between snapshots. This can be set
 	// relatively low to ensure accuracy, because if the new snapshot matches
 	// the last snapshot taken, no file will be written. Therefore, setting
@@ -94,6 +103,14 @@ type Manager struct {
 	// to the logger.
 	AllowRoot bool
 
+	// MaxConcurrentStarts, if non-zero, is how many daemons may be starting
+	// their process at the same time, so that many proxies, for example on
+	// agent startup, come up in waves rather than all at once. A daemon
+	// with a ReadyCheck counts as starting until it passed it or its
+	// ReadyTimeout ran out. Daemons beyond the limit wait for a slot in the
+	// background, so this doesn't delay syncs. It must be set before Run.
+	MaxConcurrentStarts int
+
 	// lock is held while reading/writing any internal state of the manager.
 	// cond is a condition variable on lock that is broadcasted for runState
 	// changes.
@@ -112,6 +129,10 @@ type Manager struct {
 	// proxies (unlikely scenario).
 	lastSnapshot *snapshot
 
+	// startSlots are shared by all daemons to enforce MaxConcurrentStarts.
+	// It is created on first use.
+	startSlots chan struct{}
+
 	proxies map[string]Proxy
 }
 
@@ -165,10 +186,20 @@ func (m *Manager) Close() error {
 // Kill will Close the manager and Kill all proxies that were being managed.
 // Only ONE of Kill or Close must be called. If Close has been called already
 // then this will have no effect.
+//
+// Before anything is stopped, all daemons are put into draining mode so a
+// proxy that exits while the manager is shutting down isn't restarted just
+// to be stopped again moments later.
 func (m *Manager) Kill() error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
+	for _, p := range m.proxies {
+		if d, ok := p.(*Daemon); ok {
+			d.setDraining()
+		}
+	}
+
 	return m.stop(func(p Proxy) error {
 		return p.Stop()
 	})
@@ -188,11 +219,11 @@ func (m *Manager) stop(cleaner func(Proxy) error) error {
 
 		switch m.runState {
 		case managerStateIdle:
-			// Idle so just set it to stopped and return. We notify
-			// the condition variable in case others are waiting.
+			// Idle so just set it to stopped. We notify the condition
+			// variable in case others are waiting. Proxies may still have
+			// been added with Upsert, Sync or Restore, so clean them up.
 			m.runState = managerStateStopped
 			m.cond.Broadcast()
-			return nil
 
 		case managerStateRunning:
 			// Set the state to stopping and broadcast to all waiters,
@@ -326,6 +357,294 @@ SYNC:
 	}
 }
 
+// ReopenLogs reopens the log files of all managed daemons at their
+// configured paths and closes the previous ones. This should be called after
+// an external tool rotated the files by moving them away. Processes started
+// afterwards write to the new files, as do running processes whose output
+// passes through the agent (see Daemon.SetOutput). Other running processes
+// keep writing to their moved files until they're restarted, so rotation
+// that truncates the files in place is preferable for those.
+func (m *Manager) ReopenLogs() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var result error
+	for id, proxy := range m.proxies {
+		d, ok := proxy.(*Daemon)
+		if !ok {
+			continue
+		}
+
+		var cmd exec.Cmd
+		if err := m.configureLogDir(id, &cmd); err != nil {
+			result = multierror.Append(
+				result, fmt.Errorf("failed to reopen logs for proxy %q: %s", id, err))
+			continue
+		}
+
+		oldStdout, oldStderr := d.SetOutput(cmd.Stdout, cmd.Stderr)
+		for _, w := range []io.Writer{oldStdout, oldStderr} {
+			if f, ok := w.(*os.File); ok {
+				f.Close()
+			}
+		}
+	}
+
+	return result
+}
+
+// RollingRestart restarts all managed proxies, batchSize at a time, so that
+// a set of replica proxies is never down all at once. Each proxy in a batch
+// is stopped and replaced with a freshly started one using the current
+// configuration from the local state. Daemons that aren't in the local
+// state, such as those added with Upsert, are restarted in place with
+// Daemon.Restart instead, and for other such proxies an error is returned
+// since there is no configuration to start them from. The next batch is only restarted once
+// every proxy in the current batch is ready, which for daemons means that
+// the process is running and passed its ReadyCheck, if any. If a proxy isn't ready within readyTimeout then
+// the restart is aborted with an error, leaving the remaining proxies
+// untouched.
+func (m *Manager) RollingRestart(batchSize int, readyTimeout time.Duration) error {
+	if batchSize < 1 {
+		return fmt.Errorf("batch size must be at least 1")
+	}
+
+	m.lock.Lock()
+	ids := make([]string, 0, len(m.proxies))
+	for id := range m.proxies {
+		ids = append(ids, id)
+	}
+	m.lock.Unlock()
+	sort.Strings(ids)
+
+	for len(ids) > 0 {
+		n := batchSize
+		if n > len(ids) {
+			n = len(ids)
+		}
+
+		restarted, err := m.restartProxies(ids[:n])
+		if err != nil {
+			return err
+		}
+		ids = ids[n:]
+
+		// Wait for the whole batch before moving on. We don't hold the
+		// lock while waiting so that syncs can still happen.
+		for id, proxy := range restarted {
+			if err := waitProxyReady(proxy, readyTimeout); err != nil {
+				return fmt.Errorf("proxy %q not ready after restart: %s", id, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// restartProxies replaces the proxies with the given IDs with newly started
+// ones, or restarts daemons that aren't in the local state in place, and
+// returns them. Proxies that were removed since the IDs were read are
+// skipped.
+//
+// Stopping a proxy can take as long as its DrainTimeout and GracefulWait,
+// so the old proxies are stopped without holding the lock and syncs can
+// carry on meanwhile. If a sync replaced or removed a proxy by the time it
+// is stopped, its replacement is dropped. An ID is never left pointing to a
+// stopped proxy: if the replacement fails to start, the ID is removed so
+// that the next sync creates the proxy again.
+func (m *Manager) restartProxies(ids []string) (map[string]Proxy, error) {
+	type restart struct {
+		id    string
+		old   Proxy
+		proxy Proxy // nil to restart old in place
+	}
+
+	m.lock.Lock()
+	if err := m.checkStart(); err != nil {
+		m.lock.Unlock()
+		return nil, err
+	}
+
+	var state map[string]*local.ManagedProxy
+	if m.State != nil {
+		state = m.State.Proxies()
+	}
+	restarts := make([]restart, 0, len(ids))
+	for _, id := range ids {
+		old, ok := m.proxies[id]
+		if !ok {
+			continue
+		}
+
+		stateProxy, ok := state[id]
+		if !ok {
+			if _, ok := old.(*Daemon); !ok {
+				m.lock.Unlock()
+				return nil, fmt.Errorf("proxy %q isn't in the local state and can't be restarted", id)
+			}
+			restarts = append(restarts, restart{id: id, old: old})
+			continue
+		}
+
+		proxy, err := m.newProxy(stateProxy)
+		if err != nil {
+			m.lock.Unlock()
+			return nil, fmt.Errorf("failed to initialize proxy for %q: %s", id, err)
+		}
+		restarts = append(restarts, restart{id: id, old: old, proxy: proxy})
+	}
+	m.lock.Unlock()
+
+	restarted := make(map[string]Proxy, len(restarts))
+	for _, r := range restarts {
+		if r.proxy == nil {
+			if err := r.old.(*Daemon).Restart(); err != nil {
+				return nil, fmt.Errorf("failed to restart proxy %q: %s", r.id, err)
+			}
+			restarted[r.id] = r.old
+			continue
+		}
+
+		// If stopping fails the old proxy is still recorded, as it was.
+		if err := r.old.Stop(); err != nil {
+			return nil, fmt.Errorf("failed to stop proxy %q: %s", r.id, err)
+		}
+
+		proxy, err := m.replaceProxy(r.id, r.old, r.proxy)
+		if err != nil {
+			return nil, err
+		}
+		if proxy != nil {
+			restarted[r.id] = proxy
+		}
+	}
+
+	return restarted, nil
+}
+
+// replaceProxy records and starts proxy as the proxy with the given ID in
+// place of old, which was stopped. If a sync replaced or removed old in
+// the meantime nothing is done and nil is returned. If proxy can't be
+// started the ID is removed.
+func (m *Manager) replaceProxy(id string, old, proxy Proxy) (Proxy, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.proxies[id] != old {
+		return nil, nil
+	}
+
+	if err := m.checkStart(); err != nil {
+		delete(m.proxies, id)
+		return nil, err
+	}
+
+	m.limitStarts(proxy)
+	if err := proxy.Start(); err != nil {
+		delete(m.proxies, id)
+		return nil, fmt.Errorf("failed to start proxy for %q: %s", id, err)
+	}
+
+	m.proxies[id] = proxy
+	return proxy, nil
+}
+
+// waitProxyReady waits up to timeout for the proxy to be ready after being
+// started, as reported by Daemon.Ready. Proxies other than daemons are ready
+// as soon as they're started.
+func waitProxyReady(proxy Proxy, timeout time.Duration) error {
+	d, ok := proxy.(*Daemon)
+	if !ok {
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for !d.Ready() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s", timeout)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// checkStart returns an error if the manager may not start proxies, because
+// it is stopped or running as root without AllowRoot. The lock must be held.
+func (m *Manager) checkStart() error {
+	if m.runState == managerStateStopping || m.runState == managerStateStopped {
+		return fmt.Errorf("manager is stopped")
+	}
+
+	// Same as sync, never start proxies as root unless allowed.
+	if !m.AllowRoot && isRoot() {
+		return fmt.Errorf("running as root, will not start managed proxies")
+	}
+
+	return nil
+}
+
+// Upsert starts proxy as the proxy with the given ID. If there already is a
+// proxy with that ID that is Equal to proxy it is left alone and proxy isn't
+// started, otherwise the existing proxy is stopped first.
+//
+// Upsert, Remove and Sync manage proxies without a State, for example for
+// proxies that come from configuration. If the Manager is Run with a State,
+// the next sync with the State undoes the changes.
+func (m *Manager) Upsert(id string, proxy Proxy) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.checkStart(); err != nil {
+		return err
+	}
+
+	desired := make(map[string]Proxy, len(m.proxies)+1)
+	for existingID, existing := range m.proxies {
+		desired[existingID] = existing
+	}
+	desired[id] = proxy
+
+	return m.syncLocked(desired)
+}
+
+// Remove stops the proxy with the given ID and stops managing it. It is not
+// an error if there is no such proxy. See Upsert.
+func (m *Manager) Remove(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	proxy, ok := m.proxies[id]
+	if !ok {
+		return nil
+	}
+
+	delete(m.proxies, id)
+	if err := proxy.Stop(); err != nil {
+		return fmt.Errorf("failed to stop proxy for %q: %s", id, err)
+	}
+
+	return nil
+}
+
+// Sync makes the managed proxies match desired, a map of proxy ID to proxy.
+// Proxies that are Equal to the desired proxy with the same ID are left
+// alone, ones that differ are stopped and replaced, ones that aren't desired
+// are stopped and new ones are started. Desired proxies that are left alone
+// are not started. Errors are aggregated, and a proxy that failed to start
+// isn't managed. See Upsert.
+func (m *Manager) Sync(desired map[string]Proxy) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.checkStart(); err != nil {
+		return err
+	}
+
+	return m.syncLocked(desired)
+}
+
 // sync syncs data with the local state store to update the current manager
 // state and start/stop necessary proxies.
 func (m *Manager) sync() {
@@ -338,63 +657,86 @@ func (m *Manager) sync() {
 		return
 	}
 
-	// Get the current set of proxies
+	// Get the current set of proxies and make the proxies so we can compare.
+	// This does not start them. If a proxy can't be made we keep the
+	// existing one, if any, rather than stopping it.
 	state := m.State.Proxies()
-
-	// Go through our existing proxies that we're currently managing to
-	// determine if they're still in the state or not. If they're in the
-	// state, we need to diff to determine if we're starting a new proxy
-	// If they're not in the state, then we need to stop the proxy since it
-	// is now orphaned.
-	for id, proxy := range m.proxies {
-		// Get the proxy.
-		stateProxy, ok := state[id]
-		if ok {
-			// Remove the proxy from the state so we don't start it new.
-			delete(state, id)
-
-			// Make the proxy so we can compare. This does not start it.
-			proxy2, err := m.newProxy(stateProxy)
-			if err != nil {
-				m.Logger.Printf("[ERROR] agent/proxy: failed to initialize proxy for %q: %s", id, err)
-				continue
+	desired := make(map[string]Proxy, len(state))
+	for id, stateProxy := range state {
+		proxy, err := m.newProxy(stateProxy)
+		if err != nil {
+			m.Logger.Printf("[ERR] agent/proxy: failed to initialize proxy for %q: %s", id, err)
+			if existing, ok := m.proxies[id]; ok {
+				desired[id] = existing
 			}
+			continue
+		}
+
+		desired[id] = proxy
+	}
 
-			// If the proxies are equal, then do nothing
-			if proxy.Equal(proxy2) {
-				continue
+	if err := m.syncLocked(desired); err != nil {
+		if merr, ok := err.(*multierror.Error); ok {
+			for _, err := range merr.Errors {
+				m.Logger.Printf("[ERR] agent/proxy: %s", err)
 			}
+		}
+	}
+}
 
-			// Proxies are not equal, so we should stop it. We add it
-			// back to the state here (unlikely case) so the loop below starts
-			// the new one.
-			state[id] = stateProxy
+// syncLocked makes the managed proxies match desired, as described for
+// Sync. The lock must be held.
+func (m *Manager) syncLocked(desired map[string]Proxy) error {
+	var result error
 
-			// Continue out of `if` as if proxy didn't exist so we stop it
+	// Go through our existing proxies to determine if they're still desired.
+	// If they are and the desired proxy is equal, there is nothing to do.
+	// Otherwise we stop the proxy since it is orphaned or outdated, and the
+	// loop below starts the desired one, if any.
+	for id, proxy := range m.proxies {
+		if proxy2, ok := desired[id]; ok && proxy.Equal(proxy2) {
+			continue
 		}
 
-		// Proxy is deregistered. Remove it from our map and stop it
 		delete(m.proxies, id)
 		if err := proxy.Stop(); err != nil {
-			m.Logger.Printf("[ERROR] agent/proxy: failed to stop deregistered proxy for %q: %s", id, err)
+			result = multierror.Append(
+				result, fmt.Errorf("failed to stop proxy for %q: %s", id, err))
 		}
 	}
 
-	// Remaining entries in state are new proxies. Start them!
-	for id, stateProxy := range state {
-		proxy, err := m.newProxy(stateProxy)
-		if err != nil {
-			m.Logger.Printf("[ERROR] agent/proxy: failed to initialize proxy for %q: %s", id, err)
+	// Remaining desired proxies are new. Start them!
+	for id, proxy := range desired {
+		if _, ok := m.proxies[id]; ok {
 			continue
 		}
 
+		m.limitStarts(proxy)
 		if err := proxy.Start(); err != nil {
-			m.Logger.Printf("[ERROR] agent/proxy: failed to start proxy for %q: %s", id, err)
+			result = multierror.Append(
+				result, fmt.Errorf("failed to start proxy for %q: %s", id, err))
 			continue
 		}
 
 		m.proxies[id] = proxy
 	}
+
+	return result
+}
+
+// limitStarts makes proxy, if it is a daemon, share the start slots that
+// enforce MaxConcurrentStarts. It must be called before the proxy is
+// started and the lock must be held.
+func (m *Manager) limitStarts(proxy Proxy) {
+	d, ok := proxy.(*Daemon)
+	if !ok || m.MaxConcurrentStarts <= 0 {
+		return
+	}
+
+	if m.startSlots == nil {
+		m.startSlots = make(chan struct{}, m.MaxConcurrentStarts)
+	}
+	d.startSlots = m.startSlots
 }
 
 // newProxy creates the proper Proxy implementation for the configured
@@ -482,13 +824,20 @@ func (m *Manager) configureLogDir(id string, cmd *exec.Cmd) error {
 	stdoutPath := logPath(logDir, id, "stdout")
 	stderrPath := logPath(logDir, id, "stderr")
 
+	mode := m.LogFileMode
+	if mode == 0 {
+		mode = DaemonLogFileMode
+	}
+
 	// Open the files. We want to append to each. We expect these files
-	// to be rotated by some external process.
-	stdoutF, err := os.OpenFile(stdoutPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	// to be rotated by some external process. They are owned by the agent
+	// since the daemons created here don't set User or Group and so run as
+	// the agent's user.
+	stdoutF, err := openLogFile(stdoutPath, mode)
 	if err != nil {
 		return fmt.Errorf("error creating stdout file: %s", err)
 	}
-	stderrF, err := os.OpenFile(stderrPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	stderrF, err := openLogFile(stderrPath, mode)
 	if err != nil {
 		// Don't forget to close stdoutF which successfully opened
 		stdoutF.Close()
@@ -501,6 +850,33 @@ func (m *Manager) configureLogDir(id string, cmd *exec.Cmd) error {
 	return nil
 }
 
+// openLogFile opens the log file at path for appending, creating it if
+// necessary, and makes sure it has the given mode even if it already
+// existed with a different mode.
+func openLogFile(path string, mode os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// chownLogFile changes the owner of the log file f to uid and gid, either
+// of which may be -1 to keep it.
+func chownLogFile(f *os.File, uid, gid int) error {
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+
+	return f.Chown(uid, gid)
+}
+
 // logPath is a helper to return the path to the log file for the given
 // directory, service ID, and stream type (stdout or stderr).
 func logPath(dir, id, stream string) string {
@@ -1,12 +1,15 @@
 package proxyprocess
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -28,6 +31,341 @@ func TestManagerClose_noRun(t *testing.T) {
 	require.NoError(t, m.Close())
 }
 
+func TestManagerKill_drainsDaemons(t *testing.T) {
+	t.Parallel()
+
+	m, closer := testManager(t)
+	defer closer()
+
+	d := &Daemon{Command: &exec.Cmd{}, Logger: testLogger}
+	m.proxies["web"] = d
+	require.NoError(t, m.Kill())
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	require.True(t, d.draining)
+}
+
+func TestManagerConfigureLogDir_fileMode(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	m, closer := testManager(t)
+	defer closer()
+
+	logDir := filepath.Join(m.DataDir, "logs")
+	stdoutPath := logPath(logDir, "web", "stdout")
+	stderrPath := logPath(logDir, "web", "stderr")
+
+	// By default files aren't readable by others
+	var cmd exec.Cmd
+	require.NoError(m.configureLogDir("web", &cmd))
+	cmd.Stdout.(*os.File).Close()
+	cmd.Stderr.(*os.File).Close()
+	for _, path := range []string{stdoutPath, stderrPath} {
+		fi, err := os.Stat(path)
+		require.NoError(err)
+		require.Equal(os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	// The configured mode is applied to existing files too
+	m.LogFileMode = 0640
+	require.NoError(m.configureLogDir("web", &cmd))
+	cmd.Stdout.(*os.File).Close()
+	cmd.Stderr.(*os.File).Close()
+	for _, path := range []string{stdoutPath, stderrPath} {
+		fi, err := os.Stat(path)
+		require.NoError(err)
+		require.Equal(os.FileMode(0640), fi.Mode().Perm())
+	}
+}
+
+func TestManagerReopenLogs(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	m, closer := testManager(t)
+	defer closer()
+
+	var cmd exec.Cmd
+	require.NoError(m.configureLogDir("web", &cmd))
+	d := &Daemon{Command: &cmd, Logger: testLogger}
+	m.proxies["web"] = d
+
+	// Rotate the log file away, as an external tool would
+	logDir := filepath.Join(m.DataDir, "logs")
+	stdoutPath := logPath(logDir, "web", "stdout")
+	require.NoError(os.Rename(stdoutPath, stdoutPath+".1"))
+
+	oldStdout := cmd.Stdout.(*os.File)
+	require.NoError(m.ReopenLogs())
+
+	// A new file exists at the configured path and the old one is closed
+	_, err := os.Stat(stdoutPath)
+	require.NoError(err)
+	require.Equal(stdoutPath, d.Command.Stdout.(*os.File).Name())
+	_, err = oldStdout.Write([]byte("hello"))
+	require.Error(err)
+}
+
+func TestManagerRollingRestart(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	state := local.TestState(t)
+	m, closer := testManager(t)
+	defer closer()
+	m.State = state
+	m.AllowRoot = true
+	defer m.Kill()
+
+	td, closer := testTempDir(t)
+	defer closer()
+	path := filepath.Join(td, "file")
+	webID := testStateProxy(t, state, "web", helperProcess("restart", path))
+	dbID := testStateProxy(t, state, "db", helperProcess("restart", path+"2"))
+	m.sync()
+
+	pids := func() map[string]int {
+		result := make(map[string]int)
+		for _, id := range []string{webID, dbID} {
+			d := m.proxies[id].(*Daemon)
+			require.NoError(waitProxyReady(d, 5*time.Second))
+
+			d.lock.Lock()
+			result[id] = d.process.Pid()
+			d.lock.Unlock()
+		}
+		return result
+	}
+	before := pids()
+
+	require.Error(m.RollingRestart(0, time.Second))
+	require.NoError(m.RollingRestart(1, 5*time.Second))
+
+	// Every proxy is replaced by a new process
+	after := pids()
+	for id, pid := range before {
+		require.NotEqual(pid, after[id], id)
+	}
+}
+
+func TestManagerRollingRestart_unlocked(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	state := local.TestState(t)
+	m, closer := testManager(t)
+	defer closer()
+	m.State = state
+	m.AllowRoot = true
+	defer m.Kill()
+
+	// The process ignores the interrupt so stopping it takes GracefulWait
+	td, closer := testTempDir(t)
+	defer closer()
+	webID := testStateProxy(t, state, "web", helperProcess("stop-kill", filepath.Join(td, "file")))
+	m.sync()
+	old := m.proxies[webID].(*Daemon)
+	require.NoError(waitProxyReady(old, 5*time.Second))
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- m.RollingRestart(1, 5*time.Second) }()
+	retry.Run(t, func(r *retry.R) {
+		if !old.Stats().Stopped {
+			r.Fatal("not stopping yet")
+		}
+	})
+
+	// The manager isn't locked while the old proxy is stopped
+	start := time.Now()
+	require.NoError(m.Upsert("noop", &Noop{}))
+	require.True(time.Since(start) < DaemonGracefulWait/2, "upsert waited for the stop")
+
+	require.NoError(<-errCh)
+	m.lock.Lock()
+	proxy := m.proxies[webID]
+	m.lock.Unlock()
+	require.False(proxy == old)
+	require.True(proxy.(*Daemon).Stats().Running)
+}
+
+func TestManagerRollingRestart_upsert(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	m, closer := testManager(t)
+	defer closer()
+	m.AllowRoot = true
+	defer m.Kill()
+
+	td, closer := testTempDir(t)
+	defer closer()
+	d := &Daemon{
+		Command: helperProcess("restart", filepath.Join(td, "file")),
+		Logger:  testLogger,
+	}
+	require.NoError(m.Upsert("web", d))
+	require.NoError(waitProxyReady(d, 5*time.Second))
+	pid := d.Stats().PID
+
+	// Without a State the daemon is restarted in place
+	require.NoError(m.RollingRestart(1, 5*time.Second))
+	require.True(m.proxies["web"] == d)
+	require.NotEqual(pid, d.Stats().PID)
+
+	// Other proxies can't be restarted without their configuration
+	require.NoError(m.Upsert("noop", &Noop{}))
+	err := m.RollingRestart(1, 5*time.Second)
+	require.Error(err)
+	require.Contains(err.Error(), "noop")
+}
+
+func TestManagerSync(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	m, closer := testManager(t)
+	defer closer()
+	m.AllowRoot = true
+	defer m.Kill()
+
+	td, closer := testTempDir(t)
+	defer closer()
+	webPath := filepath.Join(td, "web")
+	dbPath := filepath.Join(td, "db")
+	newDaemon := func(path, token string) *Daemon {
+		return &Daemon{
+			Command:    helperProcess("start-stop", path),
+			ProxyToken: token,
+			Logger:     testLogger,
+		}
+	}
+	waitFile := func(path, contents string) {
+		retry.Run(t, func(r *retry.R) {
+			bs, err := ioutil.ReadFile(path)
+			if err != nil {
+				r.Fatalf("error: %s", err)
+			}
+			if string(bs) != contents {
+				r.Fatalf("bad: %q", bs)
+			}
+		})
+	}
+
+	web, db := newDaemon(webPath, "a"), newDaemon(dbPath, "a")
+	require.NoError(m.Sync(map[string]Proxy{"web": web, "db": db}))
+	waitFile(webPath, ":a")
+	waitFile(dbPath, ":a")
+
+	// An equal proxy is left alone and a changed one is replaced
+	web2, db2 := newDaemon(webPath, "a"), newDaemon(dbPath, "b")
+	require.NoError(m.Sync(map[string]Proxy{"web": web2, "db": db2}))
+	waitFile(dbPath, ":b")
+	require.True(m.proxies["web"] == web)
+	require.True(m.proxies["db"] == db2)
+	require.False(web2.Stats().Running)
+	require.True(db.Stats().Stopped)
+
+	// Proxies that aren't desired anymore are stopped
+	require.NoError(m.Sync(nil))
+	require.Empty(m.proxies)
+	require.True(web.Stats().Stopped)
+	require.True(db2.Stats().Stopped)
+
+	// Start errors are returned and the proxy isn't managed
+	bad := &Daemon{Command: helperProcess("start-stop", webPath), RequireProxyToken: true}
+	err := m.Sync(map[string]Proxy{"web": bad})
+	require.Error(err)
+	require.Contains(err.Error(), `failed to start proxy for "web"`)
+	require.Empty(m.proxies)
+}
+
+func TestManagerSync_maxConcurrentStarts(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	m, closer := testManager(t)
+	defer closer()
+	m.AllowRoot = true
+	m.MaxConcurrentStarts = 1
+	defer m.Kill()
+
+	// Daemons hold on to their slot until they are ready
+	var ready int32
+	runner1, runner2 := &fakeRunner{}, &fakeRunner{}
+	newDaemon := func(runner *fakeRunner) *Daemon {
+		d := testFakeDaemon(runner)
+		d.ReadyCheck = func(ctx context.Context) error {
+			if atomic.LoadInt32(&ready) == 0 {
+				return fmt.Errorf("not ready")
+			}
+			return nil
+		}
+		return d
+	}
+	require.NoError(m.Sync(map[string]Proxy{
+		"web": newDaemon(runner1),
+		"db":  newDaemon(runner2),
+	}))
+
+	retry.Run(t, func(r *retry.R) {
+		if runner1.Starts()+runner2.Starts() == 0 {
+			r.Fatal("nothing started")
+		}
+	})
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(1, runner1.Starts()+runner2.Starts())
+
+	// Once the first one is ready the next one starts
+	atomic.StoreInt32(&ready, 1)
+	runner1.Process(t, 0)
+	runner2.Process(t, 0)
+}
+
+func TestManagerUpsertRemove(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	m, closer := testManager(t)
+	defer closer()
+	m.AllowRoot = true
+	defer m.Kill()
+
+	td, closer := testTempDir(t)
+	defer closer()
+	path := filepath.Join(td, "file")
+
+	d := &Daemon{Command: helperProcess("start-stop", path), Logger: testLogger}
+	require.NoError(m.Upsert("web", d))
+	retry.Run(t, func(r *retry.R) {
+		if !d.Stats().Running {
+			r.Fatal("not running")
+		}
+	})
+
+	// Upserting an equal proxy keeps the running one
+	d2 := &Daemon{Command: helperProcess("start-stop", path), Logger: testLogger}
+	require.NoError(m.Upsert("web", d2))
+	require.True(m.proxies["web"] == d)
+	require.False(d2.Stats().Running)
+
+	require.NoError(m.Remove("web"))
+	require.NoError(m.Remove("web"))
+	require.Empty(m.proxies)
+	require.True(d.Stats().Stopped)
+
+	// Killing the manager stops proxies even though it never ran
+	require.NoError(m.Upsert("web", d2))
+	require.NoError(m.Kill())
+	require.True(d2.Stats().Stopped)
+	require.Empty(m.proxies)
+
+	// Nothing is started once the manager is stopped
+	require.Error(m.Upsert("web", d2))
+	require.Error(m.Sync(map[string]Proxy{"web": d2}))
+}
+
 // Test that Run performs an initial sync (if local.State is already set)
 // rather than waiting for a notification from the local state.
 func TestManagerRun_initialSync(t *testing.T) {
@@ -364,6 +702,122 @@ func TestManagerPassesProxyEnv(t *testing.T) {
 }
 
 // Test the Snapshot/Restore works.
+func TestManagerRestore_idempotent(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	m, closer := testManager(t)
+	defer closer()
+	m.AllowRoot = true
+	defer m.Kill()
+
+	td, closer := testTempDir(t)
+	defer closer()
+	path := filepath.Join(td, "file")
+	d := &Daemon{Command: helperProcess("start-stop", path), Logger: testLogger}
+	require.NoError(m.Upsert("web", d))
+	retry.Run(t, func(r *retry.R) {
+		if !d.Stats().Running {
+			r.Fatal("not running")
+		}
+	})
+
+	snapPath := m.SnapshotPath()
+	require.NoError(m.Snapshot(snapPath))
+	require.NoError(m.Close())
+
+	// Restoring twice supervises the process only once
+	m2, closer := testManager(t)
+	defer closer()
+	m2.DataDir = m.DataDir
+	defer m2.Kill()
+	require.NoError(m2.Restore(snapPath))
+	restored := m2.proxies["web"]
+	require.NotNil(restored)
+	require.NoError(m2.Restore(snapPath))
+	require.Len(m2.proxies, 1)
+	require.True(m2.proxies["web"] == restored)
+
+	// Killing the restored manager stops the process
+	require.NoError(m2.Kill())
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			r.Fatalf("file still exists: %v", err)
+		}
+	})
+}
+
+func TestManagerRun_snapshotRestoreLogFileMode(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	state := local.TestState(t)
+	m, closer := testManager(t)
+	defer closer()
+	m.State = state
+	m.LogFileMode = 0640
+	defer m.Kill()
+
+	td, closer := testTempDir(t)
+	defer closer()
+	path := filepath.Join(td, "file")
+	id := testStateProxy(t, state, "web", helperProcess("start-stop", path))
+	go m.Run()
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(path); err != nil {
+			r.Fatalf("error waiting for path: %s", err)
+		}
+	})
+
+	snapPath := m.SnapshotPath()
+	require.NoError(m.Snapshot(snapPath))
+	require.NoError(m.Close())
+
+	// A non-default log file mode doesn't make the restored proxy differ
+	// from the one the first sync creates
+	m2, closer := testManager(t)
+	defer closer()
+	m2.State = state
+	m2.LogFileMode = 0640
+	defer m2.Kill()
+	require.NoError(m2.Restore(snapPath))
+	restored := m2.proxies[id]
+	require.NotNil(restored)
+	go m2.Run()
+
+	// Add a second proxy so that we know a sync happened
+	path2 := filepath.Join(td, "file2")
+	testStateProxy(t, state, "db", helperProcess("start-stop", path2))
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(path2); err != nil {
+			r.Fatalf("error waiting for path: %s", err)
+		}
+	})
+
+	m2.lock.Lock()
+	current := m2.proxies[id]
+	m2.lock.Unlock()
+	require.True(current == restored, "restored proxy was replaced")
+}
+
+func TestManagerRestore_corrupt(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	m, closer := testManager(t)
+	defer closer()
+
+	// A truncated snapshot is ignored
+	snapPath := m.SnapshotPath()
+	require.NoError(ioutil.WriteFile(snapPath, []byte(`{"Version":1,"Prox`), 0600))
+	require.NoError(m.Restore(snapPath))
+	require.Empty(m.proxies)
+
+	// An unknown version is still an error
+	require.NoError(ioutil.WriteFile(snapPath, []byte(`{"Version":99}`), 0600))
+	require.Error(m.Restore(snapPath))
+}
+
 func TestManagerRun_snapshotRestore(t *testing.T) {
 	t.Parallel()
 
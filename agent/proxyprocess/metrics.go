@@ -0,0 +1,86 @@
+package proxyprocess
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// metricLabels returns the labels of all metrics of the daemon: the proxy
+// ID followed by MetricLabels.
+func (p *Daemon) metricLabels() []metrics.Label {
+	labels := make([]metrics.Label, 0, len(p.MetricLabels)+1)
+	labels = append(labels, metrics.Label{Name: "proxy_id", Value: p.ProxyID})
+	return append(labels, p.MetricLabels...)
+}
+
+// emitRestart emits the metrics for a process that was restarted by the
+// supervision loop. The total_restarts gauge is the number of restarts
+// since Start, which unlike the restart attempts is never reset, so that
+// slow flapping shows up too.
+func (p *Daemon) emitRestart(recentRestarts int, totalRestarts uint64) {
+	labels := p.metricLabels()
+	metrics.IncrCounterWithLabels(
+		[]string{"agent", "proxy", "daemon", "restart"}, 1, labels)
+	metrics.SetGaugeWithLabels(
+		[]string{"agent", "proxy", "daemon", "recent_restarts"},
+		float32(recentRestarts), labels)
+	metrics.SetGaugeWithLabels(
+		[]string{"agent", "proxy", "daemon", "total_restarts"},
+		float32(totalRestarts), labels)
+}
+
+// emitBackoff emits the time the next start is delayed by the restart
+// backoff, in seconds. It is zero when not waiting.
+func (p *Daemon) emitBackoff(wait time.Duration) {
+	metrics.SetGaugeWithLabels(
+		[]string{"agent", "proxy", "daemon", "backoff_wait"},
+		float32(wait.Seconds()), p.metricLabels())
+}
+
+// emitTimeToReady emits the time a process took from being started to
+// passing ReadyCheck, in milliseconds. The start label tells initial starts
+// and restarts apart.
+func (p *Daemon) emitTimeToReady(d time.Duration, restarted bool) {
+	start := "initial"
+	if restarted {
+		start = "restart"
+	}
+
+	labels := append(p.metricLabels(), metrics.Label{Name: "start", Value: start})
+	metrics.AddSampleWithLabels(
+		[]string{"agent", "proxy", "daemon", "time_to_ready"},
+		float32(d.Seconds()*1000), labels)
+}
+
+// emitResources emits the resource usage of a process: the total CPU
+// time in seconds, the share of a CPU used since the last sample in
+// percent, and the resident memory in bytes.
+func (p *Daemon) emitResources(s ResourceSample) {
+	labels := p.metricLabels()
+	metrics.SetGaugeWithLabels(
+		[]string{"agent", "proxy", "daemon", "cpu_seconds"},
+		float32(s.CPUTime.Seconds()), labels)
+	metrics.SetGaugeWithLabels(
+		[]string{"agent", "proxy", "daemon", "cpu_percent"},
+		float32(s.CPUPercent), labels)
+	metrics.SetGaugeWithLabels(
+		[]string{"agent", "proxy", "daemon", "rss_bytes"},
+		float32(s.RSS), labels)
+}
+
+// emitStuck emits that a killed process wasn't reaped within KillWait.
+func (p *Daemon) emitStuck() {
+	metrics.IncrCounterWithLabels(
+		[]string{"agent", "proxy", "daemon", "stuck"}, 1, p.metricLabels())
+}
+
+// emitUptime emits how long a process that exited was supervised for.
+func (p *Daemon) emitUptime(start time.Time) {
+	if start.IsZero() {
+		return
+	}
+
+	metrics.MeasureSinceWithLabels(
+		[]string{"agent", "proxy", "daemon", "uptime"}, start, p.metricLabels())
+}
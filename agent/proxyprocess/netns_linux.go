@@ -0,0 +1,59 @@
+// +build linux
+
+package proxyprocess
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// startInNetns calls start with the calling OS thread moved into the network
+// namespace at path. A forked process inherits the namespaces of the thread
+// that forked it, so start must fork from that thread. This is done on a
+// dedicated goroutine locked to its thread. The thread is moved back to the
+// original namespace afterwards or, if that fails, discarded by letting the
+// goroutine exit while still locked so no other goroutine runs on it.
+//
+// Joining a network namespace requires CAP_SYS_ADMIN.
+func startInNetns(path string, start func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("error opening current network namespace: %s", err)
+			return
+		}
+		defer origin.Close()
+
+		target, err := os.Open(path)
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("error opening network namespace %q: %s", path, err)
+			return
+		}
+		defer target.Close()
+
+		if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("error joining network namespace %q: %s", path, err)
+			return
+		}
+
+		startErr := start()
+
+		// Only unlock the thread if it is back in the original namespace.
+		if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err == nil {
+			runtime.UnlockOSThread()
+		}
+
+		errCh <- startErr
+	}()
+
+	return <-errCh
+}
@@ -0,0 +1,38 @@
+// +build linux
+
+package proxyprocess
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartInNetns(t *testing.T) {
+	t.Parallel()
+
+	t.Run("missing namespace", func(t *testing.T) {
+		called := false
+		err := startInNetns("/does/not/exist", func() error {
+			called = true
+			return nil
+		})
+		require.Error(t, err)
+		require.False(t, called)
+	})
+
+	t.Run("current namespace", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("joining a network namespace requires root")
+		}
+
+		called := false
+		err := startInNetns("/proc/self/ns/net", func() error {
+			called = true
+			return nil
+		})
+		require.NoError(t, err)
+		require.True(t, called)
+	})
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package proxyprocess
+
+import (
+	"fmt"
+)
+
+// startInNetns is only supported on Linux.
+func startInNetns(path string, start func() error) error {
+	return fmt.Errorf("network namespaces are only supported on Linux")
+}
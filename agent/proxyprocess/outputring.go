@@ -0,0 +1,98 @@
+package proxyprocess
+
+import (
+	"bytes"
+	"sync"
+)
+
+// outputRing keeps the most recent lines of output of a process, dropping
+// the oldest lines once it holds maxLines lines or, if maxBytes is
+// positive, more than maxBytes bytes. It is safe for concurrent use.
+type outputRing struct {
+	maxLines int
+	maxBytes int
+
+	lock  sync.Mutex
+	lines []string
+	size  int
+}
+
+func newOutputRing(maxLines, maxBytes int) *outputRing {
+	return &outputRing{maxLines: maxLines, maxBytes: maxBytes}
+}
+
+// add appends line, truncating it to maxBytes if it is longer.
+func (r *outputRing) add(line string) {
+	if r.maxBytes > 0 && len(line) > r.maxBytes {
+		line = line[:r.maxBytes]
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.lines = append(r.lines, line)
+	r.size += len(line)
+
+	drop := 0
+	for len(r.lines)-drop > r.maxLines ||
+		(r.maxBytes > 0 && r.size > r.maxBytes) {
+		r.size -= len(r.lines[drop])
+		drop++
+	}
+	if drop > 0 {
+		// Copy rather than reslice so the dropped lines can be collected.
+		r.lines = append([]string(nil), r.lines[drop:]...)
+	}
+}
+
+// Lines returns a copy of the lines, oldest first.
+func (r *outputRing) Lines() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+// writer returns an io.Writer that adds each line written to it to the
+// ring. Each stream of output needs its own writer since a line may be
+// written in parts.
+func (r *outputRing) writer() *outputRingWriter {
+	return &outputRingWriter{ring: r}
+}
+
+// outputRingWriter is an io.Writer for an outputRing. It never fails so
+// that it can't hold up the process it records.
+type outputRingWriter struct {
+	ring    *outputRing
+	partial []byte
+}
+
+func (w *outputRingWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			break
+		}
+
+		w.partial = append(w.partial, b[:i]...)
+		w.ring.add(string(bytes.TrimSuffix(w.partial, []byte("\r"))))
+		w.partial = w.partial[:0]
+		b = b[i+1:]
+	}
+
+	// Don't buffer more of a partial line than the ring would keep.
+	w.partial = append(w.partial, b...)
+	if max := w.ring.maxBytes; max > 0 && len(w.partial) > max {
+		w.partial = w.partial[:max]
+	}
+
+	return n, nil
+}
+
+// Flush adds what is left of a line that wasn't terminated by a newline.
+func (w *outputRingWriter) Flush() {
+	if len(w.partial) > 0 {
+		w.ring.add(string(w.partial))
+		w.partial = nil
+	}
+}
@@ -0,0 +1,48 @@
+package proxyprocess
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutputRing(t *testing.T) {
+	t.Parallel()
+
+	t.Run("lines", func(t *testing.T) {
+		r := newOutputRing(3, 0)
+		w := r.writer()
+		w.Write([]byte("one\ntwo\nthr"))
+		require.Equal(t, []string{"one", "two"}, r.Lines())
+
+		// A line written in parts is only added once complete
+		w.Write([]byte("ee\r\nfour\nfive\n"))
+		require.Equal(t, []string{"three", "four", "five"}, r.Lines())
+
+		// An unterminated line is added on Flush
+		w.Write([]byte("six"))
+		w.Flush()
+		require.Equal(t, []string{"four", "five", "six"}, r.Lines())
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		r := newOutputRing(100, 10)
+		w := r.writer()
+		w.Write([]byte("abcd\nefgh\nijkl\n"))
+		require.Equal(t, []string{"efgh", "ijkl"}, r.Lines())
+
+		// A long line is truncated rather than dropping everything
+		w.Write([]byte(strings.Repeat("x", 50) + "\n"))
+		require.Equal(t, []string{strings.Repeat("x", 10)}, r.Lines())
+	})
+
+	t.Run("streams", func(t *testing.T) {
+		r := newOutputRing(10, 0)
+		stdout, stderr := r.writer(), r.writer()
+		stdout.Write([]byte("out "))
+		stderr.Write([]byte("err\n"))
+		stdout.Write([]byte("line\n"))
+		require.Equal(t, []string{"err", "out line"}, r.Lines())
+	})
+}
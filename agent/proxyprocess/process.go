@@ -1,7 +1,9 @@
 package proxyprocess
 
 import (
+	"os"
 	"strings"
+	"syscall"
 )
 
 // isProcessAlreadyFinishedErr does a janky comparison with an error string
@@ -12,3 +14,23 @@ import (
 func isProcessAlreadyFinishedErr(err error) bool {
 	return strings.Contains(err.Error(), "os: process already finished")
 }
+
+// isTransientSignalErr returns true if err from sending a signal only means
+// that the signal couldn't be sent right now, so sending it can be retried.
+func isTransientSignalErr(err error) bool {
+	if serr, ok := err.(*os.SyscallError); ok {
+		err = serr.Err
+	}
+
+	return err == syscall.EINTR || err == syscall.EAGAIN
+}
+
+// isInterruptedWaitErr returns true if err from waiting for a process only
+// means that the wait was interrupted, so the wait can be retried.
+func isInterruptedWaitErr(err error) bool {
+	if serr, ok := err.(*os.SyscallError); ok {
+		err = serr.Err
+	}
+
+	return err == syscall.EINTR
+}
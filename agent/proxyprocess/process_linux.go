@@ -0,0 +1,171 @@
+// +build linux
+
+package proxyprocess
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// configureDieWithParent makes the kernel kill the process started by cmd
+// when the agent exits. configureDaemon must have been called first.
+//
+// Note that the kernel tracks the thread that started the process rather
+// than the whole agent process, so the child is also killed if that OS
+// thread exits. The Go runtime only exits threads that were locked to a
+// goroutine which then returned.
+func configureDieWithParent(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+	return nil
+}
+
+// setProcessLimit sets both the soft and hard limit of resource of the
+// process with the given pid to value using prlimit(2).
+func setProcessLimit(pid int, resource limitResource, value uint64) error {
+	var r int
+	switch resource {
+	case limitOpenFiles:
+		r = unix.RLIMIT_NOFILE
+	case limitMemory:
+		r = unix.RLIMIT_AS
+	default:
+		return fmt.Errorf("unknown resource limit %d", resource)
+	}
+
+	limit := unix.Rlimit{Cur: value, Max: value}
+	_, _, errno := unix.RawSyscall6(unix.SYS_PRLIMIT64, uintptr(pid), uintptr(r),
+		uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// processExecutable returns the path of the executable running as the
+// given pid.
+func processExecutable(pid int) (string, error) {
+	return os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+}
+
+// processStartTime returns the time the process started, in clock ticks
+// since boot. Together with the pid this identifies a process since a pid
+// can be reused but not at the same start time.
+func processStartTime(pid int) (uint64, error) {
+	fields, err := processStatFields(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	// starttime is the 22nd field of the stat file, i.e. the 20th after comm.
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// processStatFields returns the fields of /proc/<pid>/stat following the
+// pid and comm fields, so the first field is the state.
+func processStatFields(pid int) ([]string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	// The format is "pid (comm) state ppid pgrp ...". comm may contain
+	// spaces and parentheses so we look after the last ')'.
+	stat := string(data)
+	idx := strings.LastIndex(stat, ")")
+	if idx < 0 {
+		return nil, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+
+	return strings.Fields(stat[idx+1:]), nil
+}
+
+// clockTicksPerSecond is the unit of the CPU times in /proc/<pid>/stat.
+// It is USER_HZ, which is 100 on all architectures Go supports.
+const clockTicksPerSecond = 100
+
+// processResources returns the total user and system CPU time and the
+// resident set size in bytes of the process with the given pid.
+func processResources(pid int) (time.Duration, uint64, error) {
+	fields, err := processStatFields(pid)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// utime and stime are the 14th and 15th fields of the stat file, i.e.
+	// the 12th and 13th after comm.
+	if len(fields) < 13 {
+		return 0, 0, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	var ticks uint64
+	for _, field := range fields[11:13] {
+		v, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("unexpected format of /proc/%d/stat: %s", pid, err)
+		}
+		ticks += v
+	}
+
+	// The second field of statm is the resident set size in pages.
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	statm := strings.Fields(string(data))
+	if len(statm) < 2 {
+		return 0, 0, fmt.Errorf("unexpected format of /proc/%d/statm", pid)
+	}
+	pages, err := strconv.ParseUint(statm[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected format of /proc/%d/statm: %s", pid, err)
+	}
+
+	cpu := time.Duration(ticks) * time.Second / clockTicksPerSecond
+	return cpu, pages * uint64(os.Getpagesize()), nil
+}
+
+// processGroupMembers returns the pids of all live (non-zombie) processes
+// in the process group pgid.
+func processGroupMembers(pgid int) ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	var result []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		// The process may exit while we're looking so errors are ignored.
+		fields, err := processStatFields(pid)
+		if err != nil || len(fields) < 3 || fields[0] == "Z" {
+			continue
+		}
+
+		if fields[2] == strconv.Itoa(pgid) {
+			result = append(result, pid)
+		}
+	}
+
+	return result, nil
+}
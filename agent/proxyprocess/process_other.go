@@ -0,0 +1,39 @@
+// +build !linux
+
+package proxyprocess
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// configureDieWithParent is not supported on this platform.
+func configureDieWithParent(cmd *exec.Cmd) error {
+	return fmt.Errorf("DieWithParent is only supported on Linux")
+}
+
+// processExecutable is not supported on this platform.
+func processExecutable(pid int) (string, error) {
+	return "", fmt.Errorf("determining the executable of a process is not supported on this platform")
+}
+
+// processGroupMembers is not supported on this platform.
+func processGroupMembers(pgid int) ([]int, error) {
+	return nil, fmt.Errorf("listing process group members is not supported on this platform")
+}
+
+// setProcessLimit is not supported on this platform.
+func setProcessLimit(pid int, resource limitResource, value uint64) error {
+	return fmt.Errorf("setting resource limits of a process is not supported on this platform")
+}
+
+// processResources is not supported on this platform.
+func processResources(pid int) (time.Duration, uint64, error) {
+	return 0, 0, fmt.Errorf("sampling the resource usage of a process is not supported on this platform")
+}
+
+// processStartTime is not supported on this platform.
+func processStartTime(pid int) (uint64, error) {
+	return 0, fmt.Errorf("determining the start time of a process is not supported on this platform")
+}
@@ -9,6 +9,17 @@ import (
 	"syscall"
 )
 
+// defaultReExecSignal is the signal sent by Daemon.ReExec by default.
+var defaultReExecSignal os.Signal = syscall.SIGUSR2
+
+// defaultReloadSignal is the signal sent by Daemon.Reload by default.
+var defaultReloadSignal os.Signal = syscall.SIGHUP
+
+// isExecutable returns true if any of the execute bits of the file is set.
+func isExecutable(fi os.FileInfo) bool {
+	return fi.Mode()&0111 != 0
+}
+
 // findProcess for non-Windows. Note that this very likely doesn't
 // work for all non-Windows platforms Go supports and we should expand
 // support as we experience it.
@@ -30,9 +41,68 @@ func findProcess(pid int) (*os.Process, error) {
 	return nil, fmt.Errorf("process %d is dead or running as another user", pid)
 }
 
+// checkCredential returns an error if the agent isn't allowed to start a
+// process as the given uid and gid, which requires running as root unless
+// they are the agent's own. Checking this up front gives a clear error
+// rather than a failure to exec.
+func checkCredential(uid, gid uint32) error {
+	euid := os.Geteuid()
+	if euid == 0 || (uint32(euid) == uid && uint32(os.Getegid()) == gid) {
+		return nil
+	}
+
+	return fmt.Errorf("running a proxy as uid %d and gid %d requires "+
+		"the agent to run as root", uid, gid)
+}
+
+// configureCredential makes the process started by cmd run as the given
+// uid and gid, without any supplementary groups. configureDaemon must have
+// been called first.
+func configureCredential(cmd *exec.Cmd, uid, gid uint32) error {
+	if err := checkCredential(uid, gid); err != nil {
+		return err
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+	return nil
+}
+
 // configureDaemon is called prior to Start to allow system-specific setup.
 func configureDaemon(cmd *exec.Cmd) {
 	// Start it in a new sessions (and hence process group) so that killing agent
 	// (even with Ctrl-C) won't kill proxy.
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
 }
+
+// signalProcessGroup sends sig to process. If the process leads its own
+// process group, as the daemons we start do, the signal is sent to the whole
+// group so that children of the process get it too. A process that has
+// already been waited for is never signalled since its pid may have been
+// reused.
+func signalProcessGroup(process *os.Process, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return process.Signal(sig)
+	}
+
+	pgid, err := syscall.Getpgid(process.Pid)
+	if err != nil || pgid != process.Pid {
+		return process.Signal(sig)
+	}
+
+	// Signal the process itself first. This fails if it was already
+	// waited for, in which case we don't touch the group either.
+	if err := process.Signal(sig); err != nil {
+		return err
+	}
+
+	if err := syscall.Kill(-pgid, s); err != nil && err != syscall.ESRCH {
+		return err
+	}
+
+	return nil
+}
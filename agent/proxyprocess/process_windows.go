@@ -3,10 +3,28 @@
 package proxyprocess
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/windows"
 )
 
+// defaultReExecSignal is nil since there is no conventional signal for
+// re-executing a process on Windows.
+var defaultReExecSignal os.Signal
+
+// defaultReloadSignal is nil since there is no conventional signal for
+// reloading the configuration of a process on Windows.
+var defaultReloadSignal os.Signal
+
+// isExecutable always returns true since Windows has no execute permission
+// bits. Whether the file can actually be executed is left to starting it.
+func isExecutable(fi os.FileInfo) bool {
+	return true
+}
+
 func findProcess(pid int) (*os.Process, error) {
 	// On Windows, os.FindProcess will error if the process is not alive,
 	// so we don't have to do any further checking. The nature of it being
@@ -14,6 +32,47 @@ func findProcess(pid int) (*os.Process, error) {
 	return os.FindProcess(pid)
 }
 
+// procGenerateConsoleCtrlEvent sends a console control event to a process
+// group. It isn't available in the syscall package.
+var procGenerateConsoleCtrlEvent = windows.NewLazySystemDLL("kernel32.dll").
+	NewProc("GenerateConsoleCtrlEvent")
+
+// configureDaemon starts the process in a new process group so that it can
+// be sent a CTRL_BREAK event by signalProcessGroup without the agent receiving
+// it too.
 func configureDaemon(cmd *exec.Cmd) {
-	// Do nothing
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
+	}
+}
+
+// checkCredential always fails since running a process as another user
+// isn't supported on Windows.
+func checkCredential(uid, gid uint32) error {
+	return fmt.Errorf("running a proxy as another user is not supported on Windows")
+}
+
+// configureCredential is not supported on Windows.
+func configureCredential(cmd *exec.Cmd, uid, gid uint32) error {
+	return checkCredential(uid, gid)
+}
+
+// signalProcessGroup sends sig to process. Windows can't deliver signals, so
+// os.Interrupt is sent as a CTRL_BREAK event to the process group of the
+// process, which the process must have been started in with configureDaemon.
+// Go programs see this as os.Interrupt. This only works if the process shares
+// the console of the agent, otherwise an error is returned and the caller
+// falls back to killing the process.
+func signalProcessGroup(process *os.Process, sig os.Signal) error {
+	if sig != os.Interrupt {
+		return process.Signal(sig)
+	}
+
+	r, _, err := procGenerateConsoleCtrlEvent.Call(
+		windows.CTRL_BREAK_EVENT, uintptr(process.Pid))
+	if r == 0 {
+		return fmt.Errorf("error sending CTRL_BREAK: %s", err)
+	}
+
+	return nil
 }
@@ -21,6 +21,11 @@ const (
 	// to managed proxies containing the proxy token.
 	EnvProxyToken = "CONNECT_PROXY_TOKEN"
 
+	// EnvProxyTokenFile is the name of the environment variable that is
+	// passed to managed proxies instead of EnvProxyToken when the token is
+	// delivered in a file. It contains the path of that file.
+	EnvProxyTokenFile = "CONNECT_PROXY_TOKEN_FILE"
+
 	// EnvSidecarFor is the name of the environment variable that is set for
 	// sidecar proxies containing the service ID of their target on the local
 	// agent
@@ -1,7 +1,9 @@
 package proxyprocess
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -10,6 +12,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -35,11 +38,88 @@ func testTempDir(t *testing.T) (string, func()) {
 	}
 }
 
+// syncBuffer is a bytes.Buffer that is safe for concurrent use. It can be
+// used as the output of a process that is written by another goroutine.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// testTracer is a Tracer that records all spans.
+type testTracer struct {
+	lock  sync.Mutex
+	spans []*testSpan
+}
+
+// testSpan is a Span recorded by testTracer.
+type testSpan struct {
+	tracer *testTracer
+	Name   string
+	Attrs  map[string]interface{}
+	Ended  bool
+	Err    error
+}
+
+func (t *testTracer) StartSpan(name string, attrs map[string]interface{}) Span {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s := &testSpan{tracer: t, Name: name, Attrs: make(map[string]interface{})}
+	for k, v := range attrs {
+		s.Attrs[k] = v
+	}
+	t.spans = append(t.spans, s)
+	return s
+}
+
+// Spans returns a copy of the ended spans in the order they were started.
+func (t *testTracer) Spans() []testSpan {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var result []testSpan
+	for _, s := range t.spans {
+		if s.Ended {
+			result = append(result, *s)
+		}
+	}
+	return result
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) {
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	s.Attrs[key] = value
+}
+
+func (s *testSpan) End(err error) {
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	s.Ended = true
+	s.Err = err
+}
+
 // helperProcessSentinel is a sentinel value that is put as the first
 // argument following "--" and is used to determine if TestHelperProcess
 // should run.
 const helperProcessSentinel = "WANT_HELPER_PROCESS"
 
+// testDieWithParentEnv is set for the "parent" helper process to make it
+// start its child with DieWithParent.
+const testDieWithParentEnv = "TEST_DIE_WITH_PARENT"
+
 // helperProcess returns an *exec.Cmd that can be used to execute the
 // TestHelperProcess function below. This can be used to test multi-process
 // interactions.
@@ -171,6 +251,203 @@ func TestHelperProcess(t *testing.T) {
 
 		<-stop
 
+	// Token writes the proxy token from the environment and the contents of
+	// the token file, if any, separated by a newline to the file given as
+	// the first argument and then waits to be interrupted.
+	case "token":
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt)
+		defer signal.Stop(stop)
+
+		var fileToken []byte
+		if tokenPath := os.Getenv(EnvProxyTokenFile); tokenPath != "" {
+			var err error
+			if fileToken, err = ioutil.ReadFile(tokenPath); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+
+		data := os.Getenv(EnvProxyToken) + "\n" + string(fileToken)
+		if err := ioutil.WriteFile(args[0], []byte(data), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		<-stop
+
+	// Token-reload writes the token from the file named by
+	// EnvProxyTokenFile to the file given as the first argument, and
+	// rereads it on SIGHUP.
+	case "token-reload":
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGHUP)
+		defer signal.Stop(ch)
+
+		for {
+			token, err := ioutil.ReadFile(os.Getenv(EnvProxyTokenFile))
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if err := ioutil.WriteFile(args[0], token, 0644); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			if sig := <-ch; sig == os.Interrupt {
+				return
+			}
+		}
+
+	// Extra-file copies the contents of file descriptor 3 to the file given
+	// as the first argument and waits for an interrupt.
+	case "extra-file":
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt)
+		defer signal.Stop(stop)
+
+		// Read from the start since the offset is shared with the agent
+		// and earlier processes.
+		f := os.NewFile(3, "extra")
+		data, err := ioutil.ReadAll(io.NewSectionReader(f, 0, 1<<20))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := ioutil.WriteFile(args[0], data, 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		<-stop
+
+	// Stdin copies stdin to the file given as the first argument and waits
+	// for an interrupt.
+	case "stdin":
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt)
+		defer signal.Stop(stop)
+
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := ioutil.WriteFile(args[0], data, 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		<-stop
+
+	// Exit writes the remaining arguments to stderr and exits with the
+	// exit code given as the first argument.
+	case "exit":
+		code, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(2)
+		}
+
+		fmt.Fprintln(os.Stderr, strings.Join(args[1:], " "))
+		os.Exit(code)
+
+	// Lines writes the given number of lines tagged with its pid to stdout
+	// and then exits with a non-zero exit code.
+	case "lines":
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(2)
+		}
+
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(os.Stdout, "%d %d\n", os.Getpid(), i)
+		}
+		os.Exit(1)
+
+	// Tick writes a line tagged with its pid to stdout every 10ms until it
+	// is interrupted.
+	case "tick":
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt)
+		defer signal.Stop(ch)
+
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Fprintf(os.Stdout, "%d tick\n", os.Getpid())
+			case <-ch:
+				return
+			}
+		}
+
+	// Reload writes the number of SIGHUPs it received to the file given as
+	// the first argument, starting with 0, until it is interrupted.
+	case "reload":
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGHUP)
+		defer signal.Stop(ch)
+
+		path := args[0]
+		for reloads := 0; ; reloads++ {
+			data := []byte(strconv.Itoa(reloads))
+			if err := ioutil.WriteFile(path, data, 0644); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			if sig := <-ch; sig == os.Interrupt {
+				return
+			}
+		}
+
+	// Reexec writes its pid to the pid file given as the first argument and
+	// creates the file given as the second argument while running. On the
+	// default ReExec signal it starts a copy of itself, waits for the copy
+	// to write its pid and then exits, leaving the file behind for the
+	// copy. On interrupt it removes the file and exits.
+	case "reexec":
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, defaultReExecSignal)
+		defer signal.Stop(ch)
+
+		pidFile, path := args[0], args[1]
+		pid := strconv.Itoa(os.Getpid())
+		if err := ioutil.WriteFile(pidFile, []byte(pid), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte("hello"), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if sig := <-ch; sig == os.Interrupt {
+			os.Remove(path)
+			return
+		}
+
+		cmd := helperProcess("reexec", pidFile, path)
+		configureDaemon(cmd)
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		for {
+			data, err := ioutil.ReadFile(pidFile)
+			if err == nil && len(data) > 0 && string(data) != pid {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+	// Spawn-child starts the given helper process as a child that stays in
+	// its process group and then waits for an interrupt. It exits without
+	// stopping the child, leaving it orphaned.
+	case "spawn-child":
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt)
+		defer signal.Stop(ch)
+
+		cmd := helperProcess(args...)
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		<-ch
+
 	case "output":
 		fmt.Fprintf(os.Stdout, "hello stdout\n")
 		fmt.Fprintf(os.Stderr, "hello stderr\n")
@@ -204,9 +481,10 @@ func TestHelperProcess(t *testing.T) {
 		pidFile := args[0]
 
 		d := &Daemon{
-			Command: helperProcess(args[1:]...),
-			Logger:  testLogger,
-			PidPath: pidFile,
+			Command:       helperProcess(args[1:]...),
+			Logger:        testLogger,
+			PidPath:       pidFile,
+			DieWithParent: os.Getenv(testDieWithParentEnv) != "",
 		}
 
 		_, err := os.Stat(pidFile)
@@ -0,0 +1,90 @@
+package proxyprocess
+
+import (
+	"context"
+	"time"
+)
+
+// readyCheckInterval is the time between calls of ReadyCheck while the
+// process isn't ready yet.
+const readyCheckInterval = 100 * time.Millisecond
+
+// watchReady calls ReadyCheck until it passes, at most for ReadyTimeout,
+// and then marks process as ready. This returns when the check passed,
+// timed out or stopCh is closed.
+//
+// If startedAt is set, the time from then until the check passed is
+// emitted as the time to ready, separately for initial starts and restarts
+// as given by restarted.
+func (p *Daemon) watchReady(process osProcess, startedAt time.Time, restarted bool, stopCh <-chan struct{}) {
+	timeout := p.ReadyTimeout
+	if timeout == 0 {
+		timeout = DaemonReadyTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Abort the check when the process exits.
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		err := p.safeCall("ReadyCheck", func() error {
+			return p.ReadyCheck(ctx)
+		})
+		if err == nil {
+			break
+		}
+
+		select {
+		case <-time.After(readyCheckInterval):
+			continue
+		case <-ctx.Done():
+		}
+
+		// The context is canceled rather than timed out if the process
+		// exited or is being stopped.
+		if ctx.Err() == context.DeadlineExceeded {
+			p.logger().Warn("daemon not ready in time",
+				"pid", process.Pid(), "timeout", timeout, "error", err)
+		}
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// The process may have exited while we checked it.
+	if p.process != process {
+		return
+	}
+
+	var timeToReady time.Duration
+	if !startedAt.IsZero() {
+		timeToReady = p.now().Sub(startedAt)
+		p.emitTimeToReady(timeToReady, restarted)
+	}
+
+	p.ready = true
+	p.publish(DaemonEvent{
+		Type:        DaemonEventReady,
+		PID:         process.Pid(),
+		Attempt:     p.attempts,
+		ExitCode:    -1,
+		TimeToReady: timeToReady,
+	})
+}
+
+// Ready returns true if the process is running and, if ReadyCheck is set,
+// has passed it.
+func (p *Daemon) Ready() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return !p.stopped && p.process != nil && p.ready
+}
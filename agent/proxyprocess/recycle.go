@@ -0,0 +1,19 @@
+package proxyprocess
+
+// watchRecycle gracefully restarts process once it ran for RecycleInterval,
+// with jitter, unless stopCh is closed first because it exited.
+func (p *Daemon) watchRecycle(process osProcess, stopCh <-chan struct{}) {
+	wait := p.jitter(p.RecycleInterval)
+	timer := p.getClock().NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+	case <-stopCh:
+		return
+	}
+
+	p.logger().Info("recycling daemon", "pid", process.Pid(), "after", wait)
+	if err := p.restartProcess(process, restartRecycle); err != nil {
+		p.logger().Warn("error recycling daemon", "pid", process.Pid(), "error", err)
+	}
+}
@@ -0,0 +1,54 @@
+package proxyprocess
+
+import (
+	"time"
+)
+
+// DaemonRepeatedExitWindow is the default for the RepeatedExitWindow field
+// of Daemon. It is longer than DaemonRestartMaxWait so that exits that are
+// only apart because of the restart backoff are still consecutive.
+const DaemonRepeatedExitWindow = 2 * time.Minute
+
+// repeatedExitDetector counts consecutive failed exits with the same exit
+// code for RepeatedExitThreshold. It is only used by keepAlive so it isn't
+// protected by the lock.
+type repeatedExitDetector struct {
+	p *Daemon
+
+	// count is the number of consecutive exits with exit code code, the
+	// last of which was at last.
+	code  int
+	count uint
+	last  time.Time
+}
+
+// exited records an exit with the given exit code, -1 if unknown, and
+// whether it was successful. It returns the number of consecutive failed
+// exits with that exit code so far, or zero if the exit doesn't count,
+// because it was successful or its exit code isn't known.
+func (d *repeatedExitDetector) exited(code int, success bool) uint {
+	now := d.p.now()
+	if success || code < 0 {
+		d.count = 0
+		return 0
+	}
+
+	if d.count > 0 && code == d.code && now.Sub(d.last) <= d.p.repeatedExitWindow() {
+		d.count++
+	} else {
+		d.code = code
+		d.count = 1
+	}
+	d.last = now
+
+	return d.count
+}
+
+// repeatedExitWindow returns RepeatedExitWindow or its default.
+func (p *Daemon) repeatedExitWindow() time.Duration {
+	if p.RepeatedExitWindow > 0 {
+		return p.RepeatedExitWindow
+	}
+
+	return DaemonRepeatedExitWindow
+}
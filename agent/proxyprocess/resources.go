@@ -0,0 +1,68 @@
+package proxyprocess
+
+import (
+	"time"
+)
+
+// ResourceSample is a sample of the resource usage of a process of a
+// Daemon. See the ResourceInterval field of Daemon.
+type ResourceSample struct {
+	// Time is when the sample was taken, or zero if there is no sample.
+	Time time.Time
+
+	// PID is the pid of the sampled process.
+	PID int
+
+	// CPUTime is the total user and system CPU time the process used so
+	// far.
+	CPUTime time.Duration
+
+	// CPUPercent is the share of one CPU the process used since the
+	// previous sample of the same process, so it may be above 100 for a
+	// multi-threaded process. It is zero for the first sample.
+	CPUPercent float64
+
+	// RSS is the resident set size of the process in bytes.
+	RSS uint64
+}
+
+// watchResources samples the resource usage of process every
+// ResourceInterval until stopCh is closed because it exited. Sampling ends
+// early if the usage can't be read, for example because the process is
+// already gone or this isn't supported on the platform.
+func (p *Daemon) watchResources(process osProcess, stopCh <-chan struct{}) {
+	pid := process.Pid()
+	var last ResourceSample
+	for {
+		cpu, rss, err := processResources(pid)
+		if err != nil {
+			// The process may have exited while we were reading, in which
+			// case there is nothing to report.
+			select {
+			case <-stopCh:
+			default:
+				p.logger().Debug("can't sample daemon resources", "pid", pid, "error", err)
+			}
+			return
+		}
+
+		sample := ResourceSample{Time: p.now(), PID: pid, CPUTime: cpu, RSS: rss}
+		if elapsed := sample.Time.Sub(last.Time); !last.Time.IsZero() && elapsed > 0 {
+			sample.CPUPercent = float64(cpu-last.CPUTime) / float64(elapsed) * 100
+		}
+		last = sample
+
+		p.lock.Lock()
+		p.resources = sample
+		p.lock.Unlock()
+		if p.ResourceMetrics {
+			p.emitResources(sample)
+		}
+
+		select {
+		case <-p.getClock().After(p.ResourceInterval):
+		case <-stopCh:
+			return
+		}
+	}
+}
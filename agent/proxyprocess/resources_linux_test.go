@@ -0,0 +1,65 @@
+// +build linux
+
+package proxyprocess
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/testutil/retry"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessResources(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	_, rss, err := processResources(os.Getpid())
+	require.NoError(err)
+	require.True(rss > 0)
+
+	// A process that is gone can't be sampled
+	_, _, err = processResources(fakePidBase)
+	require.Error(err)
+}
+
+func TestDaemon_resources(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	td, closer := testTempDir(t)
+	defer closer()
+
+	d := &Daemon{
+		Command:          helperProcess("start-stop", filepath.Join(td, "file")),
+		Logger:           testLogger,
+		ResourceInterval: 10 * time.Millisecond,
+		ResourceMetrics:  true,
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	var first ResourceSample
+	retry.Run(t, func(r *retry.R) {
+		s := d.Stats()
+		if s.Resources.Time.IsZero() || s.Resources.PID != s.PID {
+			r.Fatal("no sample yet")
+		}
+		first = s.Resources
+	})
+	require.True(first.RSS > 0)
+
+	// Samples keep being taken while the process runs
+	retry.Run(t, func(r *retry.R) {
+		if !d.Stats().Resources.Time.After(first.Time) {
+			r.Fatal("no new sample yet")
+		}
+	})
+
+	// The last sample is kept once stopped
+	require.NoError(d.Stop())
+	require.Equal(first.PID, d.Stats().Resources.PID)
+}
@@ -0,0 +1,75 @@
+package proxyprocess
+
+import (
+	"time"
+)
+
+// Defaults for the RestartLogAttempts and RestartLogInterval fields of
+// Daemon.
+const (
+	DaemonRestartLogAttempts = 5               // attempts logged in full
+	DaemonRestartLogInterval = 1 * time.Minute // time between summaries
+)
+
+// restartLogLimiter collapses the per-restart logs of a crash looping
+// daemon into periodic summaries. It is only used by keepAlive so it isn't
+// protected by the lock.
+type restartLogLimiter struct {
+	p *Daemon
+
+	// suppressed is the number of restarts whose logs were left out since
+	// the last summary at since. since is zero while logging in full.
+	suppressed int
+	since      time.Time
+}
+
+// quiet returns true if the exit and backoff logs of the given restart
+// attempt should be left out because the daemon is crash looping. A summary
+// is logged instead when the crash loop is detected and then at most once
+// per RestartLogInterval.
+func (l *restartLogLimiter) quiet(attempts uint32) bool {
+	if attempts <= l.p.restartLogAttempts() {
+		l.suppressed = 0
+		l.since = time.Time{}
+		return false
+	}
+
+	now := l.p.now()
+	interval := l.p.restartLogInterval()
+	if l.since.IsZero() {
+		l.suppressed = 1
+		l.since = now
+		l.p.logger().Warn("daemon is crash looping, collapsing restart logs",
+			"attempt", attempts, "interval", interval)
+		return true
+	}
+
+	l.suppressed++
+	if elapsed := now.Sub(l.since); elapsed >= interval {
+		l.p.logger().Warn("daemon is still crash looping",
+			"restarts", l.suppressed, "window", elapsed.Round(time.Second),
+			"attempt", attempts)
+		l.suppressed = 0
+		l.since = now
+	}
+
+	return true
+}
+
+// restartLogAttempts returns RestartLogAttempts or its default.
+func (p *Daemon) restartLogAttempts() uint32 {
+	if p.RestartLogAttempts > 0 {
+		return p.RestartLogAttempts
+	}
+
+	return DaemonRestartLogAttempts
+}
+
+// restartLogInterval returns RestartLogInterval or its default.
+func (p *Daemon) restartLogInterval() time.Duration {
+	if p.RestartLogInterval > 0 {
+		return p.RestartLogInterval
+	}
+
+	return DaemonRestartLogInterval
+}
@@ -0,0 +1,61 @@
+package proxyprocess
+
+import (
+	"os"
+	"os/exec"
+)
+
+// osProcess is a process supervised by a Daemon. It is implemented by
+// execProcess for real processes and can be faked in tests so that the
+// supervision loop can be exercised without spawning processes.
+type osProcess interface {
+	// Pid returns the process id.
+	Pid() int
+
+	// Wait waits for the process to exit. It can only be called for
+	// processes that were started, not adopted ones.
+	Wait() (*os.ProcessState, error)
+
+	// Signal sends sig to the process only.
+	Signal(sig os.Signal) error
+
+	// Kill kills the process only.
+	Kill() error
+
+	// SignalGroup is like Signal but also signals the children of the
+	// process where supported. See signalProcessGroup.
+	SignalGroup(sig os.Signal) error
+}
+
+// processRunner starts the processes of a Daemon.
+type processRunner interface {
+	// Start starts cmd, which is fully configured, and returns its process.
+	Start(cmd *exec.Cmd) (osProcess, error)
+}
+
+// execRunner is the processRunner that starts real processes.
+type execRunner struct{}
+
+func (execRunner) Start(cmd *exec.Cmd) (osProcess, error) {
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &execProcess{process: cmd.Process}, nil
+}
+
+// execProcess is an osProcess for a real process.
+type execProcess struct {
+	process *os.Process
+}
+
+func (p *execProcess) Pid() int                        { return p.process.Pid }
+func (p *execProcess) Wait() (*os.ProcessState, error) { return p.process.Wait() }
+func (p *execProcess) Signal(sig os.Signal) error      { return p.process.Signal(sig) }
+func (p *execProcess) Kill() error                     { return p.process.Kill() }
+func (p *execProcess) SignalGroup(sig os.Signal) error { return signalProcessGroup(p.process, sig) }
+
+// killProcess kills process and, where supported, its children.
+func killProcess(process osProcess) error {
+	return process.SignalGroup(os.Kill)
+}
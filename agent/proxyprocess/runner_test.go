@@ -0,0 +1,1048 @@
+package proxyprocess
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/testutil/retry"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePidBase is above the largest pid Linux hands out so that a fake
+// process never shares its pid with a real one.
+const fakePidBase = 1 << 22
+
+// fakeRunner is a processRunner that starts fakeProcesses. Tests control
+// when each process exits.
+type fakeRunner struct {
+	// ExitOnStart makes every process exit right after it started.
+	ExitOnStart bool
+
+	// IgnoreSignals makes processes ignore all signals, including the kill,
+	// as a process that is stuck would.
+	IgnoreSignals bool
+
+	// WaitErrs are returned by the first calls to Wait of every process,
+	// before it waits for the process to exit.
+	WaitErrs []error
+
+	// SignalErrs are returned by the first signals sent to every process,
+	// which then don't have an effect. A process that is already finished
+	// according to the error exits.
+	SignalErrs []error
+
+	lock      sync.Mutex
+	processes []*fakeProcess
+}
+
+func (r *fakeRunner) Start(cmd *exec.Cmd) (osProcess, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	p := &fakeProcess{
+		pid:           fakePidBase + len(r.processes),
+		exitCh:        make(chan error, 1),
+		ignoreSignals: r.IgnoreSignals,
+		waitErrs:      r.WaitErrs,
+		signalErrs:    r.SignalErrs,
+	}
+	r.processes = append(r.processes, p)
+	if r.ExitOnStart {
+		p.Exit(fmt.Errorf("exited on start"))
+	}
+
+	return p, nil
+}
+
+// Starts returns the number of processes started so far.
+func (r *fakeRunner) Starts() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.processes)
+}
+
+// Process returns the n-th process started, failing the test if there is
+// none yet.
+func (r *fakeRunner) Process(t *testing.T, n int) *fakeProcess {
+	var p *fakeProcess
+	retry.Run(t, func(rr *retry.R) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if len(r.processes) <= n {
+			rr.Fatalf("only %d processes started", len(r.processes))
+		}
+		p = r.processes[n]
+	})
+
+	return p
+}
+
+// fakeProcess is an osProcess that exits when told to or when it is
+// stopped or killed.
+type fakeProcess struct {
+	pid           int
+	exitCh        chan error
+	once          sync.Once
+	ignoreSignals bool
+
+	lock       sync.Mutex
+	waitErrs   []error
+	waits      int
+	exited     bool
+	signalErrs []error
+	signals    []os.Signal
+}
+
+// Exit makes Wait return err. Only the first call has an effect.
+func (p *fakeProcess) Exit(err error) {
+	p.once.Do(func() {
+		p.lock.Lock()
+		p.exited = true
+		p.lock.Unlock()
+		p.exitCh <- err
+	})
+}
+
+// Exited returns true if the process exited.
+func (p *fakeProcess) Exited() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.exited
+}
+
+func (p *fakeProcess) Pid() int { return p.pid }
+
+func (p *fakeProcess) Wait() (*os.ProcessState, error) {
+	p.lock.Lock()
+	p.waits++
+	if len(p.waitErrs) > 0 {
+		err := p.waitErrs[0]
+		p.waitErrs = p.waitErrs[1:]
+		p.lock.Unlock()
+		return nil, err
+	}
+	p.lock.Unlock()
+
+	return nil, <-p.exitCh
+}
+
+// Waits returns the number of calls to Wait so far.
+func (p *fakeProcess) Waits() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.waits
+}
+
+// Signals returns the signals sent to the process so far, including those
+// that failed.
+func (p *fakeProcess) Signals() []os.Signal {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]os.Signal(nil), p.signals...)
+}
+
+func (p *fakeProcess) Signal(sig os.Signal) error {
+	p.lock.Lock()
+	p.signals = append(p.signals, sig)
+	if len(p.signalErrs) > 0 {
+		err := p.signalErrs[0]
+		p.signalErrs = p.signalErrs[1:]
+		p.lock.Unlock()
+		if isProcessAlreadyFinishedErr(err) {
+			p.Exit(err)
+		}
+		return err
+	}
+	p.lock.Unlock()
+
+	if p.ignoreSignals {
+		return nil
+	}
+
+	p.Exit(fmt.Errorf("signal: %s", sig))
+	return nil
+}
+
+func (p *fakeProcess) Kill() error {
+	return p.Signal(os.Kill)
+}
+
+func (p *fakeProcess) SignalGroup(sig os.Signal) error {
+	return p.Signal(sig)
+}
+
+// testFakeDaemon returns a Daemon that starts processes with runner.
+func testFakeDaemon(runner *fakeRunner) *Daemon {
+	return &Daemon{
+		Command: exec.Command(os.Args[0]),
+		Logger:  testLogger,
+		runner:  runner,
+		stagger: func(d time.Duration) time.Duration { return d },
+	}
+}
+
+func TestDaemon_fakeMaxRestarts(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	td, closer := testTempDir(t)
+	defer closer()
+
+	runner := &fakeRunner{ExitOnStart: true}
+	d := testFakeDaemon(runner)
+	d.MaxRestarts = 3
+	d.RestartBackoffMin = 10
+	d.PidPath = filepath.Join(td, "pid")
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	select {
+	case <-d.exitedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon should give up")
+	}
+
+	// The initial start and three restarts
+	require.Equal(4, runner.Starts())
+	require.Equal(LoopExitMaxRestarts, d.TerminalReason())
+	require.Equal(uint64(3), d.Stats().Restarts)
+
+	// The pid file doesn't outlive the daemon giving up
+	_, err := os.Stat(d.PidPath)
+	require.True(os.IsNotExist(err))
+}
+
+func TestDaemon_fakeBackoffReset(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	events := make(chan DaemonEvent, 100)
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.RestartBackoffMin = 1
+	d.RestartHealthy = 200 * time.Millisecond
+	d.RestartMaxWait = 10 * time.Millisecond
+	d.Events = events
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// A process that exits right away is restarted with a backoff
+	runner.Process(t, 0).Exit(nil)
+	runner.Process(t, 1)
+	require.Equal(uint32(2), d.BackoffState().Attempts)
+	require.True(d.Stats().LastHealthyReset.IsZero())
+
+	// A process that stayed up for RestartHealthy resets the attempts, so
+	// its restart isn't delayed. The restart count isn't reset.
+	time.Sleep(2 * d.RestartHealthy)
+	runner.Process(t, 1).Exit(nil)
+	runner.Process(t, 2)
+	require.Equal(uint32(1), d.BackoffState().Attempts)
+	stats := d.Stats()
+	require.Equal(uint64(2), stats.Restarts)
+	require.False(stats.LastHealthyReset.IsZero())
+	require.True(stats.LastHealthyReset.Before(time.Now()))
+
+	var backoffs []uint32
+	for len(events) > 0 {
+		if e := <-events; e.Type == DaemonEventBackingOff {
+			backoffs = append(backoffs, e.Attempt)
+		}
+	}
+	require.Equal([]uint32{2}, backoffs)
+}
+
+func TestDaemon_fakeResetBackoffOnRestart(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	// Without ResetBackoffOnRestart a requested restart is delayed like
+	// a crash
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.RestartBackoffMin = 1
+	d.RestartHealthy = time.Hour
+	d.RestartMaxWait = time.Hour
+	require.NoError(d.Start())
+	defer d.Stop()
+	runner.Process(t, 0)
+	require.NoError(d.Restart())
+	retry.Run(t, func(r *retry.R) {
+		if d.BackoffState().NextStartAt.IsZero() {
+			r.Fatal("not backing off")
+		}
+	})
+	require.Equal(1, runner.Starts())
+
+	// With it the process is started again right away
+	runner = &fakeRunner{}
+	d = testFakeDaemon(runner)
+	d.RestartBackoffMin = 1
+	d.RestartHealthy = time.Hour
+	d.RestartMaxWait = time.Hour
+	d.ResetBackoffOnRestart = true
+	require.NoError(d.Start())
+	defer d.Stop()
+	runner.Process(t, 0)
+	for i := 0; i < 3; i++ {
+		require.NoError(d.Restart())
+		runner.Process(t, i+1)
+		require.Equal(uint32(1), d.BackoffState().Attempts)
+	}
+
+	// A crash still accrues backoff
+	runner.Process(t, 3).Exit(nil)
+	retry.Run(t, func(r *retry.R) {
+		if d.BackoffState().NextStartAt.IsZero() {
+			r.Fatal("not backing off")
+		}
+	})
+	require.Equal(4, runner.Starts())
+}
+
+func TestDaemon_fakeRestartLog(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	logger := &testStructuredLogger{}
+	runner := &fakeRunner{ExitOnStart: true}
+	d := testFakeDaemon(runner)
+	d.StructuredLogger = logger
+	d.MaxRestarts = 5
+	d.RestartBackoffMin = 10
+	d.RestartLogAttempts = 2
+	d.RestartLogInterval = time.Nanosecond
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	select {
+	case <-d.exitedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon should give up")
+	}
+
+	// The first attempts are logged in full, the rest only summarized
+	require.Equal(6, runner.Starts())
+	require.Equal(2, logger.Count("daemon exited with error"))
+	require.Equal(1, logger.Count("daemon is crash looping, collapsing restart logs"))
+	require.Equal(3, logger.Count("daemon is still crash looping"))
+	e, ok := logger.Find("daemon is still crash looping")
+	require.True(ok)
+	require.Equal(2, e.Args["restarts"])
+}
+
+func TestDaemon_fakeRecycle(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.RecycleInterval = 50 * time.Millisecond
+	d.RestartBackoffMin = 1
+	d.RestartHealthy = time.Hour
+	d.RestartMaxWait = time.Hour
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Processes are restarted on schedule without any backoff
+	start := time.Now()
+	runner.Process(t, 2)
+	require.True(time.Since(start) >= 2*d.RecycleInterval)
+	require.Equal(uint32(1), d.BackoffState().Attempts)
+	require.True(d.BackoffState().NextStartAt.IsZero())
+
+	// Once stopped, nothing is recycled anymore
+	require.NoError(d.Stop())
+	n := runner.Starts()
+	time.Sleep(2 * d.RecycleInterval)
+	require.Equal(n, runner.Starts())
+}
+
+func TestDaemon_fakeHealthy(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.RestartHealthy = 100 * time.Millisecond
+	require.False(d.Healthy())
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// Running right away, but only healthy after RestartHealthy
+	retry.Run(t, func(r *retry.R) {
+		if !d.Running() {
+			r.Fatal("not running")
+		}
+	})
+	require.False(d.Healthy())
+	retry.Run(t, func(r *retry.R) {
+		if !d.Healthy() {
+			r.Fatal("not healthy")
+		}
+	})
+
+	// The new process has to prove itself again
+	runner.Process(t, 0).Exit(nil)
+	runner.Process(t, 1)
+	require.False(d.Healthy())
+	retry.Run(t, func(r *retry.R) {
+		if !d.Healthy() {
+			r.Fatal("not healthy")
+		}
+	})
+
+	require.NoError(d.Stop())
+	require.False(d.Healthy())
+}
+
+func TestDaemon_fakeRestartDrain(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	var drains int32
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.DrainUntil = func(ctx context.Context) error {
+		atomic.AddInt32(&drains, 1)
+		return nil
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// A planned restart drains the process first
+	runner.Process(t, 0)
+	retry.Run(t, func(r *retry.R) {
+		if !d.Running() {
+			r.Fatal("not running")
+		}
+	})
+	require.NoError(d.Restart())
+	runner.Process(t, 1)
+	require.Equal(int32(1), atomic.LoadInt32(&drains))
+
+	// A process that is already gone isn't drained
+	exitedCh := make(chan struct{})
+	close(exitedCh)
+	require.True(d.drain(exitedCh))
+	require.Equal(int32(1), atomic.LoadInt32(&drains))
+}
+
+func TestDaemon_fakeJitter(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	var lock sync.Mutex
+	var staggered []time.Duration
+
+	events := make(chan DaemonEvent, 100)
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.RestartBackoffMin = 1
+	d.RestartMaxWait = 200 * time.Millisecond
+	d.Events = events
+	d.stagger = func(d time.Duration) time.Duration {
+		lock.Lock()
+		defer lock.Unlock()
+		staggered = append(staggered, d)
+		return d / 2
+	}
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	runner.Process(t, 0).Exit(nil)
+	runner.Process(t, 1)
+
+	// The wait is capped to 200ms, half of which is randomized
+	lock.Lock()
+	require.Equal([]time.Duration{100 * time.Millisecond}, staggered)
+	lock.Unlock()
+
+	var waits []time.Duration
+	for len(events) > 0 {
+		if e := <-events; e.Type == DaemonEventBackingOff {
+			waits = append(waits, e.Wait)
+		}
+	}
+	require.Equal([]time.Duration{150 * time.Millisecond}, waits)
+}
+
+func TestDaemon_fakeStop(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	require.NoError(d.Start())
+
+	p := runner.Process(t, 0)
+	retry.Run(t, func(r *retry.R) {
+		if !d.Stats().Running {
+			r.Fatal("not running")
+		}
+	})
+	require.Equal(p.Pid(), d.Stats().PID)
+
+	// Stopping signals the fake rather than any real process
+	require.NoError(d.Stop())
+	require.Equal(1, runner.Starts())
+	require.Equal(LoopExitStopped, d.TerminalReason())
+}
+
+func TestDaemon_fakeConcurrentStart(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	// Hold the loop before its first start by taking the only start slot,
+	// so that every Start below runs while there is no process yet.
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.startSlots = make(chan struct{}, 1)
+	d.startSlots <- struct{}{}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- d.Start()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(err)
+	}
+
+	// A second loop would start a process of its own that Stop, which
+	// only knows about the last loop, doesn't stop either.
+	<-d.startSlots
+	runner.Process(t, 0)
+	require.NoError(d.Stop())
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop should have exited")
+	}
+	require.Equal(1, runner.Starts())
+	require.True(runner.Process(t, 0).Exited())
+}
+
+func TestDaemon_fakeStartStopRace(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	// Hammer a daemon with concurrent starts and stops. Whichever stop
+	// wins, the daemon ends up stopped with its loop and every process it
+	// started gone.
+	for i := 0; i < 20; i++ {
+		runner := &fakeRunner{}
+		d := testFakeDaemon(runner)
+
+		var wg sync.WaitGroup
+		for j := 0; j < 10; j++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				d.Start()
+			}()
+			go func() {
+				defer wg.Done()
+				d.Stop()
+			}()
+		}
+		wg.Wait()
+		require.NoError(d.Stop())
+
+		d.lock.Lock()
+		exitedCh := d.exitedCh
+		d.lock.Unlock()
+		if exitedCh != nil {
+			select {
+			case <-exitedCh:
+			case <-time.After(5 * time.Second):
+				t.Fatal("loop should have exited")
+			}
+		}
+
+		n := runner.Starts()
+		require.True(n <= 1, "started %d processes", n)
+		for k := 0; k < n; k++ {
+			require.True(runner.Process(t, k).Exited())
+		}
+		require.Error(d.Start())
+		require.Equal(n, runner.Starts())
+	}
+}
+
+func TestDaemon_fakeDone(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	// Never started, so it is done already
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	select {
+	case <-d.Done():
+	default:
+		t.Fatal("should be done")
+	}
+
+	require.NoError(d.Start())
+	defer d.Stop()
+	runner.Process(t, 0)
+	done := d.Done()
+	select {
+	case <-done:
+		t.Fatal("should not be done")
+	default:
+	}
+
+	require.NoError(d.Stop())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("should be done")
+	}
+	require.True(d.Done() == done)
+}
+
+func TestDaemon_fakeStopSignalRetry(t *testing.T) {
+	t.Parallel()
+
+	eagain := os.NewSyscallError("kill", syscall.EAGAIN)
+	cases := []struct {
+		Name       string
+		SignalErrs []error
+		Signals    []os.Signal
+	}{
+		{
+			"transient error is retried",
+			[]error{eagain, eagain},
+			[]os.Signal{os.Interrupt, os.Interrupt, os.Interrupt},
+		},
+		{
+			"persistent transient error escalates",
+			[]error{eagain, eagain, eagain},
+			[]os.Signal{os.Interrupt, os.Interrupt, os.Interrupt, os.Kill},
+		},
+		{
+			"permanent error escalates",
+			[]error{os.NewSyscallError("kill", syscall.EPERM)},
+			[]os.Signal{os.Interrupt, os.Kill},
+		},
+		{
+			"already finished is a success",
+			[]error{fmt.Errorf("os: process already finished")},
+			[]os.Signal{os.Interrupt},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			runner := &fakeRunner{SignalErrs: tc.SignalErrs}
+			d := testFakeDaemon(runner)
+			require.NoError(t, d.Start())
+			process := runner.Process(t, 0)
+			require.NoError(t, d.Stop())
+			require.Equal(t, tc.Signals, process.Signals())
+		})
+	}
+}
+
+func TestDaemon_fakeStartContext(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	require.NoError(d.StartContext(ctx))
+	defer d.Stop()
+
+	runner.Process(t, 0)
+
+	// Cancelling the context stops the daemon like Stop does
+	cancel()
+	select {
+	case <-d.exitedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon should stop")
+	}
+	require.Equal(1, runner.Starts())
+	require.Equal(LoopExitStopped, d.TerminalReason())
+}
+
+func TestDaemon_fakeStartContextBackoff(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runner := &fakeRunner{ExitOnStart: true}
+	d := testFakeDaemon(runner)
+	d.RestartBackoffMin = 1
+	d.stagger = func(time.Duration) time.Duration { return time.Hour }
+	require.NoError(d.StartContext(ctx))
+	defer d.Stop()
+
+	// Wait until the loop is in a long backoff
+	retry.Run(t, func(r *retry.R) {
+		if d.BackoffState().NextStartAt.IsZero() {
+			r.Fatal("not backing off")
+		}
+	})
+
+	// Cancelling doesn't wait out the backoff
+	cancel()
+	select {
+	case <-d.exitedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon should stop during the backoff")
+	}
+	require.Equal(LoopExitStopped, d.TerminalReason())
+}
+
+func TestDaemon_fakeStuck(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	events := make(chan DaemonEvent, 100)
+	runner := &fakeRunner{IgnoreSignals: true}
+	d := testFakeDaemon(runner)
+	d.GracefulWait = 10 * time.Millisecond
+	d.KillWait = 50 * time.Millisecond
+	d.Events = events
+	require.NoError(d.Start())
+
+	p := runner.Process(t, 0)
+	retry.Run(t, func(r *retry.R) {
+		if !d.Stats().Running {
+			r.Fatal("not running")
+		}
+	})
+
+	// The process survives the kill, so Stop gives up on it
+	err := d.Stop()
+	require.Error(err)
+	require.Contains(err.Error(), "not reaped")
+	require.True(d.Stats().Stuck)
+
+	var stuck []int
+	for len(events) > 0 {
+		if e := <-events; e.Type == DaemonEventStuck {
+			stuck = append(stuck, e.PID)
+		}
+	}
+	require.Equal([]int{p.Pid()}, stuck)
+
+	// Once the process is finally reaped it is no longer stuck
+	p.Exit(nil)
+	select {
+	case <-d.exitedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop should end")
+	}
+	require.False(d.Stats().Stuck)
+}
+
+func TestDaemon_fakeWaitInterrupted(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	interrupted := os.NewSyscallError("wait", syscall.EINTR)
+	runner := &fakeRunner{WaitErrs: []error{interrupted, interrupted}}
+	d := testFakeDaemon(runner)
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	// The interrupted waits are retried rather than taken as an exit
+	p := runner.Process(t, 0)
+	retry.Run(t, func(r *retry.R) {
+		if n := p.Waits(); n != 3 {
+			r.Fatalf("waits: %d", n)
+		}
+	})
+	require.Equal(1, runner.Starts())
+	require.True(d.Stats().Running)
+
+	// The actual exit still restarts the process
+	p.Exit(nil)
+	runner.Process(t, 1)
+}
+
+func TestDaemon_fakeWaitFailed(t *testing.T) {
+	t.Parallel()
+
+	// A failed wait for a process that is gone counts as an exit
+	runner := &fakeRunner{
+		WaitErrs: []error{os.NewSyscallError("wait", syscall.ECHILD)},
+	}
+	d := testFakeDaemon(runner)
+	require.NoError(t, d.Start())
+	defer d.Stop()
+
+	runner.Process(t, 1)
+}
+
+func TestDaemon_fakeLastCommand(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.Command.Args = append(d.Command.Args, "-flag")
+	d.Command.Env = []string{"PATH=/bin"}
+	d.ProxyID = "web"
+	d.ProxyToken = "secret"
+
+	path, args, env := d.LastCommand()
+	require.Empty(path)
+	require.Nil(args)
+	require.Nil(env)
+
+	require.NoError(d.Start())
+	defer d.Stop()
+	runner.Process(t, 0)
+
+	// The resolved command is recorded with the token redacted
+	path, args, env = d.LastCommand()
+	require.Equal(os.Args[0], path)
+	require.Equal([]string{os.Args[0], "-flag"}, args)
+	require.Equal([]string{
+		"PATH=/bin",
+		EnvProxyID + "=web",
+		EnvProxyToken + "=<redacted>",
+	}, env)
+
+	// The result is a copy
+	env[0] = "PATH=/usr/bin"
+	_, _, env = d.LastCommand()
+	require.Equal("PATH=/bin", env[0])
+}
+
+func TestDaemon_fakeNilLogger(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	// Without any logger the logs are discarded rather than panicking
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.Logger = nil
+	d.RestartBackoffMin = 10
+	require.NoError(d.Start())
+
+	runner.Process(t, 0).Exit(fmt.Errorf("crashed"))
+	runner.Process(t, 1)
+	require.NoError(d.Stop())
+
+	_, err := (&stderrLogger{daemon: d}).Write([]byte("line\n"))
+	require.NoError(err)
+}
+
+func TestDaemon_fakeMinRuntime(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	events := make(chan DaemonEvent, 100)
+	runner := &fakeRunner{ExitOnStart: true}
+	d := testFakeDaemon(runner)
+	d.MinRuntime = time.Hour
+	d.MaxFastExits = 2
+	d.RestartBackoffMin = 10
+	d.Events = events
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	select {
+	case <-d.exitedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon should give up")
+	}
+
+	// Given up after the third fast exit in a row
+	require.Equal(3, runner.Starts())
+	require.Equal(LoopExitFastExits, d.TerminalReason())
+	require.Equal(uint(3), d.Stats().FastExits)
+
+	var exits []uint
+	var failed DaemonEvent
+	for len(events) > 0 {
+		switch e := <-events; e.Type {
+		case DaemonEventExited:
+			exits = append(exits, e.FastExits)
+		case DaemonEventFailed:
+			failed = e
+		}
+	}
+	require.Equal([]uint{1, 2, 3}, exits)
+	require.Equal(LoopExitFastExits, failed.Reason)
+	require.Equal(uint(3), failed.FastExits)
+}
+
+func TestDaemon_fakeMinRuntimeReset(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.MinRuntime = 100 * time.Millisecond
+	d.MaxFastExits = 1
+	d.RestartBackoffMin = 10
+	require.NoError(d.Start())
+	defer d.Stop()
+
+	runner.Process(t, 0).Exit(nil)
+	p := runner.Process(t, 1)
+	require.Equal(uint(1), d.Stats().FastExits)
+
+	// A process that ran long enough resets the count, so the next fast
+	// exit doesn't make the daemon give up
+	time.Sleep(2 * d.MinRuntime)
+	p.Exit(nil)
+	runner.Process(t, 2).Exit(nil)
+	runner.Process(t, 3)
+	require.Equal(uint(1), d.Stats().FastExits)
+	require.Equal(LoopExitNone, d.TerminalReason())
+}
+
+func TestDaemon_fakeReconfigure(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	d.ProxyToken = "old"
+	require.NoError(d.Start())
+	defer d.Stop()
+	runner.Process(t, 0)
+
+	// A command that can't be started is rejected and nothing restarted
+	require.Error(d.Reconfigure(exec.Command("/does/not/exist"), "new"))
+	require.Equal(1, runner.Starts())
+	require.Equal("old", d.ProxyToken)
+
+	// The process is restarted with the new command and token
+	cmd := exec.Command(os.Args[0], "-reconfigured")
+	require.NoError(d.Reconfigure(cmd, "new"))
+	runner.Process(t, 1)
+	require.True(runner.Process(t, 0).Exited())
+	_, args, env := d.LastCommand()
+	require.Equal([]string{os.Args[0], "-reconfigured"}, args)
+	require.Contains(env, EnvProxyToken+"=<redacted>")
+
+	require.NoError(d.Stop())
+	require.Error(d.Reconfigure(exec.Command(os.Args[0]), "new"))
+}
+
+func TestDaemon_fakeReconfigureConcurrent(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	runner := &fakeRunner{}
+	d := testFakeDaemon(runner)
+	require.NoError(d.Start())
+	defer d.Stop()
+	runner.Process(t, 0)
+
+	// Reading the configuration while it is replaced must not race, which
+	// is what this checks when run with -race.
+	other := testFakeDaemon(&fakeRunner{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for i := 0; i < 10; i++ {
+			d.Equal(other)
+			d.Config()
+			d.Validate()
+			d.logger().Debug("reconfiguring")
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		token := fmt.Sprintf("token-%d", i)
+		require.NoError(d.Reconfigure(exec.Command(os.Args[0], token), token))
+	}
+	<-doneCh
+
+	_, token := d.currentCommand()
+	require.Equal("token-9", token)
+}
+
+// panicTracer is a Tracer that panics when starting spans or, with
+// spanPanics, in the spans it returns.
+type panicTracer struct {
+	spanPanics bool
+}
+
+func (t panicTracer) StartSpan(string, map[string]interface{}) Span {
+	if t.spanPanics {
+		return panicSpan{}
+	}
+	panic("tracer")
+}
+
+type panicSpan struct{}
+
+func (panicSpan) SetAttribute(string, interface{}) { panic("span attribute") }
+func (panicSpan) End(error)                        { panic("span end") }
+
+func TestDaemon_fakePanickingTracer(t *testing.T) {
+	t.Parallel()
+
+	for _, tracer := range []panicTracer{{}, {spanPanics: true}} {
+		tracer := tracer
+		t.Run(fmt.Sprintf("span panics %v", tracer.spanPanics), func(t *testing.T) {
+			require := require.New(t)
+
+			runner := &fakeRunner{}
+			d := testFakeDaemon(runner)
+			d.RestartBackoffMin = 10
+			d.Tracer = tracer
+			require.NoError(d.Start())
+			defer d.Stop()
+
+			// Neither the loop nor Stop are taken down by the tracer
+			runner.Process(t, 0).Exit(nil)
+			runner.Process(t, 1)
+			require.NoError(d.Stop())
+			require.True(runner.Process(t, 1).Exited())
+		})
+	}
+}
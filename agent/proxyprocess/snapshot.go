@@ -111,7 +111,10 @@ func (m *Manager) snapshot(path string, checkDup bool) error {
 }
 
 // Restore restores the manager state from a snapshot at path. If path
-// doesn't exist, this does nothing and no error is returned.
+// doesn't exist, this does nothing and no error is returned. Snapshots are
+// written atomically, but if the file can't be decoded anyway, for example
+// because it was truncated, the error is logged and the snapshot ignored
+// rather than preventing the agent from starting.
 //
 // This restores proxy state but does not restore any Manager configuration
 // such as DataDir, Logger, etc. All of those should be set _before_ Restore
@@ -119,7 +122,11 @@ func (m *Manager) snapshot(path string, checkDup bool) error {
 //
 // Restore must be called before Run. Restore will immediately start
 // supervising the restored processes but will not sync with the local
-// state store until Run is called.
+// state store until Run is called. Proxies whose process is gone aren't
+// restored, and the pid and token files they left behind are removed.
+//
+// Restore is idempotent: proxies that are already managed, for example
+// by an earlier Restore, are left alone rather than supervised twice.
 //
 // If an error is returned the manager state is left untouched.
 func (m *Manager) Restore(path string) error {
@@ -134,7 +141,8 @@ func (m *Manager) Restore(path string) error {
 
 	var s snapshot
 	if err := json.Unmarshal(buf, &s); err != nil {
-		return err
+		m.Logger.Printf("[ERR] agent/proxy: ignoring unreadable snapshot %q: %s", path, err)
+		return nil
 	}
 
 	// Verify the version matches so we can be more confident that we're
@@ -143,7 +151,11 @@ func (m *Manager) Restore(path string) error {
 		return fmt.Errorf("unknown snapshot version, expecting %d", snapshotVersion)
 	}
 
-	// Build the proxies from the snapshot
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Build the proxies from the snapshot. Check all modes first so that
+	// nothing is restored if the snapshot is invalid.
 	proxies := make(map[string]Proxy, len(s.Proxies))
 	for id, sp := range s.Proxies {
 		p, err := m.newProxyFromMode(sp.Mode, id)
@@ -151,6 +163,19 @@ func (m *Manager) Restore(path string) error {
 			return err
 		}
 
+		proxies[id] = p
+	}
+
+	for id, sp := range s.Proxies {
+		p := proxies[id]
+		if _, ok := m.proxies[id]; ok {
+			continue
+		}
+
+		// A restored daemon restarts its process once it exits, which is
+		// subject to MaxConcurrentStarts like any other start.
+		m.limitStarts(p)
+
 		// Unmarshal the proxy. If there is an error we just continue on and
 		// ignore it. Errors restoring proxies should be exceptionally rare
 		// and only under scenarios where the proxy isn't running anymore or
@@ -160,12 +185,8 @@ func (m *Manager) Restore(path string) error {
 			continue
 		}
 
-		proxies[id] = p
+		m.proxies[id] = p
 	}
 
-	// Overwrite the proxies. The documentation notes that this will happen.
-	m.lock.Lock()
-	defer m.lock.Unlock()
-	m.proxies = proxies
 	return nil
 }
@@ -0,0 +1,58 @@
+package proxyprocess
+
+// DaemonState is the lifecycle state of a Daemon. See Daemon.State.
+type DaemonState string
+
+const (
+	// DaemonStateStarting means a process is about to be started, either
+	// initially or to replace one that exited.
+	DaemonStateStarting DaemonState = "starting"
+
+	// DaemonStateRunning means there is a process, started or adopted.
+	DaemonStateRunning DaemonState = "running"
+
+	// DaemonStateBackingOff means the process exited and its restart is
+	// delayed by the restart backoff or RestartDelay.
+	DaemonStateBackingOff DaemonState = "backing-off"
+
+	// DaemonStateStopped means Stop or Close was called, or the supervision
+	// loop ended without failing, for example because RestartPolicy says
+	// the process isn't restarted.
+	DaemonStateStopped DaemonState = "stopped"
+
+	// DaemonStateFailed means the supervision loop gave up on the process.
+	// TerminalReason says why.
+	DaemonStateFailed DaemonState = "failed"
+)
+
+// State returns the lifecycle state of the daemon, or an empty state if it
+// was never started or stopped.
+func (p *Daemon) State() DaemonState {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.state
+}
+
+// setState moves the daemon to state and publishes DaemonEventStateChanged
+// if that is a change. Once the daemon is stopped it only moves to
+// DaemonStateStopped, so that the loop winding down doesn't look like a
+// restart. The lock must be held.
+func (p *Daemon) setState(state DaemonState) {
+	if p.state == state || p.stopped && state != DaemonStateStopped {
+		return
+	}
+
+	p.state = state
+	pid := 0
+	if p.process != nil {
+		pid = p.process.Pid()
+	}
+	p.publish(DaemonEvent{
+		Type:     DaemonEventStateChanged,
+		PID:      pid,
+		Attempt:  p.attempts,
+		ExitCode: -1,
+		State:    state,
+		Reason:   p.loopExitReason,
+	})
+}
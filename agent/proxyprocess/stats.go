@@ -0,0 +1,129 @@
+package proxyprocess
+
+import (
+	"time"
+)
+
+// DaemonStats is a snapshot of the supervision state of a Daemon. See
+// Daemon.Stats.
+type DaemonStats struct {
+	// Running is true if there is currently a process, started or adopted.
+	Running bool
+
+	// PID is the pid of the current process, or zero if there is none.
+	PID int
+
+	// Attempts is the current restart attempt count used for the restart
+	// backoff. It is reset once a process stays up long enough.
+	Attempts uint32
+
+	// Restarts is the total number of times the process was restarted by
+	// the supervision loop since Start. Unlike Attempts it is never reset,
+	// so it also reveals a process that restarts rarely but regularly.
+	Restarts uint64
+
+	// FastExits is the number of consecutive exits within MinRuntime.
+	FastExits uint
+
+	// LastHealthyReset is the time Attempts was last reset because a
+	// process ran for RestartHealthy, or zero if that never happened.
+	LastHealthyReset time.Time
+
+	// LastStart is the time a process last started being supervised,
+	// or zero if none has yet.
+	LastStart time.Time
+
+	// Stopped is true if Stop was called.
+	Stopped bool
+
+	// Stuck is true if the process was killed but not reaped within
+	// KillWait. It is reset once the process is reaped.
+	Stuck bool
+
+	// TerminalReason is why the supervision loop ended, or LoopExitNone if
+	// it is still running or was never started. Any value other than
+	// LoopExitNone, LoopExitStopped, LoopExitShutdown and LoopExitCompleted
+	// means the daemon failed and won't be restarted.
+	TerminalReason LoopExitReason
+
+	// State is the lifecycle state of the daemon. See Daemon.State.
+	State DaemonState
+
+	// Resources is the latest resource usage sample if ResourceInterval
+	// is set. Its PID tells which process it is from, since it is kept
+	// after that process exits.
+	Resources ResourceSample
+}
+
+// Failed returns true if the supervision loop gave up on the process rather
+// than being stopped or completing as RestartPolicy allows.
+func (s DaemonStats) Failed() bool {
+	return s.TerminalReason.failed()
+}
+
+// failed returns true if the loop ending for reason means it gave up on the
+// process.
+func (reason LoopExitReason) failed() bool {
+	switch reason {
+	case LoopExitNone, LoopExitStopped, LoopExitShutdown, LoopExitCompleted:
+		return false
+	}
+
+	return true
+}
+
+// Stats returns a snapshot of the supervision state of the daemon.
+func (p *Daemon) Stats() DaemonStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	s := DaemonStats{
+		Running:          !p.stopped && p.process != nil,
+		Attempts:         p.attempts,
+		Restarts:         p.restarts,
+		LastStart:        p.lastStart,
+		LastHealthyReset: p.lastHealthyReset,
+		FastExits:        p.fastExits,
+		Stopped:          p.stopped,
+		Stuck:            p.stuck,
+		TerminalReason:   p.loopExitReason,
+		State:            p.state,
+		Resources:        p.resources,
+	}
+	if s.Running {
+		s.PID = p.process.Pid()
+	}
+
+	return s
+}
+
+// Running returns true if there is currently a process, started or adopted,
+// that hasn't exited, and the daemon isn't stopped. This is the same as
+// Stats().Running but cheaper, for callers that only need liveness.
+func (p *Daemon) Running() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return !p.stopped && p.process != nil
+}
+
+// Healthy returns true if the current process has been up long enough for
+// the supervision loop to consider it stable, which is when its restart
+// attempts are reset: after RestartHealthy, or earlier once it passed a
+// HealthCheck. Unlike Running this is false right after the process was
+// started, and unlike HealthCheck it doesn't say whether the proxy works.
+func (p *Daemon) Healthy() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.stopped || p.process == nil {
+		return false
+	}
+
+	// An adopted process has no deadline set by the loop.
+	deadline := p.attemptsDeadline
+	if deadline.IsZero() {
+		deadline = p.lastStart.Add(p.restartHealthy())
+	}
+
+	return !p.now().Before(deadline)
+}
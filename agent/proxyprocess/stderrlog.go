@@ -0,0 +1,60 @@
+package proxyprocess
+
+import (
+	"strings"
+)
+
+// stderrLogLevels are the valid values of StderrLogLevel, the same levels
+// that the agent logs at.
+var stderrLogLevels = []string{"DEBUG", "INFO", "WARN", "ERR"}
+
+// validStderrLogLevel returns true if level is one of stderrLogLevels.
+func validStderrLogLevel(level string) bool {
+	for _, l := range stderrLogLevels {
+		if level == l {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stderrLogger is the io.Writer that the stderr of the process is written
+// to with StderrLogLevel set. Every write must be a single line, as done by
+// filterOutput, which is logged attributed to the daemon:
+//
+//	[INFO] agent/proxy[web-proxy]: line written by the proxy
+type stderrLogger struct {
+	daemon *Daemon
+}
+
+func (l *stderrLogger) Write(b []byte) (int, error) {
+	p := l.daemon
+	line := strings.TrimSuffix(string(b), "\n")
+	level := p.StderrLogLevel
+
+	// A structured logger gets the line as the message, with the usual
+	// key/value pairs identifying the daemon.
+	if p.StructuredLogger != nil {
+		logger := p.logger()
+		switch level {
+		case "DEBUG":
+			logger.Debug(line, "stream", "stderr")
+		case "WARN":
+			logger.Warn(line, "stream", "stderr")
+		case "ERR":
+			logger.Error(line, "stream", "stderr")
+		default:
+			logger.Info(line, "stream", "stderr")
+		}
+
+		return len(b), nil
+	}
+
+	id := p.ProxyID
+	if id == "" {
+		id = p.name()
+	}
+	p.stdLogger().Printf("[%s] agent/proxy[%s]: %s", level, id, line)
+	return len(b), nil
+}
@@ -0,0 +1,30 @@
+package proxyprocess
+
+import (
+	"github.com/mitchellh/go-testing-interface"
+)
+
+// TestDaemonOrphans returns the pids of any processes that are still
+// running in the process groups of processes supervised by the daemon.
+// Every process started by a Daemon leads its own process group, which its
+// children join unless they detach, so after Stop this should be empty.
+// Tests can use this to detect leaked child or grandchild processes.
+//
+// This is only supported on Linux and fails the test elsewhere.
+func TestDaemonOrphans(t testing.T, d *Daemon) []int {
+	d.lock.Lock()
+	pgids := append([]int(nil), d.pgids...)
+	d.lock.Unlock()
+
+	var result []int
+	for _, pgid := range pgids {
+		pids, err := processGroupMembers(pgid)
+		if err != nil {
+			t.Fatalf("error listing process group %d: %s", pgid, err)
+		}
+
+		result = append(result, pids...)
+	}
+
+	return result
+}
@@ -0,0 +1,191 @@
+package proxyprocess
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-testing-interface"
+)
+
+// TestFakeProxyConfig controls how the fake proxy of TestFakeProxyDaemon
+// behaves. The zero value runs until it is signalled and then exits with
+// exit code 0.
+type TestFakeProxyConfig struct {
+	// Crash makes the proxy exit with ExitCode right after it started, so
+	// that the daemon crash loops.
+	Crash bool
+
+	// ExitAfter, if non-zero, makes the proxy exit with ExitCode on its own
+	// once it ran for this long.
+	ExitAfter time.Duration
+
+	// ExitCode is the exit code for Crash and ExitAfter.
+	ExitCode int
+
+	// IgnoreSignals makes the proxy ignore the stop signals, so that it
+	// hangs on stop until it is killed.
+	IgnoreSignals bool
+
+	// StopDelay is how long the proxy takes to exit once it is signalled,
+	// to simulate a slow shutdown.
+	StopDelay time.Duration
+
+	// ReadyFile, if set, is written with the pid of the proxy once it is
+	// running, so that tests can wait for it to be started.
+	ReadyFile string
+}
+
+// args returns the command line arguments of the fake proxy for c.
+func (c TestFakeProxyConfig) args() []string {
+	args := []string{"-exit-code", strconv.Itoa(c.ExitCode)}
+	if c.Crash {
+		args = append(args, "-crash")
+	}
+	if c.ExitAfter > 0 {
+		args = append(args, "-exit-after", c.ExitAfter.String())
+	}
+	if c.IgnoreSignals {
+		args = append(args, "-ignore-signals")
+	}
+	if c.StopDelay > 0 {
+		args = append(args, "-stop-delay", c.StopDelay.String())
+	}
+	if c.ReadyFile != "" {
+		args = append(args, "-ready-file", c.ReadyFile)
+	}
+
+	return args
+}
+
+// TestFakeProxyDaemon returns a Daemon that runs a small fake proxy binary
+// behaving as configured by c, so that the supervision of a real process
+// can be tested without shell scripts. Only Command is set, so tests can
+// set any other fields before starting the daemon.
+//
+// The fake proxy is built with the go tool the first time it is needed,
+// which skips the test if that isn't possible.
+func TestFakeProxyDaemon(t testing.T, c TestFakeProxyConfig) *Daemon {
+	return &Daemon{
+		Command: exec.Command(TestFakeProxyBinary(t), c.args()...),
+	}
+}
+
+var (
+	testFakeProxyOnce sync.Once
+	testFakeProxyPath string
+	testFakeProxyErr  error
+)
+
+// TestFakeProxyBinary returns the path of the fake proxy binary used by
+// TestFakeProxyDaemon, building it on first use. The binary lives in a
+// temporary directory for the lifetime of the test binary. The test is
+// skipped if the go tool isn't available.
+func TestFakeProxyBinary(t testing.T) string {
+	testFakeProxyOnce.Do(func() {
+		testFakeProxyPath, testFakeProxyErr = buildTestFakeProxy()
+	})
+	if testFakeProxyErr != nil {
+		t.Skipf("can't build fake proxy: %s", testFakeProxyErr)
+	}
+
+	return testFakeProxyPath
+}
+
+// buildTestFakeProxy builds testFakeProxySource and returns the path of the
+// binary.
+func buildTestFakeProxy() (string, error) {
+	goBin := filepath.Join(runtime.GOROOT(), "bin", "go")
+	if _, err := os.Stat(goBin); err != nil {
+		if goBin, err = exec.LookPath("go"); err != nil {
+			return "", err
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "proxyprocess-fake")
+	if err != nil {
+		return "", err
+	}
+
+	src := filepath.Join(dir, "main.go")
+	if err := ioutil.WriteFile(src, []byte(testFakeProxySource), 0600); err != nil {
+		return "", err
+	}
+
+	bin := filepath.Join(dir, "fakeproxy")
+	if runtime.GOOS == "windows" {
+		bin += ".exe"
+	}
+	cmd := exec.Command(goBin, "build", "-o", bin, src)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("%s: %s", err, out)
+	}
+
+	return bin, nil
+}
+
+// testFakeProxySource is the source of the fake proxy. It only uses the
+// standard library so that it builds anywhere.
+const testFakeProxySource = `package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+func main() {
+	crash := flag.Bool("crash", false, "exit right away")
+	exitAfter := flag.Duration("exit-after", 0, "exit after running this long")
+	exitCode := flag.Int("exit-code", 0, "exit code for -crash and -exit-after")
+	ignoreSignals := flag.Bool("ignore-signals", false, "ignore stop signals")
+	stopDelay := flag.Duration("stop-delay", 0, "time to exit once signalled")
+	readyFile := flag.String("ready-file", "", "file to write the pid to once running")
+	flag.Parse()
+
+	if *crash {
+		os.Exit(*exitCode)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	if *readyFile != "" {
+		pid := []byte(strconv.Itoa(os.Getpid()))
+		if err := ioutil.WriteFile(*readyFile, pid, 0644); err != nil {
+			os.Exit(2)
+		}
+	}
+
+	var exitCh <-chan time.Time
+	if *exitAfter > 0 {
+		exitCh = time.After(*exitAfter)
+	}
+
+	for {
+		select {
+		case <-exitCh:
+			os.Exit(*exitCode)
+
+		case <-sigCh:
+			if *ignoreSignals {
+				continue
+			}
+
+			time.Sleep(*stopDelay)
+			os.Exit(0)
+		}
+	}
+}
+`
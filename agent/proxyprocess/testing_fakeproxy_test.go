@@ -0,0 +1,117 @@
+package proxyprocess
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/testutil/retry"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeProxy(t *testing.T) {
+	t.Parallel()
+
+	t.Run("stops slowly", func(t *testing.T) {
+		t.Parallel()
+
+		require := require.New(t)
+		td, closer := testTempDir(t)
+		defer closer()
+
+		ready := filepath.Join(td, "ready")
+		d := TestFakeProxyDaemon(t, TestFakeProxyConfig{
+			StopDelay: 200 * time.Millisecond,
+			ReadyFile: ready,
+		})
+		d.Logger = testLogger
+		require.NoError(d.Start())
+		defer d.Stop()
+
+		retry.Run(t, func(r *retry.R) {
+			bs, err := ioutil.ReadFile(ready)
+			if err != nil {
+				r.Fatalf("error: %s", err)
+			}
+			if string(bs) != strconv.Itoa(d.Stats().PID) {
+				r.Fatalf("bad: %q", bs)
+			}
+		})
+
+		start := time.Now()
+		require.NoError(d.Stop())
+		require.True(time.Since(start) >= 200*time.Millisecond)
+		code, err, _ := d.LastExit()
+		require.NoError(err)
+		require.Equal(0, code)
+	})
+
+	t.Run("hangs on stop", func(t *testing.T) {
+		t.Parallel()
+
+		require := require.New(t)
+		td, closer := testTempDir(t)
+		defer closer()
+
+		ready := filepath.Join(td, "ready")
+		d := TestFakeProxyDaemon(t, TestFakeProxyConfig{
+			IgnoreSignals: true,
+			ReadyFile:     ready,
+		})
+		d.Logger = testLogger
+		d.GracefulWait = 100 * time.Millisecond
+		require.NoError(d.Start())
+		defer d.Stop()
+
+		retry.Run(t, func(r *retry.R) {
+			if _, err := ioutil.ReadFile(ready); err != nil {
+				r.Fatalf("error: %s", err)
+			}
+		})
+		// Stop doesn't wait for a killed process without KillWait
+		require.NoError(d.Stop())
+		require.NoError(d.WaitForExit(context.Background()))
+		_, err, _ := d.LastExit()
+		require.Error(err)
+		require.Contains(err.Error(), "killed")
+	})
+
+	t.Run("crash loops", func(t *testing.T) {
+		t.Parallel()
+
+		require := require.New(t)
+		d := TestFakeProxyDaemon(t, TestFakeProxyConfig{Crash: true, ExitCode: 3})
+		d.Logger = testLogger
+		d.RestartBackoffMin = 10
+		d.MaxRestarts = 2
+		require.NoError(d.Start())
+		defer d.Stop()
+
+		require.NoError(d.WaitForExit(context.Background()))
+		require.Equal(LoopExitMaxRestarts, d.TerminalReason())
+		code, _, _ := d.LastExit()
+		require.Equal(3, code)
+	})
+
+	t.Run("exits on its own", func(t *testing.T) {
+		t.Parallel()
+
+		require := require.New(t)
+		d := TestFakeProxyDaemon(t, TestFakeProxyConfig{
+			ExitAfter: 100 * time.Millisecond,
+			ExitCode:  4,
+		})
+		d.Logger = testLogger
+		d.RestartPolicy = RestartNever
+		require.NoError(d.Start())
+		defer d.Stop()
+
+		require.NoError(d.WaitForExit(context.Background()))
+		require.Equal(LoopExitCompleted, d.TerminalReason())
+		code, _, _ := d.LastExit()
+		require.Equal(4, code)
+	})
+}
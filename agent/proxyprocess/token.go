@@ -0,0 +1,112 @@
+package proxyprocess
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/go-uuid"
+)
+
+// TokenDelivery is how a Daemon passes ProxyToken to its process.
+type TokenDelivery string
+
+const (
+	// TokenDeliveryEnv passes the token in the EnvProxyToken environment
+	// variable. This is the default.
+	TokenDeliveryEnv TokenDelivery = ""
+
+	// TokenDeliveryFile writes the token to a file that only the agent's
+	// user can read and passes the path of the file in EnvProxyTokenFile,
+	// so that the token doesn't show up in the environment of the process.
+	TokenDeliveryFile TokenDelivery = "file"
+)
+
+// validateProxyToken checks ProxyToken as configured by RequireProxyToken
+// and RequireUUIDProxyToken. The lock must be held.
+func (p *Daemon) validateProxyToken() error {
+	if p.RequireProxyToken && p.ProxyToken == "" {
+		return fmt.Errorf("proxy token is required but empty")
+	}
+
+	if p.RequireUUIDProxyToken && p.ProxyToken != "" {
+		if _, err := uuid.ParseUUID(p.ProxyToken); err != nil {
+			return fmt.Errorf("proxy token is not a UUID")
+		}
+	}
+
+	return nil
+}
+
+// writeTokenFile writes ProxyToken to a new file in dir, or the default
+// temporary directory if dir is empty, and returns its path. The file is
+// created with mode 0600.
+func (p *Daemon) writeTokenFile(dir string) (string, error) {
+	f, err := ioutil.TempFile(dir, "proxy-token-")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.WriteString(p.ProxyToken)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// removeTokenFile removes the token file of the current process, if any.
+// This must be called with the lock held.
+func (p *Daemon) removeTokenFile() {
+	if p.tokenFile == "" {
+		return
+	}
+
+	if err := os.Remove(p.tokenFile); err != nil && !os.IsNotExist(err) {
+		p.logger().Warn("error removing token file", "path", p.tokenFile, "error", err)
+	}
+	p.tokenFile = ""
+}
+
+// SetProxyToken replaces ProxyToken, for example after the token was
+// rotated, without restarting the process. Later starts of the process use
+// the new token.
+//
+// With TokenDeliveryFile the token file of the running process is replaced
+// atomically and ReloadSignal is sent, so a proxy that rereads the file
+// named by EnvProxyTokenFile on that signal picks up the new token without
+// dropping connections. With TokenDeliveryEnv the environment of the running
+// process can't be changed, so it keeps the old token until it restarts.
+func (p *Daemon) SetProxyToken(token string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.commandLock.Lock()
+	p.ProxyToken = token
+	p.commandLock.Unlock()
+	if p.stopped || p.process == nil || p.tokenFile == "" {
+		return nil
+	}
+
+	// Write the new file next to the old one so that it can be renamed
+	// over it. The process never sees a partially written token.
+	path, err := p.writeTokenFile(filepath.Dir(p.tokenFile))
+	if err != nil {
+		return fmt.Errorf("error writing token file: %s", err)
+	}
+	if err := os.Rename(path, p.tokenFile); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("error replacing token file: %s", err)
+	}
+
+	if err := p.reloadLocked(); err != nil {
+		return fmt.Errorf("error reloading proxy token: %s", err)
+	}
+
+	return nil
+}
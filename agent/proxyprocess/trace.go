@@ -0,0 +1,72 @@
+package proxyprocess
+
+// Tracer creates spans around daemon lifecycle operations: starting,
+// restarting and stopping the process. It is intentionally minimal so that
+// it can be adapted to a tracing library such as OpenTelemetry without this
+// package depending on one.
+type Tracer interface {
+	// StartSpan starts a span with the given name and initial attributes.
+	StartSpan(name string, attrs map[string]interface{}) Span
+}
+
+// Span is a single traced operation started by a Tracer.
+type Span interface {
+	// SetAttribute sets an attribute on the span.
+	SetAttribute(key string, value interface{})
+
+	// End completes the span. err is the result of the operation and is
+	// nil if it succeeded.
+	End(err error)
+}
+
+// noopTracer is the Tracer used when none is configured.
+type noopTracer struct{}
+
+func (noopTracer) StartSpan(string, map[string]interface{}) Span { return noopSpan{} }
+
+// noopSpan is the Span returned by noopTracer.
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) End(error)                        {}
+
+// safeTracer wraps a user-supplied Tracer so that a panic in it, or in its
+// spans, is recovered with safeCall rather than crashing the agent. A span
+// that fails to start is replaced with a no-op one.
+type safeTracer struct {
+	p      *Daemon
+	tracer Tracer
+}
+
+func (t safeTracer) StartSpan(name string, attrs map[string]interface{}) Span {
+	var span Span
+	t.p.safeCall("Tracer", func() error {
+		span = t.tracer.StartSpan(name, attrs)
+		return nil
+	})
+	if span == nil {
+		return noopSpan{}
+	}
+
+	return safeSpan{p: t.p, span: span}
+}
+
+// safeSpan is the Span returned by safeTracer.
+type safeSpan struct {
+	p    *Daemon
+	span Span
+}
+
+func (s safeSpan) SetAttribute(key string, value interface{}) {
+	s.p.safeCall("Span", func() error {
+		s.span.SetAttribute(key, value)
+		return nil
+	})
+}
+
+func (s safeSpan) End(err error) {
+	s.p.safeCall("Span", func() error {
+		s.span.End(err)
+		return nil
+	})
+}